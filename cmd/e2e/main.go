@@ -1,16 +1,40 @@
 package main
 
 import (
+	"crypto/rand"
 	"log"
 	"log/slog"
+	"net/http"
+	"time"
 
 	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/adminhandler"
+	"github.com/OliverSchlueter/mail-server/internal/auth"
+	"github.com/OliverSchlueter/mail-server/internal/blobs"
+	fake3 "github.com/OliverSchlueter/mail-server/internal/blobs/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	fake6 "github.com/OliverSchlueter/mail-server/internal/domains/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/events"
 	"github.com/OliverSchlueter/mail-server/internal/imap"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	fake4 "github.com/OliverSchlueter/mail-server/internal/keys/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/mailhandler"
 	"github.com/OliverSchlueter/mail-server/internal/mails"
 	fake2 "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+	fake5 "github.com/OliverSchlueter/mail-server/internal/outbox/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/quotas"
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+	fake7 "github.com/OliverSchlueter/mail-server/internal/routing/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/search"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	fake9 "github.com/OliverSchlueter/mail-server/internal/sieve/database/fake"
 	"github.com/OliverSchlueter/mail-server/internal/smtp"
+	"github.com/OliverSchlueter/mail-server/internal/srs"
 	"github.com/OliverSchlueter/mail-server/internal/users"
 	"github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+	fake8 "github.com/OliverSchlueter/mail-server/internal/vacation/database/fake"
 )
 
 const hostname = "localhost"
@@ -38,16 +62,88 @@ func main() {
 		Emails: []string{
 			"oliver@" + hostname,
 		},
+		Role: users.RoleAdmin,
 	})
 
+	// hosted domains, signed with the server-wide DKIM key unless they have their own
+	ds := domains.NewStore(domains.Configuration{
+		DB: fake6.NewDB(),
+	})
+	if _, err := ds.Add(domains.Domain{Name: hostname}); err != nil {
+		log.Fatal(err)
+	}
+
 	// load DKIM private key
 	if err := smtp.LoadDKIMPrivateKey("/etc/mail/dkim_private.pem"); err != nil {
 		log.Fatal(err)
 	}
 
+	// outgoing mail, signed with the key of its domain
+	sc := smtp.NewClient(smtp.ClientConfiguration{Domains: ds})
+
+	// blobs
+	bs := blobs.NewStore(blobs.Configuration{
+		DB:          fake3.NewDB(),
+		Compression: true,
+	})
+
+	// encryption keys, only users with zero-access enabled are encrypted without a master key
+	ks := keys.NewStore(keys.Configuration{
+		DB: fake4.NewDB(),
+	})
+
+	// search index, kept in memory like all other test data
+	si, err := search.NewIndex(search.Configuration{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// events, streamed to rest api clients
+	eb := events.NewBus(events.Configuration{})
+
 	// mails
 	ms := mails.NewStore(mails.Configuration{
-		DB: fake2.NewDB(),
+		DB:      fake2.NewDB(),
+		Blobs:   bs,
+		Keys:    ks,
+		Indexer: si,
+		Events:  eb,
+	})
+
+	// quotas
+	qs := quotas.NewService(quotas.Configuration{
+		Hostname: hostname,
+		Mails:    *ms,
+		Domains:  ds,
+	})
+
+	// aliases and groups
+	rs := routing.NewStore(routing.Configuration{
+		Hostname: hostname,
+		DB:       fake7.NewDB(),
+		Users:    *us,
+		Domains:  ds,
+	})
+
+	// sender rewriting for forwarded mail, bounces to forwarded mail are
+	// rejected after a restart as the secret is not kept
+	srsSecret := make([]byte, 32)
+	if _, err := rand.Read(srsSecret); err != nil {
+		log.Fatal(err)
+	}
+	rewriter := srs.New(srs.Configuration{
+		Secret: srsSecret,
+		Domain: hostname,
+	})
+
+	// automatic replies while users are away
+	vs := vacation.NewService(vacation.Configuration{
+		DB: fake8.NewDB(),
+	})
+
+	// sieve scripts that filter incoming mail
+	ss := sieve.NewStore(sieve.Configuration{
+		DB: fake9.NewDB(),
 	})
 
 	// smtp server
@@ -56,18 +152,82 @@ func main() {
 		Port:     "25",
 		Users:    *us,
 		Mails:    *ms,
+		Quotas:   qs,
+		Domains:  ds,
+		Routes:   rs,
+		Send:     sc.SendMail,
+
+		SubaddressSeparators: "+",
+		DetailMailboxes:      true,
+		SRS:                  rewriter,
+		Vacation:             vs,
+		Sieve:                ss,
 	})
 	go smtpSever.Start()
 	slog.Info("Started SMTP server")
 
 	// imap server
 	imapServer := imap.NewServer(imap.Configuration{
-		Port:  "143",
-		Users: *us,
+		Port:   "143",
+		Users:  *us,
+		Mails:  *ms,
+		Keys:   ks,
+		Quotas: qs,
+		Search: si,
 	})
 	go imapServer.Start()
 	slog.Info("Started IMAP server")
 
+	// outbox, holds mails sent through the rest api for the undo window or until their send time
+	ob := outbox.NewService(outbox.Configuration{
+		DB:    fake5.NewDB(),
+		Mails: *ms,
+		Users: us,
+		Send:  sc.SendMail,
+	})
+	go ob.Start()
+	slog.Info("Started outbox")
+
+	// rest api
+	as := auth.NewService(auth.Configuration{
+		Users:  *us,
+		Issuer: hostname,
+		Keys:   ks,
+	})
+	mh := mailhandler.New(mailhandler.Configuration{
+		MailStore:   *ms,
+		UserStore:   *us,
+		Auth:        as,
+		SearchIndex: si,
+		Outbox:      ob,
+		Send:        sc.SendMail,
+		UndoWindow:  10 * time.Second,
+		Events:      eb,
+		Vacation:    vs,
+		Sieve:       ss,
+	})
+
+	mux := http.NewServeMux()
+	as.Register("/api/v1", mux)
+	mh.Register("/api/v1", mux)
+	adminhandler.New(adminhandler.Configuration{
+		UserStore: *us,
+		MailStore: *ms,
+		Auth:      as,
+		Outbox:    ob,
+		Domains:   ds,
+		Routes:    rs,
+		Keys:      ks,
+		Sieve:     ss,
+		Vacation:  vs,
+	}).Register("/api/v1", mux)
+	go func() {
+		if err := http.ListenAndServe(":8080", mux); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	slog.Info("Started REST API")
+
 	c := make(chan struct{})
 	<-c
 }
@@ -0,0 +1,255 @@
+// Command mailadmin manages a running mail server through its admin REST API.
+//
+// Usage:
+//
+//	mailadmin [flags] domains list
+//	mailadmin [flags] domains add [domain flags] <name>
+//	mailadmin [flags] domains remove <name>
+//	mailadmin [flags] routes list
+//	mailadmin [flags] routes add [-group] <address> <target>...
+//	mailadmin [flags] routes remove <address>
+//	mailadmin [flags] keys rotate <user id>
+//	mailadmin [flags] keys enable-zero-access <user id>
+//	mailadmin [flags] keys rewrap
+//	mailadmin [flags] search reindex <user id>...
+//
+// enable-zero-access reads the password of the user from the first line of
+// standard input, as their keys are wrapped with it. Only mail bodies are
+// protected, headers like Subject, From and To stay readable by the server.
+//
+// The credentials of an admin are read from MAIL_SERVER_TOKEN (a session or
+// personal API token), or MAIL_SERVER_USER and MAIL_SERVER_PASSWORD.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// stdin is read by commands that need secrets.
+var stdin io.Reader = os.Stdin
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "mailadmin:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("mailadmin", flag.ExitOnError)
+	apiURL := fs.String("url", envOr("MAIL_SERVER_URL", "http://localhost:8080/api/v1"), "base URL of the REST API")
+	fs.Parse(args)
+
+	c := &client{
+		baseURL:  strings.TrimSuffix(*apiURL, "/"),
+		token:    os.Getenv("MAIL_SERVER_TOKEN"),
+		user:     os.Getenv("MAIL_SERVER_USER"),
+		password: os.Getenv("MAIL_SERVER_PASSWORD"),
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		return fmt.Errorf("usage: mailadmin [-url url] domains|routes|keys|search <command>")
+	}
+
+	switch args[0] {
+	case "domains":
+		return domains(c, args[1:])
+	case "routes":
+		return routes(c, args[1:])
+	case "keys":
+		return keys(c, args[1:])
+	case "search":
+		return search(c, args[1:])
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func domains(c *client, args []string) error {
+	switch args[0] {
+	case "list":
+		return c.do(http.MethodGet, "/admin/domains", nil)
+	case "add":
+		return addDomain(c, args[1:])
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: mailadmin domains remove <name>")
+		}
+		return c.do(http.MethodDelete, "/admin/domains/"+url.PathEscape(args[1]), nil)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func addDomain(c *client, args []string) error {
+	fs := flag.NewFlagSet("domains add", flag.ExitOnError)
+	selector := fs.String("dkim-selector", "", "DKIM selector, defaults to mail")
+	dkimKey := fs.String("dkim-key", "", "file with the PEM encoded DKIM private key")
+	catchAll := fs.String("catch-all", "", "address that receives mail to unknown addresses")
+	storageLimit := fs.Int64("storage-limit", 0, "default storage limit of users in bytes")
+	tlsCert := fs.String("tls-cert", "", "file with the PEM encoded TLS certificate chain")
+	tlsKey := fs.String("tls-key", "", "file with the PEM encoded TLS private key")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: mailadmin domains add [flags] <name>")
+	}
+
+	req := map[string]any{
+		"name":                  fs.Arg(0),
+		"dkim_selector":         *selector,
+		"catch_all":             *catchAll,
+		"default_storage_limit": *storageLimit,
+	}
+	for field, path := range map[string]string{"dkim_private_key": *dkimKey, "tls_certificate": *tlsCert, "tls_private_key": *tlsKey} {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		req[field] = string(data)
+	}
+
+	return c.do(http.MethodPost, "/admin/domains", req)
+}
+
+func routes(c *client, args []string) error {
+	switch args[0] {
+	case "list":
+		return c.do(http.MethodGet, "/admin/routes", nil)
+	case "add":
+		fs := flag.NewFlagSet("routes add", flag.ExitOnError)
+		group := fs.Bool("group", false, "distribute mail to the targets as members of a group instead of forwarding it")
+		fs.Parse(args[1:])
+
+		if fs.NArg() < 2 {
+			return fmt.Errorf("usage: mailadmin routes add [-group] <address> <target>...")
+		}
+		kind := "alias"
+		if *group {
+			kind = "group"
+		}
+		return c.do(http.MethodPost, "/admin/routes", map[string]any{
+			"address": fs.Arg(0),
+			"kind":    kind,
+			"targets": fs.Args()[1:],
+		})
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: mailadmin routes remove <address>")
+		}
+		return c.do(http.MethodDelete, "/admin/routes/"+url.PathEscape(args[1]), nil)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func keys(c *client, args []string) error {
+	switch args[0] {
+	case "rotate":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: mailadmin keys rotate <user id>")
+		}
+		return c.do(http.MethodPost, "/admin/users/"+url.PathEscape(args[1])+"/keys/rotate", nil)
+	case "enable-zero-access":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: mailadmin keys enable-zero-access <user id> < password")
+		}
+		password, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return fmt.Errorf("the password of the user must be given on standard input")
+		}
+		return c.do(http.MethodPost, "/admin/users/"+url.PathEscape(args[1])+"/keys/zero-access", map[string]any{
+			"password": password,
+		})
+	case "rewrap":
+		return c.do(http.MethodPost, "/admin/keys/rewrap", nil)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func search(c *client, args []string) error {
+	switch args[0] {
+	case "reindex":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: mailadmin search reindex <user id>...")
+		}
+		for _, userID := range args[1:] {
+			if err := c.do(http.MethodPost, "/search/"+url.PathEscape(userID)+"/reindex", nil); err != nil {
+				return fmt.Errorf("%s: %w", userID, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+type client struct {
+	baseURL  string
+	token    string
+	user     string
+	password string
+}
+
+// do sends the request and prints the response body, which is an error if the
+// status is not successful.
+func (c *client) do(method string, path string, body any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	var out bytes.Buffer
+	if json.Indent(&out, respBody, "", "  ") == nil {
+		fmt.Println(out.String())
+	}
+	return nil
+}
+
+func envOr(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
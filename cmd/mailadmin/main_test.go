@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/adminhandler"
+	"github.com/OliverSchlueter/mail-server/internal/auth"
+	keystore "github.com/OliverSchlueter/mail-server/internal/keys"
+	kdb "github.com/OliverSchlueter/mail-server/internal/keys/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/mailhandler"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	searchindex "github.com/OliverSchlueter/mail-server/internal/search"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	udb "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func TestKeys(t *testing.T) {
+	us := users.NewStore(users.Configuration{DB: udb.NewDB()})
+	for _, u := range []users.User{
+		{Name: "alice", Password: "alice123", PrimaryEmail: "alice@example.com", Role: users.RoleAdmin},
+		{Name: "bob", Password: "bob123", PrimaryEmail: "bob@example.com"},
+	} {
+		if err := us.Create(u); err != nil {
+			t.Fatalf("Create user: unexpected error: %v", err)
+		}
+	}
+	bob, err := us.GetByName("bob")
+	if err != nil {
+		t.Fatalf("Get user: unexpected error: %v", err)
+	}
+
+	// The mail of bob is stored with the old master key, the server was
+	// restarted with a new one since
+	keyDB := kdb.NewDB()
+	mailDB := mdb.NewDB()
+	old := keystore.NewStore(keystore.Configuration{DB: keyDB, MasterKeys: map[string][]byte{"m1": bytes.Repeat([]byte{1}, 32)}, ActiveMasterKey: "m1"})
+	if err := mails.NewStore(mails.Configuration{DB: mailDB, Keys: old}).CreateMail(bob.ID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "top secret"}); err != nil {
+		t.Fatalf("Create mail: unexpected error: %v", err)
+	}
+
+	ks := keystore.NewStore(keystore.Configuration{
+		DB:              keyDB,
+		MasterKeys:      map[string][]byte{"m1": bytes.Repeat([]byte{1}, 32), "m2": bytes.Repeat([]byte{2}, 32)},
+		ActiveMasterKey: "m2",
+	})
+	ms := mails.NewStore(mails.Configuration{DB: mailDB, Keys: ks})
+	as := auth.NewService(auth.Configuration{Users: *us, Keys: ks})
+
+	mux := http.NewServeMux()
+	as.Register("/api", mux)
+	adminhandler.New(adminhandler.Configuration{UserStore: *us, MailStore: *ms, Auth: as, Keys: ks}).Register("/api", mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	t.Setenv("MAIL_SERVER_TOKEN", "")
+	t.Setenv("MAIL_SERVER_USER", "alice")
+	t.Setenv("MAIL_SERVER_PASSWORD", "alice123")
+	mailadmin := func(input string, args ...string) error {
+		stdin = strings.NewReader(input)
+		defer func() { stdin = os.Stdin }()
+		return run(append([]string{"-url", srv.URL + "/api"}, args...))
+	}
+	readMail := func() (string, error) {
+		m, err := ms.GetMailByUID(bob.ID, mails.DefaultMailboxUID, 1)
+		if err != nil {
+			return "", err
+		}
+		return m.Body, nil
+	}
+
+	if err := mailadmin("", "keys", "rewrap"); err != nil {
+		t.Fatalf("keys rewrap: unexpected error: %v", err)
+	}
+	if k, err := keyDB.GetLatest(bob.ID); err != nil || k.MasterKeyID != "m2" {
+		t.Fatalf("keys rewrap: expected key wrapped with m2, got %+v, %v", k, err)
+	}
+
+	if err := mailadmin("", "keys", "rotate", bob.ID); err != nil {
+		t.Fatalf("keys rotate: unexpected error: %v", err)
+	}
+	if stored := mailDB.Mails[bob.ID][0]; stored.KeyVersion != 2 {
+		t.Errorf("keys rotate: expected mail to be re-encrypted with version 2, got %d", stored.KeyVersion)
+	}
+	if _, err := keyDB.Get(bob.ID, 1); !errors.Is(err, keystore.ErrKeyNotFound) {
+		t.Errorf("keys rotate: expected version 1 to be retired, got %v", err)
+	}
+
+	if err := mailadmin("wrong\n", "keys", "enable-zero-access", bob.ID); err == nil {
+		t.Errorf("keys enable-zero-access with wrong password: expected error")
+	}
+	if err := mailadmin("bob123\n", "keys", "enable-zero-access", bob.ID); err != nil {
+		t.Fatalf("keys enable-zero-access: unexpected error: %v", err)
+	}
+	if zeroAccess, err := ks.IsZeroAccess(bob.ID); err != nil || !zeroAccess {
+		t.Fatalf("keys enable-zero-access: expected zero-access keys, got %v, %v", zeroAccess, err)
+	}
+
+	// Without the password of bob, neither the server nor the admin can read the mail
+	ks.Lock(bob.ID)
+	if _, err := readMail(); !errors.Is(err, keystore.ErrKeyLocked) {
+		t.Errorf("Read while locked: expected ErrKeyLocked, got %v", err)
+	}
+	if err := mailadmin("", "keys", "rotate", bob.ID); err == nil {
+		t.Errorf("keys rotate while locked: expected error")
+	}
+
+	resp, err := http.Post(srv.URL+"/api/auth/login", "application/json", strings.NewReader(`{"login": "bob", "password": "bob123"}`))
+	if err != nil {
+		t.Fatalf("Login: unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Login: expected 201, got %d", resp.StatusCode)
+	}
+	if body, err := readMail(); err != nil || body != "top secret" {
+		t.Errorf("Read after login: expected the mail, got %q, %v", body, err)
+	}
+
+	if err := mailadmin("", "keys", "rotate", bob.ID); err != nil {
+		t.Fatalf("keys rotate after login: unexpected error: %v", err)
+	}
+	if body, err := readMail(); err != nil || body != "top secret" {
+		t.Errorf("Read after rotation: expected the mail, got %q, %v", body, err)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	us := users.NewStore(users.Configuration{DB: udb.NewDB()})
+	if err := us.Create(users.User{Name: "alice", Password: "alice123", PrimaryEmail: "alice@example.com", Role: users.RoleAdmin}); err != nil {
+		t.Fatalf("Create user: unexpected error: %v", err)
+	}
+	alice, err := us.GetByName("alice")
+	if err != nil {
+		t.Fatalf("Get user: unexpected error: %v", err)
+	}
+
+	si, err := searchindex.NewIndex(searchindex.Configuration{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewIndex: unexpected error: %v", err)
+	}
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB(), Indexer: si})
+	if err := ms.CreateMail(alice.ID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "Subject: Lunch\r\n\r\nPizza at noon?"}); err != nil {
+		t.Fatalf("Create mail: unexpected error: %v", err)
+	}
+	if err := si.Clear(alice.ID); err != nil {
+		t.Fatalf("Clear: unexpected error: %v", err)
+	}
+
+	as := auth.NewService(auth.Configuration{Users: *us})
+	mux := http.NewServeMux()
+	mailhandler.New(mailhandler.Configuration{MailStore: *ms, UserStore: *us, Auth: as, SearchIndex: si}).Register("/api", mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	t.Setenv("MAIL_SERVER_TOKEN", "")
+	t.Setenv("MAIL_SERVER_USER", "alice")
+	t.Setenv("MAIL_SERVER_PASSWORD", "alice123")
+	if err := run([]string{"-url", srv.URL + "/api", "search", "reindex", alice.ID}); err != nil {
+		t.Fatalf("search reindex: unexpected error: %v", err)
+	}
+
+	hits, err := si.Search(alice.ID, searchindex.Query{Text: "pizza"})
+	if err != nil || len(hits) != 1 {
+		t.Errorf("Search after reindex: expected 1 hit, got %v, %v", hits, err)
+	}
+}
@@ -6,15 +6,15 @@ require (
 	github.com/OliverSchlueter/goutils v0.0.28
 	github.com/emersion/go-msgauth v0.7.0
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.4
 	github.com/wneessen/go-mail v0.7.2
+	golang.org/x/crypto v0.47.0
+	golang.org/x/text v0.33.0
 )
 
 require (
-	github.com/klauspost/compress v1.18.4 // indirect
 	github.com/nats-io/nats.go v1.48.0 // indirect
 	github.com/nats-io/nkeys v0.4.15 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
-	golang.org/x/crypto v0.47.0 // indirect
 	golang.org/x/sys v0.41.0 // indirect
-	golang.org/x/text v0.33.0 // indirect
 )
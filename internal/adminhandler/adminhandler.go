@@ -0,0 +1,527 @@
+// Package adminhandler provides the REST API for admins to manage users,
+// hosted domains, aliases, groups and encryption keys.
+package adminhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/auth"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+)
+
+type Handler struct {
+	userStore users.Store
+	mailStore mails.Store
+	auth      *auth.Service
+	outbox    *outbox.Service
+	domains   *domains.Store
+	routes    *routing.Store
+	keys      *keys.Store
+	sieve     *sieve.Store
+	vacation  *vacation.Service
+}
+
+type Configuration struct {
+	UserStore users.Store
+	MailStore mails.Store
+	Auth      *auth.Service   // all endpoints are only available to admins
+	Outbox    *outbox.Service // optional, pending mails of deleted users are cancelled
+	// Domains is optional, enables the domain endpoints. Addresses of users
+	// must then be in one of the hosted domains.
+	Domains *domains.Store
+	// Routes is optional, enables the endpoints for aliases and groups. Their
+	// addresses can then not be added to users.
+	Routes *routing.Store
+	// Keys is optional, enables the endpoints for encryption keys. Passwords of
+	// users with zero-access keys can then only be reset with their old
+	// password, and keys of deleted users are deleted. It must be the key store
+	// of the mail store.
+	Keys     *keys.Store
+	Sieve    *sieve.Store      // optional, scripts of deleted users are deleted
+	Vacation *vacation.Service // optional, responders of deleted users are deleted
+}
+
+func New(cfg Configuration) *Handler {
+	return &Handler{
+		userStore: cfg.UserStore,
+		mailStore: cfg.MailStore,
+		auth:      cfg.Auth,
+		outbox:    cfg.Outbox,
+		domains:   cfg.Domains,
+		routes:    cfg.Routes,
+		keys:      cfg.Keys,
+		sieve:     cfg.Sieve,
+		vacation:  cfg.Vacation,
+	}
+}
+
+func (h *Handler) Register(prefix string, mux *http.ServeMux) {
+	mux.HandleFunc(prefix+"/admin/users", h.auth.RequireAdmin(h.handleUsers))
+	mux.HandleFunc(prefix+"/admin/users/{user_id}", h.auth.RequireAdmin(h.handleUser))
+	mux.HandleFunc(prefix+"/admin/users/{user_id}/password", h.auth.RequireAdmin(h.handlePassword))
+	mux.HandleFunc(prefix+"/admin/users/{user_id}/emails", h.auth.RequireAdmin(h.handleEmails))
+	mux.HandleFunc(prefix+"/admin/users/{user_id}/emails/{email}", h.auth.RequireAdmin(h.handleEmail))
+
+	if h.keys != nil {
+		mux.HandleFunc(prefix+"/admin/users/{user_id}/keys/rotate", h.auth.RequireAdmin(h.handleRotateKey))
+		mux.HandleFunc(prefix+"/admin/users/{user_id}/keys/zero-access", h.auth.RequireAdmin(h.handleZeroAccess))
+		mux.HandleFunc(prefix+"/admin/keys/rewrap", h.auth.RequireAdmin(h.handleRewrapKeys))
+	}
+	if h.domains != nil {
+		mux.HandleFunc(prefix+"/admin/domains", h.auth.RequireAdmin(h.handleDomains))
+		mux.HandleFunc(prefix+"/admin/domains/{domain}", h.auth.RequireAdmin(h.handleDomain))
+	}
+	if h.routes != nil {
+		mux.HandleFunc(prefix+"/admin/routes", h.auth.RequireAdmin(h.handleRoutes))
+		mux.HandleFunc(prefix+"/admin/routes/{address}", h.auth.RequireAdmin(h.handleRoute))
+	}
+}
+
+func (h *Handler) handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getUsers(w, r)
+	case http.MethodPost:
+		h.createUser(w, r)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getUsers(w http.ResponseWriter, r *http.Request) {
+	list, err := h.userStore.List()
+	if err != nil {
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	resp := make([]UserResp, 0, len(list))
+	for _, u := range list {
+		resp = append(resp, userResp(u))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) {
+	var req CreateUserReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if req.Password == "" {
+		problems.ValidationError("password", "Password must not be empty").WriteToHTTP(w)
+		return
+	}
+	if req.PrimaryEmail == "" {
+		problems.ValidationError("primary_email", "Primary address must not be empty").WriteToHTTP(w)
+		return
+	}
+	if !validRole(req.Role) {
+		problems.ValidationError("role", "Role must be empty or admin").WriteToHTTP(w)
+		return
+	}
+
+	emails := req.Emails
+	if !slices.Contains(emails, req.PrimaryEmail) {
+		emails = append([]string{req.PrimaryEmail}, emails...)
+	}
+	if !h.checkDomains(w, emails...) || !h.checkRoutes(w, emails...) {
+		return
+	}
+
+	u, err := h.userStore.CreateUser(users.User{
+		Name:         req.Name,
+		Password:     req.Password,
+		PrimaryEmail: req.PrimaryEmail,
+		Emails:       emails,
+		Role:         req.Role,
+	})
+	if err != nil {
+		writeError(w, err, req.Name)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, userResp(*u))
+}
+
+func (h *Handler) handleUser(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getUser(w, r, userId)
+	case http.MethodPatch:
+		h.updateUser(w, r, userId)
+	case http.MethodDelete:
+		h.deleteUser(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPatch, http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getUser(w http.ResponseWriter, r *http.Request, userId string) {
+	u, err := h.userStore.GetByID(userId)
+	if err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, userResp(*u))
+}
+
+func (h *Handler) updateUser(w http.ResponseWriter, r *http.Request, userId string) {
+	var req UpdateUserReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	u, err := h.userStore.GetByID(userId)
+	if err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	// Admins can not lock themselves out, another admin has to do it
+	self := isSelf(r, userId)
+	if req.Disabled != nil && *req.Disabled && self {
+		problems.ValidationError("disabled", "Admins can not disable themselves").WriteToHTTP(w)
+		return
+	}
+	if req.Role != nil && *req.Role != users.RoleAdmin && self {
+		problems.ValidationError("role", "Admins can not revoke their own role").WriteToHTTP(w)
+		return
+	}
+
+	if req.Name != nil {
+		u.Name = *req.Name
+	}
+	if req.PrimaryEmail != nil && *req.PrimaryEmail != u.PrimaryEmail {
+		if !h.checkDomains(w, *req.PrimaryEmail) || !h.checkRoutes(w, *req.PrimaryEmail) {
+			return
+		}
+		u.PrimaryEmail = *req.PrimaryEmail
+	}
+	if req.Role != nil {
+		if !validRole(*req.Role) {
+			problems.ValidationError("role", "Role must be empty or admin").WriteToHTTP(w)
+			return
+		}
+		u.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		u.Disabled = *req.Disabled
+	}
+
+	if err := h.userStore.Update(*u); err != nil {
+		writeError(w, err, u.Name)
+		return
+	}
+
+	// Normalized by Update
+	u, err = h.userStore.GetByID(userId)
+	if err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, userResp(*u))
+}
+
+// deleteUser deletes the user with their mailboxes, pending mails, filters and
+// keys, and removes their addresses from aliases and groups. The user is
+// disabled first, so a failed deletion can be retried without the user being
+// able to log in in the meantime.
+func (h *Handler) deleteUser(w http.ResponseWriter, r *http.Request, userId string) {
+	if isSelf(r, userId) {
+		problems.ValidationError("user_id", "Admins can not delete themselves").WriteToHTTP(w)
+		return
+	}
+
+	if err := h.userStore.SetDisabled(userId, true); err != nil {
+		writeError(w, err, userId)
+		return
+	}
+	h.auth.RevokeUserTokens(userId)
+
+	u, err := h.userStore.GetByID(userId)
+	if err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	if h.outbox != nil {
+		pending, err := h.outbox.List(userId)
+		if err != nil {
+			problems.InternalServerError("Failed to list pending mails: " + err.Error()).WriteToHTTP(w)
+			return
+		}
+		for _, m := range pending {
+			// Mails that are sent meanwhile are gone from the outbox as well
+			if err := h.outbox.Cancel(userId, m.ID); err != nil && !errors.Is(err, outbox.ErrMessageNotFound) {
+				problems.InternalServerError("Failed to cancel pending mail: " + err.Error()).WriteToHTTP(w)
+				return
+			}
+		}
+	}
+
+	if h.routes != nil {
+		if err := h.routes.RemoveTargets(u.Emails...); err != nil {
+			problems.InternalServerError("Failed to remove addresses from routes: " + err.Error()).WriteToHTTP(w)
+			return
+		}
+	}
+
+	if h.sieve != nil {
+		if err := h.sieve.RemoveAll(userId); err != nil {
+			problems.InternalServerError("Failed to delete Sieve scripts: " + err.Error()).WriteToHTTP(w)
+			return
+		}
+	}
+
+	if h.vacation != nil {
+		if err := h.vacation.RemoveAll(userId); err != nil {
+			problems.InternalServerError("Failed to delete vacation responder: " + err.Error()).WriteToHTTP(w)
+			return
+		}
+	}
+
+	if err := h.mailStore.DeleteMailboxes(userId); err != nil {
+		problems.InternalServerError("Failed to delete mailboxes: " + err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	// Mail is encrypted with the keys, so they are deleted after the mailboxes
+	if h.keys != nil {
+		if err := h.keys.DeleteAll(userId); err != nil {
+			problems.InternalServerError("Failed to delete keys: " + err.Error()).WriteToHTTP(w)
+			return
+		}
+	}
+
+	if err := h.userStore.Delete(userId); err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	slog.Info("Deleted user", slog.String("user_id", userId))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handlePassword(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodPut:
+		h.setPassword(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPut}).WriteToHTTP(w)
+	}
+}
+
+// setPassword resets the password of the user and ends their sessions. App
+// passwords and personal tokens are kept. The zero-access keys of a user are
+// wrapped by their password, so for those users the old password is required
+// to rewrap the keys. If the password can not be set, the keys are wrapped
+// with the old password again.
+func (h *Handler) setPassword(w http.ResponseWriter, r *http.Request, userId string) {
+	var req SetPasswordReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if req.Password == "" {
+		problems.ValidationError("password", "Password must not be empty").WriteToHTTP(w)
+		return
+	}
+
+	if _, err := h.userStore.GetByID(userId); err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	rewrapped := false
+	if h.keys != nil {
+		zeroAccess, err := h.keys.IsZeroAccess(userId)
+		if err != nil {
+			problems.InternalServerError("Failed to get keys: " + err.Error()).WriteToHTTP(w)
+			return
+		}
+
+		if zeroAccess {
+			if req.OldPassword == "" {
+				problems.ValidationError("old_password", "The user has zero-access encryption, their old password is required").WriteToHTTP(w)
+				return
+			}
+
+			err := h.keys.ChangePassword(userId, req.OldPassword, req.Password)
+			if errors.Is(err, keys.ErrInvalidPassword) {
+				problems.ValidationError("old_password", "Old password is invalid").WriteToHTTP(w)
+				return
+			}
+			if err != nil {
+				problems.InternalServerError("Failed to rewrap keys: " + err.Error()).WriteToHTTP(w)
+				return
+			}
+			rewrapped = true
+		}
+	}
+
+	if err := h.userStore.SetPassword(userId, req.Password); err != nil {
+		if rewrapped {
+			if err := h.keys.ChangePassword(userId, req.Password, req.OldPassword); err != nil {
+				slog.Error("Failed to rewrap keys with the old password", slog.String("user_id", userId), sloki.WrapError(err))
+			}
+		}
+		writeError(w, err, userId)
+		return
+	}
+	h.auth.RevokeUserTokens(userId)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleEmails(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodPost:
+		h.addEmail(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) addEmail(w http.ResponseWriter, r *http.Request, userId string) {
+	var req AddEmailReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	u, err := h.userStore.GetByID(userId)
+	if err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	if slices.Contains(u.Emails, req.Email) {
+		problems.AlreadyExists("Email address", req.Email).WriteToHTTP(w)
+		return
+	}
+	if !h.checkDomains(w, req.Email) || !h.checkRoutes(w, req.Email) {
+		return
+	}
+
+	u.Emails = append(u.Emails, req.Email)
+	if err := h.userStore.Update(*u); err != nil {
+		writeError(w, err, u.Name)
+		return
+	}
+
+	u, err = h.userStore.GetByID(userId)
+	if err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, userResp(*u))
+}
+
+func (h *Handler) handleEmail(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	email := r.PathValue("email")
+
+	switch r.Method {
+	case http.MethodDelete:
+		h.removeEmail(w, r, userId, email)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) removeEmail(w http.ResponseWriter, r *http.Request, userId string, email string) {
+	u, err := h.userStore.GetByID(userId)
+	if err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	i := slices.Index(u.Emails, email)
+	if i < 0 {
+		problems.NotFound("Email address", email).WriteToHTTP(w)
+		return
+	}
+	if email == u.PrimaryEmail {
+		problems.ValidationError("email", "The primary address can not be removed").WriteToHTTP(w)
+		return
+	}
+
+	u.Emails = slices.Delete(u.Emails, i, i+1)
+	if err := h.userStore.Update(*u); err != nil {
+		writeError(w, err, u.Name)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isSelf reports whether the caller is the user with the ID.
+func isSelf(r *http.Request, userId string) bool {
+	id, ok := auth.FromContext(r.Context())
+	return ok && id.User.ID == userId
+}
+
+func validRole(role users.Role) bool {
+	return role == users.RoleUser || role == users.RoleAdmin
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		problems.InternalServerError("Error marshalling response").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeError writes the problem matching an error of the user store. user is
+// the name or ID of the user the request is about.
+func writeError(w http.ResponseWriter, err error, user string) {
+	switch {
+	case errors.Is(err, users.ErrUserNotFound):
+		problems.NotFound("User", user).WriteToHTTP(w)
+	case errors.Is(err, users.ErrUserAlreadyExists):
+		problems.AlreadyExists("User", user).WriteToHTTP(w)
+	case errors.Is(err, users.ErrInvalidName):
+		problems.ValidationError("name", "Name must not be empty or contain whitespace, / or @").WriteToHTTP(w)
+	case errors.Is(err, users.ErrInvalidEmail):
+		problems.ValidationError("emails", "Addresses must be plain email addresses").WriteToHTTP(w)
+	case errors.Is(err, users.ErrEmailInUse):
+		problems.ValidationError("emails", "An address is used by another user").WriteToHTTP(w)
+	case errors.Is(err, users.ErrPrimaryEmail):
+		problems.ValidationError("primary_email", "The primary address must be one of the user's addresses").WriteToHTTP(w)
+	default:
+		slog.Error("Failed to manage user", slog.String("user", user), sloki.WrapError(err))
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
+}
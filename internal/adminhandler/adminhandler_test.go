@@ -0,0 +1,540 @@
+package adminhandler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/adminhandler"
+	"github.com/OliverSchlueter/mail-server/internal/auth"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	ddb "github.com/OliverSchlueter/mail-server/internal/domains/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	kdb "github.com/OliverSchlueter/mail-server/internal/keys/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+	rdb "github.com/OliverSchlueter/mail-server/internal/routing/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	sdb "github.com/OliverSchlueter/mail-server/internal/sieve/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	udb "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+	vdb "github.com/OliverSchlueter/mail-server/internal/vacation/database/fake"
+)
+
+func TestManageUsers(t *testing.T) {
+	mux, us, ms, as := setup(t)
+
+	if w := do(t, mux, "bob", http.MethodGet, "/api/admin/users", nil); w.Code != http.StatusForbidden {
+		t.Errorf("List as regular user: expected 403, got %d", w.Code)
+	}
+
+	w := do(t, mux, "alice", http.MethodPost, "/api/admin/users", map[string]any{
+		"name":          "carol",
+		"password":      "carol123",
+		"primary_email": "carol@example.com",
+		"emails":        []string{"carol@other.example.com"},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var carol adminhandler.UserResp
+	decode(t, w, &carol)
+	if carol.ID == "" || len(carol.Emails) != 2 || carol.Emails[0] != "carol@example.com" || carol.Disabled {
+		t.Errorf("Create: unexpected user %+v", carol)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("password")) {
+		t.Errorf("Create: response must not contain the password: %s", w.Body)
+	}
+
+	for _, c := range []struct {
+		name   string
+		body   map[string]any
+		status int
+	}{
+		{"taken name", map[string]any{"name": "carol", "password": "x", "primary_email": "carol2@example.com"}, http.StatusConflict},
+		{"address of other user", map[string]any{"name": "dave", "password": "x", "primary_email": "bob@example.com"}, http.StatusBadRequest},
+		{"invalid address", map[string]any{"name": "dave", "password": "x", "primary_email": "dave"}, http.StatusBadRequest},
+		{"no password", map[string]any{"name": "dave", "primary_email": "dave@example.com"}, http.StatusBadRequest},
+		{"unknown role", map[string]any{"name": "dave", "password": "x", "primary_email": "dave@example.com", "role": "root"}, http.StatusBadRequest},
+	} {
+		if w := do(t, mux, "alice", http.MethodPost, "/api/admin/users", c.body); w.Code != c.status {
+			t.Errorf("Create with %s: expected %d, got %d: %s", c.name, c.status, w.Code, w.Body)
+		}
+	}
+
+	var list []adminhandler.UserResp
+	decode(t, do(t, mux, "alice", http.MethodGet, "/api/admin/users", nil), &list)
+	if len(list) != 3 || list[0].Name != "alice" || list[2].Name != "carol" {
+		t.Errorf("List: expected alice, bob and carol, got %+v", list)
+	}
+
+	// Renaming and addresses
+	w = do(t, mux, "alice", http.MethodPatch, "/api/admin/users/"+carol.ID, map[string]any{"name": "caroline", "primary_email": "carol@other.example.com"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Update: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	decode(t, w, &carol)
+	if carol.Name != "caroline" || carol.PrimaryEmail != "carol@other.example.com" {
+		t.Errorf("Update: unexpected user %+v", carol)
+	}
+	if w := do(t, mux, "alice", http.MethodPatch, "/api/admin/users/"+carol.ID, map[string]any{"name": "bob"}); w.Code != http.StatusConflict {
+		t.Errorf("Rename to taken name: expected 409, got %d", w.Code)
+	}
+
+	if w := do(t, mux, "alice", http.MethodPost, "/api/admin/users/"+carol.ID+"/emails", map[string]any{"email": "caroline@example.com"}); w.Code != http.StatusCreated {
+		t.Errorf("Add address: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if w := do(t, mux, "alice", http.MethodPost, "/api/admin/users/"+carol.ID+"/emails", map[string]any{"email": "bob@example.com"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Add address of bob: expected 400, got %d", w.Code)
+	}
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/users/"+carol.ID+"/emails/carol@other.example.com", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Remove primary address: expected 400, got %d", w.Code)
+	}
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/users/"+carol.ID+"/emails/carol@example.com", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Remove address: expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if exists, _ := us.DoesUserExistByEmail("carol@example.com"); exists {
+		t.Errorf("Expected removed address to be released")
+	}
+
+	// Resetting the password ends sessions
+	session, err := as.IssueToken(carol.ID)
+	if err != nil {
+		t.Fatalf("IssueToken: unexpected error: %v", err)
+	}
+	if w := do(t, mux, "alice", http.MethodPut, "/api/admin/users/"+carol.ID+"/password", map[string]any{"password": "new-password"}); w.Code != http.StatusNoContent {
+		t.Fatalf("Reset password: expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if _, _, err := us.Authenticate("caroline", "new-password", users.ScopeIMAP); err != nil {
+		t.Errorf("Authenticate with new password: unexpected error: %v", err)
+	}
+	if _, err := as.Authenticate(bearer(session.Token)); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("Expected session to be revoked, got %v", err)
+	}
+
+	// Disabled users can not log in
+	if w := do(t, mux, "alice", http.MethodPatch, "/api/admin/users/"+carol.ID, map[string]any{"disabled": true}); w.Code != http.StatusOK {
+		t.Fatalf("Disable: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if _, _, err := us.Authenticate("caroline", "new-password", users.ScopeIMAP); !errors.Is(err, users.ErrUserDisabled) {
+		t.Errorf("Authenticate disabled user: expected ErrUserDisabled, got %v", err)
+	}
+
+	// Admins can not lock themselves out
+	if w := do(t, mux, "alice", http.MethodPatch, "/api/admin/users/"+adminID(t, us), map[string]any{"disabled": true}); w.Code != http.StatusBadRequest {
+		t.Errorf("Disable self: expected 400, got %d", w.Code)
+	}
+	if w := do(t, mux, "alice", http.MethodPatch, "/api/admin/users/"+adminID(t, us), map[string]any{"role": ""}); w.Code != http.StatusBadRequest {
+		t.Errorf("Revoke own role: expected 400, got %d", w.Code)
+	}
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/users/"+adminID(t, us), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Delete self: expected 400, got %d", w.Code)
+	}
+
+	// Deleting removes the mailboxes
+	if err := ms.CreateMail(carol.ID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "hello"}); err != nil {
+		t.Fatalf("CreateMail: unexpected error: %v", err)
+	}
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/users/"+carol.ID, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete: expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if mailboxes, err := ms.GetMailboxes(carol.ID); err != nil || len(mailboxes) != 0 {
+		t.Errorf("Expected mailboxes to be deleted, got %+v, %v", mailboxes, err)
+	}
+	if w := do(t, mux, "alice", http.MethodGet, "/api/admin/users/"+carol.ID, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Get deleted user: expected 404, got %d", w.Code)
+	}
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/users/"+carol.ID, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Delete twice: expected 404, got %d", w.Code)
+	}
+}
+
+func TestSetPasswordZeroAccess(t *testing.T) {
+	ks := keys.NewStore(keys.Configuration{DB: kdb.NewDB()})
+	mux, us, _, _ := setup(t, func(cfg *adminhandler.Configuration) {
+		cfg.Keys = ks
+	})
+
+	bob, err := us.GetByName("bob")
+	if err != nil {
+		t.Fatalf("Get user: unexpected error: %v", err)
+	}
+	if err := ks.EnableZeroAccess(bob.ID, "bob123"); err != nil {
+		t.Fatalf("EnableZeroAccess: unexpected error: %v", err)
+	}
+	sealed, version, err := ks.Seal(bob.ID, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Seal: unexpected error: %v", err)
+	}
+	ks.Lock(bob.ID)
+
+	path := "/api/admin/users/" + bob.ID + "/password"
+	if w := do(t, mux, "alice", http.MethodPut, path, map[string]any{"password": "new-password"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Reset without old password: expected 400, got %d", w.Code)
+	}
+	if w := do(t, mux, "alice", http.MethodPut, path, map[string]any{"password": "new-password", "old_password": "wrong"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Reset with wrong old password: expected 400, got %d", w.Code)
+	}
+	if _, _, err := us.Authenticate("bob", "bob123", users.ScopeIMAP); err != nil {
+		t.Fatalf("Refused resets must keep the password, got %v", err)
+	}
+
+	if w := do(t, mux, "alice", http.MethodPut, path, map[string]any{"password": "new-password", "old_password": "bob123"}); w.Code != http.StatusNoContent {
+		t.Fatalf("Reset with old password: expected 204, got %d: %s", w.Code, w.Body)
+	}
+	ks.Lock(bob.ID)
+	if err := ks.Unlock(bob.ID, "new-password"); err != nil {
+		t.Fatalf("Unlock with new password: unexpected error: %v", err)
+	}
+	if plaintext, err := ks.Open(bob.ID, version, sealed); err != nil || string(plaintext) != "secret" {
+		t.Errorf("Open after reset: expected secret, got %q, %v", plaintext, err)
+	}
+}
+
+func TestSetPasswordRollback(t *testing.T) {
+	db := &failingUserDB{DB: udb.NewDB()}
+	us := users.NewStore(users.Configuration{DB: db})
+	for _, u := range []users.User{
+		{Name: "alice", Password: "alice123", PrimaryEmail: "alice@example.com", Emails: []string{"alice@example.com"}, Role: users.RoleAdmin},
+		{Name: "bob", Password: "bob123", PrimaryEmail: "bob@example.com", Emails: []string{"bob@example.com"}},
+	} {
+		if err := us.Create(u); err != nil {
+			t.Fatalf("Create user: unexpected error: %v", err)
+		}
+	}
+	bob, err := us.GetByName("bob")
+	if err != nil {
+		t.Fatalf("Get user: unexpected error: %v", err)
+	}
+
+	ks := keys.NewStore(keys.Configuration{DB: kdb.NewDB()})
+	if err := ks.EnableZeroAccess(bob.ID, "bob123"); err != nil {
+		t.Fatalf("EnableZeroAccess: unexpected error: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	adminhandler.New(adminhandler.Configuration{
+		UserStore: *us,
+		MailStore: *mails.NewStore(mails.Configuration{DB: mdb.NewDB()}),
+		Auth:      auth.NewService(auth.Configuration{Users: *us}),
+		Keys:      ks,
+	}).Register("/api", mux)
+
+	db.failUpdates = true
+	w := do(t, mux, "alice", http.MethodPut, "/api/admin/users/"+bob.ID+"/password", map[string]any{"password": "new-password", "old_password": "bob123"})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Reset with failing database: expected 500, got %d", w.Code)
+	}
+
+	// The keys are wrapped with the password bob still has
+	if err := ks.Unlock(bob.ID, "bob123"); err != nil {
+		t.Errorf("Unlock with old password: unexpected error: %v", err)
+	}
+	if err := ks.Unlock(bob.ID, "new-password"); !errors.Is(err, keys.ErrInvalidPassword) {
+		t.Errorf("Unlock with new password: expected ErrInvalidPassword, got %v", err)
+	}
+}
+
+func TestDeleteUserCleanup(t *testing.T) {
+	ks := keys.NewStore(keys.Configuration{DB: kdb.NewDB(), MasterKeys: map[string][]byte{"m1": bytes.Repeat([]byte{1}, 32)}, ActiveMasterKey: "m1"})
+	ss := sieve.NewStore(sieve.Configuration{DB: sdb.NewDB()})
+	vacationDB := vdb.NewDB()
+	vs := vacation.NewService(vacation.Configuration{DB: vacationDB})
+	var rs *routing.Store
+	mux, us, _, _ := setup(t, func(cfg *adminhandler.Configuration) {
+		rs = routing.NewStore(routing.Configuration{Hostname: "example.com", DB: rdb.NewDB(), Users: cfg.UserStore})
+		cfg.Routes = rs
+		cfg.Keys = ks
+		cfg.Sieve = ss
+		cfg.Vacation = vs
+	})
+
+	bob, err := us.GetByName("bob")
+	if err != nil {
+		t.Fatalf("Get user: unexpected error: %v", err)
+	}
+	if _, _, err := ks.Seal(bob.ID, []byte("secret")); err != nil {
+		t.Fatalf("Seal: unexpected error: %v", err)
+	}
+	if _, err := ss.Put(bob.ID, "filters", "keep;"); err != nil {
+		t.Fatalf("Put script: unexpected error: %v", err)
+	}
+	if _, err := vs.Set(vacation.Responder{UserID: bob.ID, Body: "Away"}); err != nil {
+		t.Fatalf("Set responder: unexpected error: %v", err)
+	}
+	if err := vacationDB.SetLastReply(bob.ID, "carol@example.org", time.Now()); err != nil {
+		t.Fatalf("SetLastReply: unexpected error: %v", err)
+	}
+	for _, r := range []routing.Route{
+		{Address: "team@example.com", Kind: routing.KindGroup, Targets: []string{"alice@example.com", "bob@example.com"}},
+		{Address: "bob.alias@example.com", Kind: routing.KindAlias, Targets: []string{"bob@example.com"}},
+	} {
+		if _, err := rs.Add(r); err != nil {
+			t.Fatalf("Add route: unexpected error: %v", err)
+		}
+	}
+
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/users/"+bob.ID, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete user: expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	if zeroAccess, err := ks.IsZeroAccess(bob.ID); err != nil || zeroAccess {
+		t.Errorf("IsZeroAccess: unexpected %v, %v", zeroAccess, err)
+	}
+	if _, err := ks.Open(bob.ID, 1, nil); !errors.Is(err, keys.ErrKeyNotFound) {
+		t.Errorf("Expected keys to be deleted, got %v", err)
+	}
+	if list, err := ss.List(bob.ID); err != nil || len(list) != 0 {
+		t.Errorf("Expected scripts to be deleted, got %+v, %v", list, err)
+	}
+	if _, err := vs.Get(bob.ID); !errors.Is(err, vacation.ErrResponderNotFound) {
+		t.Errorf("Expected responder to be deleted, got %v", err)
+	}
+	if at, err := vacationDB.LastReply(bob.ID, "carol@example.org"); err != nil || !at.IsZero() {
+		t.Errorf("Expected replies to be forgotten, got %v, %v", at, err)
+	}
+	if r, err := rs.Get("team@example.com"); err != nil || len(r.Targets) != 1 || r.Targets[0] != "alice@example.com" {
+		t.Errorf("Expected bob to be removed from the group, got %+v, %v", r, err)
+	}
+	if _, err := rs.Get("bob.alias@example.com"); !errors.Is(err, routing.ErrRouteNotFound) {
+		t.Errorf("Expected alias without targets to be deleted, got %v", err)
+	}
+}
+
+func TestManageDomains(t *testing.T) {
+	ds := domains.NewStore(domains.Configuration{DB: ddb.NewDB()})
+	mux, us, _, _ := setup(t, func(cfg *adminhandler.Configuration) {
+		cfg.Domains = ds
+	})
+
+	if w := do(t, mux, "bob", http.MethodGet, "/api/admin/domains", nil); w.Code != http.StatusForbidden {
+		t.Errorf("List as regular user: expected 403, got %d", w.Code)
+	}
+
+	w := do(t, mux, "alice", http.MethodPost, "/api/admin/domains", map[string]any{"name": "Example.org", "default_storage_limit": 1024})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Add: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var d adminhandler.DomainResp
+	decode(t, w, &d)
+	if d.Name != "example.org" || d.DKIMSelector != domains.DefaultSelector || d.DefaultStorageLimit != 1024 {
+		t.Errorf("Add: unexpected domain %+v", d)
+	}
+
+	if w := do(t, mux, "alice", http.MethodPost, "/api/admin/domains", map[string]any{"name": "example.org"}); w.Code != http.StatusConflict {
+		t.Errorf("Add twice: expected 409, got %d", w.Code)
+	}
+	if w := do(t, mux, "alice", http.MethodPost, "/api/admin/domains", map[string]any{"name": "exa mple.org"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Add invalid name: expected 400, got %d", w.Code)
+	}
+	if w := do(t, mux, "alice", http.MethodPost, "/api/admin/domains", map[string]any{"name": "example.net", "dkim_private_key": "key"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Add invalid key: expected 400, got %d", w.Code)
+	}
+
+	w = do(t, mux, "alice", http.MethodPatch, "/api/admin/domains/example.org", map[string]any{"catch_all": "postmaster@example.org"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Update: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	decode(t, w, &d)
+	if d.CatchAll != "postmaster@example.org" || d.DefaultStorageLimit != 1024 {
+		t.Errorf("Update: unexpected domain %+v", d)
+	}
+
+	// Addresses must be in hosted domains
+	if w := do(t, mux, "alice", http.MethodPost, "/api/admin/users", map[string]any{"name": "carol", "password": "x", "primary_email": "carol@example.net"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Create user in unknown domain: expected 400, got %d", w.Code)
+	}
+	w = do(t, mux, "alice", http.MethodPost, "/api/admin/users", map[string]any{"name": "carol", "password": "x", "primary_email": "carol@example.org"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create user: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var carol adminhandler.UserResp
+	decode(t, w, &carol)
+
+	// Addresses that were added before their domain was hosted can not become primary
+	bob, err := us.GetByName("bob")
+	if err != nil {
+		t.Fatalf("Get user: unexpected error: %v", err)
+	}
+	bob.Emails = append(bob.Emails, "bob@example.net")
+	if err := us.Update(*bob); err != nil {
+		t.Fatalf("Update user: unexpected error: %v", err)
+	}
+	if w := do(t, mux, "alice", http.MethodPatch, "/api/admin/users/"+bob.ID, map[string]any{"primary_email": "bob@example.net"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Set primary address in unknown domain: expected 400, got %d", w.Code)
+	}
+
+	// Domains in use are kept
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/domains/example.org", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Remove domain in use: expected 400, got %d", w.Code)
+	}
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/users/"+carol.ID, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Delete user: expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/domains/example.org", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Remove domain: expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := do(t, mux, "alice", http.MethodGet, "/api/admin/domains/example.org", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Get removed domain: expected 404, got %d", w.Code)
+	}
+}
+
+func TestManageRoutes(t *testing.T) {
+	mux, us, _, _ := setup(t, func(cfg *adminhandler.Configuration) {
+		cfg.Routes = routing.NewStore(routing.Configuration{Hostname: "example.com", DB: rdb.NewDB(), Users: cfg.UserStore})
+	})
+
+	if w := do(t, mux, "bob", http.MethodGet, "/api/admin/routes", nil); w.Code != http.StatusForbidden {
+		t.Errorf("List as regular user: expected 403, got %d", w.Code)
+	}
+
+	w := do(t, mux, "alice", http.MethodPost, "/api/admin/routes", map[string]any{"address": "Team@example.com", "kind": "group", "targets": []string{"alice@example.com", "bob@example.com"}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Add: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var route routing.Route
+	decode(t, w, &route)
+	if route.Address != "team@example.com" || route.Kind != routing.KindGroup || len(route.Targets) != 2 {
+		t.Errorf("Add: unexpected route %+v", route)
+	}
+
+	for _, c := range []struct {
+		name string
+		body map[string]any
+		code int
+	}{
+		{"twice", map[string]any{"address": "team@example.com", "kind": "alias", "targets": []string{"bob@example.com"}}, http.StatusConflict},
+		{"user address", map[string]any{"address": "bob@example.com", "kind": "alias", "targets": []string{"alice@example.com"}}, http.StatusBadRequest},
+		{"invalid kind", map[string]any{"address": "info@example.com", "kind": "list", "targets": []string{"bob@example.com"}}, http.StatusBadRequest},
+		{"no targets", map[string]any{"address": "info@example.com", "kind": "alias"}, http.StatusBadRequest},
+		{"external group member", map[string]any{"address": "info@example.com", "kind": "group", "targets": []string{"carol@example.org"}}, http.StatusBadRequest},
+	} {
+		if w := do(t, mux, "alice", http.MethodPost, "/api/admin/routes", c.body); w.Code != c.code {
+			t.Errorf("Add %s: expected %d, got %d", c.name, c.code, w.Code)
+		}
+	}
+
+	w = do(t, mux, "alice", http.MethodPatch, "/api/admin/routes/team@example.com", map[string]any{"kind": "alias", "targets": []string{"bob@example.com", "carol@example.org"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Update: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	decode(t, w, &route)
+	if route.Kind != routing.KindAlias || len(route.Targets) != 2 || route.Targets[1] != "carol@example.org" {
+		t.Errorf("Update: unexpected route %+v", route)
+	}
+
+	// Addresses of routes can not be given to users
+	if w := do(t, mux, "alice", http.MethodPost, "/api/admin/users", map[string]any{"name": "carol", "password": "x", "primary_email": "team@example.com"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Create user with route address: expected 400, got %d", w.Code)
+	}
+	bob, err := us.GetByName("bob")
+	if err != nil {
+		t.Fatalf("Get user: unexpected error: %v", err)
+	}
+	bob.Emails = append(bob.Emails, "team@example.com")
+	if err := us.Update(*bob); err != nil {
+		t.Fatalf("Update user: unexpected error: %v", err)
+	}
+	if w := do(t, mux, "alice", http.MethodPatch, "/api/admin/users/"+bob.ID, map[string]any{"primary_email": "team@example.com"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Set route address as primary address: expected 400, got %d", w.Code)
+	}
+
+	if w := do(t, mux, "alice", http.MethodDelete, "/api/admin/routes/team@example.com", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Remove: expected 204, got %d: %s", w.Code, w.Body)
+	}
+	if w := do(t, mux, "alice", http.MethodGet, "/api/admin/routes/team@example.com", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Get removed route: expected 404, got %d", w.Code)
+	}
+}
+
+func setup(t *testing.T, configure ...func(*adminhandler.Configuration)) (*http.ServeMux, *users.Store, *mails.Store, *auth.Service) {
+	t.Helper()
+
+	us := users.NewStore(users.Configuration{DB: udb.NewDB()})
+	for _, u := range []users.User{
+		{Name: "alice", Password: "alice123", PrimaryEmail: "alice@example.com", Emails: []string{"alice@example.com"}, Role: users.RoleAdmin},
+		{Name: "bob", Password: "bob123", PrimaryEmail: "bob@example.com", Emails: []string{"bob@example.com"}},
+	} {
+		if err := us.Create(u); err != nil {
+			t.Fatalf("Create user: unexpected error: %v", err)
+		}
+	}
+
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+	as := auth.NewService(auth.Configuration{Users: *us})
+
+	cfg := adminhandler.Configuration{
+		UserStore: *us,
+		MailStore: *ms,
+		Auth:      as,
+	}
+	for _, c := range configure {
+		c(&cfg)
+	}
+
+	mux := http.NewServeMux()
+	adminhandler.New(cfg).Register("/api", mux)
+
+	return mux, us, ms, as
+}
+
+func adminID(t *testing.T, us *users.Store) string {
+	t.Helper()
+
+	u, err := us.GetByName("alice")
+	if err != nil {
+		t.Fatalf("Get user: unexpected error: %v", err)
+	}
+	return u.ID
+}
+
+// failingUserDB fails to update users once failUpdates is set.
+type failingUserDB struct {
+	users.DB
+	failUpdates bool
+}
+
+func (db *failingUserDB) Update(u users.User) error {
+	if db.failUpdates {
+		return errors.New("database unavailable")
+	}
+	return db.DB.Update(u)
+}
+
+func do(t *testing.T, mux *http.ServeMux, login string, method string, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatalf("Marshal request: %v", err)
+		}
+	}
+
+	r := httptest.NewRequest(method, path, bytes.NewReader(data))
+	r.SetBasicAuth(login, login+"123")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func bearer(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("Decode response %d: %v: %s", w.Code, err, w.Body)
+	}
+}
@@ -0,0 +1,226 @@
+package adminhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+)
+
+func (h *Handler) handleDomains(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getDomains(w, r)
+	case http.MethodPost:
+		h.addDomain(w, r)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getDomains(w http.ResponseWriter, r *http.Request) {
+	list, err := h.domains.List()
+	if err != nil {
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	resp := make([]DomainResp, 0, len(list))
+	for _, d := range list {
+		resp = append(resp, domainResp(d))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) addDomain(w http.ResponseWriter, r *http.Request) {
+	var req CreateDomainReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if req.DefaultStorageLimit < 0 {
+		problems.ValidationError("default_storage_limit", "Limit must not be negative").WriteToHTTP(w)
+		return
+	}
+
+	d, err := h.domains.Add(domains.Domain{
+		Name:                req.Name,
+		DKIM:                domains.DKIM{Selector: req.DKIMSelector, PrivateKey: req.DKIMPrivateKey},
+		CatchAll:            req.CatchAll,
+		DefaultStorageLimit: req.DefaultStorageLimit,
+		TLS:                 domains.TLS{Certificate: req.TLSCertificate, PrivateKey: req.TLSPrivateKey},
+	})
+	if err != nil {
+		writeDomainError(w, err, req.Name)
+		return
+	}
+
+	slog.Info("Added domain", slog.String("domain", d.Name))
+	writeJSON(w, http.StatusCreated, domainResp(*d))
+}
+
+func (h *Handler) handleDomain(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("domain")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getDomain(w, r, name)
+	case http.MethodPatch:
+		h.updateDomain(w, r, name)
+	case http.MethodDelete:
+		h.removeDomain(w, r, name)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPatch, http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getDomain(w http.ResponseWriter, r *http.Request, name string) {
+	d, err := h.domains.Get(name)
+	if err != nil {
+		writeDomainError(w, err, name)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, domainResp(*d))
+}
+
+func (h *Handler) updateDomain(w http.ResponseWriter, r *http.Request, name string) {
+	var req UpdateDomainReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	d, err := h.domains.Get(name)
+	if err != nil {
+		writeDomainError(w, err, name)
+		return
+	}
+
+	if req.DKIMSelector != nil {
+		d.DKIM.Selector = *req.DKIMSelector
+	}
+	if req.DKIMPrivateKey != nil {
+		d.DKIM.PrivateKey = *req.DKIMPrivateKey
+	}
+	if req.CatchAll != nil {
+		d.CatchAll = *req.CatchAll
+	}
+	if req.DefaultStorageLimit != nil {
+		if *req.DefaultStorageLimit < 0 {
+			problems.ValidationError("default_storage_limit", "Limit must not be negative").WriteToHTTP(w)
+			return
+		}
+		d.DefaultStorageLimit = *req.DefaultStorageLimit
+	}
+	if req.TLSCertificate != nil {
+		d.TLS.Certificate = *req.TLSCertificate
+	}
+	if req.TLSPrivateKey != nil {
+		d.TLS.PrivateKey = *req.TLSPrivateKey
+	}
+
+	if err := h.domains.Update(*d); err != nil {
+		writeDomainError(w, err, name)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, domainResp(*d))
+}
+
+// removeDomain stops hosting the domain. Domains that are still used by
+// addresses of users or routes can not be removed, the addresses have to be
+// removed first.
+func (h *Handler) removeDomain(w http.ResponseWriter, r *http.Request, name string) {
+	d, err := h.domains.Get(name)
+	if err != nil {
+		writeDomainError(w, err, name)
+		return
+	}
+
+	list, err := h.userStore.List()
+	if err != nil {
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+	for _, u := range list {
+		for _, email := range u.Emails {
+			if domains.DomainOf(email) == d.Name {
+				problems.ValidationError("domain", fmt.Sprintf("The domain is used by the address %s of user %s", email, u.Name)).WriteToHTTP(w)
+				return
+			}
+		}
+	}
+
+	if h.routes != nil {
+		routes, err := h.routes.List()
+		if err != nil {
+			problems.InternalServerError(err.Error()).WriteToHTTP(w)
+			return
+		}
+		for _, route := range routes {
+			if domains.DomainOf(route.Address) == d.Name {
+				problems.ValidationError("domain", fmt.Sprintf("The domain is used by the %s %s", route.Kind, route.Address)).WriteToHTTP(w)
+				return
+			}
+		}
+	}
+
+	if err := h.domains.Remove(d.Name); err != nil {
+		writeDomainError(w, err, name)
+		return
+	}
+
+	slog.Info("Removed domain", slog.String("domain", d.Name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkDomains writes a problem and returns false if one of the addresses is
+// not in a hosted domain. All addresses are accepted if domains are not managed.
+func (h *Handler) checkDomains(w http.ResponseWriter, emails ...string) bool {
+	if h.domains == nil {
+		return true
+	}
+
+	for _, email := range emails {
+		hosted, err := h.domains.IsHosted(domains.DomainOf(email))
+		if err != nil {
+			problems.InternalServerError(err.Error()).WriteToHTTP(w)
+			return false
+		}
+		if !hosted {
+			problems.ValidationError("emails", fmt.Sprintf("The domain of %s is not hosted", email)).WriteToHTTP(w)
+			return false
+		}
+	}
+	return true
+}
+
+func writeDomainError(w http.ResponseWriter, err error, name string) {
+	switch {
+	case errors.Is(err, domains.ErrDomainNotFound):
+		problems.NotFound("Domain", name).WriteToHTTP(w)
+	case errors.Is(err, domains.ErrDomainAlreadyExists):
+		problems.AlreadyExists("Domain", name).WriteToHTTP(w)
+	case errors.Is(err, domains.ErrInvalidName):
+		problems.ValidationError("name", "Invalid domain name").WriteToHTTP(w)
+	case errors.Is(err, domains.ErrInvalidSelector):
+		problems.ValidationError("dkim_selector", "Invalid DKIM selector").WriteToHTTP(w)
+	case errors.Is(err, domains.ErrInvalidKey):
+		problems.ValidationError("dkim_private_key", "Key must be a PEM encoded RSA or Ed25519 private key").WriteToHTTP(w)
+	case errors.Is(err, domains.ErrInvalidCertificate):
+		problems.ValidationError("tls_certificate", "Certificate and key must be a matching PEM encoded pair").WriteToHTTP(w)
+	case errors.Is(err, domains.ErrInvalidCatchAll):
+		problems.ValidationError("catch_all", "Catch-all must be a plain email address").WriteToHTTP(w)
+	default:
+		slog.Error("Failed to manage domain", slog.String("domain", name), sloki.WrapError(err))
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
+}
@@ -0,0 +1,125 @@
+package adminhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+func (h *Handler) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.rotateKey(w, r, r.PathValue("user_id"))
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+// rotateKey re-encrypts all mail of the user with a new key and retires the
+// old ones. Zero-access keys must be unlocked, i.e. the user must have logged
+// in with their password.
+func (h *Handler) rotateKey(w http.ResponseWriter, r *http.Request, userId string) {
+	if _, err := h.userStore.GetByID(userId); err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	if err := h.mailStore.RotateUserKey(userId); err != nil {
+		writeKeyError(w, err, userId)
+		return
+	}
+
+	slog.Info("Rotated key", slog.String("user_id", userId))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleZeroAccess(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.enableZeroAccess(w, r, r.PathValue("user_id"))
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+// enableZeroAccess wraps the keys of the user with their password. The
+// password of the user is required, admins can not read it. The headers of
+// mail are not encrypted, see mails.Configuration.Keys.
+func (h *Handler) enableZeroAccess(w http.ResponseWriter, r *http.Request, userId string) {
+	var req EnableZeroAccessReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	u, err := h.userStore.GetByID(userId)
+	if err != nil {
+		writeError(w, err, userId)
+		return
+	}
+
+	if _, err := h.userStore.VerifyPassword(u.Name, req.Password); err != nil {
+		if errors.Is(err, users.ErrInvalidCredentials) || errors.Is(err, users.ErrUserDisabled) {
+			problems.ValidationError("password", "Password is invalid").WriteToHTTP(w)
+			return
+		}
+		writeError(w, err, userId)
+		return
+	}
+
+	if err := h.mailStore.EnableZeroAccess(userId, req.Password); err != nil {
+		writeKeyError(w, err, userId)
+		return
+	}
+
+	slog.Info("Enabled zero-access encryption", slog.String("user_id", userId))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleRewrapKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.rewrapKeys(w, r)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+// rewrapKeys rewraps the keys of all users that are wrapped by an old master
+// key with the active one, after the master key was rotated.
+func (h *Handler) rewrapKeys(w http.ResponseWriter, r *http.Request) {
+	n, err := h.keys.RewrapMasterKeys()
+	if err != nil {
+		if errors.Is(err, keys.ErrMasterKeyMissing) {
+			problems.InternalServerError("A master key is missing, check the configured master keys").WriteToHTTP(w)
+			return
+		}
+		slog.Error("Failed to rewrap keys", sloki.WrapError(err))
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	slog.Info("Rewrapped keys", slog.Int("count", n))
+	writeJSON(w, http.StatusOK, RewrapKeysResp{Rewrapped: n})
+}
+
+// writeKeyError writes the problem matching an error of the key store.
+func writeKeyError(w http.ResponseWriter, err error, userId string) {
+	switch {
+	case errors.Is(err, keys.ErrKeyNotFound):
+		problems.NotFound("Key", userId).WriteToHTTP(w)
+	case errors.Is(err, keys.ErrKeyAlreadyExists):
+		problems.ValidationError("user_id", "The user already has zero-access encryption").WriteToHTTP(w)
+	case errors.Is(err, keys.ErrKeyLocked):
+		problems.ValidationError("user_id", "The keys of the user are locked, they have to log in with their password first").WriteToHTTP(w)
+	default:
+		slog.Error("Failed to manage keys", slog.String("user_id", userId), sloki.WrapError(err))
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
+}
@@ -0,0 +1,140 @@
+package adminhandler
+
+import (
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+// UserResp is a user without their password and tokens.
+type UserResp struct {
+	ID               string           `json:"id"`
+	Name             string           `json:"name"`
+	PrimaryEmail     string           `json:"primary_email"`
+	Emails           []string         `json:"emails"`
+	Role             users.Role       `json:"role"`
+	Disabled         bool             `json:"disabled"`
+	Quota            users.Quota      `json:"quota"`
+	TwoFactorEnabled bool             `json:"two_factor_enabled"`
+	Forwarding       users.Forwarding `json:"forwarding"`
+}
+
+func userResp(u users.User) UserResp {
+	emails := u.Emails
+	if emails == nil {
+		emails = []string{}
+	}
+	forwarding := u.Forwarding
+	if forwarding.Addresses == nil {
+		forwarding.Addresses = []string{}
+	}
+
+	return UserResp{
+		ID:               u.ID,
+		Name:             u.Name,
+		PrimaryEmail:     u.PrimaryEmail,
+		Emails:           emails,
+		Role:             u.Role,
+		Disabled:         u.Disabled,
+		Quota:            u.Quota,
+		TwoFactorEnabled: u.TwoFactor.Enabled,
+		Forwarding:       forwarding,
+	}
+}
+
+type CreateUserReq struct {
+	Name         string     `json:"name"`
+	Password     string     `json:"password"`
+	PrimaryEmail string     `json:"primary_email"`
+	Emails       []string   `json:"emails"` // the primary address is added if missing
+	Role         users.Role `json:"role"`
+}
+
+// UpdateUserReq only changes the fields that are set.
+type UpdateUserReq struct {
+	Name         *string     `json:"name"`
+	PrimaryEmail *string     `json:"primary_email"` // must be one of the user's addresses
+	Role         *users.Role `json:"role"`
+	Disabled     *bool       `json:"disabled"`
+}
+
+type SetPasswordReq struct {
+	Password string `json:"password"`
+	// OldPassword is required for users with zero-access encryption, their
+	// keys are rewrapped with the new password.
+	OldPassword string `json:"old_password,omitempty"`
+}
+
+type EnableZeroAccessReq struct {
+	Password string `json:"password"` // the user's password, their keys are wrapped with it
+}
+
+type RewrapKeysResp struct {
+	Rewrapped int `json:"rewrapped"` // number of keys that were wrapped by an old master key
+}
+
+type AddEmailReq struct {
+	Email string `json:"email"`
+}
+
+type DomainResp struct {
+	Name         string `json:"name"`
+	DKIMSelector string `json:"dkim_selector"`
+	// DKIMRecord is the TXT record to publish at <dkim_selector>._domainkey.<name>,
+	// empty if the domain is signed with the server-wide key.
+	DKIMRecord          string    `json:"dkim_record,omitempty"`
+	CatchAll            string    `json:"catch_all"`
+	DefaultStorageLimit int64     `json:"default_storage_limit"`
+	TLSCertificate      string    `json:"tls_certificate,omitempty"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+func domainResp(d domains.Domain) DomainResp {
+	// The key was validated when it was stored
+	record, _ := d.DKIMRecord()
+
+	return DomainResp{
+		Name:                d.Name,
+		DKIMSelector:        d.DKIM.Selector,
+		DKIMRecord:          record,
+		CatchAll:            d.CatchAll,
+		DefaultStorageLimit: d.DefaultStorageLimit,
+		TLSCertificate:      d.TLS.Certificate,
+		CreatedAt:           d.CreatedAt,
+	}
+}
+
+type CreateDomainReq struct {
+	Name                string `json:"name"`
+	DKIMSelector        string `json:"dkim_selector"`    // optional
+	DKIMPrivateKey      string `json:"dkim_private_key"` // optional, PEM encoded
+	CatchAll            string `json:"catch_all"`        // optional
+	DefaultStorageLimit int64  `json:"default_storage_limit"`
+	TLSCertificate      string `json:"tls_certificate"` // optional, PEM encoded
+	TLSPrivateKey       string `json:"tls_private_key"` // required with the certificate
+}
+
+// UpdateDomainReq only changes the fields that are set. An empty key or
+// certificate removes it.
+type UpdateDomainReq struct {
+	DKIMSelector        *string `json:"dkim_selector"`
+	DKIMPrivateKey      *string `json:"dkim_private_key"`
+	CatchAll            *string `json:"catch_all"`
+	DefaultStorageLimit *int64  `json:"default_storage_limit"`
+	TLSCertificate      *string `json:"tls_certificate"`
+	TLSPrivateKey       *string `json:"tls_private_key"`
+}
+
+type CreateRouteReq struct {
+	Address string       `json:"address"`
+	Kind    routing.Kind `json:"kind"`    // alias or group
+	Targets []string     `json:"targets"` // members of groups must be local addresses
+}
+
+// UpdateRouteReq only changes the fields that are set.
+type UpdateRouteReq struct {
+	Kind    *routing.Kind `json:"kind"`
+	Targets *[]string     `json:"targets"`
+}
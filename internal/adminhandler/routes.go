@@ -0,0 +1,161 @@
+package adminhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+)
+
+func (h *Handler) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getRoutes(w, r)
+	case http.MethodPost:
+		h.addRoute(w, r)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getRoutes(w http.ResponseWriter, r *http.Request) {
+	list, err := h.routes.List()
+	if err != nil {
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *Handler) addRoute(w http.ResponseWriter, r *http.Request) {
+	var req CreateRouteReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	route, err := h.routes.Add(routing.Route{
+		Address: req.Address,
+		Kind:    req.Kind,
+		Targets: req.Targets,
+	})
+	if err != nil {
+		writeRouteError(w, err, req.Address)
+		return
+	}
+
+	slog.Info("Added route", slog.String("address", route.Address), slog.String("kind", string(route.Kind)))
+	writeJSON(w, http.StatusCreated, route)
+}
+
+func (h *Handler) handleRoute(w http.ResponseWriter, r *http.Request) {
+	address := r.PathValue("address")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getRoute(w, r, address)
+	case http.MethodPatch:
+		h.updateRoute(w, r, address)
+	case http.MethodDelete:
+		h.removeRoute(w, r, address)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPatch, http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getRoute(w http.ResponseWriter, r *http.Request, address string) {
+	route, err := h.routes.Get(address)
+	if err != nil {
+		writeRouteError(w, err, address)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, route)
+}
+
+func (h *Handler) updateRoute(w http.ResponseWriter, r *http.Request, address string) {
+	var req UpdateRouteReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	route, err := h.routes.Get(address)
+	if err != nil {
+		writeRouteError(w, err, address)
+		return
+	}
+
+	if req.Kind != nil {
+		route.Kind = *req.Kind
+	}
+	if req.Targets != nil {
+		route.Targets = *req.Targets
+	}
+
+	if err := h.routes.Update(*route); err != nil {
+		writeRouteError(w, err, address)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, route)
+}
+
+func (h *Handler) removeRoute(w http.ResponseWriter, r *http.Request, address string) {
+	if err := h.routes.Remove(address); err != nil {
+		writeRouteError(w, err, address)
+		return
+	}
+
+	slog.Info("Removed route", slog.String("address", routing.Normalize(address)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkRoutes writes a problem and returns false if one of the addresses
+// belongs to an alias or group.
+func (h *Handler) checkRoutes(w http.ResponseWriter, emails ...string) bool {
+	if h.routes == nil {
+		return true
+	}
+
+	for _, email := range emails {
+		_, err := h.routes.Get(email)
+		if err == nil {
+			problems.ValidationError("emails", fmt.Sprintf("The address %s is an alias or group", email)).WriteToHTTP(w)
+			return false
+		}
+		if !errors.Is(err, routing.ErrRouteNotFound) {
+			problems.InternalServerError(err.Error()).WriteToHTTP(w)
+			return false
+		}
+	}
+	return true
+}
+
+func writeRouteError(w http.ResponseWriter, err error, address string) {
+	switch {
+	case errors.Is(err, routing.ErrRouteNotFound):
+		problems.NotFound("Route", address).WriteToHTTP(w)
+	case errors.Is(err, routing.ErrRouteAlreadyExists):
+		problems.AlreadyExists("Route", address).WriteToHTTP(w)
+	case errors.Is(err, routing.ErrInvalidAddress):
+		problems.ValidationError("address", "Address and targets must be plain email addresses, a route can not target itself").WriteToHTTP(w)
+	case errors.Is(err, routing.ErrInvalidKind):
+		problems.ValidationError("kind", "Kind must be alias or group").WriteToHTTP(w)
+	case errors.Is(err, routing.ErrNoTargets):
+		problems.ValidationError("targets", "Targets must not be empty").WriteToHTTP(w)
+	case errors.Is(err, routing.ErrAddressInUse):
+		problems.ValidationError("address", "The address belongs to a user").WriteToHTTP(w)
+	case errors.Is(err, routing.ErrDomainNotHosted):
+		problems.ValidationError("address", "The address and the members of groups must be in hosted domains").WriteToHTTP(w)
+	default:
+		slog.Error("Failed to manage route", slog.String("address", address), sloki.WrapError(err))
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
+}
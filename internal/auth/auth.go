@@ -0,0 +1,345 @@
+// Package auth authenticates and authorizes requests to the REST API.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+const DefaultTokenTTL = 24 * time.Hour
+
+const (
+	// challengeTTL is the time a user has to enter the second factor after the password.
+	challengeTTL = 5 * time.Minute
+	// maxChallengeAttempts limits guessing of second factor codes per login.
+	maxChallengeAttempts = 5
+)
+
+// UserIDPathValue is the path wildcard that names the user a request acts on.
+const UserIDPathValue = "user_id"
+
+type contextKey struct{}
+
+type Service struct {
+	users    users.Store
+	keys     *keys.Store
+	tokenTTL time.Duration
+	issuer   string
+
+	mu         sync.Mutex
+	sessions   map[string]session   // token hash -> session
+	challenges map[string]challenge // challenge hash -> challenge
+}
+
+type Configuration struct {
+	Users    users.Store
+	TokenTTL time.Duration // lifetime of bearer tokens, defaults to DefaultTokenTTL
+	Issuer   string        // shown in authenticator apps, usually the hostname
+	// Keys is optional, unlocks the zero-access encryption keys of users when
+	// they log in with their password.
+	Keys *keys.Store
+}
+
+func NewService(cfg Configuration) *Service {
+	if cfg.TokenTTL == 0 {
+		cfg.TokenTTL = DefaultTokenTTL
+	}
+
+	return &Service{
+		users:      cfg.Users,
+		keys:       cfg.Keys,
+		tokenTTL:   cfg.TokenTTL,
+		issuer:     cfg.Issuer,
+		sessions:   make(map[string]session),
+		challenges: make(map[string]challenge),
+	}
+}
+
+// Authenticate returns the identity of the caller, based on the Authorization
+// header. HTTP Basic authentication with passwords or app passwords, session
+// tokens and personal API tokens are accepted. Personal tokens must have the
+// scope required by the request method.
+func (s *Service) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	scheme, credentials, _ := strings.Cut(header, " ")
+	scope := scopeFor(r)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		login, password, ok := r.BasicAuth()
+		if !ok {
+			return nil, users.ErrInvalidCredentials
+		}
+
+		u, t, err := s.users.Authenticate(login, password, scope)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{User: u, Method: MethodBasic, PersonalToken: t}, nil
+
+	case "bearer":
+		token := strings.TrimSpace(credentials)
+		if strings.HasPrefix(token, users.TokenPrefix) {
+			u, t, err := s.users.AuthenticateToken(token, scope)
+			if err != nil {
+				return nil, err
+			}
+			return &Identity{User: u, Method: MethodBearer, Token: token, PersonalToken: t}, nil
+		}
+
+		u, err := s.validateToken(token)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{User: u, Method: MethodBearer, Token: token}, nil
+	}
+
+	return nil, ErrMissingCredentials
+}
+
+// RequireAuth only calls next for authenticated callers. The identity of the
+// caller is available via FromContext. Requests with the user's password
+// unlock their zero-access keys until next returns.
+func (s *Service) RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := s.Authenticate(r)
+		if err != nil {
+			if errors.Is(err, users.ErrInsufficientScope) {
+				problems.Forbidden().WriteToHTTP(w)
+				return
+			}
+			if !isAuthError(err) {
+				slog.Error("Failed to authenticate request", sloki.WrapError(err))
+				problems.InternalServerError("Failed to authenticate request").WriteToHTTP(w)
+				return
+			}
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail-server", Bearer realm="mail-server"`)
+			problems.Unauthorized().WriteToHTTP(w)
+			return
+		}
+
+		// Zero-access keys are derived from the user's password, so they stay locked for app passwords
+		if id.Method == MethodBasic && id.PersonalToken == nil {
+			_, password, _ := r.BasicAuth()
+			unlocked, err := s.unlockKeys(id.User.ID, password)
+			if err != nil {
+				slog.Error("Failed to unlock encryption keys", slog.String("user_id", id.User.ID), sloki.WrapError(err))
+				problems.InternalServerError("Failed to unlock encryption keys").WriteToHTTP(w)
+				return
+			}
+			if unlocked {
+				defer s.keys.Release(id.User.ID)
+			}
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, id)))
+	}
+}
+
+// RequireUser only calls next for callers that act on their own data, i.e. the
+// {user_id} of the path is their ID, or for admins.
+func (s *Service) RequireUser(next http.HandlerFunc) http.HandlerFunc {
+	return s.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := FromContext(r.Context())
+		if !id.User.IsAdmin() && r.PathValue(UserIDPathValue) != id.User.ID {
+			problems.Forbidden().WriteToHTTP(w)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// RequireAdmin only calls next for admins.
+func (s *Service) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return s.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := FromContext(r.Context())
+		if !id.User.IsAdmin() {
+			problems.Forbidden().WriteToHTTP(w)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// FromContext returns the identity stored by the middlewares of this package.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(*Identity)
+	return id, ok
+}
+
+// IssueToken creates a new bearer token for the user. It does not unlock the
+// zero-access keys of the user, see Login.
+func (s *Service) IssueToken(userID string) (*Token, error) {
+	return s.issueToken(userID, false)
+}
+
+// issueToken creates a new bearer token for the user. Sessions that hold the
+// unlocked keys of the user release them when they are revoked or expire.
+func (s *Service) issueToken(userID string, unlocked bool) (*Token, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Token{
+		Token:     token,
+		ExpiresAt: time.Now().Add(s.tokenTTL),
+	}
+
+	key := hashToken(t.Token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[key] = session{
+		UserID:    userID,
+		ExpiresAt: t.ExpiresAt,
+		Unlocked:  unlocked,
+	}
+	if unlocked {
+		// The keys must not stay unlocked until the token is used again
+		time.AfterFunc(s.tokenTTL, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			s.removeSession(key)
+		})
+	}
+	return t, nil
+}
+
+// RevokeToken invalidates the bearer token.
+func (s *Service) RevokeToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeSession(hashToken(token))
+}
+
+// RevokeUserTokens invalidates all bearer tokens and pending logins of the
+// user, e.g. after their password was reset.
+func (s *Service) RevokeUserTokens(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, sess := range s.sessions {
+		if sess.UserID == userID {
+			s.removeSession(key)
+		}
+	}
+	for key, ch := range s.challenges {
+		if ch.UserID == userID {
+			s.removeChallenge(key)
+		}
+	}
+}
+
+// removeSession deletes the session and releases the keys it holds.
+// It expects the caller to hold s.mu.
+func (s *Service) removeSession(key string) {
+	sess, ok := s.sessions[key]
+	if !ok {
+		return
+	}
+
+	delete(s.sessions, key)
+	if sess.Unlocked {
+		s.keys.Release(sess.UserID)
+	}
+}
+
+// unlockKeys unlocks the zero-access keys of the user with their password for
+// a session. The password was verified already, so keys that are unlocked are
+// only retained. It reports whether the session has to release the keys.
+func (s *Service) unlockKeys(userID string, password string) (bool, error) {
+	if s.keys == nil {
+		return false, nil
+	}
+	if s.keys.Retain(userID) {
+		return true, nil
+	}
+
+	if err := s.keys.Unlock(userID, password); err != nil {
+		return false, err
+	}
+	return s.keys.IsUnlocked(userID), nil
+}
+
+func (s *Service) validateToken(token string) (*users.User, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+
+	s.mu.Lock()
+	key := hashToken(token)
+	sess, ok := s.sessions[key]
+	if ok && !time.Now().Before(sess.ExpiresAt) {
+		s.removeSession(key)
+		ok = false
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	u, err := s.users.GetByID(sess.UserID)
+	if err != nil {
+		if errors.Is(err, users.ErrUserNotFound) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, ErrInvalidToken
+	}
+	return u, nil
+}
+
+// scopeFor returns the scope a personal token needs for the request.
+func scopeFor(r *http.Request) users.Scope {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return users.ScopeAPIRead
+	default:
+		return users.ScopeAPISend
+	}
+}
+
+func isAuthError(err error) bool {
+	return errors.Is(err, ErrMissingCredentials) ||
+		errors.Is(err, ErrInvalidToken) ||
+		errors.Is(err, users.ErrInvalidCredentials) ||
+		errors.Is(err, users.ErrUserDisabled) ||
+		errors.Is(err, users.ErrSecondFactorRequired)
+}
+
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,532 @@
+package auth_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/auth"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	kdb "github.com/OliverSchlueter/mail-server/internal/keys/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/totp"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	udb "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func TestRequireUser(t *testing.T) {
+	s, alice, bob, admin := setup(t, 0)
+
+	aliceToken, err := s.IssueToken(alice.ID)
+	if err != nil {
+		t.Fatalf("IssueToken: unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		userID        string
+		authorization func(r *http.Request)
+		want          int
+	}{
+		{"no credentials", alice.ID, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic with email", alice.ID, basic("alice@example.com", "alice123"), http.StatusOK},
+		{"basic with name", alice.ID, basic("alice", "alice123"), http.StatusOK},
+		{"wrong password", alice.ID, basic("alice", "wrong"), http.StatusUnauthorized},
+		{"unknown user", alice.ID, basic("mallory", "alice123"), http.StatusUnauthorized},
+		{"bearer", alice.ID, bearer(aliceToken.Token), http.StatusOK},
+		{"unknown token", alice.ID, bearer("nope"), http.StatusUnauthorized},
+		{"other user", bob.ID, basic("alice", "alice123"), http.StatusForbidden},
+		{"other user with bearer", bob.ID, bearer(aliceToken.Token), http.StatusForbidden},
+		{"admin", bob.ID, basic("admin", "admin123"), http.StatusOK},
+		{"admin itself", admin.ID, basic("admin", "admin123"), http.StatusOK},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mailboxes/{user_id}", s.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := auth.FromContext(r.Context()); !ok {
+			t.Errorf("FromContext: expected identity in context")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/mailboxes/"+tc.userID, nil)
+			tc.authorization(r)
+			w := httptest.NewRecorder()
+
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tc.want {
+				t.Errorf("Expected status %d, got %d", tc.want, w.Code)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected WWW-Authenticate header on 401")
+			}
+		})
+	}
+}
+
+func TestTokenEndpoints(t *testing.T) {
+	s, _, _, _ := setup(t, 0)
+
+	mux := http.NewServeMux()
+	s.Register("/api", mux)
+
+	// Issue with basic authentication
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/token", nil)
+	basic("alice", "alice123")(r)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	var token auth.Token
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
+		t.Fatalf("Failed to decode token: %v", err)
+	}
+
+	// Tokens cannot be used to issue new tokens
+	r = httptest.NewRequest(http.MethodPost, "/api/auth/token", nil)
+	bearer(token.Token)(r)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	// Revoke
+	r = httptest.NewRequest(http.MethodDelete, "/api/auth/token", nil)
+	bearer(token.Token)(r)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/auth/token", nil)
+	bearer(token.Token)(r)
+	if _, err := s.Authenticate(r); err == nil {
+		t.Errorf("Authenticate: expected revoked token to be rejected")
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	s, alice, _, _ := setup(t, time.Nanosecond)
+
+	token, err := s.IssueToken(alice.ID)
+	if err != nil {
+		t.Fatalf("IssueToken: unexpected error: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	bearer(token.Token)(r)
+	if _, err := s.Authenticate(r); err == nil {
+		t.Errorf("Authenticate: expected expired token to be rejected")
+	}
+}
+
+func TestPersonalTokens(t *testing.T) {
+	s, alice, _, _ := setup(t, 0)
+
+	mux := http.NewServeMux()
+	s.Register("/api", mux)
+	mux.HandleFunc("/api/mailboxes/{user_id}", s.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	do := func(method, path, body string, authorization func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		authorization(r)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodPost, "/api/tokens/"+alice.ID, `{"name": "script", "scopes": ["api-read"]}`, basic("alice", "alice123"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create token: expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	var created auth.CreatePersonalTokenResp
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode token: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization func(r *http.Request)
+		want          int
+	}{
+		{"read with bearer", http.MethodGet, "/api/mailboxes/" + alice.ID, bearer(created.Secret), http.StatusOK},
+		{"read with basic", http.MethodGet, "/api/mailboxes/" + alice.ID, basic("alice", created.Secret), http.StatusOK},
+		{"write without scope", http.MethodPost, "/api/mailboxes/" + alice.ID, bearer(created.Secret), http.StatusForbidden},
+		{"list tokens with token", http.MethodGet, "/api/tokens/" + alice.ID, bearer(created.Secret), http.StatusForbidden},
+		{"session with token", http.MethodPost, "/api/auth/token", basic("alice", created.Secret), http.StatusForbidden},
+		{"list tokens", http.MethodGet, "/api/tokens/" + alice.ID, basic("alice", "alice123"), http.StatusOK},
+		{"invalid scope", http.MethodPost, "/api/tokens/" + alice.ID, basic("alice", "alice123"), http.StatusBadRequest},
+		{"revoke", http.MethodDelete, "/api/tokens/" + alice.ID + "/" + created.Token.ID, basic("alice", "alice123"), http.StatusNoContent},
+		{"read after revoke", http.MethodGet, "/api/mailboxes/" + alice.ID, bearer(created.Secret), http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"name": "bad", "scopes": ["everything"]}`
+			if w := do(tc.method, tc.path, body, tc.authorization); w.Code != tc.want {
+				t.Errorf("Expected status %d, got %d", tc.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestLoginWithSecondFactor(t *testing.T) {
+	s, alice, _, _ := setup(t, 0)
+
+	mux := http.NewServeMux()
+	s.Register("/api", mux)
+
+	do := func(method, path string, body any, authorization func(r *http.Request), out any) int {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Failed to marshal body: %v", err)
+		}
+		r := httptest.NewRequest(method, path, bytes.NewReader(data))
+		authorization(r)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if out != nil && w.Code < 300 {
+			if err := json.NewDecoder(w.Body).Decode(out); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w.Code
+	}
+	none := func(r *http.Request) {}
+
+	// Without second factor the login returns a session right away
+	var login auth.LoginResp
+	if code := do(http.MethodPost, "/api/auth/login", auth.LoginReq{Login: "alice", Password: "alice123"}, none, &login); code != http.StatusCreated || login.Token == nil {
+		t.Fatalf("Login: expected session, got status %d", code)
+	}
+	session := bearer(login.Token.Token)
+
+	// Enroll
+	var begin auth.BeginTwoFactorResp
+	if code := do(http.MethodPost, "/api/two-factor/"+alice.ID, nil, session, &begin); code != http.StatusCreated {
+		t.Fatalf("Begin two-factor: expected status %d, got %d", http.StatusCreated, code)
+	}
+	if !strings.HasPrefix(begin.URI, "otpauth://totp/") {
+		t.Errorf("Begin two-factor: unexpected URI %s", begin.URI)
+	}
+	var confirm auth.ConfirmTwoFactorResp
+	if code := do(http.MethodPost, "/api/two-factor/"+alice.ID+"/confirm", auth.TwoFactorCodeReq{Code: codeAt(t, begin.Secret, -1)}, session, &confirm); code != http.StatusOK {
+		t.Fatalf("Confirm two-factor: expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// Basic authentication with the password is no longer accepted
+	if code := do(http.MethodGet, "/api/two-factor/"+alice.ID, nil, basic("alice", "alice123"), nil); code != http.StatusUnauthorized {
+		t.Errorf("Basic with password: expected status %d, got %d", http.StatusUnauthorized, code)
+	}
+
+	// Login requires the second factor
+	login = auth.LoginResp{}
+	if code := do(http.MethodPost, "/api/auth/login", auth.LoginReq{Login: "alice", Password: "alice123"}, none, &login); code != http.StatusOK || !login.SecondFactorRequired || login.Token != nil {
+		t.Fatalf("Login: expected challenge, got status %d", code)
+	}
+	if code := do(http.MethodPost, "/api/auth/login/verify", auth.VerifyLoginReq{Challenge: login.Challenge, Code: "000000"}, none, nil); code != http.StatusUnauthorized {
+		t.Errorf("Verify with wrong code: expected status %d, got %d", http.StatusUnauthorized, code)
+	}
+
+	var verified auth.LoginResp
+	if code := do(http.MethodPost, "/api/auth/login/verify", auth.VerifyLoginReq{Challenge: login.Challenge, Code: codeAt(t, begin.Secret, 0)}, none, &verified); code != http.StatusCreated || verified.Token == nil {
+		t.Fatalf("Verify: expected session, got status %d", code)
+	}
+
+	var status auth.TwoFactorStatus
+	if code := do(http.MethodGet, "/api/two-factor/"+alice.ID, nil, bearer(verified.Token.Token), &status); code != http.StatusOK || !status.Enabled {
+		t.Errorf("Two-factor status: expected enabled, got status %d, %+v", code, status)
+	}
+
+	// Challenges can only be used once
+	if code := do(http.MethodPost, "/api/auth/login/verify", auth.VerifyLoginReq{Challenge: login.Challenge, Code: confirm.RecoveryCodes[0]}, none, nil); code != http.StatusUnauthorized {
+		t.Errorf("Verify with used challenge: expected status %d, got %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	var us users.Store
+	s, alice, _, _ := setup(t, 0, func(cfg *auth.Configuration) {
+		us = cfg.Users
+	})
+	secret, err := us.BeginTwoFactor(alice.ID)
+	if err != nil {
+		t.Fatalf("BeginTwoFactor: unexpected error: %v", err)
+	}
+	if _, err := us.ConfirmTwoFactor(alice.ID, codeAt(t, secret, -1)); err != nil {
+		t.Fatalf("ConfirmTwoFactor: unexpected error: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	s.Register("/api", mux)
+	verify := func(challenge, code string) int {
+		data, err := json.Marshal(auth.VerifyLoginReq{Challenge: challenge, Code: code})
+		if err != nil {
+			t.Fatalf("Failed to marshal body: %v", err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/auth/login/verify", bytes.NewReader(data)))
+		return w.Code
+	}
+
+	// Every login allows a few attempts, but wrong codes are counted across logins
+	for range 2 {
+		login, err := s.Login("alice", "alice123")
+		if err != nil {
+			t.Fatalf("Login: unexpected error: %v", err)
+		}
+		for range 5 {
+			if code := verify(login.Challenge, "000000"); code != http.StatusUnauthorized {
+				t.Fatalf("Verify with wrong code: expected status %d, got %d", http.StatusUnauthorized, code)
+			}
+		}
+	}
+
+	login, err := s.Login("alice", "alice123")
+	if err != nil {
+		t.Fatalf("Login: unexpected error: %v", err)
+	}
+	if code := verify(login.Challenge, codeAt(t, secret, 0)); code != http.StatusTooManyRequests {
+		t.Errorf("Verify while locked: expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestUnlockKeys(t *testing.T) {
+	ks := keys.NewStore(keys.Configuration{DB: kdb.NewDB()})
+	s, alice, _, _ := setup(t, 0, func(cfg *auth.Configuration) {
+		cfg.Keys = ks
+	})
+
+	var unlockedInRequest bool
+	mux := http.NewServeMux()
+	s.Register("/api", mux)
+	mux.HandleFunc("/api/mailboxes/{user_id}", s.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		unlockedInRequest = ks.IsUnlocked(alice.ID)
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func(method, path, body string, authorization func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		authorization(r)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodPost, "/api/tokens/"+alice.ID, `{"name": "phone", "scopes": ["api-read"]}`, basic("alice", "alice123"))
+	var created auth.CreatePersonalTokenResp
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode token: %v", err)
+	}
+
+	if err := ks.EnableZeroAccess(alice.ID, "alice123"); err != nil {
+		t.Fatalf("EnableZeroAccess: unexpected error: %v", err)
+	}
+	sealed, version, err := ks.Seal(alice.ID, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Seal: unexpected error: %v", err)
+	}
+	canOpen := func() bool {
+		_, err := ks.Open(alice.ID, version, sealed)
+		if err != nil && !errors.Is(err, keys.ErrKeyLocked) {
+			t.Fatalf("Open: unexpected error: %v", err)
+		}
+		return err == nil
+	}
+
+	// App passwords can not unlock the keys
+	do(http.MethodGet, "/api/mailboxes/"+alice.ID, "", basic("alice", created.Secret))
+	if unlockedInRequest {
+		t.Errorf("Basic with app password: expected keys to stay locked")
+	}
+
+	// The password unlocks them for the request only
+	do(http.MethodGet, "/api/mailboxes/"+alice.ID, "", basic("alice", "alice123"))
+	if !unlockedInRequest {
+		t.Errorf("Basic with password: expected keys to be unlocked during the request")
+	}
+	if canOpen() {
+		t.Errorf("Basic with password: expected keys to be locked after the request")
+	}
+
+	// Sessions keep the keys unlocked until the last one is revoked
+	var tokens []string
+	for range 2 {
+		login, err := s.Login("alice", "alice123")
+		if err != nil {
+			t.Fatalf("Login: unexpected error: %v", err)
+		}
+		tokens = append(tokens, login.Token.Token)
+	}
+	w = do(http.MethodPost, "/api/auth/token", "", basic("alice", "alice123"))
+	var token auth.Token
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
+		t.Fatalf("Failed to decode token: %v", err)
+	}
+	tokens = append(tokens, token.Token)
+
+	for _, token := range tokens {
+		if !canOpen() {
+			t.Fatalf("Expected keys to be unlocked while a session is left")
+		}
+		s.RevokeToken(token)
+	}
+	if canOpen() {
+		t.Errorf("Revoked sessions: expected keys to be locked")
+	}
+
+	if _, err := s.Login("alice", "alice123"); err != nil {
+		t.Fatalf("Login: unexpected error: %v", err)
+	}
+	s.RevokeUserTokens(alice.ID)
+	if canOpen() {
+		t.Errorf("Revoked user sessions: expected keys to be locked")
+	}
+}
+
+func TestUnlockKeysExpiry(t *testing.T) {
+	ks := keys.NewStore(keys.Configuration{DB: kdb.NewDB()})
+	s, alice, _, _ := setup(t, 20*time.Millisecond, func(cfg *auth.Configuration) {
+		cfg.Keys = ks
+	})
+	if err := ks.EnableZeroAccess(alice.ID, "alice123"); err != nil {
+		t.Fatalf("EnableZeroAccess: unexpected error: %v", err)
+	}
+
+	if _, err := s.Login("alice", "alice123"); err != nil {
+		t.Fatalf("Login: unexpected error: %v", err)
+	}
+	if !ks.IsUnlocked(alice.ID) {
+		t.Fatalf("Login: expected keys to be unlocked")
+	}
+
+	// The keys are locked when the session expires, even if it is never used again
+	deadline := time.Now().Add(time.Second)
+	for ks.IsUnlocked(alice.ID) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ks.IsUnlocked(alice.ID) {
+		t.Errorf("Expired session: expected keys to be locked")
+	}
+}
+
+func TestUnlockKeysWithSecondFactor(t *testing.T) {
+	ks := keys.NewStore(keys.Configuration{DB: kdb.NewDB()})
+	var us users.Store
+	s, alice, _, _ := setup(t, 0, func(cfg *auth.Configuration) {
+		cfg.Keys = ks
+		us = cfg.Users
+	})
+
+	secret, err := us.BeginTwoFactor(alice.ID)
+	if err != nil {
+		t.Fatalf("BeginTwoFactor: unexpected error: %v", err)
+	}
+	if _, err := us.ConfirmTwoFactor(alice.ID, codeAt(t, secret, -1)); err != nil {
+		t.Fatalf("ConfirmTwoFactor: unexpected error: %v", err)
+	}
+	if err := ks.EnableZeroAccess(alice.ID, "alice123"); err != nil {
+		t.Fatalf("EnableZeroAccess: unexpected error: %v", err)
+	}
+
+	// A failed challenge locks the keys again
+	login, err := s.Login("alice", "alice123")
+	if err != nil {
+		t.Fatalf("Login: unexpected error: %v", err)
+	}
+	for range 5 {
+		if _, err := s.VerifyLogin(login.Challenge, "000000"); err == nil {
+			t.Fatalf("VerifyLogin: expected wrong code to be rejected")
+		}
+	}
+	if ks.IsUnlocked(alice.ID) {
+		t.Errorf("Failed challenge: expected keys to be locked")
+	}
+
+	// A completed challenge passes the keys on to the session
+	login, err = s.Login("alice", "alice123")
+	if err != nil {
+		t.Fatalf("Login: unexpected error: %v", err)
+	}
+	token, err := s.VerifyLogin(login.Challenge, codeAt(t, secret, 0))
+	if err != nil {
+		t.Fatalf("VerifyLogin: unexpected error: %v", err)
+	}
+	if !ks.IsUnlocked(alice.ID) {
+		t.Errorf("Completed challenge: expected keys to be unlocked")
+	}
+	s.RevokeToken(token.Token)
+	if ks.IsUnlocked(alice.ID) {
+		t.Errorf("Revoked session: expected keys to be locked")
+	}
+}
+
+// codeAt returns the TOTP code of the secret, steps away from the current time step.
+func codeAt(t *testing.T, secret string, steps int64) string {
+	t.Helper()
+
+	code, err := totp.Code(secret, totp.Step(time.Now())+steps)
+	if err != nil {
+		t.Fatalf("Code: unexpected error: %v", err)
+	}
+	return code
+}
+
+func setup(t *testing.T, ttl time.Duration, configure ...func(*auth.Configuration)) (*auth.Service, *users.User, *users.User, *users.User) {
+	t.Helper()
+
+	us := users.NewStore(users.Configuration{DB: udb.NewDB()})
+	for _, u := range []users.User{
+		{Name: "alice", Password: "alice123", PrimaryEmail: "alice@example.com"},
+		{Name: "bob", Password: "bob123", PrimaryEmail: "bob@example.com"},
+		{Name: "admin", Password: "admin123", PrimaryEmail: "admin@example.com", Role: users.RoleAdmin},
+	} {
+		if err := us.Create(u); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	var created []*users.User
+	for _, name := range []string{"alice", "bob", "admin"} {
+		u, err := us.GetByName(name)
+		if err != nil {
+			t.Fatalf("Failed to get user: %v", err)
+		}
+		created = append(created, u)
+	}
+
+	cfg := auth.Configuration{Users: *us, TokenTTL: ttl}
+	for _, c := range configure {
+		c(&cfg)
+	}
+
+	s := auth.NewService(cfg)
+	return s, created[0], created[1], created[2]
+}
+
+func basic(login, password string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.SetBasicAuth(login, password)
+	}
+}
+
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
@@ -0,0 +1,9 @@
+package auth
+
+import "errors"
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidToken       = errors.New("invalid or expired token")
+	ErrInvalidChallenge   = errors.New("invalid or expired login challenge")
+)
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+// Register adds the endpoints to log in, to issue and revoke session tokens and
+// to manage personal API tokens and the second factor.
+func (s *Service) Register(prefix string, mux *http.ServeMux) {
+	mux.HandleFunc(prefix+"/auth/login", s.handleLogin)
+	mux.HandleFunc(prefix+"/auth/login/verify", s.handleVerifyLogin)
+	mux.HandleFunc(prefix+"/auth/token", s.RequireAuth(s.handleToken))
+	mux.HandleFunc(prefix+"/two-factor/{user_id}", s.RequireUser(s.handleTwoFactor))
+	mux.HandleFunc(prefix+"/two-factor/{user_id}/confirm", s.RequireUser(s.handleConfirmTwoFactor))
+	mux.HandleFunc(prefix+"/tokens/{user_id}", s.RequireUser(s.handlePersonalTokens))
+	mux.HandleFunc(prefix+"/tokens/{user_id}/{token_id}", s.RequireUser(s.handlePersonalToken))
+}
+
+func (s *Service) handleToken(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.createToken(w, r)
+	case http.MethodDelete:
+		s.revokeToken(w, r)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost, http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (s *Service) createToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := FromContext(r.Context())
+
+	// Tokens may not be renewed with a token, otherwise a stolen token would never expire
+	if id.Method != MethodBasic || id.PersonalToken != nil {
+		problems.Forbidden().WriteToHTTP(w)
+		return
+	}
+
+	_, password, _ := r.BasicAuth()
+	unlocked, err := s.unlockKeys(id.User.ID, password)
+	if err != nil {
+		problems.InternalServerError("Failed to unlock encryption keys").WriteToHTTP(w)
+		return
+	}
+
+	t, err := s.issueToken(id.User.ID, unlocked)
+	if err != nil {
+		if unlocked {
+			s.keys.Release(id.User.ID)
+		}
+		problems.InternalServerError("Failed to issue token").WriteToHTTP(w)
+		return
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		problems.InternalServerError("Error marshalling token").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+func (s *Service) revokeToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := FromContext(r.Context())
+	if id.Method != MethodBearer {
+		problems.ValidationError("Authorization", "Only bearer tokens can be revoked").WriteToHTTP(w)
+		return
+	}
+
+	s.RevokeToken(id.Token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) handlePersonalTokens(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	// Personal tokens can not be used to manage tokens, so a leaked token can not create more
+	if id, _ := FromContext(r.Context()); id.PersonalToken != nil {
+		problems.Forbidden().WriteToHTTP(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getPersonalTokens(w, r, userId)
+	case http.MethodPost:
+		s.createPersonalToken(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (s *Service) getPersonalTokens(w http.ResponseWriter, r *http.Request, userId string) {
+	tokens, err := s.users.GetTokens(userId)
+	if err != nil {
+		if errors.Is(err, users.ErrUserNotFound) {
+			problems.NotFound("User", userId).WriteToHTTP(w)
+			return
+		}
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		problems.InternalServerError("Error marshalling tokens").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (s *Service) createPersonalToken(w http.ResponseWriter, r *http.Request, userId string) {
+	var req CreatePersonalTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		problems.ValidationError("name", "Name must not be empty").WriteToHTTP(w)
+		return
+	}
+	if !req.ExpiresAt.IsZero() && req.ExpiresAt.Before(time.Now()) {
+		problems.ValidationError("expires_at", "Expiry must be in the future").WriteToHTTP(w)
+		return
+	}
+
+	secret, t, err := s.users.CreateToken(userId, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, users.ErrInvalidScope) {
+			problems.ValidationError("scopes", "Scopes must be any of smtp-submit, imap, api-read and api-send").WriteToHTTP(w)
+			return
+		}
+		if errors.Is(err, users.ErrUserNotFound) {
+			problems.NotFound("User", userId).WriteToHTTP(w)
+			return
+		}
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	data, err := json.Marshal(CreatePersonalTokenResp{
+		Secret: secret,
+		Token:  *t,
+	})
+	if err != nil {
+		problems.InternalServerError("Error marshalling token").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+func (s *Service) handlePersonalToken(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	tokenId := r.PathValue("token_id")
+
+	if id, _ := FromContext(r.Context()); id.PersonalToken != nil {
+		problems.Forbidden().WriteToHTTP(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		s.revokePersonalToken(w, r, userId, tokenId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (s *Service) revokePersonalToken(w http.ResponseWriter, r *http.Request, userId string, tokenId string) {
+	if err := s.users.RevokeToken(userId, tokenId); err != nil {
+		if errors.Is(err, users.ErrTokenNotFound) {
+			problems.NotFound("Token", tokenId).WriteToHTTP(w)
+			return
+		}
+		if errors.Is(err, users.ErrUserNotFound) {
+			problems.NotFound("User", userId).WriteToHTTP(w)
+			return
+		}
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+// Login checks the password of the user. Users without a second factor get a
+// session token right away, all others a challenge for VerifyLogin. The
+// zero-access keys of the user are unlocked once the password is checked, and
+// locked again if the challenge fails or expires.
+func (s *Service) Login(login string, password string) (*LoginResp, error) {
+	u, err := s.users.VerifyPassword(login, password)
+	if err != nil {
+		return nil, err
+	}
+
+	unlocked, err := s.unlockKeys(u.ID, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.TwoFactor.Enabled {
+		t, err := s.issueToken(u.ID, unlocked)
+		if err != nil {
+			if unlocked {
+				s.keys.Release(u.ID)
+			}
+			return nil, err
+		}
+		return &LoginResp{Token: t}, nil
+	}
+
+	c, err := randomToken()
+	if err != nil {
+		if unlocked {
+			s.keys.Release(u.ID)
+		}
+		return nil, err
+	}
+	key := hashToken(c)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.challenges[key] = challenge{
+		UserID:    u.ID,
+		ExpiresAt: time.Now().Add(challengeTTL),
+		Unlocked:  unlocked,
+	}
+	if unlocked {
+		time.AfterFunc(challengeTTL, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			s.removeChallenge(key)
+		})
+	}
+	return &LoginResp{SecondFactorRequired: true, Challenge: c}, nil
+}
+
+// VerifyLogin completes a login with the second factor and returns a session token.
+func (s *Service) VerifyLogin(c string, code string) (*Token, error) {
+	key := hashToken(c)
+
+	s.mu.Lock()
+	ch, ok := s.challenges[key]
+	if ok && (!time.Now().Before(ch.ExpiresAt) || ch.Attempts >= maxChallengeAttempts) {
+		s.removeChallenge(key)
+		ok = false
+	}
+	if ok {
+		ch.Attempts++
+		s.challenges[key] = ch
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, ErrInvalidChallenge
+	}
+
+	if err := s.users.VerifySecondFactor(ch.UserID, code); err != nil {
+		if ch.Attempts >= maxChallengeAttempts {
+			s.mu.Lock()
+			s.removeChallenge(key)
+			s.mu.Unlock()
+		}
+		return nil, err
+	}
+
+	// The challenge may have been used or revoked concurrently, its keys are
+	// passed on to the session only once
+	s.mu.Lock()
+	_, ok = s.challenges[key]
+	delete(s.challenges, key)
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, ErrInvalidChallenge
+	}
+
+	t, err := s.issueToken(ch.UserID, ch.Unlocked)
+	if err != nil && ch.Unlocked {
+		s.keys.Release(ch.UserID)
+	}
+	return t, err
+}
+
+// removeChallenge deletes the pending login and releases the keys it holds.
+// It expects the caller to hold s.mu.
+func (s *Service) removeChallenge(key string) {
+	ch, ok := s.challenges[key]
+	if !ok {
+		return
+	}
+
+	delete(s.challenges, key)
+	if ch.Unlocked {
+		s.keys.Release(ch.UserID)
+	}
+}
+
+func (s *Service) handleLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.login(w, r)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (s *Service) login(w http.ResponseWriter, r *http.Request) {
+	var req LoginReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	resp, err := s.Login(req.Login, req.Password)
+	if err != nil {
+		if errors.Is(err, users.ErrInvalidCredentials) || errors.Is(err, users.ErrUserDisabled) {
+			problems.Unauthorized().WriteToHTTP(w)
+			return
+		}
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		problems.InternalServerError("Error marshalling login").WriteToHTTP(w)
+		return
+	}
+
+	status := http.StatusCreated
+	if resp.SecondFactorRequired {
+		status = http.StatusOK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (s *Service) handleVerifyLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.verifyLogin(w, r)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (s *Service) verifyLogin(w http.ResponseWriter, r *http.Request) {
+	var req VerifyLoginReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	t, err := s.VerifyLogin(req.Challenge, req.Code)
+	if err != nil {
+		if errors.Is(err, users.ErrTooManyAttempts) {
+			problems.TooManyRequests().WriteToHTTP(w)
+			return
+		}
+		if errors.Is(err, ErrInvalidChallenge) || errors.Is(err, users.ErrInvalidCode) || errors.Is(err, users.ErrTwoFactorNotEnrolled) {
+			problems.Unauthorized().WriteToHTTP(w)
+			return
+		}
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	data, err := json.Marshal(LoginResp{Token: t})
+	if err != nil {
+		problems.InternalServerError("Error marshalling login").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+type Method string
+
+const (
+	MethodBasic  Method = "basic"
+	MethodBearer Method = "bearer"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	User          *users.User
+	Method        Method
+	Token         string       // the bearer token of the request, if any
+	PersonalToken *users.Token // the personal API token or app password used, nil for the user's own password and session tokens
+}
+
+type Token struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// session is an issued bearer token, only the hash of the token is kept.
+type session struct {
+	UserID    string
+	ExpiresAt time.Time
+	Unlocked  bool // the session holds the unlocked zero-access keys of the user
+}
+
+// challenge is a login that is waiting for the second factor.
+type challenge struct {
+	UserID    string
+	ExpiresAt time.Time
+	Attempts  int
+	Unlocked  bool // the login holds the unlocked zero-access keys of the user, passed on to its session
+}
+
+type CreatePersonalTokenReq struct {
+	Name      string        `json:"name"`
+	Scopes    []users.Scope `json:"scopes"`
+	ExpiresAt time.Time     `json:"expires_at"` // optional
+}
+
+type CreatePersonalTokenResp struct {
+	Secret string      `json:"secret"` // only returned once
+	Token  users.Token `json:"token"`
+}
+
+type LoginReq struct {
+	Login    string `json:"login"` // email address or name
+	Password string `json:"password"`
+}
+
+type LoginResp struct {
+	Token                *Token `json:"token,omitempty"`
+	SecondFactorRequired bool   `json:"second_factor_required"`
+	Challenge            string `json:"challenge,omitempty"` // to be passed to the verify endpoint with the code
+}
+
+type VerifyLoginReq struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"` // TOTP or recovery code
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+type BeginTwoFactorResp struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth URI, usually shown as QR code
+}
+
+type TwoFactorCodeReq struct {
+	Code string `json:"code"`
+}
+
+type ConfirmTwoFactorResp struct {
+	RecoveryCodes []string `json:"recovery_codes"` // only returned once
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/totp"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+func (s *Service) handleTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	// Personal tokens can not be used to change the second factor
+	if id, _ := FromContext(r.Context()); id.PersonalToken != nil {
+		problems.Forbidden().WriteToHTTP(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getTwoFactor(w, r, userId)
+	case http.MethodPost:
+		s.beginTwoFactor(w, r, userId)
+	case http.MethodDelete:
+		s.disableTwoFactor(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPost, http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (s *Service) getTwoFactor(w http.ResponseWriter, r *http.Request, userId string) {
+	u, err := s.users.GetByID(userId)
+	if err != nil {
+		writeUserError(w, err, userId)
+		return
+	}
+
+	data, err := json.Marshal(TwoFactorStatus{
+		Enabled:           u.TwoFactor.Enabled,
+		RecoveryCodesLeft: len(u.TwoFactor.RecoveryCodes),
+	})
+	if err != nil {
+		problems.InternalServerError("Error marshalling two-factor status").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (s *Service) beginTwoFactor(w http.ResponseWriter, r *http.Request, userId string) {
+	u, err := s.users.GetByID(userId)
+	if err != nil {
+		writeUserError(w, err, userId)
+		return
+	}
+
+	secret, err := s.users.BeginTwoFactor(userId)
+	if err != nil {
+		writeUserError(w, err, userId)
+		return
+	}
+
+	data, err := json.Marshal(BeginTwoFactorResp{
+		Secret: secret,
+		URI:    totp.URI(s.issuer, u.PrimaryEmail, secret),
+	})
+	if err != nil {
+		problems.InternalServerError("Error marshalling two-factor secret").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+func (s *Service) disableTwoFactor(w http.ResponseWriter, r *http.Request, userId string) {
+	var req TwoFactorCodeReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if err := s.users.DisableTwoFactor(userId, req.Code); err != nil {
+		writeUserError(w, err, userId)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) handleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	if id, _ := FromContext(r.Context()); id.PersonalToken != nil {
+		problems.Forbidden().WriteToHTTP(w)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		s.confirmTwoFactor(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (s *Service) confirmTwoFactor(w http.ResponseWriter, r *http.Request, userId string) {
+	var req TwoFactorCodeReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	codes, err := s.users.ConfirmTwoFactor(userId, req.Code)
+	if err != nil {
+		writeUserError(w, err, userId)
+		return
+	}
+
+	data, err := json.Marshal(ConfirmTwoFactorResp{RecoveryCodes: codes})
+	if err != nil {
+		problems.InternalServerError("Error marshalling recovery codes").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// writeUserError writes the problem matching an error of the users store.
+func writeUserError(w http.ResponseWriter, err error, userId string) {
+	switch {
+	case errors.Is(err, users.ErrUserNotFound):
+		problems.NotFound("User", userId).WriteToHTTP(w)
+	case errors.Is(err, users.ErrTwoFactorEnabled):
+		problems.AlreadyExists("Two-factor authentication", userId).WriteToHTTP(w)
+	case errors.Is(err, users.ErrTwoFactorNotEnrolled):
+		problems.ValidationError("two_factor", "Two-factor authentication is not set up").WriteToHTTP(w)
+	case errors.Is(err, users.ErrInvalidCode):
+		problems.ValidationError("code", "Invalid code").WriteToHTTP(w)
+	case errors.Is(err, users.ErrTooManyAttempts):
+		problems.TooManyRequests().WriteToHTTP(w)
+	default:
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
+}
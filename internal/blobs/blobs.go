@@ -0,0 +1,104 @@
+package blobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const DefaultMinCompressSize = 1024
+
+type DB interface {
+	Get(id string) (*Blob, error)
+	// Ref stores the blob if it does not exist yet and increments its reference count.
+	Ref(blob Blob) error
+	// Unref decrements the reference count of the blob and deletes it once no references are left.
+	Unref(id string) error
+}
+
+type Store struct {
+	db              DB
+	compression     bool
+	minCompressSize int
+	encoder         *zstd.Encoder
+	decoder         *zstd.Decoder
+}
+
+type Configuration struct {
+	DB              DB
+	Compression     bool // compress blobs with zstd
+	MinCompressSize int  // blobs smaller than this are never compressed
+}
+
+func NewStore(cfg Configuration) *Store {
+	if cfg.MinCompressSize == 0 {
+		cfg.MinCompressSize = DefaultMinCompressSize
+	}
+
+	// Encoder and decoder are safe for concurrent use of EncodeAll and DecodeAll
+	encoder, _ := zstd.NewWriter(nil)
+	decoder, _ := zstd.NewReader(nil)
+
+	return &Store{
+		db:              cfg.DB,
+		compression:     cfg.Compression,
+		minCompressSize: cfg.MinCompressSize,
+		encoder:         encoder,
+		decoder:         decoder,
+	}
+}
+
+// Put stores the content and returns its ID. Storing the same content multiple
+// times only keeps one copy, but every Put must be paired with a Release.
+func (s *Store) Put(content []byte) (string, error) {
+	b := Blob{
+		ID:   ID(content),
+		Data: content,
+		Size: len(content),
+	}
+
+	if s.compression && len(content) >= s.minCompressSize {
+		compressed := s.encoder.EncodeAll(content, nil)
+		// Only keep the compressed data if it actually saves space
+		if len(compressed) < len(content) {
+			b.Data = compressed
+			b.Compressed = true
+		}
+	}
+
+	if err := s.db.Ref(b); err != nil {
+		return "", err
+	}
+
+	return b.ID, nil
+}
+
+func (s *Store) Get(id string) ([]byte, error) {
+	b, err := s.db.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !b.Compressed {
+		return b.Data, nil
+	}
+
+	content, err := s.decoder.DecodeAll(b.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress blob %s: %w", id, err)
+	}
+	return content, nil
+}
+
+// Release drops one reference to the blob, deleting it once it is no longer referenced.
+func (s *Store) Release(id string) error {
+	return s.db.Unref(id)
+}
+
+// ID returns the content address of the given content.
+func ID(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
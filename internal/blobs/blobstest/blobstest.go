@@ -0,0 +1,107 @@
+// Package blobstest provides a conformance test suite that every blobs.DB
+// implementation is expected to pass.
+package blobstest
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/blobs"
+)
+
+// RunDBSuite runs all conformance tests against the blobs.DB returned by newDB.
+// newDB is called once per test and must return an empty database.
+func RunDBSuite(t *testing.T, newDB func() blobs.DB) {
+	t.Run("NotFound", func(t *testing.T) { TestNotFound(t, newDB()) })
+	t.Run("RefCounting", func(t *testing.T) { TestRefCounting(t, newDB()) })
+	t.Run("Concurrency", func(t *testing.T) { TestConcurrency(t, newDB()) })
+}
+
+func TestNotFound(t *testing.T, db blobs.DB) {
+	if _, err := db.Get("missing"); !errors.Is(err, blobs.ErrBlobNotFound) {
+		t.Errorf("Get: expected ErrBlobNotFound, got %v", err)
+	}
+	if err := db.Unref("missing"); !errors.Is(err, blobs.ErrBlobNotFound) {
+		t.Errorf("Unref: expected ErrBlobNotFound, got %v", err)
+	}
+}
+
+func TestRefCounting(t *testing.T, db blobs.DB) {
+	content := []byte("hello world")
+	b := blobs.Blob{ID: blobs.ID(content), Data: content, Size: len(content)}
+
+	for i := 0; i < 2; i++ {
+		if err := db.Ref(b); err != nil {
+			t.Fatalf("Ref: unexpected error: %v", err)
+		}
+	}
+
+	got, err := db.Get(b.ID)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if !bytes.Equal(got.Data, content) || got.Size != len(content) {
+		t.Errorf("Get: stored blob does not match: %+v", got)
+	}
+	if got.RefCount != 2 {
+		t.Errorf("Get: expected 2 references, got %d", got.RefCount)
+	}
+
+	if err := db.Unref(b.ID); err != nil {
+		t.Fatalf("Unref: unexpected error: %v", err)
+	}
+	if _, err := db.Get(b.ID); err != nil {
+		t.Errorf("Get: blob deleted while still referenced: %v", err)
+	}
+
+	if err := db.Unref(b.ID); err != nil {
+		t.Fatalf("Unref: unexpected error: %v", err)
+	}
+	if _, err := db.Get(b.ID); !errors.Is(err, blobs.ErrBlobNotFound) {
+		t.Errorf("Get: expected unreferenced blob to be deleted, got %v", err)
+	}
+}
+
+func TestConcurrency(t *testing.T, db blobs.DB) {
+	const workers = 8
+	const perWorker = 25
+
+	content := []byte("shared content")
+	b := blobs.Blob{ID: blobs.ID(content), Data: content, Size: len(content)}
+
+	// Keep one reference for the whole test so the blob is never deleted
+	if err := db.Ref(b); err != nil {
+		t.Fatalf("Ref: unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < perWorker; i++ {
+				if err := db.Ref(b); err != nil {
+					t.Errorf("Ref: unexpected error: %v", err)
+				}
+				if _, err := db.Get(b.ID); err != nil {
+					t.Errorf("Get: unexpected error: %v", err)
+				}
+				if err := db.Unref(b.ID); err != nil {
+					t.Errorf("Unref: unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := db.Get(b.ID)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if got.RefCount != 1 {
+		t.Errorf("Get: expected 1 reference, got %d", got.RefCount)
+	}
+}
@@ -0,0 +1,67 @@
+package fake
+
+import (
+	"github.com/OliverSchlueter/mail-server/internal/blobs"
+	"slices"
+	"sync"
+)
+
+type DB struct {
+	Items map[string]blobs.Blob
+	mu    sync.Mutex
+}
+
+func NewDB() *DB {
+	return &DB{
+		Items: make(map[string]blobs.Blob),
+		mu:    sync.Mutex{},
+	}
+}
+
+func (db *DB) Get(id string) (*blobs.Blob, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	blob, exists := db.Items[id]
+	if !exists {
+		return nil, blobs.ErrBlobNotFound
+	}
+	blob.Data = slices.Clone(blob.Data)
+	return &blob, nil
+}
+
+func (db *DB) Ref(blob blobs.Blob) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	existing, exists := db.Items[blob.ID]
+	if exists {
+		existing.RefCount++
+		db.Items[blob.ID] = existing
+		return nil
+	}
+
+	blob.Data = slices.Clone(blob.Data)
+	blob.RefCount = 1
+	db.Items[blob.ID] = blob
+	return nil
+}
+
+func (db *DB) Unref(id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	blob, exists := db.Items[id]
+	if !exists {
+		return blobs.ErrBlobNotFound
+	}
+
+	blob.RefCount--
+	if blob.RefCount <= 0 {
+		delete(db.Items, id)
+		return nil
+	}
+
+	db.Items[id] = blob
+	return nil
+}
@@ -0,0 +1,14 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/blobs"
+	"github.com/OliverSchlueter/mail-server/internal/blobs/blobstest"
+)
+
+func TestDB(t *testing.T) {
+	blobstest.RunDBSuite(t, func() blobs.DB {
+		return NewDB()
+	})
+}
@@ -0,0 +1,7 @@
+package blobs
+
+import "errors"
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+)
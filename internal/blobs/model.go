@@ -0,0 +1,9 @@
+package blobs
+
+type Blob struct {
+	ID         string `json:"id"`         // hex encoded SHA-256 of the uncompressed content
+	Data       []byte `json:"data"`       // content, zstd compressed if Compressed is set
+	Compressed bool   `json:"compressed"` // whether Data is zstd compressed
+	Size       int    `json:"size"`       // size of the uncompressed content
+	RefCount   int    `json:"ref_count"`
+}
@@ -0,0 +1,404 @@
+// Package compose builds MIME messages (RFC 5322, RFC 2045-2049) from their
+// parts, with all headers and bodies encoded for transport over SMTP.
+package compose
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxRecipients is the maximum number of To, Cc and Bcc recipients combined.
+const MaxRecipients = 100
+
+// lineLength is the maximum length of base64 encoded lines, as required by RFC 2045.
+const lineLength = 76
+
+// Build returns the encoded message with CRLF line endings.
+func (m Message) Build() ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m.build(false)
+}
+
+// BuildDraft returns the encoded message like Build, but the message may
+// still be incomplete. The Bcc recipients are kept in the headers, so the
+// draft can be restored with ParseDraft.
+func (m Message) BuildDraft() ([]byte, error) {
+	if err := m.validateFields(); err != nil {
+		return nil, err
+	}
+	return m.build(true)
+}
+
+func (m Message) build(draft bool) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.writeHeader(&buf, draft); err != nil {
+		return nil, err
+	}
+
+	var attachments, inline []Attachment
+	for _, a := range m.Attachments {
+		if a.IsInline() && m.HTML != "" {
+			inline = append(inline, a)
+		} else {
+			attachments = append(attachments, a)
+		}
+	}
+
+	body := m.bodyPart(inline)
+	if len(attachments) > 0 {
+		parts := []part{body}
+		for _, a := range attachments {
+			parts = append(parts, attachmentPart(a, "attachment"))
+		}
+		body = multipartPart("mixed", parts)
+	}
+
+	header, content, err := body.render()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHeader(&buf, header); err != nil {
+		return nil, err
+	}
+	buf.Write(content)
+	return buf.Bytes(), nil
+}
+
+// Validate checks the addresses and that the message has a body and recipients.
+func (m Message) Validate() error {
+	if err := m.validateFields(); err != nil {
+		return err
+	}
+
+	recipients := m.Recipients()
+	if len(recipients) == 0 {
+		return ErrNoRecipients
+	}
+
+	if m.Text == "" && m.HTML == "" && len(m.Attachments) == 0 {
+		return ErrNoBody
+	}
+
+	return nil
+}
+
+// validateFields checks the fields that are set.
+func (m Message) validateFields() error {
+	if _, err := mail.ParseAddress(m.From); err != nil {
+		return fmt.Errorf("%w: from: %s", ErrInvalidAddress, m.From)
+	}
+
+	lists := map[string][]string{"to": m.To, "cc": m.Cc, "bcc": m.Bcc, "reply_to": m.ReplyTo}
+	for field, list := range lists {
+		for _, addr := range list {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return fmt.Errorf("%w: %s: %s", ErrInvalidAddress, field, addr)
+			}
+		}
+	}
+
+	if len(m.Recipients()) > MaxRecipients {
+		return ErrTooManyRecipients
+	}
+
+	for k, v := range m.Headers {
+		if strings.ContainsAny(k, ": \r\n") || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("%w: %s", ErrInvalidHeader, k)
+		}
+	}
+
+	return nil
+}
+
+// Recipients returns the envelope recipients, which are the addresses of To,
+// Cc and Bcc without duplicates.
+func (m Message) Recipients() []string {
+	var recipients []string
+	for _, list := range [][]string{m.To, m.Cc, m.Bcc} {
+		for _, addr := range list {
+			parsed, err := mail.ParseAddress(addr)
+			if err != nil {
+				continue
+			}
+			if !slices.ContainsFunc(recipients, func(r string) bool { return strings.EqualFold(r, parsed.Address) }) {
+				recipients = append(recipients, parsed.Address)
+			}
+		}
+	}
+	return recipients
+}
+
+func (m Message) writeHeader(w io.Writer, draft bool) error {
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	msgID := m.MessageID
+	if msgID == "" {
+		var err error
+		if msgID, err = GenerateMessageID(m.From); err != nil {
+			return err
+		}
+	}
+
+	from, _ := mail.ParseAddress(m.From)
+
+	header := []string{
+		"Date: " + date.Format(time.RFC1123Z),
+		"From: " + from.String(),
+	}
+	if len(m.To) > 0 {
+		header = append(header, "To: "+formatAddressList(m.To))
+	}
+	if len(m.Cc) > 0 {
+		header = append(header, "Cc: "+formatAddressList(m.Cc))
+	}
+	if draft && len(m.Bcc) > 0 {
+		header = append(header, "Bcc: "+formatAddressList(m.Bcc))
+	}
+	if len(m.ReplyTo) > 0 {
+		header = append(header, "Reply-To: "+formatAddressList(m.ReplyTo))
+	}
+	header = append(header,
+		"Subject: "+EncodeHeader(m.Subject),
+		"Message-ID: <"+msgID+">",
+	)
+
+	extra := make([]string, 0, len(m.Headers))
+	for k := range m.Headers {
+		extra = append(extra, k)
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		header = append(header, textproto.CanonicalMIMEHeaderKey(k)+": "+m.Headers[k])
+	}
+
+	header = append(header, "MIME-Version: 1.0")
+
+	for _, line := range header {
+		if _, err := io.WriteString(w, line+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bodyPart returns the text of the message, as alternatives if it has both a
+// plain text and an HTML body.
+func (m Message) bodyPart(inline []Attachment) part {
+	var html part
+	if m.HTML != "" {
+		html = textPart("text/html", m.HTML)
+		if len(inline) > 0 {
+			parts := []part{html}
+			for _, a := range inline {
+				parts = append(parts, attachmentPart(a, "inline"))
+			}
+			html = multipartPart("related", parts)
+		}
+	}
+
+	switch {
+	case m.Text != "" && m.HTML != "":
+		return multipartPart("alternative", []part{textPart("text/plain", m.Text), html})
+	case m.HTML != "":
+		return html
+	default:
+		return textPart("text/plain", m.Text)
+	}
+}
+
+// part is a MIME entity, either with content or with child parts.
+type part struct {
+	header   textproto.MIMEHeader
+	subtype  string // multipart subtype, e.g. "mixed", if the part has children
+	children []part
+	content  []byte // already transfer-encoded
+}
+
+func textPart(contentType string, text string) part {
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(crlf(text)))
+	qp.Close()
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"charset": "utf-8"}))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return part{header: header, content: buf.Bytes()}
+}
+
+func attachmentPart(a Attachment, disposition string) part {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = DetectContentType(a.Filename, a.Data)
+	}
+
+	header := textproto.MIMEHeader{}
+	params := map[string]string{}
+	if a.Filename != "" {
+		params["name"] = a.Filename
+	}
+	if mediaType, typeParams, err := mime.ParseMediaType(contentType); err == nil {
+		for k, v := range typeParams {
+			params[k] = v
+		}
+		contentType = mediaType
+	}
+	formatted := mime.FormatMediaType(contentType, params)
+	if formatted == "" {
+		formatted = mime.FormatMediaType("application/octet-stream", params)
+	}
+	header.Set("Content-Type", formatted)
+
+	if a.Filename != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	} else {
+		header.Set("Content-Disposition", disposition)
+	}
+	if a.IsInline() && disposition == "inline" {
+		header.Set("Content-ID", "<"+a.ContentID+">")
+	}
+	// Messages must not be encoded, see RFC 2046 section 5.2.1
+	if contentType == "message/rfc822" {
+		header.Set("Content-Transfer-Encoding", "8bit")
+		return part{header: header, content: []byte(crlf(string(a.Data)))}
+	}
+
+	header.Set("Content-Transfer-Encoding", "base64")
+	return part{header: header, content: encodeBase64(a.Data)}
+}
+
+func multipartPart(subtype string, children []part) part {
+	return part{subtype: subtype, children: children}
+}
+
+// render returns the headers and the encoded content of the part.
+func (p part) render() (textproto.MIMEHeader, []byte, error) {
+	if p.subtype == "" {
+		return p.header, p.content, nil
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, child := range p.children {
+		header, content, err := child.render()
+		if err != nil {
+			return nil, nil, err
+		}
+		cw, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := cw.Write(content); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "multipart/"+p.subtype+"; boundary="+mw.Boundary())
+	return header, buf.Bytes(), nil
+}
+
+func writeHeader(w io.Writer, header textproto.MIMEHeader) error {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range header[k] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, v); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// EncodeHeader encodes a header value as RFC 2047 encoded words if it is not
+// plain ASCII. Long values are folded across multiple lines.
+func EncodeHeader(value string) string {
+	encoded := mime.QEncoding.Encode("utf-8", value)
+	return strings.ReplaceAll(encoded, "?= =?", "?=\r\n =?")
+}
+
+// GenerateMessageID returns a new unique message ID for the domain of the address.
+func GenerateMessageID(from string) (string, error) {
+	domain := "localhost"
+	if parsed, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(parsed.Address, "@"); i >= 0 {
+			domain = parsed.Address[i+1:]
+		}
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw) + "@" + domain, nil
+}
+
+// DetectContentType returns the media type of a file, based on the extension
+// of its name and falling back to sniffing its content.
+func DetectContentType(filename string, data []byte) string {
+	if t := mime.TypeByExtension(filepath.Ext(filename)); t != "" {
+		return t
+	}
+	return http.DetectContentType(data)
+}
+
+func formatAddressList(list []string) string {
+	formatted := make([]string, 0, len(list))
+	for _, addr := range list {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			continue
+		}
+		formatted = append(formatted, parsed.String())
+	}
+	return strings.Join(formatted, ",\r\n ")
+}
+
+func encodeBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var buf bytes.Buffer
+	for len(encoded) > lineLength {
+		buf.WriteString(encoded[:lineLength] + "\r\n")
+		encoded = encoded[lineLength:]
+	}
+	if encoded != "" {
+		buf.WriteString(encoded + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+// crlf converts all line endings to CRLF.
+func crlf(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
@@ -0,0 +1,242 @@
+package compose
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+)
+
+func TestBuild(t *testing.T) {
+	m := Message{
+		From:    "Jörg <joerg@example.com>",
+		To:      []string{"alice@example.com", "Bob <bob@example.com>"},
+		Cc:      []string{"carol@example.com"},
+		Bcc:     []string{"secret@example.com"},
+		ReplyTo: []string{"replies@example.com"},
+		Subject: "Grüße aus München",
+		Text:    "Hallo = Welt\nzweite Zeile",
+		HTML:    `<p>Hallo</p><img src="cid:logo">`,
+		Attachments: []Attachment{
+			{Filename: "report.pdf", Data: []byte("%PDF-1.4 report")},
+			{Filename: "logo.png", ContentType: "image/png", ContentID: "logo", Data: []byte{0x89, 'P', 'N', 'G'}},
+		},
+		Date:      time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		MessageID: "1234@example.com",
+		Headers:   map[string]string{"In-Reply-To": "<0@example.com>"},
+	}
+
+	raw, err := m.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Errorf("Line exceeds 998 characters: %d", len(line))
+		}
+	}
+	if strings.Contains(string(raw), "secret@example.com") {
+		t.Errorf("Bcc recipient must not appear in the message")
+	}
+
+	msg, err := message.Parse(mails.Mail{Body: string(raw)})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if got := msg.Subject(); got != m.Subject {
+		t.Errorf("Expected subject %q, got %q", m.Subject, got)
+	}
+	if got := msg.Addresses("To"); len(got) != 2 || got[1].Address != "bob@example.com" {
+		t.Errorf("Unexpected To addresses: %v", got)
+	}
+	if got := msg.Addresses("From"); len(got) != 1 || got[0].Name != "Jörg" {
+		t.Errorf("Unexpected From address: %v", got)
+	}
+	if got := msg.Header.Get("In-Reply-To"); got != "<0@example.com>" {
+		t.Errorf("Expected In-Reply-To header, got %q", got)
+	}
+	if got := msg.Text(); got != "Hallo = Welt\nzweite Zeile" {
+		t.Errorf("Unexpected text %q", got)
+	}
+
+	attachments := msg.Attachments()
+	if len(attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got %d", len(attachments))
+	}
+
+	var sawPDF, sawLogo bool
+	for _, a := range attachments {
+		switch a.Filename {
+		case "report.pdf":
+			sawPDF = a.ContentType == "application/pdf" && a.Disposition == "attachment" && string(a.Content) == "%PDF-1.4 report"
+		case "logo.png":
+			sawLogo = a.ContentID == "logo" && a.Disposition == "inline"
+		}
+	}
+	if !sawPDF || !sawLogo {
+		t.Errorf("Unexpected attachments: %+v", attachments)
+	}
+
+	recipients := m.Recipients()
+	if len(recipients) != 4 || recipients[3] != "secret@example.com" {
+		t.Errorf("Unexpected recipients: %v", recipients)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want error
+	}{
+		{"no recipients", Message{From: "a@example.com", Text: "hi"}, ErrNoRecipients},
+		{"invalid from", Message{From: "nope", To: []string{"b@example.com"}, Text: "hi"}, ErrInvalidAddress},
+		{"invalid cc", Message{From: "a@example.com", Cc: []string{"@"}, Text: "hi"}, ErrInvalidAddress},
+		{"no body", Message{From: "a@example.com", To: []string{"b@example.com"}}, ErrNoBody},
+		{"header injection", Message{From: "a@example.com", To: []string{"b@example.com"}, Text: "hi", Headers: map[string]string{"X-Test": "a\r\nBcc: c@example.com"}}, ErrInvalidHeader},
+	}
+
+	for _, tc := range tests {
+		if err := tc.msg.Validate(); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	original := mails.Mail{
+		Headers: map[string]string{"Subject": "Lunch"},
+		Body: "From: Bob <bob@example.com>\r\n" +
+			"To: alice@example.com, carol@example.com\r\n" +
+			"Cc: Dave <dave@example.com>, ALICE@example.com\r\n" +
+			"Subject: Lunch\r\n" +
+			"Date: Mon, 6 May 2024 10:00:00 +0000\r\n" +
+			"Message-ID: <2@example.com>\r\n" +
+			"References: <0@example.com> <1@example.com>\r\n" +
+			"\r\n" +
+			"Pizza?\r\n> earlier\r\n",
+	}
+
+	reply, err := Reply(original, "alice@example.com", []string{"alice@example.com"}, false)
+	if err != nil {
+		t.Fatalf("Reply failed: %v", err)
+	}
+	if len(reply.To) != 1 || reply.To[0] != `"Bob" <bob@example.com>` || len(reply.Cc) != 0 {
+		t.Errorf("Unexpected reply recipients: to %v, cc %v", reply.To, reply.Cc)
+	}
+	if reply.Subject != "Re: Lunch" {
+		t.Errorf("Unexpected subject %q", reply.Subject)
+	}
+	if reply.Headers["In-Reply-To"] != "<2@example.com>" || reply.Headers["References"] != "<0@example.com> <1@example.com> <2@example.com>" {
+		t.Errorf("Unexpected threading headers: %v", reply.Headers)
+	}
+	if !strings.Contains(reply.Text, "Bob <bob@example.com> wrote:\n> Pizza?\n>> earlier\n") {
+		t.Errorf("Unexpected quote %q", reply.Text)
+	}
+
+	all, err := Reply(original, "alice@example.com", []string{"alice@example.com"}, true)
+	if err != nil {
+		t.Fatalf("Reply all failed: %v", err)
+	}
+	if len(all.To) != 2 || all.To[1] != "<carol@example.com>" {
+		t.Errorf("Unexpected reply all To: %v", all.To)
+	}
+	if len(all.Cc) != 1 || all.Cc[0] != `"Dave" <dave@example.com>` {
+		t.Errorf("Unexpected reply all Cc: %v", all.Cc)
+	}
+
+	again, err := Reply(mails.Mail{Headers: map[string]string{"Subject": "RE: Lunch", "From": "bob@example.com"}, Body: "ok"}, "alice@example.com", nil, false)
+	if err != nil {
+		t.Fatalf("Reply failed: %v", err)
+	}
+	if again.Subject != "RE: Lunch" {
+		t.Errorf("Expected subject not to be prefixed twice, got %q", again.Subject)
+	}
+}
+
+func TestForward(t *testing.T) {
+	original := mails.Mail{
+		Headers: map[string]string{
+			"From":       "bob@example.com",
+			"Subject":    "Report",
+			"Message-ID": "<3@example.com>",
+		},
+		Body: "See the numbers.",
+	}
+
+	fwd, err := Forward(original, "alice@example.com", false)
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+	if fwd.Subject != "Fwd: Report" || fwd.Headers["References"] != "<3@example.com>" || fwd.Headers["In-Reply-To"] != "" {
+		t.Errorf("Unexpected forward: %+v", fwd)
+	}
+	if !strings.Contains(fwd.Text, "From: bob@example.com\n") || !strings.HasSuffix(fwd.Text, "See the numbers.") {
+		t.Errorf("Unexpected forward text %q", fwd.Text)
+	}
+
+	attached, err := Forward(original, "alice@example.com", true)
+	if err != nil {
+		t.Fatalf("Forward as attachment failed: %v", err)
+	}
+	attached.To = []string{"carol@example.com"}
+
+	raw, err := attached.Build()
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if !strings.Contains(string(raw), "Content-Type: message/rfc822; name=Report.eml\r\n") {
+		t.Errorf("Expected original to be attached as message/rfc822:\n%s", raw)
+	}
+	if !strings.Contains(string(raw), "Subject: Report\r\n\r\nSee the numbers.\r\n") {
+		t.Errorf("Expected original to be attached unencoded:\n%s", raw)
+	}
+}
+
+func TestDraftRoundTrip(t *testing.T) {
+	draft := Message{
+		From:    "alice@example.com",
+		Bcc:     []string{"secret@example.com"},
+		Cc:      []string{"@"},
+		Subject: "Unfinished",
+		Text:    "first line\nsecond line",
+		HTML:    "<p>first line</p>",
+		Attachments: []Attachment{
+			{Filename: "notes.txt", ContentType: "text/plain", Data: []byte("notes")},
+		},
+		Headers: map[string]string{"In-Reply-To": "<1@example.com>"},
+	}
+
+	if _, err := draft.BuildDraft(); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("Expected invalid addresses to be rejected in drafts, got %v", err)
+	}
+	draft.Cc = nil
+
+	raw, err := draft.BuildDraft()
+	if err != nil {
+		t.Fatalf("BuildDraft failed: %v", err)
+	}
+
+	got, err := ParseDraft(mails.Mail{Body: string(raw)})
+	if err != nil {
+		t.Fatalf("ParseDraft failed: %v", err)
+	}
+
+	if len(got.To) != 0 || len(got.Bcc) != 1 || got.Bcc[0] != "<secret@example.com>" {
+		t.Errorf("Unexpected recipients: to %v, bcc %v", got.To, got.Bcc)
+	}
+	if got.Subject != draft.Subject || got.Text != "first line\nsecond line" || got.HTML != draft.HTML {
+		t.Errorf("Unexpected content: %q %q %q", got.Subject, got.Text, got.HTML)
+	}
+	if len(got.Attachments) != 1 || string(got.Attachments[0].Data) != "notes" || got.Attachments[0].Filename != "notes.txt" {
+		t.Errorf("Unexpected attachments: %+v", got.Attachments)
+	}
+	if got.Headers["In-Reply-To"] != "<1@example.com>" {
+		t.Errorf("Expected threading headers to be kept, got %v", got.Headers)
+	}
+}
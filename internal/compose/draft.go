@@ -0,0 +1,73 @@
+package compose
+
+import (
+	"maps"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+)
+
+// draftHeaders are the additional headers that are kept when a draft is parsed.
+var draftHeaders = []string{"In-Reply-To", "References"}
+
+// ParseDraft restores the message of a draft that was built with BuildDraft.
+func ParseDraft(draft mails.Mail) (Message, error) {
+	msg, err := message.Parse(draft)
+	if err != nil {
+		return Message{}, err
+	}
+
+	m := Message{
+		To:      addressList(msg.Addresses("To")),
+		Cc:      addressList(msg.Addresses("Cc")),
+		Bcc:     addressList(msg.Addresses("Bcc")),
+		ReplyTo: addressList(msg.Addresses("Reply-To")),
+		Subject: msg.Subject(),
+		Text:    trimNewline(msg.Body("text/plain")),
+		HTML:    trimNewline(msg.Body("text/html")),
+		Headers: map[string]string{},
+	}
+	if from := msg.Addresses("From"); len(from) > 0 {
+		m.From = from[0].String()
+	}
+
+	for _, k := range draftHeaders {
+		if v := msg.Header.Get(k); v != "" {
+			m.Headers[k] = v
+		}
+	}
+
+	for _, p := range msg.Attachments() {
+		params := maps.Clone(p.Params)
+		delete(params, "name")
+
+		a := Attachment{
+			Filename:    p.Filename,
+			ContentType: mime.FormatMediaType(p.ContentType, params),
+			Data:        p.Content,
+		}
+		if p.Disposition == "inline" {
+			a.ContentID = p.ContentID
+		}
+		m.Attachments = append(m.Attachments, a)
+	}
+
+	return m, nil
+}
+
+func addressList(addrs []*mail.Address) []string {
+	var list []string
+	for _, a := range addrs {
+		list = append(list, a.String())
+	}
+	return list
+}
+
+// trimNewline removes the line break that ends the content of single part messages.
+func trimNewline(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	return strings.TrimSuffix(s, "\r")
+}
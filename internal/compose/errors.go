@@ -0,0 +1,11 @@
+package compose
+
+import "errors"
+
+var (
+	ErrNoRecipients      = errors.New("no recipients")
+	ErrTooManyRecipients = errors.New("too many recipients")
+	ErrInvalidAddress    = errors.New("invalid address")
+	ErrNoBody            = errors.New("message has neither a text nor an HTML body")
+	ErrInvalidHeader     = errors.New("invalid header")
+)
@@ -0,0 +1,34 @@
+package compose
+
+import "time"
+
+type Message struct {
+	From    string
+	To      []string
+	Cc      []string
+	Bcc     []string // receive the message, but are not listed in its headers
+	ReplyTo []string
+	Subject string
+	Text    string // plain text body
+	HTML    string // HTML body, sent as alternative to Text if both are set
+
+	// Attachments with a ContentID are inline parts of the HTML body,
+	// referenced as "cid:<ContentID>".
+	Attachments []Attachment
+
+	Date      time.Time         // defaults to now
+	MessageID string            // without angle brackets, generated if empty
+	Headers   map[string]string // additional headers, e.g. In-Reply-To
+}
+
+type Attachment struct {
+	Filename    string
+	ContentType string // detected from the filename or content if empty
+	ContentID   string // without angle brackets, only for inline parts
+	Data        []byte
+}
+
+// IsInline reports whether the attachment is part of the HTML body.
+func (a Attachment) IsInline() bool {
+	return a.ContentID != ""
+}
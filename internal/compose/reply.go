@@ -0,0 +1,179 @@
+package compose
+
+import (
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+)
+
+// replyPrefix matches the reply prefixes that are already present, in the
+// most common languages, so they are not repeated.
+var replyPrefix = regexp.MustCompile(`(?i)^\s*(re|aw|sv|antw)\s*:`)
+
+var forwardPrefix = regexp.MustCompile(`(?i)^\s*(fwd?|wg)\s*:`)
+
+// Reply returns a reply from the given address to the original mail, with the
+// threading headers set and the original text quoted. The reply goes to the
+// Reply-To or From address of the original or, if all is set, also to its
+// other recipients. The own addresses are never added as recipients.
+func Reply(original mails.Mail, from string, own []string, all bool) (Message, error) {
+	msg, err := message.Parse(original)
+	if err != nil {
+		return Message{}, err
+	}
+
+	isOwn := func(addr string) bool {
+		return slices.ContainsFunc(own, func(o string) bool { return strings.EqualFold(o, addr) })
+	}
+
+	sender := msg.Addresses("Reply-To")
+	if len(sender) == 0 {
+		sender = msg.Addresses("From")
+	}
+
+	var to, cc []string
+	seen := map[string]bool{}
+	add := func(list *[]string, addrs []*mail.Address) {
+		for _, a := range addrs {
+			key := strings.ToLower(a.Address)
+			if a.Address == "" || seen[key] || isOwn(a.Address) {
+				continue
+			}
+			seen[key] = true
+			*list = append(*list, a.String())
+		}
+	}
+
+	add(&to, sender)
+	if all {
+		add(&to, msg.Addresses("To"))
+		add(&cc, msg.Addresses("Cc"))
+	}
+
+	// Replying to an own message continues the conversation with its recipients
+	if len(to) == 0 && len(cc) == 0 {
+		seen = map[string]bool{}
+		add(&to, msg.Addresses("To"))
+	}
+
+	return Message{
+		From:    from,
+		To:      to,
+		Cc:      cc,
+		Subject: prefixSubject("Re: ", msg.Subject(), replyPrefix),
+		Text:    "\n\n" + attribution(msg) + "\n" + quote(msg.Text()),
+		Headers: threadHeaders(msg, true),
+	}, nil
+}
+
+// Forward returns a forward of the original mail from the given address,
+// without recipients. The original is either attached as message/rfc822 or
+// included below a summary of its headers, together with its attachments.
+func Forward(original mails.Mail, from string, asAttachment bool) (Message, error) {
+	msg, err := message.Parse(original)
+	if err != nil {
+		return Message{}, err
+	}
+
+	fwd := Message{
+		From:    from,
+		Subject: prefixSubject("Fwd: ", msg.Subject(), forwardPrefix),
+		Headers: threadHeaders(msg, false),
+	}
+
+	if asAttachment {
+		name := msg.Subject()
+		if strings.TrimSpace(name) == "" {
+			name = "message"
+		}
+		fwd.Attachments = []Attachment{{
+			Filename:    name + ".eml",
+			ContentType: "message/rfc822",
+			Data:        message.Raw(original),
+		}}
+		return fwd, nil
+	}
+
+	var b strings.Builder
+	b.WriteString("\n\n---------- Forwarded message ----------\n")
+	for _, field := range []string{"From", "Date", "Subject", "To", "Cc"} {
+		if v := msg.Header.Get(field); v != "" {
+			b.WriteString(field + ": " + message.DecodeHeader(v) + "\n")
+		}
+	}
+	b.WriteString("\n" + msg.Text())
+	fwd.Text = b.String()
+
+	for _, p := range msg.Attachments() {
+		fwd.Attachments = append(fwd.Attachments, Attachment{
+			Filename:    p.Filename,
+			ContentType: p.ContentType,
+			Data:        p.Content,
+		})
+	}
+	return fwd, nil
+}
+
+// threadHeaders returns the headers that place a reply or forward in the
+// thread of the original message, see RFC 5322 section 3.6.4.
+func threadHeaders(msg *message.Message, reply bool) map[string]string {
+	headers := map[string]string{}
+
+	id := strings.TrimSpace(msg.Header.Get("Message-Id"))
+	if id == "" {
+		return headers
+	}
+
+	references := strings.Fields(msg.Header.Get("References"))
+	if len(references) == 0 {
+		references = strings.Fields(msg.Header.Get("In-Reply-To"))
+	}
+	references = append(references, id)
+	headers["References"] = strings.Join(references, " ")
+
+	if reply {
+		headers["In-Reply-To"] = id
+	}
+	return headers
+}
+
+func prefixSubject(prefix string, subject string, existing *regexp.Regexp) string {
+	if existing.MatchString(subject) {
+		return subject
+	}
+	return prefix + subject
+}
+
+// attribution returns the line introducing the quote of the original message.
+func attribution(msg *message.Message) string {
+	from := "someone"
+	if addrs := msg.Addresses("From"); len(addrs) > 0 {
+		from = addrs[0].String()
+		if addrs[0].Name != "" {
+			from = addrs[0].Name + " <" + addrs[0].Address + ">"
+		}
+	}
+
+	if date := msg.Header.Get("Date"); date != "" {
+		return "On " + date + ", " + from + " wrote:"
+	}
+	return from + " wrote:"
+}
+
+// quote prefixes every line of the text with "> ".
+func quote(text string) string {
+	lines := strings.Split(strings.TrimRight(text, "\r\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, ">") {
+			lines[i] = ">" + line
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
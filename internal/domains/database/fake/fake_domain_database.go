@@ -0,0 +1,76 @@
+package fake
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+)
+
+type DB struct {
+	Items map[string]domains.Domain
+	mu    sync.Mutex
+}
+
+func NewDB() *DB {
+	return &DB{
+		Items: make(map[string]domains.Domain),
+		mu:    sync.Mutex{},
+	}
+}
+
+func (db *DB) Get(name string) (*domains.Domain, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	d, exists := db.Items[name]
+	if !exists {
+		return nil, domains.ErrDomainNotFound
+	}
+	return &d, nil
+}
+
+func (db *DB) List() ([]domains.Domain, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	list := make([]domains.Domain, 0, len(db.Items))
+	for _, name := range slices.Sorted(maps.Keys(db.Items)) {
+		list = append(list, db.Items[name])
+	}
+	return list, nil
+}
+
+func (db *DB) Insert(d domains.Domain) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[d.Name]; exists {
+		return domains.ErrDomainAlreadyExists
+	}
+	db.Items[d.Name] = d
+	return nil
+}
+
+func (db *DB) Update(d domains.Domain) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[d.Name]; !exists {
+		return domains.ErrDomainNotFound
+	}
+	db.Items[d.Name] = d
+	return nil
+}
+
+func (db *DB) Delete(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[name]; !exists {
+		return domains.ErrDomainNotFound
+	}
+	delete(db.Items, name)
+	return nil
+}
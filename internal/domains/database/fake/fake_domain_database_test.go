@@ -0,0 +1,14 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	"github.com/OliverSchlueter/mail-server/internal/domains/domainstest"
+)
+
+func TestDB(t *testing.T) {
+	domainstest.RunDBSuite(t, func() domains.DB {
+		return NewDB()
+	})
+}
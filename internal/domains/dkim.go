@@ -0,0 +1,83 @@
+package domains
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// DKIMSigner returns the key and selector mail from the domain is signed
+// with. The key is nil if the domain is not hosted or has no key of its own.
+func (s *Store) DKIMSigner(domain string) (crypto.Signer, string, error) {
+	d, err := s.db.Get(Normalize(domain))
+	if err != nil {
+		if errors.Is(err, ErrDomainNotFound) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	if d.DKIM.PrivateKey == "" {
+		return nil, "", nil
+	}
+
+	key, err := parsePrivateKey(d.DKIM.PrivateKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, d.DKIM.Selector, nil
+}
+
+// DKIMRecord returns the TXT record to publish at <selector>._domainkey.<domain>,
+// or an empty string if the domain has no key.
+func (d Domain) DKIMRecord() (string, error) {
+	if d.DKIM.PrivateKey == "" {
+		return "", nil
+	}
+
+	key, err := parsePrivateKey(d.DKIM.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	}
+	return "", ErrInvalidKey
+}
+
+// parsePrivateKey parses a PEM encoded PKCS#1 RSA key or PKCS#8 RSA or Ed25519 key.
+func parsePrivateKey(data string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM data")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, ErrInvalidKey
+}
@@ -0,0 +1,155 @@
+// Package domains manages the mail domains hosted by the server and their
+// settings, like DKIM keys, catch-all addresses and TLS certificates.
+package domains
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// DefaultSelector is the DKIM selector of domains that do not set their own.
+const DefaultSelector = "mail"
+
+type DB interface {
+	Get(name string) (*Domain, error)
+	// List returns all domains, sorted by name.
+	List() ([]Domain, error)
+	Insert(domain Domain) error
+	// Update replaces the domain with the same name.
+	Update(domain Domain) error
+	Delete(name string) error
+}
+
+type Store struct {
+	db DB
+}
+
+type Configuration struct {
+	DB DB
+}
+
+func NewStore(cfg Configuration) *Store {
+	return &Store{
+		db: cfg.DB,
+	}
+}
+
+func (s *Store) Get(name string) (*Domain, error) {
+	return s.db.Get(Normalize(name))
+}
+
+func (s *Store) List() ([]Domain, error) {
+	return s.db.List()
+}
+
+// Add validates the domain and starts hosting it.
+func (s *Store) Add(d Domain) (*Domain, error) {
+	if err := validate(&d); err != nil {
+		return nil, err
+	}
+	d.CreatedAt = time.Now().UTC()
+
+	if err := s.db.Insert(d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Update validates the domain and replaces its settings.
+func (s *Store) Update(d Domain) error {
+	if err := validate(&d); err != nil {
+		return err
+	}
+	return s.db.Update(d)
+}
+
+// Remove stops hosting the domain. Users with addresses in the domain are
+// not touched, mail to them is rejected from now on.
+func (s *Store) Remove(name string) error {
+	return s.db.Delete(Normalize(name))
+}
+
+// IsHosted reports whether mail for the domain is accepted.
+func (s *Store) IsHosted(name string) (bool, error) {
+	if _, err := s.db.Get(Normalize(name)); err != nil {
+		if errors.Is(err, ErrDomainNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Normalize returns the domain name in lower case without trailing dot.
+func Normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// DomainOf returns the normalized domain of the address.
+func DomainOf(address string) string {
+	return Normalize(address[strings.LastIndex(address, "@")+1:])
+}
+
+// validate checks the domain and normalizes its name, the DKIM selector and
+// the catch-all address.
+func validate(d *Domain) error {
+	d.Name = Normalize(d.Name)
+	if !validName(d.Name) {
+		return ErrInvalidName
+	}
+
+	if d.DKIM.Selector == "" {
+		d.DKIM.Selector = DefaultSelector
+	}
+	d.DKIM.Selector = strings.ToLower(d.DKIM.Selector)
+	if !validName(d.DKIM.Selector) {
+		return ErrInvalidSelector
+	}
+	if d.DKIM.PrivateKey != "" {
+		if _, err := parsePrivateKey(d.DKIM.PrivateKey); err != nil {
+			return ErrInvalidKey
+		}
+	}
+
+	if d.TLS.Certificate != "" || d.TLS.PrivateKey != "" {
+		if _, err := tls.X509KeyPair([]byte(d.TLS.Certificate), []byte(d.TLS.PrivateKey)); err != nil {
+			return ErrInvalidCertificate
+		}
+	}
+
+	d.CatchAll = strings.TrimSpace(d.CatchAll)
+	if d.CatchAll != "" {
+		addr, err := mail.ParseAddress(d.CatchAll)
+		if err != nil || addr.Address != d.CatchAll {
+			return ErrInvalidCatchAll
+		}
+	}
+
+	if d.DefaultStorageLimit < 0 {
+		d.DefaultStorageLimit = 0
+	}
+	return nil
+}
+
+// validName reports whether the name is a valid host name. Single labels like
+// localhost are allowed.
+func validName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package domains_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	"github.com/OliverSchlueter/mail-server/internal/domains/database/fake"
+)
+
+func TestStore(t *testing.T) {
+	s := domains.NewStore(domains.Configuration{DB: fake.NewDB()})
+
+	d, err := s.Add(domains.Domain{Name: " Example.COM. "})
+	if err != nil {
+		t.Fatalf("Add: unexpected error: %v", err)
+	}
+	if d.Name != "example.com" || d.DKIM.Selector != domains.DefaultSelector || d.CreatedAt.IsZero() {
+		t.Errorf("Add: expected normalized domain, got %+v", d)
+	}
+	if _, err := s.Add(domains.Domain{Name: "example.com"}); !errors.Is(err, domains.ErrDomainAlreadyExists) {
+		t.Errorf("Add twice: expected ErrDomainAlreadyExists, got %v", err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		domain domains.Domain
+		err    error
+	}{
+		{"empty name", domains.Domain{Name: ""}, domains.ErrInvalidName},
+		{"invalid label", domains.Domain{Name: "-example.org"}, domains.ErrInvalidName},
+		{"empty label", domains.Domain{Name: "example..org"}, domains.ErrInvalidName},
+		{"invalid selector", domains.Domain{Name: "example.org", DKIM: domains.DKIM{Selector: "a b"}}, domains.ErrInvalidSelector},
+		{"invalid key", domains.Domain{Name: "example.org", DKIM: domains.DKIM{PrivateKey: "key"}}, domains.ErrInvalidKey},
+		{"invalid certificate", domains.Domain{Name: "example.org", TLS: domains.TLS{Certificate: "cert"}}, domains.ErrInvalidCertificate},
+		{"invalid catch-all", domains.Domain{Name: "example.org", CatchAll: "Postmaster <postmaster@example.org>"}, domains.ErrInvalidCatchAll},
+	} {
+		if _, err := s.Add(c.domain); !errors.Is(err, c.err) {
+			t.Errorf("Add with %s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	for name, want := range map[string]bool{"example.com": true, "EXAMPLE.com": true, "example.org": false} {
+		if hosted, err := s.IsHosted(name); err != nil || hosted != want {
+			t.Errorf("IsHosted(%s): expected %v, got %v, %v", name, want, hosted, err)
+		}
+	}
+
+	if err := s.Remove("Example.com"); err != nil {
+		t.Fatalf("Remove: unexpected error: %v", err)
+	}
+	if hosted, _ := s.IsHosted("example.com"); hosted {
+		t.Errorf("IsHosted after Remove: expected false")
+	}
+	if err := s.Remove("example.com"); !errors.Is(err, domains.ErrDomainNotFound) {
+		t.Errorf("Remove twice: expected ErrDomainNotFound, got %v", err)
+	}
+}
+
+func TestDKIM(t *testing.T) {
+	s := domains.NewStore(domains.Configuration{DB: fake.NewDB()})
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	d, err := s.Add(domains.Domain{Name: "example.com", DKIM: domains.DKIM{Selector: "2024", PrivateKey: keyPEM}})
+	if err != nil {
+		t.Fatalf("Add: unexpected error: %v", err)
+	}
+	if _, err := s.Add(domains.Domain{Name: "example.org"}); err != nil {
+		t.Fatalf("Add: unexpected error: %v", err)
+	}
+
+	signer, selector, err := s.DKIMSigner("example.com")
+	if err != nil {
+		t.Fatalf("DKIMSigner: unexpected error: %v", err)
+	}
+	if selector != "2024" || !pub.Equal(signer.Public()) {
+		t.Errorf("DKIMSigner: unexpected selector %q or key", selector)
+	}
+
+	for _, name := range []string{"example.org", "example.net"} {
+		if signer, _, err := s.DKIMSigner(name); err != nil || signer != nil {
+			t.Errorf("DKIMSigner(%s): expected no key, got %v, %v", name, signer, err)
+		}
+	}
+
+	record, err := d.DKIMRecord()
+	if err != nil {
+		t.Fatalf("DKIMRecord: unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(record, "v=DKIM1; k=ed25519; p=") {
+		t.Errorf("DKIMRecord: unexpected record %q", record)
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	s := domains.NewStore(domains.Configuration{DB: fake.NewDB()})
+
+	certPEM, keyPEM := certificate(t, "mail.example.com")
+	if _, err := s.Add(domains.Domain{Name: "example.com", TLS: domains.TLS{Certificate: certPEM, PrivateKey: keyPEM}}); err != nil {
+		t.Fatalf("Add: unexpected error: %v", err)
+	}
+
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "mail.example.com"})
+	if err != nil || cert == nil {
+		t.Fatalf("GetCertificate: expected certificate, got %v, %v", cert, err)
+	}
+	if cert.Leaf.Subject.CommonName != "mail.example.com" {
+		t.Errorf("GetCertificate: unexpected certificate %s", cert.Leaf.Subject)
+	}
+
+	if cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "mail.example.org"}); err != nil || cert != nil {
+		t.Errorf("GetCertificate for unknown name: expected none, got %v, %v", cert, err)
+	}
+}
+
+// certificate returns a self-signed certificate for the host name and its key.
+func certificate(t *testing.T, host string) (string, string) {
+	t.Helper()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
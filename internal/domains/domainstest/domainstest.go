@@ -0,0 +1,96 @@
+// Package domainstest provides a conformance test suite that every domains.DB
+// implementation is expected to pass.
+package domainstest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+)
+
+// RunDBSuite runs all conformance tests against the domains.DB returned by newDB.
+// newDB is called once per test and must return an empty database.
+func RunDBSuite(t *testing.T, newDB func() domains.DB) {
+	t.Run("NotFound", func(t *testing.T) { TestNotFound(t, newDB()) })
+	t.Run("InsertGet", func(t *testing.T) { TestInsertGet(t, newDB()) })
+	t.Run("ListUpdateDelete", func(t *testing.T) { TestListUpdateDelete(t, newDB()) })
+}
+
+func TestNotFound(t *testing.T, db domains.DB) {
+	if _, err := db.Get("example.com"); !errors.Is(err, domains.ErrDomainNotFound) {
+		t.Errorf("Get: expected ErrDomainNotFound, got %v", err)
+	}
+	if err := db.Update(domains.Domain{Name: "example.com"}); !errors.Is(err, domains.ErrDomainNotFound) {
+		t.Errorf("Update: expected ErrDomainNotFound, got %v", err)
+	}
+	if err := db.Delete("example.com"); !errors.Is(err, domains.ErrDomainNotFound) {
+		t.Errorf("Delete: expected ErrDomainNotFound, got %v", err)
+	}
+}
+
+func TestInsertGet(t *testing.T, db domains.DB) {
+	d := domain("example.com")
+	if err := db.Insert(d); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+	if err := db.Insert(d); !errors.Is(err, domains.ErrDomainAlreadyExists) {
+		t.Errorf("Insert twice: expected ErrDomainAlreadyExists, got %v", err)
+	}
+
+	got, err := db.Get("example.com")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if got.Name != d.Name || got.DKIM != d.DKIM || got.TLS != d.TLS || got.CatchAll != d.CatchAll ||
+		got.DefaultStorageLimit != d.DefaultStorageLimit || !got.CreatedAt.Equal(d.CreatedAt) {
+		t.Errorf("Get: stored domain does not match inserted domain: %+v", got)
+	}
+}
+
+func TestListUpdateDelete(t *testing.T, db domains.DB) {
+	for _, name := range []string{"example.org", "example.com", "example.net"} {
+		if err := db.Insert(domain(name)); err != nil {
+			t.Fatalf("Insert: unexpected error: %v", err)
+		}
+	}
+
+	list, err := db.List()
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(list) != 3 || list[0].Name != "example.com" || list[1].Name != "example.net" || list[2].Name != "example.org" {
+		t.Errorf("List: expected domains sorted by name, got %+v", list)
+	}
+
+	d := domain("example.com")
+	d.CatchAll = "postmaster@example.org"
+	if err := db.Update(d); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+	if got, err := db.Get("example.com"); err != nil || got.CatchAll != d.CatchAll {
+		t.Errorf("Get after Update: expected catch-all %s, got %v, %v", d.CatchAll, got, err)
+	}
+
+	if err := db.Delete("example.net"); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	if _, err := db.Get("example.net"); !errors.Is(err, domains.ErrDomainNotFound) {
+		t.Errorf("Get after Delete: expected ErrDomainNotFound, got %v", err)
+	}
+	if list, err := db.List(); err != nil || len(list) != 2 {
+		t.Errorf("List after Delete: expected 2 domains, got %v, %v", list, err)
+	}
+}
+
+func domain(name string) domains.Domain {
+	return domains.Domain{
+		Name:                name,
+		DKIM:                domains.DKIM{Selector: "mail", PrivateKey: "key"},
+		TLS:                 domains.TLS{Certificate: "cert", PrivateKey: "key"},
+		CatchAll:            "catch-all@" + name,
+		DefaultStorageLimit: 1024,
+		CreatedAt:           time.Now().UTC().Truncate(time.Second),
+	}
+}
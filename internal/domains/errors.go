@@ -0,0 +1,13 @@
+package domains
+
+import "errors"
+
+var (
+	ErrDomainNotFound      = errors.New("domain not found")
+	ErrDomainAlreadyExists = errors.New("domain already exists")
+	ErrInvalidName         = errors.New("invalid domain name")
+	ErrInvalidSelector     = errors.New("invalid DKIM selector")
+	ErrInvalidKey          = errors.New("invalid DKIM private key")
+	ErrInvalidCertificate  = errors.New("invalid TLS certificate or key")
+	ErrInvalidCatchAll     = errors.New("invalid catch-all address")
+)
@@ -0,0 +1,31 @@
+package domains
+
+import "time"
+
+// Domain is a mail domain hosted by the server.
+type Domain struct {
+	Name string `json:"name"` // lower case, without trailing dot
+	DKIM DKIM   `json:"dkim"`
+	// CatchAll receives mail to addresses of the domain that belong to no
+	// user. Mail to unknown addresses is rejected if it is empty.
+	CatchAll string `json:"catch_all"`
+	// DefaultStorageLimit applies to users whose primary address is in the
+	// domain and that have no limit of their own. In bytes, 0 means unlimited.
+	DefaultStorageLimit int64     `json:"default_storage_limit"`
+	TLS                 TLS       `json:"tls"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// DKIM is the key mail from the domain is signed with. Without a key, the
+// server-wide key is used.
+type DKIM struct {
+	Selector   string `json:"selector"` // defaults to DefaultSelector
+	PrivateKey string `json:"-"`        // PEM encoded RSA or Ed25519 key
+}
+
+// TLS is the certificate served to clients that ask for one of its names via
+// SNI. Without a certificate, the server-wide certificate is used.
+type TLS struct {
+	Certificate string `json:"certificate"` // PEM encoded chain
+	PrivateKey  string `json:"-"`           // PEM encoded
+}
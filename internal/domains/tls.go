@@ -0,0 +1,39 @@
+package domains
+
+import (
+	"crypto/tls"
+	"log/slog"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+)
+
+// GetCertificate returns the certificate of the first domain that is valid for
+// the server name the client asked for. It can be used as
+// tls.Config.GetCertificate, nil is returned if no domain has a matching
+// certificate, so the certificates of the config are used instead.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		return nil, nil
+	}
+
+	list, err := s.db.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range list {
+		if d.TLS.Certificate == "" {
+			continue
+		}
+
+		cert, err := tls.X509KeyPair([]byte(d.TLS.Certificate), []byte(d.TLS.PrivateKey))
+		if err != nil {
+			slog.Warn("Failed to load TLS certificate of domain", slog.String("domain", d.Name), sloki.WrapError(err))
+			continue
+		}
+		if cert.Leaf != nil && cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+			return &cert, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,9 @@
+package events
+
+import "errors"
+
+var (
+	// ErrEventsExpired is returned when events after the requested ID are no
+	// longer kept, so the client has to reload its state.
+	ErrEventsExpired = errors.New("events expired")
+)
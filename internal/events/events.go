@@ -0,0 +1,148 @@
+// Package events distributes changes to mailboxes and mails to subscribers,
+// e.g. clients of the REST API that want to be notified about new mail.
+package events
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHistorySize = 100
+	DefaultBufferSize  = 64
+)
+
+type Bus struct {
+	historySize int
+	bufferSize  int
+
+	mu          sync.Mutex
+	lastID      uint64
+	history     map[string][]Event // user ID -> latest events of the user
+	expired     map[string]uint64  // user ID -> ID of the latest event dropped from the history
+	subscribers map[string]map[*Subscription]struct{}
+}
+
+type Configuration struct {
+	HistorySize int // events kept per user to resume streams
+	BufferSize  int // events buffered per subscriber before it is dropped
+}
+
+func NewBus(cfg Configuration) *Bus {
+	if cfg.HistorySize == 0 {
+		cfg.HistorySize = DefaultHistorySize
+	}
+	if cfg.BufferSize == 0 {
+		cfg.BufferSize = DefaultBufferSize
+	}
+
+	return &Bus{
+		historySize: cfg.HistorySize,
+		bufferSize:  cfg.BufferSize,
+		history:     map[string][]Event{},
+		expired:     map[string]uint64{},
+		subscribers: map[string]map[*Subscription]struct{}{},
+	}
+}
+
+// Subscription receives the events of a user until it is closed.
+type Subscription struct {
+	// C is closed when the subscription is closed, also if the subscriber did
+	// not keep up with the events. It can then resume after the last event it got.
+	C <-chan Event
+
+	c      chan Event
+	userID string
+	bus    *Bus
+}
+
+// Publish assigns the event its ID and delivers it to the subscribers of its user.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Flags = slices.Clone(e.Flags)
+
+	history := append(b.history[e.UserID], e)
+	if len(history) > b.historySize {
+		b.expired[e.UserID] = history[len(history)-b.historySize-1].ID
+		history = slices.Clone(history[len(history)-b.historySize:])
+	}
+	b.history[e.UserID] = history
+
+	for s := range b.subscribers[e.UserID] {
+		select {
+		case s.c <- e:
+		default:
+			b.remove(s)
+		}
+	}
+}
+
+// Subscribe returns a subscription to the events of the user. If after is
+// not zero, the kept events after that ID are delivered first, or
+// ErrEventsExpired is returned if some of them are no longer kept.
+func (b *Bus) Subscribe(userID string, after uint64) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var replay []Event
+	if after > 0 {
+		if after > b.lastID || after < b.expired[userID] {
+			return nil, ErrEventsExpired
+		}
+		for _, e := range b.history[userID] {
+			if e.ID > after {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	c := make(chan Event, b.bufferSize+len(replay))
+	for _, e := range replay {
+		c <- e
+	}
+
+	s := &Subscription{C: c, c: c, userID: userID, bus: b}
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = map[*Subscription]struct{}{}
+	}
+	b.subscribers[userID][s] = struct{}{}
+	return s, nil
+}
+
+// LastID returns the ID of the latest event, which is a valid point to resume from.
+func (b *Bus) LastID() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lastID
+}
+
+// Close ends the subscription. It is safe to call multiple times.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	s.bus.remove(s)
+}
+
+// remove must be called with the lock held.
+func (b *Bus) remove(s *Subscription) {
+	subs := b.subscribers[s.userID]
+	if _, ok := subs[s]; !ok {
+		return
+	}
+
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(b.subscribers, s.userID)
+	}
+	close(s.c)
+}
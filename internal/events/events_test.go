@@ -0,0 +1,61 @@
+package events
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	b := NewBus(Configuration{HistorySize: 2, BufferSize: 1})
+
+	alice, err := b.Subscribe("alice", 0)
+	if err != nil {
+		t.Fatalf("Subscribe: unexpected error: %v", err)
+	}
+	defer alice.Close()
+
+	b.Publish(Event{UserID: "alice", Type: MailCreated, UID: 1})
+	b.Publish(Event{UserID: "bob", Type: MailCreated, UID: 2})
+
+	e := <-alice.C
+	if e.ID != 1 || e.Type != MailCreated || e.UID != 1 || e.Time.IsZero() {
+		t.Errorf("Unexpected event %+v", e)
+	}
+	select {
+	case e := <-alice.C:
+		t.Errorf("Received event of other user %+v", e)
+	default:
+	}
+
+	// A subscriber that does not keep up is dropped
+	b.Publish(Event{UserID: "alice", Type: MailUpdated, UID: 1})
+	b.Publish(Event{UserID: "alice", Type: MailDeleted, UID: 1})
+	<-alice.C
+	if _, ok := <-alice.C; ok {
+		t.Errorf("Expected slow subscription to be closed")
+	}
+	alice.Close()
+
+	// Resume after the last received event
+	resumed, err := b.Subscribe("alice", 3)
+	if err != nil {
+		t.Fatalf("Subscribe: unexpected error: %v", err)
+	}
+	defer resumed.Close()
+	if e := <-resumed.C; e.ID != 4 || e.Type != MailDeleted {
+		t.Errorf("Expected replay of event 4, got %+v", e)
+	}
+
+	// Events 3 and 4 are kept, so resuming after event 1 misses nothing
+	if _, err := b.Subscribe("alice", 1); err != nil {
+		t.Errorf("Subscribe after event 1: unexpected error: %v", err)
+	}
+	// Event 3 is dropped from the history of alice
+	b.Publish(Event{UserID: "alice", Type: MailCreated, UID: 5})
+	if _, err := b.Subscribe("alice", 1); !errors.Is(err, ErrEventsExpired) {
+		t.Errorf("Expected ErrEventsExpired, got %v", err)
+	}
+	if _, err := b.Subscribe("alice", 99); !errors.Is(err, ErrEventsExpired) {
+		t.Errorf("Expected ErrEventsExpired for unknown ID, got %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package events
+
+import "time"
+
+type Type string
+
+const (
+	MailCreated    Type = "mail_created"
+	MailUpdated    Type = "mail_updated" // e.g. flags changed
+	MailDeleted    Type = "mail_deleted"
+	MailboxCreated Type = "mailbox_created"
+	MailboxUpdated Type = "mailbox_updated" // e.g. renamed
+	MailboxDeleted Type = "mailbox_deleted"
+)
+
+// Event is a change to a mailbox or mail of a user.
+type Event struct {
+	ID         uint64    `json:"id"` // increases with every event, used to resume a stream
+	UserID     string    `json:"-"`
+	Type       Type      `json:"type"`
+	Time       time.Time `json:"time"`
+	MailboxUID uint32    `json:"mailbox_uid"`
+	Mailbox    string    `json:"mailbox,omitempty"`  // name of the mailbox, for mailbox events
+	OldName    string    `json:"old_name,omitempty"` // previous name of a renamed mailbox
+	UID        uint32    `json:"uid,omitempty"`      // UID of the mail, for mail events
+	Flags      []string  `json:"flags,omitempty"`
+}
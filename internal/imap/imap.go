@@ -6,6 +6,10 @@ import (
 	"encoding/base64"
 	"errors"
 	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/quotas"
+	"github.com/OliverSchlueter/mail-server/internal/search"
 	"github.com/OliverSchlueter/mail-server/internal/users"
 	"log/slog"
 	"net"
@@ -16,12 +20,20 @@ import (
 type Server struct {
 	port      string
 	users     users.Store
+	mails     mails.Store
+	keys      *keys.Store
+	quotas    *quotas.Service
+	search    *search.Index
 	tlsConfig *tls.Config
 }
 
 type Configuration struct {
 	Port     string
 	Users    users.Store
+	Mails    mails.Store
+	Keys     *keys.Store     // optional, unlocks zero-access encryption keys on login
+	Quotas   *quotas.Service // optional, enables the QUOTA extension
+	Search   *search.Index   // optional, SEARCH scans all mails of the mailbox if not set or the user has zero-access encryption
 	CertFile string
 	KeyFile  string
 }
@@ -46,6 +58,10 @@ func NewServer(config Configuration) *Server {
 	return &Server{
 		port:      config.Port,
 		users:     config.Users,
+		mails:     config.Mails,
+		keys:      config.Keys,
+		quotas:    config.Quotas,
+		search:    config.Search,
 		tlsConfig: tlsConfig,
 	}
 }
@@ -72,6 +88,7 @@ func (s *Server) handle(conn net.Conn) {
 	defer conn.Close()
 
 	session := &Session{}
+	defer s.releaseKeys(session)
 	session.RemoteAddr = conn.RemoteAddr().String()
 	session.IsTLS = false
 	session.Authentication = Authentication{
@@ -121,7 +138,11 @@ func (s *Server) handle(conn net.Conn) {
 
 		switch command {
 		case "CAPABILITY":
-			writeLine(w, "* CAPABILITY IMAP4rev2 STARTTLS AUTH=PLAIN UTF8=ACCEPT")
+			capabilities := "* CAPABILITY IMAP4rev2 STARTTLS AUTH=PLAIN UTF8=ACCEPT ESEARCH"
+			if s.quotas != nil {
+				capabilities += " QUOTA QUOTA=RES-STORAGE"
+			}
+			writeLine(w, capabilities)
 			writeLine(w, tag+" OK CAPABILITY completed")
 
 		case "STARTTLS":
@@ -180,19 +201,82 @@ func (s *Server) handle(conn net.Conn) {
 				continue
 			}
 
-			u, err := s.users.GetByEmail(username)
+			// Besides the user's password, app passwords with the imap scope are accepted
+			u, token, err := s.users.Authenticate(username, password, users.ScopeIMAP)
 			if err != nil {
-				writeLine(w, tag+" NO User not found: "+username)
+				if errors.Is(err, users.ErrSecondFactorRequired) {
+					writeLine(w, tag+" NO [AUTHENTICATIONFAILED] Two-factor authentication is enabled, use an app password")
+					continue
+				}
+				if errors.Is(err, users.ErrUserDisabled) {
+					writeLine(w, tag+" NO [CONTACTADMIN] Account is disabled")
+					continue
+				}
+				if errors.Is(err, users.ErrInvalidCredentials) || errors.Is(err, users.ErrInsufficientScope) {
+					writeLine(w, tag+" NO [AUTHENTICATIONFAILED] Invalid credentials")
+					continue
+				}
+				slog.Error("Failed to authenticate user", sloki.WrapError(err))
+				writeLine(w, tag+" NO [UNAVAILABLE] Authentication failed")
 				continue
 			}
-			if u.Password != users.Hash(password) {
-				writeLine(w, tag+" NO Invalid password for user: "+username)
-				continue
+			// Zero-access keys are derived from the user's password, so app passwords
+			// can only be used while the keys are unlocked by another login. The keys
+			// stay unlocked until the connection is closed.
+			unlocked := false
+			if s.keys != nil && token == nil {
+				if err := s.keys.Unlock(u.ID, password); err != nil {
+					slog.Error("Failed to unlock encryption keys", slog.String("user_id", u.ID), sloki.WrapError(err))
+					writeLine(w, tag+" NO Failed to unlock mailbox encryption keys")
+					continue
+				}
+				unlocked = s.keys.IsUnlocked(u.ID)
 			}
+			if s.keys != nil && token != nil {
+				unlocked = s.keys.Retain(u.ID)
+				if !unlocked {
+					zeroAccess, err := s.keys.IsZeroAccess(u.ID)
+					if err != nil {
+						slog.Error("Failed to get encryption keys", slog.String("user_id", u.ID), sloki.WrapError(err))
+						writeLine(w, tag+" NO [UNAVAILABLE] Authentication failed")
+						continue
+					}
+					if zeroAccess {
+						writeLine(w, tag+" NO [AUTHENTICATIONFAILED] Mailbox is encrypted with the account password, log in with it once to unlock it")
+						continue
+					}
+				}
+			}
+			s.releaseKeys(session)
 			session.Authentication.IsAuthenticated = true
 			session.Authentication.User = u
+			session.Authentication.KeysUnlocked = unlocked
 			writeLine(w, tag+" OK Authentication successful")
 
+		case "SELECT", "EXAMINE":
+			s.handleSelect(session, w, tag, command, args)
+
+		case "SEARCH":
+			s.handleSearch(session, w, tag, args, false)
+
+		case "UID":
+			split := strings.SplitN(args, " ", 2)
+			if strings.ToUpper(split[0]) != "SEARCH" {
+				writeLine(w, tag+" BAD Unknown or unsupported command: UID "+split[0])
+				continue
+			}
+			var searchArgs string
+			if len(split) > 1 {
+				searchArgs = split[1]
+			}
+			s.handleSearch(session, w, tag, searchArgs, true)
+
+		case "GETQUOTAROOT":
+			s.handleGetQuotaRoot(session, w, tag, args)
+
+		case "GETQUOTA":
+			s.handleGetQuota(session, w, tag, args)
+
 		case "NOOP":
 			writeLine(w, tag+" OK NOOP completed")
 
@@ -207,6 +291,15 @@ func (s *Server) handle(conn net.Conn) {
 	}
 }
 
+// releaseKeys ends the use of the zero-access keys of the authenticated user
+// by the session.
+func (s *Server) releaseKeys(session *Session) {
+	if session.Authentication.KeysUnlocked {
+		s.keys.Release(session.Authentication.User.ID)
+		session.Authentication.KeysUnlocked = false
+	}
+}
+
 func writeLine(w *bufio.Writer, line string) {
 	if _, err := w.WriteString(line + "\r\n"); err != nil {
 		slog.Error("Failed to write to connection", sloki.WrapError(err))
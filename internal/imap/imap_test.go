@@ -0,0 +1,303 @@
+package imap
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	kdb "github.com/OliverSchlueter/mail-server/internal/keys/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/totp"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	udb "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func TestLogin(t *testing.T) {
+	s, alice := setup(t)
+
+	c := connect(t, s)
+	if _, status := c.command("AUTHENTICATE PLAIN"); status != "BAD Must issue STARTTLS before authentication" {
+		t.Errorf("AUTHENTICATE: expected BAD without TLS, got %q", status)
+	}
+	if status := c.login("alice", "wrong"); status != "NO [AUTHENTICATIONFAILED] Invalid credentials" {
+		t.Errorf("AUTHENTICATE: expected NO for wrong password, got %q", status)
+	}
+
+	if err := s.users.SetDisabled(alice.ID, true); err != nil {
+		t.Fatalf("SetDisabled: unexpected error: %v", err)
+	}
+	c = connect(t, s)
+	if status := c.login("alice", "alice123"); status != "NO [CONTACTADMIN] Account is disabled" {
+		t.Errorf("AUTHENTICATE: expected NO for disabled user, got %q", status)
+	}
+}
+
+func TestLoginAppPassword(t *testing.T) {
+	s, alice := setup(t)
+
+	secret, _, err := s.users.CreateToken(alice.ID, "phone", []users.Scope{users.ScopeIMAP}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken: unexpected error: %v", err)
+	}
+	apiToken, _, err := s.users.CreateToken(alice.ID, "script", []users.Scope{users.ScopeAPIRead}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken: unexpected error: %v", err)
+	}
+
+	c := connect(t, s)
+	if status := c.login("alice", secret); status != "OK Authentication successful" {
+		t.Errorf("AUTHENTICATE: expected OK with app password, got %q", status)
+	}
+	c = connect(t, s)
+	if status := c.login("alice", apiToken); status != "NO [AUTHENTICATIONFAILED] Invalid credentials" {
+		t.Errorf("AUTHENTICATE: expected NO for token without imap scope, got %q", status)
+	}
+
+	// With a second factor, only app passwords are accepted
+	totpSecret, err := s.users.BeginTwoFactor(alice.ID)
+	if err != nil {
+		t.Fatalf("BeginTwoFactor: unexpected error: %v", err)
+	}
+	code, err := totp.Code(totpSecret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatalf("Code: unexpected error: %v", err)
+	}
+	if _, err := s.users.ConfirmTwoFactor(alice.ID, code); err != nil {
+		t.Fatalf("ConfirmTwoFactor: unexpected error: %v", err)
+	}
+	c = connect(t, s)
+	if status := c.login("alice", "alice123"); status != "NO [AUTHENTICATIONFAILED] Two-factor authentication is enabled, use an app password" {
+		t.Errorf("AUTHENTICATE: expected NO for password with second factor, got %q", status)
+	}
+	c = connect(t, s)
+	if status := c.login("alice", secret); status != "OK Authentication successful" {
+		t.Errorf("AUTHENTICATE: expected OK with app password and second factor, got %q", status)
+	}
+}
+
+func TestLoginZeroAccess(t *testing.T) {
+	s, alice := setup(t)
+
+	if err := s.mails.CreateMail(alice.ID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "top secret"}); err != nil {
+		t.Fatalf("CreateMail: unexpected error: %v", err)
+	}
+	if err := s.mails.EnableZeroAccess(alice.ID, "alice123"); err != nil {
+		t.Fatalf("EnableZeroAccess: unexpected error: %v", err)
+	}
+	secret, _, err := s.users.CreateToken(alice.ID, "phone", []users.Scope{users.ScopeIMAP}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken: unexpected error: %v", err)
+	}
+
+	// App passwords can not unlock the keys, which are derived from the password
+	app := connect(t, s)
+	if status := app.login("alice", secret); status != "NO [AUTHENTICATIONFAILED] Mailbox is encrypted with the account password, log in with it once to unlock it" {
+		t.Errorf("AUTHENTICATE: expected NO for app password while locked, got %q", status)
+	}
+
+	password := connect(t, s)
+	if status := password.login("alice", "alice123"); status != "OK Authentication successful" {
+		t.Fatalf("AUTHENTICATE: expected OK with password, got %q", status)
+	}
+	if !s.keys.IsUnlocked(alice.ID) {
+		t.Fatalf("Expected keys to be unlocked by the password login")
+	}
+	if untagged, status := password.command("SELECT INBOX"); status != "OK [READ-WRITE] SELECT completed" || untagged[0] != "* 1 EXISTS" {
+		t.Errorf("SELECT: expected encrypted mail to be readable, got %q, %q", untagged, status)
+	}
+
+	app = connect(t, s)
+	if status := app.login("alice", secret); status != "OK Authentication successful" {
+		t.Errorf("AUTHENTICATE: expected OK for app password while unlocked, got %q", status)
+	}
+
+	// The keys stay unlocked until the last session that uses them is closed
+	password.close()
+	if !s.keys.IsUnlocked(alice.ID) {
+		t.Errorf("Expected keys to stay unlocked while the app password session is open")
+	}
+	app.close()
+	if s.keys.IsUnlocked(alice.ID) {
+		t.Errorf("Expected keys to be locked once all sessions are closed")
+	}
+}
+
+// testClient speaks IMAP with a server over an in-memory connection.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	tags int
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// setup returns a server with TLS and zero-access keys, and the user alice
+// with the password alice123. configure may change the configuration before
+// the server is created.
+func setup(t *testing.T, configure ...func(*Configuration)) (*Server, *users.User) {
+	t.Helper()
+
+	us := users.NewStore(users.Configuration{DB: udb.NewDB()})
+	if err := us.Create(users.User{Name: "alice", Password: "alice123", PrimaryEmail: "alice@example.com", Emails: []string{"alice@example.com"}}); err != nil {
+		t.Fatalf("Create: unexpected error: %v", err)
+	}
+	alice, err := us.GetByName("alice")
+	if err != nil {
+		t.Fatalf("GetByName: unexpected error: %v", err)
+	}
+
+	ks := keys.NewStore(keys.Configuration{DB: kdb.NewDB()})
+	cfg := Configuration{
+		Users: *us,
+		Mails: *mails.NewStore(mails.Configuration{DB: mdb.NewDB(), Keys: ks}),
+		Keys:  ks,
+	}
+	for _, c := range configure {
+		c(&cfg)
+	}
+
+	s := NewServer(cfg)
+	s.tlsConfig = testTLSConfig(t)
+	return s, alice
+}
+
+// connect opens a connection to the server and reads its greeting.
+func connect(t *testing.T, s *Server) *testClient {
+	t.Helper()
+
+	client, server := net.Pipe()
+	c := &testClient{t: t, conn: client, r: bufio.NewReader(client), done: make(chan struct{})}
+	go func() {
+		s.handle(server)
+		close(c.done)
+	}()
+	t.Cleanup(c.close)
+
+	if line := c.readLine(); !strings.HasPrefix(line, "* OK") {
+		t.Fatalf("Expected greeting, got %q", line)
+	}
+	return c
+}
+
+// login starts TLS and authenticates with AUTHENTICATE PLAIN. It returns the
+// completion of the AUTHENTICATE command, e.g. "OK Authentication successful".
+func (c *testClient) login(username, password string) string {
+	c.t.Helper()
+
+	if _, status := c.command("STARTTLS"); !strings.HasPrefix(status, "OK") {
+		c.t.Fatalf("STARTTLS: expected OK, got %q", status)
+	}
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatalf("TLS handshake failed: %v", err)
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	if line := c.readLine(); line != "* OK TLS negotiation completed" {
+		c.t.Fatalf("STARTTLS: unexpected response %q", line)
+	}
+
+	tag := c.nextTag()
+	c.writeLine(tag + " AUTHENTICATE PLAIN")
+	if line := c.readLine(); line != "+" {
+		c.t.Fatalf("AUTHENTICATE: expected continuation, got %q", line)
+	}
+	c.writeLine(base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password)))
+	return strings.TrimPrefix(c.readLine(), tag+" ")
+}
+
+// command sends the command with a new tag. It returns the untagged responses
+// and the completion without the tag.
+func (c *testClient) command(command string) ([]string, string) {
+	c.t.Helper()
+
+	tag := c.nextTag()
+	c.writeLine(tag + " " + command)
+
+	var untagged []string
+	for {
+		line := c.readLine()
+		if status, ok := strings.CutPrefix(line, tag+" "); ok {
+			return untagged, status
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+func (c *testClient) nextTag() string {
+	c.tags++
+	return fmt.Sprintf("a%d", c.tags)
+}
+
+func (c *testClient) writeLine(line string) {
+	c.t.Helper()
+
+	if err := c.conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		c.t.Fatalf("Failed to set deadline: %v", err)
+	}
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatalf("Failed to write %q: %v", line, err)
+	}
+}
+
+func (c *testClient) readLine() string {
+	c.t.Helper()
+
+	if err := c.conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		c.t.Fatalf("Failed to set deadline: %v", err)
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Failed to read response: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// close closes the connection and waits until the server is done with it.
+func (c *testClient) close() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		<-c.done
+	})
+}
+
+// testTLSConfig returns a configuration with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
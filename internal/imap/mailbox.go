@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+)
+
+// handleSelect implements SELECT and EXAMINE. Mailbox names are matched
+// case-insensitively for INBOX only, as required by RFC 9051.
+func (s *Server) handleSelect(session *Session, w *bufio.Writer, tag string, command string, args string) {
+	if !session.Authentication.IsAuthenticated {
+		writeLine(w, tag+" BAD Command only valid in authenticated state")
+		return
+	}
+
+	// A failed SELECT leaves the previously selected mailbox closed
+	session.Selected = nil
+	session.ReadOnly = false
+
+	name := unquote(args)
+	if name == "" {
+		writeLine(w, tag+" BAD Missing mailbox name")
+		return
+	}
+	if strings.EqualFold(name, mails.DefaultMailboxName) {
+		name = mails.DefaultMailboxName
+	}
+
+	u := session.Authentication.User
+	mb, err := s.mails.GetMailboxByName(u.ID, name)
+	if err != nil {
+		if errors.Is(err, mails.ErrMailboxNotFound) {
+			writeLine(w, tag+" NO [NONEXISTENT] Mailbox does not exist")
+			return
+		}
+		slog.Error("Failed to get mailbox", slog.String("user_id", u.ID), sloki.WrapError(err))
+		writeLine(w, tag+" NO Failed to select mailbox")
+		return
+	}
+
+	ms, err := s.mails.GetMails(u.ID, mb.UID)
+	if err != nil {
+		slog.Error("Failed to get mails", slog.String("user_id", u.ID), sloki.WrapError(err))
+		writeLine(w, tag+" NO Failed to select mailbox")
+		return
+	}
+
+	var uidNext uint32 = 1
+	for _, m := range ms {
+		if m.UID >= uidNext {
+			uidNext = m.UID + 1
+		}
+	}
+
+	writeLine(w, fmt.Sprintf("* %d EXISTS", len(ms)))
+	writeLine(w, `* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`)
+	// Mailbox UIDs are never reused, so they are a valid UIDVALIDITY
+	writeLine(w, fmt.Sprintf("* OK [UIDVALIDITY %d] UIDs valid", mb.UID))
+	writeLine(w, fmt.Sprintf("* OK [UIDNEXT %d] Predicted next UID", uidNext))
+	writeLine(w, `* LIST () "/" `+quote(mb.Name))
+
+	session.Selected = mb
+	session.ReadOnly = command == "EXAMINE"
+	if session.ReadOnly {
+		writeLine(w, tag+" OK [READ-ONLY] EXAMINE completed")
+	} else {
+		writeLine(w, tag+" OK [READ-WRITE] SELECT completed")
+	}
+}
+
+// selectedMails returns the mails of the selected mailbox ordered by UID, so
+// the index of a mail is its message sequence number minus one.
+func (s *Server) selectedMails(session *Session) ([]mails.Mail, error) {
+	ms, err := s.mails.GetMails(session.Authentication.User.ID, session.Selected.UID)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(ms, func(a, b mails.Mail) int {
+		return cmp.Compare(a.UID, b.UID)
+	})
+	return ms, nil
+}
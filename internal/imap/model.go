@@ -1,14 +1,20 @@
 package imap
 
-import "github.com/OliverSchlueter/mail-server/internal/users"
+import (
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
 
 type Session struct {
 	RemoteAddr     string
 	IsTLS          bool
 	Authentication Authentication
+	Selected       *mails.Mailbox // nil unless a mailbox is selected
+	ReadOnly       bool           // the selected mailbox was opened with EXAMINE
 }
 
 type Authentication struct {
 	User            *users.User
 	IsAuthenticated bool
+	KeysUnlocked    bool // the session holds the unlocked zero-access keys of the user
 }
@@ -0,0 +1,108 @@
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/quotas"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+// handleGetQuotaRoot implements GETQUOTAROOT from RFC 9208.
+func (s *Server) handleGetQuotaRoot(session *Session, w *bufio.Writer, tag string, args string) {
+	if s.quotas == nil {
+		writeLine(w, tag+" BAD Unknown or unsupported command: GETQUOTAROOT")
+		return
+	}
+	if !session.Authentication.IsAuthenticated {
+		writeLine(w, tag+" BAD Command only valid in authenticated state")
+		return
+	}
+
+	mailbox := unquote(args)
+	if mailbox == "" {
+		writeLine(w, tag+" BAD Missing mailbox name")
+		return
+	}
+
+	u := session.Authentication.User
+	roots := s.quotas.GetRoots(u, mailbox)
+
+	line := "* QUOTAROOT " + quote(mailbox)
+	for _, root := range roots {
+		line += " " + quote(root)
+	}
+	writeLine(w, line)
+
+	for _, root := range roots {
+		usage, err := s.getQuotaUsage(u, root)
+		if err != nil {
+			slog.Error("Failed to get quota usage", sloki.WrapError(err))
+			writeLine(w, tag+" NO Failed to get quota")
+			return
+		}
+		writeLine(w, quotaLine(usage))
+	}
+
+	writeLine(w, tag+" OK GETQUOTAROOT completed")
+}
+
+// handleGetQuota implements GETQUOTA from RFC 9208.
+func (s *Server) handleGetQuota(session *Session, w *bufio.Writer, tag string, args string) {
+	if s.quotas == nil {
+		writeLine(w, tag+" BAD Unknown or unsupported command: GETQUOTA")
+		return
+	}
+	if !session.Authentication.IsAuthenticated {
+		writeLine(w, tag+" BAD Command only valid in authenticated state")
+		return
+	}
+
+	u := session.Authentication.User
+	root := unquote(args)
+	if root != quotas.UserRoot || s.quotas.StorageLimit(u) <= 0 {
+		if _, ok := u.Quota.MailboxLimits[root]; !ok {
+			writeLine(w, tag+" NO No such quota root")
+			return
+		}
+	}
+
+	usage, err := s.getQuotaUsage(u, root)
+	if err != nil {
+		slog.Error("Failed to get quota usage", sloki.WrapError(err))
+		writeLine(w, tag+" NO Failed to get quota")
+		return
+	}
+
+	writeLine(w, quotaLine(usage))
+	writeLine(w, tag+" OK GETQUOTA completed")
+}
+
+func (s *Server) getQuotaUsage(u *users.User, root string) (*quotas.Usage, error) {
+	if root == quotas.UserRoot {
+		return s.quotas.GetUsage(u)
+	}
+	return s.quotas.GetMailboxUsage(u, root)
+}
+
+// quotaLine formats the usage as QUOTA response, STORAGE is counted in units of 1024 octets.
+func quotaLine(usage *quotas.Usage) string {
+	return fmt.Sprintf("* QUOTA %s (STORAGE %d %d)", quote(usage.Root), (usage.Used+1023)/1024, usage.Limit/1024)
+}
+
+func quote(s string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		s = s[1 : len(s)-1]
+		s = strings.ReplaceAll(s, `\"`, `"`)
+		s = strings.ReplaceAll(s, `\\`, `\`)
+	}
+	return s
+}
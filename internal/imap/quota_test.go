@@ -0,0 +1,98 @@
+package imap
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/quotas"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	udb "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func TestQuota(t *testing.T) {
+	us := users.NewStore(users.Configuration{DB: udb.NewDB()})
+	err := us.Create(users.User{
+		Name:         "alice",
+		Password:     "alice123",
+		PrimaryEmail: "alice@example.com",
+		Emails:       []string{"alice@example.com"},
+		Quota: users.Quota{
+			StorageLimit:  10 * 1024,
+			MailboxLimits: map[string]int64{mails.DefaultMailboxName: 4 * 1024},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Create: unexpected error: %v", err)
+	}
+	alice, err := us.GetByName("alice")
+	if err != nil {
+		t.Fatalf("GetByName: unexpected error: %v", err)
+	}
+
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+	if err := ms.CreateMail(alice.ID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Size: 1500, Body: "Hello"}); err != nil {
+		t.Fatalf("CreateMail: unexpected error: %v", err)
+	}
+	s := NewServer(Configuration{Users: *us, Quotas: quotas.NewService(quotas.Configuration{Mails: *ms})})
+	s.tlsConfig = testTLSConfig(t)
+
+	c := connect(t, s)
+	caps, status := c.command("CAPABILITY")
+	if status != "OK CAPABILITY completed" || len(caps) != 1 || !slices.Contains(strings.Fields(caps[0]), "QUOTA") {
+		t.Errorf("CAPABILITY: expected QUOTA, got %q, %q", caps, status)
+	}
+	if _, status := c.command("GETQUOTA \"\""); status != "BAD Command only valid in authenticated state" {
+		t.Errorf("GETQUOTA: expected BAD before login, got %q", status)
+	}
+
+	if status := c.login("alice@example.com", "alice123"); status != "OK Authentication successful" {
+		t.Fatalf("AUTHENTICATE: expected OK, got %q", status)
+	}
+
+	// The inbox is limited by the user's storage and its own limit, usage is counted in KiB
+	untagged, status := c.command("GETQUOTAROOT INBOX")
+	expected := []string{
+		`* QUOTAROOT "INBOX" "" "INBOX"`,
+		`* QUOTA "" (STORAGE 2 10)`,
+		`* QUOTA "INBOX" (STORAGE 2 4)`,
+	}
+	if status != "OK GETQUOTAROOT completed" || !slices.Equal(untagged, expected) {
+		t.Errorf("GETQUOTAROOT: expected %q, got %q, %q", expected, untagged, status)
+	}
+
+	untagged, status = c.command(`GETQUOTA ""`)
+	if status != "OK GETQUOTA completed" || !slices.Equal(untagged, []string{`* QUOTA "" (STORAGE 2 10)`}) {
+		t.Errorf("GETQUOTA: unexpected response %q, %q", untagged, status)
+	}
+
+	// Mailboxes without a limit of their own are only in the user's root
+	untagged, status = c.command(`GETQUOTAROOT "Sent"`)
+	if status != "OK GETQUOTAROOT completed" || len(untagged) != 2 || untagged[0] != `* QUOTAROOT "Sent" ""` {
+		t.Errorf("GETQUOTAROOT: unexpected response %q, %q", untagged, status)
+	}
+	if _, status := c.command(`GETQUOTA "Sent"`); status != "NO No such quota root" {
+		t.Errorf("GETQUOTA: expected NO for unknown root, got %q", status)
+	}
+	if _, status := c.command("GETQUOTAROOT"); status != "BAD Missing mailbox name" {
+		t.Errorf("GETQUOTAROOT: expected BAD without mailbox, got %q", status)
+	}
+}
+
+func TestQuotaDisabled(t *testing.T) {
+	s, _ := setup(t)
+	c := connect(t, s)
+	if status := c.login("alice@example.com", "alice123"); status != "OK Authentication successful" {
+		t.Fatalf("AUTHENTICATE: expected OK, got %q", status)
+	}
+
+	caps, _ := c.command("CAPABILITY")
+	if len(caps) != 1 || strings.Contains(caps[0], "QUOTA") {
+		t.Errorf("CAPABILITY: expected no QUOTA without quotas, got %q", caps)
+	}
+	if _, status := c.command("GETQUOTAROOT INBOX"); status != "BAD Unknown or unsupported command: GETQUOTAROOT" {
+		t.Errorf("GETQUOTAROOT: expected BAD without quotas, got %q", status)
+	}
+}
@@ -0,0 +1,280 @@
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+	"github.com/OliverSchlueter/mail-server/internal/search"
+)
+
+var errUnsupportedCriterion = errors.New("unsupported search criterion")
+
+// criterion is a single search key with its argument, e.g. SUBJECT "hello".
+type criterion struct {
+	field search.Field // 0 for ALL
+	value string
+}
+
+var searchKeys = map[string]search.Field{
+	"TEXT":    search.FieldAll,
+	"BODY":    search.FieldBody,
+	"SUBJECT": search.FieldSubject,
+	"FROM":    search.FieldFrom,
+	"TO":      search.FieldTo,
+	"CC":      search.FieldTo,
+	"BCC":     search.FieldTo,
+}
+
+// handleSearch implements SEARCH and UID SEARCH for the keys ALL, TEXT, BODY,
+// SUBJECT, FROM, TO, CC and BCC. All keys must match. Results are returned as
+// ESEARCH response as required by IMAP4rev2.
+func (s *Server) handleSearch(session *Session, w *bufio.Writer, tag string, args string, uid bool) {
+	command := "SEARCH"
+	if uid {
+		command = "UID SEARCH"
+	}
+
+	if session.Selected == nil {
+		writeLine(w, tag+" BAD Command only valid in selected state")
+		return
+	}
+
+	criteria, err := parseSearch(args)
+	if err != nil {
+		writeLine(w, tag+" BAD "+err.Error())
+		return
+	}
+
+	ms, err := s.selectedMails(session)
+	if err != nil {
+		slog.Error("Failed to get mails", slog.String("user_id", session.Authentication.User.ID), sloki.WrapError(err))
+		writeLine(w, tag+" NO Failed to search mailbox")
+		return
+	}
+
+	matches, err := s.matchAll(session, ms, criteria)
+	if err != nil {
+		slog.Error("Failed to search mailbox", slog.String("user_id", session.Authentication.User.ID), sloki.WrapError(err))
+		writeLine(w, tag+" NO Failed to search mailbox")
+		return
+	}
+
+	var numbers []uint32
+	for i, m := range ms {
+		if !matches[m.UID] {
+			continue
+		}
+		if uid {
+			numbers = append(numbers, m.UID)
+		} else {
+			numbers = append(numbers, uint32(i+1))
+		}
+	}
+
+	line := "* ESEARCH (TAG " + quote(tag) + ")"
+	if uid {
+		line += " UID"
+	}
+	if len(numbers) > 0 {
+		line += " ALL " + sequenceSet(numbers)
+	}
+	writeLine(w, line)
+	writeLine(w, tag+" OK "+command+" completed")
+}
+
+// matchAll returns the UIDs of the mails that match all criteria. The search
+// index is used if configured, otherwise and for users with zero-access
+// encryption the mails are scanned.
+func (s *Server) matchAll(session *Session, ms []mails.Mail, criteria []criterion) (map[uint32]bool, error) {
+	matches := make(map[uint32]bool, len(ms))
+	for _, m := range ms {
+		matches[m.UID] = true
+	}
+
+	for _, c := range criteria {
+		if c.field == 0 {
+			continue
+		}
+
+		found, err := s.match(session, ms, c)
+		if err != nil {
+			return nil, err
+		}
+
+		for uid := range matches {
+			if !found[uid] {
+				delete(matches, uid)
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+func (s *Server) match(session *Session, ms []mails.Mail, c criterion) (map[uint32]bool, error) {
+	found := make(map[uint32]bool)
+
+	// Mails with zero-access encryption are not indexed, they are scanned instead
+	if s.search != nil && s.mails.Indexable(session.Authentication.User.ID) {
+		hits, err := s.search.Search(session.Authentication.User.ID, search.Query{
+			Text:       c.value,
+			Fields:     c.field,
+			MailboxUID: session.Selected.UID,
+		})
+		if errors.Is(err, search.ErrEmptyQuery) {
+			// Nothing to look for, e.g. only punctuation, matches every mail
+			for _, m := range ms {
+				found[m.UID] = true
+			}
+			return found, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, h := range hits {
+			found[h.UID] = true
+		}
+		return found, nil
+	}
+
+	value := strings.ToLower(c.value)
+	for _, m := range ms {
+		msg, err := message.Parse(m)
+		if err != nil {
+			continue
+		}
+		if strings.Contains(strings.ToLower(searchText(msg, c.field)), value) {
+			found[m.UID] = true
+		}
+	}
+	return found, nil
+}
+
+// searchText returns the text of the fields of the message.
+func searchText(msg *message.Message, fields search.Field) string {
+	var b strings.Builder
+	if fields&search.FieldSubject != 0 {
+		b.WriteString(msg.Subject() + "\n")
+	}
+	if fields&search.FieldFrom != 0 {
+		b.WriteString(msg.Header.Get("From") + "\n")
+	}
+	if fields&search.FieldTo != 0 {
+		for _, h := range []string{"To", "Cc", "Bcc"} {
+			b.WriteString(msg.Header.Get(h) + "\n")
+		}
+	}
+	if fields&search.FieldBody != 0 {
+		b.WriteString(msg.Text() + "\n")
+	}
+	if fields&search.FieldAttachment != 0 {
+		for _, a := range msg.Attachments() {
+			b.WriteString(a.Filename + "\n")
+		}
+	}
+	return b.String()
+}
+
+// parseSearch parses the search criteria, a leading CHARSET is ignored as all
+// text is searched as UTF-8.
+func parseSearch(args string) ([]criterion, error) {
+	tokens, err := tokenize(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) >= 2 && strings.EqualFold(tokens[0], "CHARSET") {
+		tokens = tokens[2:]
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("missing search criteria")
+	}
+
+	var criteria []criterion
+	for i := 0; i < len(tokens); i++ {
+		key := strings.ToUpper(tokens[i])
+		if key == "ALL" {
+			criteria = append(criteria, criterion{})
+			continue
+		}
+
+		field, ok := searchKeys[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errUnsupportedCriterion, key)
+		}
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("missing argument for %s", key)
+		}
+
+		i++
+		criteria = append(criteria, criterion{field: field, value: tokens[i]})
+	}
+
+	return criteria, nil
+}
+
+// tokenize splits the arguments into atoms and quoted strings.
+func tokenize(args string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(args); {
+		switch args[i] {
+		case ' ':
+			i++
+
+		case '"':
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(args) {
+					return nil, errors.New("unterminated quoted string")
+				}
+				if args[i] == '\\' && i+1 < len(args) {
+					b.WriteByte(args[i+1])
+					i += 2
+					continue
+				}
+				if args[i] == '"' {
+					i++
+					break
+				}
+				b.WriteByte(args[i])
+				i++
+			}
+			tokens = append(tokens, b.String())
+
+		default:
+			start := i
+			for i < len(args) && args[i] != ' ' {
+				i++
+			}
+			tokens = append(tokens, args[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+// sequenceSet formats the ascending numbers as sequence set, e.g. "1,3:5".
+func sequenceSet(numbers []uint32) string {
+	var parts []string
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+
+		if i == j {
+			parts = append(parts, fmt.Sprintf("%d", numbers[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d:%d", numbers[i], numbers[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
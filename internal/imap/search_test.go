@@ -0,0 +1,159 @@
+package imap
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/search"
+)
+
+// setupSearch returns a server that searches through an index, with three
+// mails of alice in her inbox.
+func setupSearch(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	si, err := search.NewIndex(search.Configuration{})
+	if err != nil {
+		t.Fatalf("NewIndex: unexpected error: %v", err)
+	}
+	s, alice := setup(t, func(cfg *Configuration) {
+		cfg.Mails = *mails.NewStore(mails.Configuration{DB: mdb.NewDB(), Keys: cfg.Keys, Indexer: si})
+		cfg.Search = si
+	})
+
+	for _, m := range []mails.Mail{
+		{UID: 3, Headers: map[string]string{"Subject": "Quarterly report", "From": "bob@example.com"}, Body: "Numbers attached"},
+		{UID: 5, Headers: map[string]string{"Subject": "Lunch", "From": "carol@example.com"}, Body: "Pizza or sushi?"},
+		{UID: 8, Headers: map[string]string{"Subject": "Re: Quarterly report", "From": "carol@example.com"}, Body: "Looks good"},
+	} {
+		if err := s.mails.CreateMail(alice.ID, mails.DefaultMailboxUID, m); err != nil {
+			t.Fatalf("CreateMail: unexpected error: %v", err)
+		}
+	}
+	return s, alice.ID
+}
+
+func TestSelect(t *testing.T) {
+	s, _ := setupSearch(t)
+	c := connect(t, s)
+
+	if _, status := c.command("SELECT INBOX"); status != "BAD Command only valid in authenticated state" {
+		t.Errorf("SELECT: expected BAD before login, got %q", status)
+	}
+	if status := c.login("alice@example.com", "alice123"); status != "OK Authentication successful" {
+		t.Fatalf("AUTHENTICATE: expected OK, got %q", status)
+	}
+	if _, status := c.command("SEARCH ALL"); status != "BAD Command only valid in selected state" {
+		t.Errorf("SEARCH: expected BAD without a selected mailbox, got %q", status)
+	}
+
+	// INBOX is matched case-insensitively
+	untagged, status := c.command(`SELECT "inbox"`)
+	expected := []string{
+		"* 3 EXISTS",
+		`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`,
+		"* OK [UIDVALIDITY 1] UIDs valid",
+		"* OK [UIDNEXT 9] Predicted next UID",
+		`* LIST () "/" "INBOX"`,
+	}
+	if status != "OK [READ-WRITE] SELECT completed" || !slices.Equal(untagged, expected) {
+		t.Errorf("SELECT: expected %q, got %q, %q", expected, untagged, status)
+	}
+
+	if _, status := c.command("EXAMINE INBOX"); status != "OK [READ-ONLY] EXAMINE completed" {
+		t.Errorf("EXAMINE: expected read-only, got %q", status)
+	}
+
+	// A failed SELECT closes the selected mailbox
+	if _, status := c.command("SELECT Archive"); status != "NO [NONEXISTENT] Mailbox does not exist" {
+		t.Errorf("SELECT: expected NONEXISTENT, got %q", status)
+	}
+	if _, status := c.command("SEARCH ALL"); status != "BAD Command only valid in selected state" {
+		t.Errorf("SEARCH: expected BAD after failed SELECT, got %q", status)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s, _ := setupSearch(t)
+	c := connect(t, s)
+	if status := c.login("alice@example.com", "alice123"); status != "OK Authentication successful" {
+		t.Fatalf("AUTHENTICATE: expected OK, got %q", status)
+	}
+	if _, status := c.command("SELECT INBOX"); status != "OK [READ-WRITE] SELECT completed" {
+		t.Fatalf("SELECT: expected OK, got %q", status)
+	}
+
+	for _, tc := range []struct {
+		command string
+		result  string
+	}{
+		{"SEARCH ALL", "ALL 1:3"},
+		{"SEARCH SUBJECT quarterly", "ALL 1,3"},
+		{"UID SEARCH SUBJECT quarterly", "UID ALL 3,8"},
+		{`SEARCH CHARSET UTF-8 FROM "carol@example.com" SUBJECT report`, "ALL 3"},
+		{"uid search text pizza", "UID ALL 5"},
+		{"SEARCH BODY invoice", ""},
+	} {
+		untagged, status := c.command(tc.command)
+		command := strings.ToUpper(strings.Join(strings.Fields(tc.command)[:2], " "))
+		if !strings.HasPrefix(command, "UID") {
+			command = "SEARCH"
+		}
+		if status != "OK "+command+" completed" || len(untagged) != 1 {
+			t.Errorf("%s: expected a single ESEARCH response, got %q, %q", tc.command, untagged, status)
+			continue
+		}
+		if result := esearchResult(untagged[0], c.tags); result != tc.result {
+			t.Errorf("%s: expected %q, got %q", tc.command, tc.result, untagged[0])
+		}
+	}
+
+	for _, command := range []string{"SEARCH", "SEARCH SUBJECT", `SEARCH SUBJECT "unterminated`, "SEARCH UNSEEN"} {
+		if _, status := c.command(command); !strings.HasPrefix(status, "BAD ") {
+			t.Errorf("%s: expected BAD, got %q", command, status)
+		}
+	}
+}
+
+func TestSearchZeroAccess(t *testing.T) {
+	s, aliceID := setupSearch(t)
+	if err := s.mails.EnableZeroAccess(aliceID, "alice123"); err != nil {
+		t.Fatalf("EnableZeroAccess: unexpected error: %v", err)
+	}
+
+	c := connect(t, s)
+	if status := c.login("alice@example.com", "alice123"); status != "OK Authentication successful" {
+		t.Fatalf("AUTHENTICATE: expected OK, got %q", status)
+	}
+	if _, status := c.command("SELECT INBOX"); status != "OK [READ-WRITE] SELECT completed" {
+		t.Fatalf("SELECT: expected OK, got %q", status)
+	}
+
+	// Encrypted mails are not indexed, so they are scanned instead
+	for _, tc := range []struct {
+		command string
+		result  string
+	}{
+		{"SEARCH SUBJECT quarterly", "ALL 1,3"},
+		{"UID SEARCH BODY pizza", "UID ALL 5"},
+	} {
+		untagged, status := c.command(tc.command)
+		if !strings.HasPrefix(status, "OK ") || len(untagged) != 1 || esearchResult(untagged[0], c.tags) != tc.result {
+			t.Errorf("%s: expected %q, got %q, %q", tc.command, tc.result, untagged, status)
+		}
+	}
+}
+
+// esearchResult returns the result of an ESEARCH response to the command with
+// the given tag number, e.g. "UID ALL 3,8".
+func esearchResult(line string, tag int) string {
+	prefix := `* ESEARCH (TAG "a` + strconv.Itoa(tag) + `")`
+	if !strings.HasPrefix(line, prefix) {
+		return "unexpected response"
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, prefix))
+}
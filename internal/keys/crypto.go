@@ -0,0 +1,133 @@
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	keySize  = 32
+	saltSize = 16
+
+	// argon2id parameters for deriving key encryption keys from passwords
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+
+	hkdfInfo = "mail-server mail encryption"
+)
+
+// seal encrypts plaintext for the given X25519 public key. The result is laid
+// out as ephemeral public key | nonce | ciphertext.
+func seal(publicKey []byte, plaintext []byte) ([]byte, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hkdf.Key(sha256.New, shared, nil, hkdfInfo+string(ephemeral.PublicKey().Bytes())+string(publicKey), keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := encrypt(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ephemeral.PublicKey().Bytes(), sealed...), nil
+}
+
+// open decrypts data produced by seal with the given X25519 private key.
+func open(privateKey *ecdh.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < keySize {
+		return nil, ErrInvalidData
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(data[:keySize])
+	if err != nil {
+		return nil, ErrInvalidData
+	}
+
+	shared, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hkdf.Key(sha256.New, shared, nil, hkdfInfo+string(data[:keySize])+string(privateKey.PublicKey().Bytes()), keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypt(key, data[keySize:])
+}
+
+// encrypt encrypts plaintext with AES-256-GCM, prefixing the random nonce.
+func encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt reverses encrypt.
+func decrypt(key []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrInvalidData
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalidData
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives a key encryption key from the password.
+func deriveKey(password string, salt []byte) []byte {
+	return argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, keySize)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
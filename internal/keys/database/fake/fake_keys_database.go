@@ -0,0 +1,119 @@
+package fake
+
+import (
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	"slices"
+	"sync"
+)
+
+type DB struct {
+	Items map[string][]keys.UserKey // user ID -> keys ordered by version
+	mu    sync.Mutex
+}
+
+func NewDB() *DB {
+	return &DB{
+		Items: make(map[string][]keys.UserKey),
+		mu:    sync.Mutex{},
+	}
+}
+
+func (db *DB) Get(userID string, version int) (*keys.UserKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, k := range db.Items[userID] {
+		if k.Version == version {
+			k = clone(k)
+			return &k, nil
+		}
+	}
+	return nil, keys.ErrKeyNotFound
+}
+
+func (db *DB) GetLatest(userID string) (*keys.UserKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	userKeys := db.Items[userID]
+	if len(userKeys) == 0 {
+		return nil, keys.ErrKeyNotFound
+	}
+
+	k := clone(userKeys[len(userKeys)-1])
+	return &k, nil
+}
+
+func (db *DB) GetAll(userID string) ([]keys.UserKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	userKeys := []keys.UserKey{}
+	for _, k := range db.Items[userID] {
+		userKeys = append(userKeys, clone(k))
+	}
+	return userKeys, nil
+}
+
+func (db *DB) List() ([]keys.UserKey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	all := []keys.UserKey{}
+	for _, userKeys := range db.Items {
+		for _, k := range userKeys {
+			all = append(all, clone(k))
+		}
+	}
+	return all, nil
+}
+
+func (db *DB) Insert(key keys.UserKey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	userKeys := db.Items[key.UserID]
+	for _, existing := range userKeys {
+		if existing.Version >= key.Version {
+			return keys.ErrKeyAlreadyExists
+		}
+	}
+
+	db.Items[key.UserID] = append(userKeys, clone(key))
+	return nil
+}
+
+func (db *DB) Update(key keys.UserKey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i, existing := range db.Items[key.UserID] {
+		if existing.Version == key.Version {
+			db.Items[key.UserID][i] = clone(key)
+			return nil
+		}
+	}
+	return keys.ErrKeyNotFound
+}
+
+func (db *DB) Delete(userID string, version int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	userKeys := db.Items[userID]
+	for i, existing := range userKeys {
+		if existing.Version == version {
+			db.Items[userID] = append(userKeys[:i], userKeys[i+1:]...)
+			return nil
+		}
+	}
+	return keys.ErrKeyNotFound
+}
+
+// clone returns a copy of the key that does not share any slices with k.
+func clone(k keys.UserKey) keys.UserKey {
+	k.Salt = slices.Clone(k.Salt)
+	k.PublicKey = slices.Clone(k.PublicKey)
+	k.WrappedKey = slices.Clone(k.WrappedKey)
+	return k
+}
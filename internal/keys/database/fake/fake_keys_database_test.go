@@ -0,0 +1,14 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	"github.com/OliverSchlueter/mail-server/internal/keys/keystest"
+)
+
+func TestDB(t *testing.T) {
+	keystest.RunDBSuite(t, func() keys.DB {
+		return NewDB()
+	})
+}
@@ -0,0 +1,12 @@
+package keys
+
+import "errors"
+
+var (
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrKeyAlreadyExists = errors.New("key already exists")
+	ErrKeyLocked        = errors.New("key is locked")
+	ErrInvalidPassword  = errors.New("invalid password")
+	ErrMasterKeyMissing = errors.New("master key missing")
+	ErrInvalidData      = errors.New("invalid encrypted data")
+)
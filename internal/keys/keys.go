@@ -0,0 +1,485 @@
+package keys
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"sync"
+)
+
+type DB interface {
+	Get(userID string, version int) (*UserKey, error)
+	GetLatest(userID string) (*UserKey, error)
+	GetAll(userID string) ([]UserKey, error)
+	List() ([]UserKey, error)
+	Insert(key UserKey) error
+	Update(key UserKey) error
+	Delete(userID string, version int) error
+}
+
+type Store struct {
+	db              DB
+	masterKeys      map[string][]byte
+	activeMasterKey string
+
+	mu       *sync.Mutex
+	unlocked map[string]*unlockedKey // user ID -> unlocked zero-access key
+}
+
+type Configuration struct {
+	DB DB
+	// MasterKeys maps master key IDs to 32 byte AES keys. Old master keys must
+	// be kept until RewrapMasterKeys has been run after a rotation.
+	MasterKeys map[string][]byte
+	// ActiveMasterKey is the ID of the master key used to wrap new keys. If it is
+	// empty, only mail of users with zero-access keys is encrypted.
+	ActiveMasterKey string
+}
+
+type unlockedKey struct {
+	kek      []byte // derived from the user's password
+	private  map[int]*ecdh.PrivateKey
+	sessions int // sessions of the user that use the keys, see Unlock
+}
+
+func NewStore(cfg Configuration) *Store {
+	if cfg.MasterKeys == nil {
+		cfg.MasterKeys = map[string][]byte{}
+	}
+
+	return &Store{
+		db:              cfg.DB,
+		masterKeys:      cfg.MasterKeys,
+		activeMasterKey: cfg.ActiveMasterKey,
+		mu:              &sync.Mutex{},
+		unlocked:        map[string]*unlockedKey{},
+	}
+}
+
+// Seal encrypts data with the latest key of the user and returns the key
+// version used. Users without a key get a master key wrapped key on first use.
+// ErrKeyNotFound is returned if the user has no key and no master key is active.
+func (s *Store) Seal(userID string, plaintext []byte) ([]byte, int, error) {
+	k, err := s.db.GetLatest(userID)
+	if errors.Is(err, ErrKeyNotFound) && s.activeMasterKey != "" {
+		k, _, err = s.newUserKey(userID, 1, ModeMaster, nil, nil)
+		if err == nil {
+			err = s.db.Insert(*k)
+		}
+		if errors.Is(err, ErrKeyAlreadyExists) {
+			// Created concurrently
+			k, err = s.db.GetLatest(userID)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data, err := seal(k.PublicKey, plaintext)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return data, k.Version, nil
+}
+
+// Open decrypts data sealed with the given key version of the user.
+// Zero-access keys must be unlocked first.
+func (s *Store) Open(userID string, version int, data []byte) ([]byte, error) {
+	priv, err := s.privateKey(userID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(priv, data)
+}
+
+// Unlock makes the zero-access keys of the user usable for a session of the
+// user, until it is ended with Release. The keys stay unlocked while the user
+// has sessions. It does nothing for users without zero-access keys.
+func (s *Store) Unlock(userID string, password string) error {
+	ks, err := s.db.GetAll(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range ks {
+		if k.Mode != ModePassword {
+			continue
+		}
+
+		kek := deriveKey(password, k.Salt)
+		if _, err := decrypt(kek, k.WrappedKey); err != nil {
+			return ErrInvalidPassword
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if u, ok := s.unlocked[userID]; ok {
+			u.sessions++
+			return nil
+		}
+		s.unlocked[userID] = &unlockedKey{kek: kek, private: map[int]*ecdh.PrivateKey{}, sessions: 1}
+		return nil
+	}
+
+	return nil
+}
+
+// Retain adds a session of the user to the unlocked zero-access keys, for
+// logins that can not unlock the keys themselves, like app passwords. It
+// reports false if the keys are locked.
+func (s *Store) Retain(userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.unlocked[userID]
+	if ok {
+		u.sessions++
+	}
+	return ok
+}
+
+// Release ends a session of Unlock or Retain. The keys are locked once the
+// last session of the user ended.
+func (s *Store) Release(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.unlocked[userID]
+	if !ok {
+		return
+	}
+	u.sessions--
+	if u.sessions <= 0 {
+		delete(s.unlocked, userID)
+	}
+}
+
+// Lock forgets the unlocked zero-access keys of the user, regardless of their sessions.
+func (s *Store) Lock(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.unlocked, userID)
+}
+
+// IsUnlocked reports whether the zero-access keys of the user are unlocked.
+func (s *Store) IsUnlocked(userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.unlocked[userID]
+	return ok
+}
+
+// IsZeroAccess reports whether the keys of the user are wrapped by their password.
+func (s *Store) IsZeroAccess(userID string) (bool, error) {
+	k, err := s.db.GetLatest(userID)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return k.Mode == ModePassword, nil
+}
+
+// EnableZeroAccess wraps all keys of the user with a key derived from the
+// password, so the server can no longer decrypt the user's mail bodies on its
+// own. All keys are checked before the first one is rewrapped, so a failure
+// leaves the keys as they were. The keys stay locked until the user logs in.
+func (s *Store) EnableZeroAccess(userID string, password string) error {
+	ks, err := s.db.GetAll(userID)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+
+	privs := make([]*ecdh.PrivateKey, len(ks))
+	for i, k := range ks {
+		if k.Mode == ModePassword {
+			// Already zero-access, use ChangePassword instead
+			return ErrKeyAlreadyExists
+		}
+
+		privs[i], err = s.privateKey(userID, k.Version)
+		if err != nil {
+			return err
+		}
+	}
+
+	salt, err := randomBytes(saltSize)
+	if err != nil {
+		return err
+	}
+	kek := deriveKey(password, salt)
+
+	if len(ks) == 0 {
+		k, _, err := s.newUserKey(userID, 1, ModePassword, kek, salt)
+		if err != nil {
+			return err
+		}
+		return s.db.Insert(*k)
+	}
+
+	for i, k := range ks {
+		if err := s.rewrap(k, privs[i], ModePassword, kek, salt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangePassword rewraps the zero-access keys of the user with the new
+// password. All keys are decrypted with the old password before the first one
+// is rewrapped, so a wrong password leaves the keys as they were. The keys are
+// not unlocked by this, but keys that are unlocked stay so.
+func (s *Store) ChangePassword(userID string, oldPassword string, newPassword string) error {
+	ks, err := s.db.GetAll(userID)
+	if err != nil {
+		return err
+	}
+
+	var (
+		oldKEK  []byte
+		wrapped []UserKey
+		privs   []*ecdh.PrivateKey
+	)
+	for _, k := range ks {
+		if k.Mode != ModePassword {
+			continue
+		}
+
+		if oldKEK == nil {
+			oldKEK = deriveKey(oldPassword, k.Salt)
+		}
+		raw, err := decrypt(oldKEK, k.WrappedKey)
+		if err != nil {
+			return ErrInvalidPassword
+		}
+		priv, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return err
+		}
+
+		wrapped = append(wrapped, k)
+		privs = append(privs, priv)
+	}
+	if len(wrapped) == 0 {
+		return nil
+	}
+
+	salt, err := randomBytes(saltSize)
+	if err != nil {
+		return err
+	}
+	kek := deriveKey(newPassword, salt)
+
+	for i, k := range wrapped {
+		if err := s.rewrap(k, privs[i], ModePassword, kek, salt); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if u, ok := s.unlocked[userID]; ok {
+		u.kek = kek
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Rotate creates a new key version for the user and returns the previous
+// version. The previous version stays usable until it is retired, so mail can
+// be re-encrypted in the meantime.
+func (s *Store) Rotate(userID string) (int, error) {
+	latest, err := s.db.GetLatest(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var kek []byte
+	if latest.Mode == ModePassword {
+		s.mu.Lock()
+		u, ok := s.unlocked[userID]
+		s.mu.Unlock()
+		if !ok {
+			return 0, ErrKeyLocked
+		}
+		kek = u.kek
+	}
+
+	k, _, err := s.newUserKey(userID, latest.Version+1, latest.Mode, kek, latest.Salt)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.db.Insert(*k); err != nil {
+		return 0, err
+	}
+
+	return latest.Version, nil
+}
+
+// Retire deletes a key version of the user. Mail encrypted with it can no longer be read.
+func (s *Store) Retire(userID string, version int) error {
+	if err := s.db.Delete(userID, version); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if u, ok := s.unlocked[userID]; ok {
+		delete(u.private, version)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// DeleteAll deletes all key versions of the user. Their mail can no longer be read.
+func (s *Store) DeleteAll(userID string) error {
+	ks, err := s.db.GetAll(userID)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+
+	for _, k := range ks {
+		if err := s.db.Delete(userID, k.Version); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+	}
+
+	s.Lock(userID)
+	return nil
+}
+
+// RewrapMasterKeys rewraps all keys that are wrapped by an old master key with
+// the active master key and returns how many keys were rewrapped.
+func (s *Store) RewrapMasterKeys() (int, error) {
+	if s.activeMasterKey == "" {
+		return 0, ErrMasterKeyMissing
+	}
+
+	ks, err := s.db.List()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, k := range ks {
+		if k.Mode != ModeMaster || k.MasterKeyID == s.activeMasterKey {
+			continue
+		}
+
+		priv, err := s.privateKey(k.UserID, k.Version)
+		if err != nil {
+			return count, err
+		}
+
+		if err := s.rewrap(k, priv, ModeMaster, nil, nil); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (s *Store) privateKey(userID string, version int) (*ecdh.PrivateKey, error) {
+	k, err := s.db.Get(userID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k.Mode {
+	case ModeMaster:
+		mk, ok := s.masterKeys[k.MasterKeyID]
+		if !ok {
+			return nil, ErrMasterKeyMissing
+		}
+
+		raw, err := decrypt(mk, k.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		return ecdh.X25519().NewPrivateKey(raw)
+
+	case ModePassword:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		u, ok := s.unlocked[userID]
+		if !ok {
+			return nil, ErrKeyLocked
+		}
+		if priv, ok := u.private[version]; ok {
+			return priv, nil
+		}
+
+		raw, err := decrypt(u.kek, k.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		u.private[version] = priv
+		return priv, nil
+	}
+
+	return nil, ErrInvalidData
+}
+
+func (s *Store) newUserKey(userID string, version int, mode Mode, kek []byte, salt []byte) (*UserKey, *ecdh.PrivateKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k := UserKey{
+		UserID:    userID,
+		Version:   version,
+		PublicKey: priv.PublicKey().Bytes(),
+	}
+	if err := s.wrap(&k, priv, mode, kek, salt); err != nil {
+		return nil, nil, err
+	}
+
+	return &k, priv, nil
+}
+
+func (s *Store) rewrap(k UserKey, priv *ecdh.PrivateKey, mode Mode, kek []byte, salt []byte) error {
+	if err := s.wrap(&k, priv, mode, kek, salt); err != nil {
+		return err
+	}
+
+	return s.db.Update(k)
+}
+
+// wrap encrypts the private key into k, either with the active master key or the given key encryption key.
+func (s *Store) wrap(k *UserKey, priv *ecdh.PrivateKey, mode Mode, kek []byte, salt []byte) error {
+	k.Mode = mode
+	k.MasterKeyID = ""
+	k.Salt = nil
+
+	if mode == ModeMaster {
+		mk, ok := s.masterKeys[s.activeMasterKey]
+		if !ok {
+			return ErrMasterKeyMissing
+		}
+		kek = mk
+		k.MasterKeyID = s.activeMasterKey
+	} else {
+		k.Salt = salt
+	}
+
+	wrapped, err := encrypt(kek, priv.Bytes())
+	if err != nil {
+		return err
+	}
+
+	k.WrappedKey = wrapped
+	return nil
+}
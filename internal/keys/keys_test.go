@@ -0,0 +1,214 @@
+package keys_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	"github.com/OliverSchlueter/mail-server/internal/keys/database/fake"
+)
+
+func TestSealOpenMasterKey(t *testing.T) {
+	ks := keys.NewStore(keys.Configuration{
+		DB:              fake.NewDB(),
+		MasterKeys:      map[string][]byte{"m1": bytes.Repeat([]byte{1}, 32)},
+		ActiveMasterKey: "m1",
+	})
+
+	sealed, version, err := ks.Seal("alice", []byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	if version != 1 {
+		t.Errorf("Expected key version 1, got %d", version)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Errorf("Expected sealed data not to contain the plaintext")
+	}
+
+	opened, err := ks.Open("alice", version, sealed)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if string(opened) != "secret" {
+		t.Errorf("Expected 'secret', got %q", opened)
+	}
+
+	if _, err := ks.Open("bob", version, sealed); !errors.Is(err, keys.ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for other user, got %v", err)
+	}
+}
+
+func TestSealWithoutMasterKey(t *testing.T) {
+	ks := keys.NewStore(keys.Configuration{DB: fake.NewDB()})
+
+	if _, _, err := ks.Seal("alice", []byte("secret")); !errors.Is(err, keys.ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestRewrapMasterKeys(t *testing.T) {
+	db := fake.NewDB()
+	old := keys.NewStore(keys.Configuration{
+		DB:              db,
+		MasterKeys:      map[string][]byte{"m1": bytes.Repeat([]byte{1}, 32)},
+		ActiveMasterKey: "m1",
+	})
+
+	sealed, version, err := old.Seal("alice", []byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+
+	rotated := keys.NewStore(keys.Configuration{
+		DB: db,
+		MasterKeys: map[string][]byte{
+			"m1": bytes.Repeat([]byte{1}, 32),
+			"m2": bytes.Repeat([]byte{2}, 32),
+		},
+		ActiveMasterKey: "m2",
+	})
+	n, err := rotated.RewrapMasterKeys()
+	if err != nil {
+		t.Fatalf("Failed to rewrap master keys: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 rewrapped key, got %d", n)
+	}
+
+	// The old master key is no longer needed
+	withoutOld := keys.NewStore(keys.Configuration{
+		DB:              db,
+		MasterKeys:      map[string][]byte{"m2": bytes.Repeat([]byte{2}, 32)},
+		ActiveMasterKey: "m2",
+	})
+	opened, err := withoutOld.Open("alice", version, sealed)
+	if err != nil {
+		t.Fatalf("Failed to open after rewrap: %v", err)
+	}
+	if string(opened) != "secret" {
+		t.Errorf("Expected 'secret', got %q", opened)
+	}
+}
+
+func TestZeroAccess(t *testing.T) {
+	ks := keys.NewStore(keys.Configuration{DB: fake.NewDB()})
+
+	if err := ks.EnableZeroAccess("alice", "pw1"); err != nil {
+		t.Fatalf("Failed to enable zero-access: %v", err)
+	}
+	ks.Lock("alice")
+
+	// Sealing only needs the public key
+	sealed, version, err := ks.Seal("alice", []byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+
+	if _, err := ks.Open("alice", version, sealed); !errors.Is(err, keys.ErrKeyLocked) {
+		t.Errorf("Expected ErrKeyLocked, got %v", err)
+	}
+
+	if err := ks.Unlock("alice", "wrong"); !errors.Is(err, keys.ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+
+	if err := ks.ChangePassword("alice", "pw1", "pw2"); err != nil {
+		t.Fatalf("Failed to change password: %v", err)
+	}
+	ks.Lock("alice")
+
+	if err := ks.Unlock("alice", "pw1"); !errors.Is(err, keys.ErrInvalidPassword) {
+		t.Errorf("Expected old password to be rejected, got %v", err)
+	}
+	if err := ks.Unlock("alice", "pw2"); err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+
+	opened, err := ks.Open("alice", version, sealed)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if string(opened) != "secret" {
+		t.Errorf("Expected 'secret', got %q", opened)
+	}
+}
+
+func TestZeroAccessRewrapIsAtomic(t *testing.T) {
+	db := fake.NewDB()
+	m1, m2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	// Version 1 is wrapped with a master key that is no longer configured
+	old := keys.NewStore(keys.Configuration{DB: db, MasterKeys: map[string][]byte{"m1": m1}, ActiveMasterKey: "m1"})
+	if _, _, err := old.Seal("alice", []byte("secret")); err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	ks := keys.NewStore(keys.Configuration{DB: db, MasterKeys: map[string][]byte{"m2": m2}, ActiveMasterKey: "m2"})
+	if _, err := ks.Rotate("alice"); err != nil {
+		t.Fatalf("Failed to rotate: %v", err)
+	}
+
+	if err := ks.EnableZeroAccess("alice", "pw1"); !errors.Is(err, keys.ErrMasterKeyMissing) {
+		t.Fatalf("Expected ErrMasterKeyMissing, got %v", err)
+	}
+	for _, version := range []int{1, 2} {
+		if k, err := db.Get("alice", version); err != nil || k.Mode != keys.ModeMaster {
+			t.Errorf("Expected version %d to keep its master key, got %+v, %v", version, k, err)
+		}
+	}
+
+	// Without version 1, zero-access can be enabled
+	if err := ks.Retire("alice", 1); err != nil {
+		t.Fatalf("Failed to retire: %v", err)
+	}
+	if err := ks.EnableZeroAccess("alice", "pw1"); err != nil {
+		t.Fatalf("Failed to enable zero-access: %v", err)
+	}
+	if ks.IsUnlocked("alice") {
+		t.Errorf("Expected EnableZeroAccess not to unlock the keys")
+	}
+
+	// A wrong old password changes nothing and changing the password never unlocks
+	if err := ks.ChangePassword("alice", "wrong", "pw2"); !errors.Is(err, keys.ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+	if err := ks.ChangePassword("alice", "pw1", "pw2"); err != nil {
+		t.Fatalf("Failed to change password: %v", err)
+	}
+	if ks.IsUnlocked("alice") {
+		t.Errorf("Expected ChangePassword not to unlock the keys")
+	}
+	if err := ks.Unlock("alice", "pw2"); err != nil {
+		t.Errorf("Failed to unlock with the new password: %v", err)
+	}
+}
+
+func TestUnlockSessions(t *testing.T) {
+	ks := keys.NewStore(keys.Configuration{DB: fake.NewDB()})
+	if err := ks.EnableZeroAccess("alice", "pw"); err != nil {
+		t.Fatalf("Failed to enable zero-access: %v", err)
+	}
+	if ks.Retain("alice") {
+		t.Errorf("Expected Retain to fail while locked")
+	}
+
+	for range 2 {
+		if err := ks.Unlock("alice", "pw"); err != nil {
+			t.Fatalf("Failed to unlock: %v", err)
+		}
+	}
+	if !ks.Retain("alice") {
+		t.Errorf("Expected Retain to succeed while unlocked")
+	}
+
+	for i := range 3 {
+		if !ks.IsUnlocked("alice") {
+			t.Fatalf("Expected keys to be unlocked with %d sessions left", 3-i)
+		}
+		ks.Release("alice")
+	}
+	if ks.IsUnlocked("alice") {
+		t.Errorf("Expected keys to be locked after the last session")
+	}
+}
@@ -0,0 +1,166 @@
+// Package keystest provides a conformance test suite that every keys.DB
+// implementation is expected to pass.
+package keystest
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+)
+
+// RunDBSuite runs all conformance tests against the keys.DB returned by newDB.
+// newDB is called once per test and must return an empty database.
+func RunDBSuite(t *testing.T, newDB func() keys.DB) {
+	t.Run("NotFound", func(t *testing.T) { TestNotFound(t, newDB()) })
+	t.Run("Versions", func(t *testing.T) { TestVersions(t, newDB()) })
+	t.Run("UserIsolation", func(t *testing.T) { TestUserIsolation(t, newDB()) })
+	t.Run("Concurrency", func(t *testing.T) { TestConcurrency(t, newDB()) })
+}
+
+func TestNotFound(t *testing.T, db keys.DB) {
+	if _, err := db.Get("alice", 1); !errors.Is(err, keys.ErrKeyNotFound) {
+		t.Errorf("Get: expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := db.GetLatest("alice"); !errors.Is(err, keys.ErrKeyNotFound) {
+		t.Errorf("GetLatest: expected ErrKeyNotFound, got %v", err)
+	}
+	if err := db.Update(newKey("alice", 1)); !errors.Is(err, keys.ErrKeyNotFound) {
+		t.Errorf("Update: expected ErrKeyNotFound, got %v", err)
+	}
+	if err := db.Delete("alice", 1); !errors.Is(err, keys.ErrKeyNotFound) {
+		t.Errorf("Delete: expected ErrKeyNotFound, got %v", err)
+	}
+
+	all, err := db.GetAll("alice")
+	if err != nil {
+		t.Fatalf("GetAll: unexpected error: %v", err)
+	}
+	if len(all) != 0 {
+		t.Errorf("GetAll: expected no keys, got %d", len(all))
+	}
+}
+
+func TestVersions(t *testing.T, db keys.DB) {
+	for v := 1; v <= 3; v++ {
+		if err := db.Insert(newKey("alice", v)); err != nil {
+			t.Fatalf("Insert: unexpected error: %v", err)
+		}
+	}
+	if err := db.Insert(newKey("alice", 2)); !errors.Is(err, keys.ErrKeyAlreadyExists) {
+		t.Errorf("Insert with old version: expected ErrKeyAlreadyExists, got %v", err)
+	}
+
+	latest, err := db.GetLatest("alice")
+	if err != nil {
+		t.Fatalf("GetLatest: unexpected error: %v", err)
+	}
+	if latest.Version != 3 {
+		t.Errorf("GetLatest: expected version 3, got %d", latest.Version)
+	}
+
+	k := newKey("alice", 2)
+	k.Mode = keys.ModePassword
+	k.Salt = []byte("salt")
+	if err := db.Update(k); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+	got, err := db.Get("alice", 2)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if got.Mode != keys.ModePassword || !bytes.Equal(got.Salt, []byte("salt")) {
+		t.Errorf("Get: expected updated key, got %+v", got)
+	}
+
+	if err := db.Delete("alice", 1); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	all, err := db.GetAll("alice")
+	if err != nil {
+		t.Fatalf("GetAll: unexpected error: %v", err)
+	}
+	if len(all) != 2 {
+		t.Errorf("GetAll: expected 2 keys, got %d", len(all))
+	}
+
+	// Modifying a returned key must not modify the stored key
+	got.WrappedKey[0] ^= 0xff
+	again, err := db.Get("alice", 2)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if again.WrappedKey[0] != k.WrappedKey[0] {
+		t.Errorf("Get: stored key was modified through returned value")
+	}
+}
+
+func TestUserIsolation(t *testing.T, db keys.DB) {
+	if err := db.Insert(newKey("alice", 1)); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+	if err := db.Insert(newKey("bob", 1)); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+
+	if err := db.Delete("bob", 1); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	if _, err := db.Get("alice", 1); err != nil {
+		t.Errorf("Delete removed key of other user: %v", err)
+	}
+
+	all, err := db.List()
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(all) != 1 || all[0].UserID != "alice" {
+		t.Errorf("List: expected only alice's key, got %+v", all)
+	}
+}
+
+func TestConcurrency(t *testing.T, db keys.DB) {
+	const workers = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Only one of the workers may create the first version
+			errs <- db.Insert(newKey("alice", 1))
+			if _, err := db.GetLatest("alice"); err != nil {
+				t.Errorf("GetLatest: unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, keys.ErrKeyAlreadyExists) {
+			t.Errorf("Insert: unexpected error: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Insert: expected exactly 1 successful insert, got %d", succeeded)
+	}
+}
+
+func newKey(userID string, version int) keys.UserKey {
+	return keys.UserKey{
+		UserID:      userID,
+		Version:     version,
+		Mode:        keys.ModeMaster,
+		MasterKeyID: "master-1",
+		PublicKey:   bytes.Repeat([]byte{byte(version)}, 32),
+		WrappedKey:  bytes.Repeat([]byte{byte(version) + 1}, 60),
+	}
+}
@@ -0,0 +1,23 @@
+package keys
+
+type Mode string
+
+const (
+	// ModeMaster keys are wrapped by a server master key, the server can always decrypt the user's mail.
+	ModeMaster Mode = "master"
+	// ModePassword keys are wrapped by a key derived from the user's password (zero-access),
+	// the server can only decrypt the user's mail while the key is unlocked. Only
+	// what is sealed with the key is protected, mails.Store keeps the headers of
+	// mail in plaintext.
+	ModePassword Mode = "password"
+)
+
+type UserKey struct {
+	UserID      string `json:"user_id"`
+	Version     int    `json:"version"` // incremented on every rotation, starting at 1
+	Mode        Mode   `json:"mode"`
+	MasterKeyID string `json:"master_key_id,omitempty"` // master key that wrapped the private key (ModeMaster)
+	Salt        []byte `json:"salt,omitempty"`          // salt for deriving the key from the password (ModePassword)
+	PublicKey   []byte `json:"public_key"`              // X25519 public key, mail is encrypted with this key
+	WrappedKey  []byte `json:"wrapped_key"`             // X25519 private key, encrypted with AES-256-GCM
+}
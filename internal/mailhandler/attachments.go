@@ -0,0 +1,204 @@
+package mailhandler
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+)
+
+func (h *Handler) handleAttachments(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	mailboxName := r.PathValue("mailbox")
+	mailUID := r.PathValue("mail")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getAttachments(w, r, userId, mailboxName, mailUID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getAttachments(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string) {
+	msg, ok := h.parseMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return
+	}
+
+	resp := []AttachmentResp{}
+	for _, p := range msg.Attachments() {
+		resp = append(resp, attachmentResp(p))
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		problems.InternalServerError("Error marshalling attachments").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (h *Handler) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	mailboxName := r.PathValue("mailbox")
+	mailUID := r.PathValue("mail")
+	partID := r.PathValue("part")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getAttachment(w, r, userId, mailboxName, mailUID, partID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+	}
+}
+
+// getAttachment writes the decoded content of a part. Any part that is not a
+// multipart container can be downloaded, not only attachments. With
+// ?inline=true the part is meant to be displayed instead of saved.
+func (h *Handler) getAttachment(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string, partID string) {
+	msg, ok := h.parseMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return
+	}
+
+	part, err := msg.Part(partID)
+	if err != nil || part.IsMultipart() {
+		problems.NotFound("Attachment", partID).WriteToHTTP(w)
+		return
+	}
+
+	disposition := "attachment"
+	if r.URL.Query().Get("inline") == "true" {
+		disposition = "inline"
+	}
+
+	contentType := mime.FormatMediaType(part.ContentType, part.Params)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": partFilename(*part)}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(part.Content)))
+	// Parts are untrusted content, they must not run scripts on the API's origin
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.WriteHeader(http.StatusOK)
+	w.Write(part.Content)
+}
+
+func (h *Handler) handleAttachmentsZip(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	mailboxName := r.PathValue("mailbox")
+	mailUID := r.PathValue("mail")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getAttachmentsZip(w, r, userId, mailboxName, mailUID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+	}
+}
+
+// getAttachmentsZip writes all attachments of the mail as a zip archive.
+// Files with the same name are numbered, so none is overwritten on extraction.
+func (h *Handler) getAttachmentsZip(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string) {
+	msg, ok := h.parseMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return
+	}
+
+	attachments := msg.Attachments()
+	if len(attachments) == 0 {
+		problems.NotFound("Attachments of mail", mailUID).WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": mailUID + "-attachments.zip"}))
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+	used := map[string]bool{}
+	for _, p := range attachments {
+		name := uniqueName(partFilename(p), used)
+		fw, err := zw.Create(name)
+		if err == nil {
+			_, err = fw.Write(p.Content)
+		}
+		if err != nil {
+			// The status is already written, the client sees a truncated archive
+			slog.Warn("Failed to write attachments archive", slog.String("user_id", userId), sloki.WrapError(err))
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		slog.Warn("Failed to write attachments archive", slog.String("user_id", userId), sloki.WrapError(err))
+	}
+}
+
+// parseMail looks up the mail and parses its MIME structure. If this fails,
+// the problem is written and false is returned.
+func (h *Handler) parseMail(w http.ResponseWriter, userId string, mailboxName string, mailUID string) (*message.Message, bool) {
+	_, m, ok := h.lookupMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return nil, false
+	}
+
+	msg, err := message.Parse(*m)
+	if err != nil {
+		problems.InternalServerError("Failed to parse mail: " + err.Error()).WriteToHTTP(w)
+		return nil, false
+	}
+	return msg, true
+}
+
+func attachmentResp(p message.Part) AttachmentResp {
+	return AttachmentResp{
+		ID:          p.ID,
+		Filename:    partFilename(p),
+		ContentType: p.ContentType,
+		ContentID:   p.ContentID,
+		Disposition: p.Disposition,
+		Size:        len(p.Content),
+	}
+}
+
+// partFilename returns a file name for the part that is safe to use as a
+// path, falling back to the part ID for parts without a name.
+func partFilename(p message.Part) string {
+	name := strings.TrimSpace(p.Filename)
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name != "" && name != "." && name != "/" && name != ".." {
+		return name
+	}
+
+	name = "part-" + p.ID
+	if exts, _ := mime.ExtensionsByType(p.ContentType); len(exts) > 0 {
+		name += exts[0]
+	}
+	return name
+}
+
+// uniqueName returns the name, numbered if it is already used.
+func uniqueName(name string, used map[string]bool) string {
+	unique := name
+	ext := path.Ext(name)
+	for i := 2; used[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[strings.ToLower(unique)] = true
+	return unique
+}
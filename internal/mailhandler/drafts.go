@@ -0,0 +1,443 @@
+package mailhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/compose"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/smtp"
+)
+
+// draftVersionHeader keeps the version of a draft, which is increased on every save.
+const draftVersionHeader = "X-Draft-Version"
+
+func (h *Handler) handleDrafts(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getDrafts(w, r, userId)
+	case http.MethodPost:
+		h.createDraft(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getDrafts(w http.ResponseWriter, r *http.Request, userId string) {
+	mailbox, err := h.specialMailbox(userId, mails.DraftsMailboxName, `\Drafts`)
+	if err != nil {
+		writeError(w, err, mails.DraftsMailboxName, "")
+		return
+	}
+
+	h.listMails(w, r, userId, mailbox)
+}
+
+func (h *Handler) createDraft(w http.ResponseWriter, r *http.Request, userId string) {
+	var req DraftReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	user, ok := h.lookupUser(w, userId)
+	if !ok {
+		return
+	}
+
+	mailbox, err := h.specialMailbox(userId, mails.DraftsMailboxName, `\Drafts`)
+	if err != nil {
+		writeError(w, err, mails.DraftsMailboxName, "")
+		return
+	}
+
+	msg := compose.Message{From: user.PrimaryEmail}
+	req.apply(&msg)
+
+	draft, ok := h.saveDraft(w, userId, mailbox, mails.RandomUID(), msg, 1, true)
+	if !ok {
+		return
+	}
+
+	writeDraft(w, http.StatusCreated, draft, msg)
+}
+
+func (h *Handler) handleDraft(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	draftUID := r.PathValue("draft")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getDraft(w, r, userId, draftUID)
+	case http.MethodPut:
+		h.updateDraft(w, r, userId, draftUID)
+	case http.MethodDelete:
+		h.deleteDraft(w, r, userId, draftUID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPut, http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getDraft(w http.ResponseWriter, r *http.Request, userId string, draftUID string) {
+	_, draft, msg, ok := h.lookupDraft(w, userId, draftUID)
+	if !ok {
+		return
+	}
+
+	writeDraft(w, http.StatusOK, draft, msg)
+}
+
+// updateDraft replaces the content of the draft, but keeps its attachments.
+// This is also used to autosave drafts.
+func (h *Handler) updateDraft(w http.ResponseWriter, r *http.Request, userId string, draftUID string) {
+	var req DraftReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	h.draftsMu.Lock()
+	defer h.draftsMu.Unlock()
+
+	mailbox, draft, msg, ok := h.lookupDraft(w, userId, draftUID)
+	if !ok {
+		return
+	}
+
+	version := draftVersion(*draft)
+	if req.Version != version {
+		versionConflict(version).WriteToHTTP(w)
+		return
+	}
+
+	req.apply(&msg)
+
+	updated, ok := h.saveDraft(w, userId, mailbox, draft.UID, msg, version+1, false)
+	if !ok {
+		return
+	}
+
+	writeDraft(w, http.StatusOK, updated, msg)
+}
+
+func (h *Handler) deleteDraft(w http.ResponseWriter, r *http.Request, userId string, draftUID string) {
+	h.draftsMu.Lock()
+	defer h.draftsMu.Unlock()
+
+	mailbox, draft, _, ok := h.lookupDraft(w, userId, draftUID)
+	if !ok {
+		return
+	}
+
+	if err := h.mailStore.DeleteMail(userId, mailbox.UID, draft.UID); err != nil {
+		writeError(w, err, mailbox.Name, draftUID)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleDraftAttachments(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	draftUID := r.PathValue("draft")
+
+	switch r.Method {
+	case http.MethodPost:
+		h.addDraftAttachments(w, r, userId, draftUID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+// addDraftAttachments stages attachments in the draft. They are either
+// uploaded as multipart form with the files in the "file" field, which are
+// inline parts if the "inline" field is true, or as a JSON attachment.
+func (h *Handler) addDraftAttachments(w http.ResponseWriter, r *http.Request, userId string, draftUID string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCreateMailSize)
+
+	var added []AttachmentReq
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+			problems.CouldNotDecodeBody().WriteToHTTP(w)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		files, err := formFiles(r, "file", r.FormValue("inline") == "true")
+		if err != nil {
+			problems.CouldNotDecodeBody().WriteToHTTP(w)
+			return
+		}
+		added = files
+	} else {
+		var req AttachmentReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problems.CouldNotDecodeBody().WriteToHTTP(w)
+			return
+		}
+		added = []AttachmentReq{req}
+	}
+
+	if len(added) == 0 {
+		problems.ValidationError("file", "At least one file is required").WriteToHTTP(w)
+		return
+	}
+
+	h.draftsMu.Lock()
+	defer h.draftsMu.Unlock()
+
+	mailbox, draft, msg, ok := h.lookupDraft(w, userId, draftUID)
+	if !ok {
+		return
+	}
+
+	msg.Attachments = append(msg.Attachments, attachments(added)...)
+
+	updated, ok := h.saveDraft(w, userId, mailbox, draft.UID, msg, draftVersion(*draft)+1, false)
+	if !ok {
+		return
+	}
+
+	writeDraft(w, http.StatusCreated, updated, msg)
+}
+
+func (h *Handler) handleDraftAttachment(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	draftUID := r.PathValue("draft")
+	attachmentID := r.PathValue("attachment")
+
+	switch r.Method {
+	case http.MethodDelete:
+		h.removeDraftAttachment(w, r, userId, draftUID, attachmentID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) removeDraftAttachment(w http.ResponseWriter, r *http.Request, userId string, draftUID string, attachmentID string) {
+	h.draftsMu.Lock()
+	defer h.draftsMu.Unlock()
+
+	mailbox, draft, msg, ok := h.lookupDraft(w, userId, draftUID)
+	if !ok {
+		return
+	}
+
+	i, err := strconv.Atoi(attachmentID)
+	if err != nil || i < 1 || i > len(msg.Attachments) {
+		problems.NotFound("Attachment", attachmentID).WriteToHTTP(w)
+		return
+	}
+	msg.Attachments = append(msg.Attachments[:i-1], msg.Attachments[i:]...)
+
+	updated, ok := h.saveDraft(w, userId, mailbox, draft.UID, msg, draftVersion(*draft)+1, false)
+	if !ok {
+		return
+	}
+
+	writeDraft(w, http.StatusOK, updated, msg)
+}
+
+func (h *Handler) handleSendDraft(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	draftUID := r.PathValue("draft")
+
+	switch r.Method {
+	case http.MethodPost:
+		h.sendDraft(w, r, userId, draftUID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+// sendDraft sends the draft and removes it. As drafts are locked while being
+// sent, a concurrent autosave can not bring the draft back.
+func (h *Handler) sendDraft(w http.ResponseWriter, r *http.Request, userId string, draftUID string) {
+	var req SendDraftReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problems.CouldNotDecodeBody().WriteToHTTP(w)
+			return
+		}
+	}
+
+	user, ok := h.lookupUser(w, userId)
+	if !ok {
+		return
+	}
+
+	h.draftsMu.Lock()
+	defer h.draftsMu.Unlock()
+
+	mailbox, draft, msg, ok := h.lookupDraft(w, userId, draftUID)
+	if !ok {
+		return
+	}
+
+	if version := draftVersion(*draft); req.Version != 0 && req.Version != version {
+		versionConflict(version).WriteToHTTP(w)
+		return
+	}
+
+	sent, err := h.sentMailbox(userId, req.SentMailbox)
+	if err != nil {
+		writeError(w, err, req.SentMailbox, "")
+		return
+	}
+
+	msg.From = user.PrimaryEmail
+	if !h.sendMessage(w, userId, msg, sent) {
+		return
+	}
+
+	if err := h.mailStore.DeleteMail(userId, mailbox.UID, draft.UID); err != nil {
+		slog.Error("Failed to delete sent draft", slog.String("user_id", userId), sloki.WrapError(err))
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// lookupDraft returns the drafts mailbox, the draft and its message. If the
+// draft does not exist, the problem is written and false is returned.
+func (h *Handler) lookupDraft(w http.ResponseWriter, userId string, draftUID string) (*mails.Mailbox, *mails.Mail, compose.Message, bool) {
+	if _, err := h.specialMailbox(userId, mails.DraftsMailboxName, `\Drafts`); err != nil {
+		writeError(w, err, mails.DraftsMailboxName, "")
+		return nil, nil, compose.Message{}, false
+	}
+
+	mailbox, draft, ok := h.lookupMail(w, userId, mails.DraftsMailboxName, draftUID)
+	if !ok {
+		return nil, nil, compose.Message{}, false
+	}
+
+	msg, err := compose.ParseDraft(*draft)
+	if err != nil {
+		problems.InternalServerError("Failed to parse the draft: " + err.Error()).WriteToHTTP(w)
+		return nil, nil, compose.Message{}, false
+	}
+
+	return mailbox, draft, msg, true
+}
+
+// saveDraft stores the message as draft with the given version. If this
+// fails, the problem is written and false is returned.
+func (h *Handler) saveDraft(w http.ResponseWriter, userId string, mailbox *mails.Mailbox, uid uint32, msg compose.Message, version int, create bool) (*mails.Mail, bool) {
+	if msg.Headers == nil {
+		msg.Headers = map[string]string{}
+	}
+	msg.Headers[draftVersionHeader] = strconv.Itoa(version)
+	msg.Date = time.Now()
+
+	raw, err := msg.BuildDraft()
+	if err != nil {
+		writeComposeError(w, err)
+		return nil, false
+	}
+	if len(raw) > smtp.MaxMessageSize {
+		problems.ValidationError("attachments", "The message exceeds the maximum size").WriteToHTTP(w)
+		return nil, false
+	}
+
+	stored := smtp.Mail{DataBuffer: lines(raw)}
+	draft := mails.Mail{
+		UID:        uid,
+		MailboxUID: mailbox.UID,
+		Flags:      []string{`\Draft`, `\Seen`},
+		Date:       msg.Date,
+		Size:       stored.Size(),
+		Headers:    stored.Headers(),
+		Body:       stored.Body(),
+	}
+
+	if create {
+		err = h.mailStore.CreateMail(userId, mailbox.UID, draft)
+	} else {
+		err = h.mailStore.UpdateMail(userId, mailbox.UID, draft)
+	}
+	if err != nil {
+		writeError(w, err, mailbox.Name, strconv.FormatUint(uint64(uid), 10))
+		return nil, false
+	}
+
+	return &draft, true
+}
+
+func writeDraft(w http.ResponseWriter, status int, draft *mails.Mail, msg compose.Message) {
+	resp := DraftResp{
+		UID:         draft.UID,
+		Version:     draftVersion(*draft),
+		UpdatedAt:   draft.Date,
+		To:          nonNil(msg.To),
+		Cc:          nonNil(msg.Cc),
+		Bcc:         nonNil(msg.Bcc),
+		ReplyTo:     nonNil(msg.ReplyTo),
+		Subject:     msg.Subject,
+		Text:        msg.Text,
+		HTML:        msg.HTML,
+		Attachments: []DraftAttachment{},
+	}
+	for i, a := range msg.Attachments {
+		resp.Attachments = append(resp.Attachments, DraftAttachment{
+			ID:          strconv.Itoa(i + 1),
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			ContentID:   a.ContentID,
+			Size:        len(a.Data),
+		})
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		problems.InternalServerError("Error marshalling draft").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// draftVersion returns the version of the draft, which is 0 for drafts that
+// were not saved through the API, e.g. by IMAP clients.
+func draftVersion(draft mails.Mail) int {
+	version, _ := strconv.Atoi(draft.Header(draftVersionHeader))
+	return version
+}
+
+func versionConflict(current int) *problems.Problem {
+	return &problems.Problem{
+		Type:      "Conflict",
+		Title:     "Draft was changed",
+		Detail:    fmt.Sprintf("The draft was changed in the meantime, its current version is %d.", current),
+		Status:    http.StatusConflict,
+		Timestamp: time.Now(),
+	}
+}
+
+// apply sets the fields of the message to the ones of the request.
+func (req DraftReq) apply(msg *compose.Message) {
+	msg.To = req.To
+	msg.Cc = req.Cc
+	msg.Bcc = req.Bcc
+	msg.ReplyTo = req.ReplyTo
+	msg.Subject = req.Subject
+	msg.Text = req.Text
+	msg.HTML = req.HTML
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
@@ -0,0 +1,101 @@
+package mailhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/events"
+)
+
+// keepAliveInterval is how often a comment is sent on idle event streams, so
+// proxies do not close the connection.
+const keepAliveInterval = 30 * time.Second
+
+// resetEvent tells the client that events were missed and it has to reload its state.
+const resetEvent = "reset"
+
+func (h *Handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.streamEvents(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+	}
+}
+
+// streamEvents streams the changes to the mailboxes and mails of the user as
+// Server-Sent Events. A reconnecting client resumes after the ID in the
+// Last-Event-ID header or the last_event_id query parameter.
+func (h *Handler) streamEvents(w http.ResponseWriter, r *http.Request, userId string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		problems.InternalServerError("Streaming is not supported").WriteToHTTP(w)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var after uint64
+	if lastEventID != "" {
+		var err error
+		if after, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			problems.ValidationError("last_event_id", "Invalid event ID").WriteToHTTP(w)
+			return
+		}
+	}
+
+	sub, err := h.events.Subscribe(userId, after)
+	reset := errors.Is(err, events.ErrEventsExpired)
+	if reset {
+		sub, err = h.events.Subscribe(userId, 0)
+	}
+	if err != nil {
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if reset {
+		// The ID lets the client resume from here once it reloaded its state
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: {}\n\n", h.events.LastID(), resetEvent)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case e, ok := <-sub.C:
+			if !ok {
+				// The client fell behind, it reconnects and resumes after the last event
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package mailhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+func (h *Handler) handleForwarding(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getForwarding(w, r, userId)
+	case http.MethodPut:
+		h.setForwarding(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPut}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getForwarding(w http.ResponseWriter, r *http.Request, userId string) {
+	u, ok := h.lookupUser(w, userId)
+	if !ok {
+		return
+	}
+
+	writeForwarding(w, u.Forwarding)
+}
+
+// setForwarding replaces the forwarding of the user, an empty list of
+// addresses turns it off.
+func (h *Handler) setForwarding(w http.ResponseWriter, r *http.Request, userId string) {
+	var req users.Forwarding
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if err := h.userStore.SetForwarding(userId, req); err != nil {
+		writeForwardingError(w, err, userId)
+		return
+	}
+
+	u, ok := h.lookupUser(w, userId)
+	if !ok {
+		return
+	}
+
+	writeForwarding(w, u.Forwarding)
+}
+
+func writeForwarding(w http.ResponseWriter, f users.Forwarding) {
+	if f.Addresses == nil {
+		f.Addresses = []string{}
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		problems.InternalServerError("Error marshalling forwarding").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func writeForwardingError(w http.ResponseWriter, err error, userId string) {
+	switch {
+	case errors.Is(err, users.ErrUserNotFound):
+		problems.NotFound("User", userId).WriteToHTTP(w)
+	case errors.Is(err, users.ErrInvalidForwarding):
+		problems.ValidationError("addresses", fmt.Sprintf("Addresses must be plain email addresses that are not your own, at most %d", users.MaxForwardingAddresses)).WriteToHTTP(w)
+	default:
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
+}
@@ -0,0 +1,212 @@
+package mailhandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/mbox"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+	"github.com/OliverSchlueter/mail-server/internal/smtp"
+)
+
+// maxImportSize limits the size of an import request, which may contain many messages.
+const maxImportSize = 256 << 20
+
+// statusFlags maps the letters of the Status and X-Status headers, which
+// mbox files use to keep the state of a message, to IMAP flags.
+var statusFlags = map[rune]string{
+	'R': `\Seen`,
+	'A': `\Answered`,
+	'F': `\Flagged`,
+	'T': `\Draft`,
+	'D': `\Deleted`,
+}
+
+func (h *Handler) handleRawMail(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	mailboxName := r.PathValue("mailbox")
+	mailUID := r.PathValue("mail")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getRawMail(w, r, userId, mailboxName, mailUID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getRawMail(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string) {
+	_, m, ok := h.lookupMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return
+	}
+
+	raw := message.Raw(*m)
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": mailUID + ".eml"}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(raw)
+}
+
+func (h *Handler) handleImport(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	mailboxName := r.PathValue("mailbox")
+
+	switch r.Method {
+	case http.MethodPost:
+		h.importMails(w, r, userId, mailboxName)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+// importMails stores raw messages in the mailbox. The body is either a
+// single message, an mbox file or a multipart form with any number of both
+// in the "messages" field. Either all messages are imported or none.
+func (h *Handler) importMails(w http.ResponseWriter, r *http.Request, userId string, mailboxName string) {
+	mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
+	if err != nil {
+		writeError(w, err, mailboxName, "")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	messages, err := readImport(r)
+	if err != nil {
+		problems.ValidationError("messages", err.Error()).WriteToHTTP(w)
+		return
+	}
+	if len(messages) == 0 {
+		problems.ValidationError("messages", "At least one message is required").WriteToHTTP(w)
+		return
+	}
+
+	imported := make([]mails.Mail, 0, len(messages))
+	for i, m := range messages {
+		parsed, err := importedMail(m, mailbox.UID)
+		if err != nil {
+			problems.ValidationError("messages", fmt.Sprintf("Message %d: %v", i+1, err)).WriteToHTTP(w)
+			return
+		}
+		imported = append(imported, parsed)
+	}
+
+	for _, m := range imported {
+		if err := h.mailStore.CreateMail(userId, mailbox.UID, m); err != nil {
+			writeError(w, err, mailboxName, "")
+			return
+		}
+	}
+
+	data, err := json.Marshal(ImportResp{Imported: len(imported)})
+	if err != nil {
+		problems.InternalServerError("Error marshalling import").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// readImport returns the messages of the request body.
+func readImport(r *http.Request) ([]mbox.Message, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return splitImport(data)
+	}
+
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+		return nil, err
+	}
+
+	var messages []mbox.Message
+	for _, fh := range r.MultipartForm.File["messages"] {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		split, err := splitImport(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fh.Filename, err)
+		}
+		messages = append(messages, split...)
+	}
+	return messages, nil
+}
+
+// splitImport returns the messages of an mbox file or the single message.
+func splitImport(data []byte) ([]mbox.Message, error) {
+	if mbox.IsMbox(data) {
+		return mbox.Read(bytes.NewReader(data))
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	return []mbox.Message{{Raw: data}}, nil
+}
+
+// importedMail returns the mail to store for the raw message. The date it was
+// delivered is taken from the mbox separator or otherwise its Date header.
+func importedMail(m mbox.Message, mailboxUID uint32) (mails.Mail, error) {
+	if len(m.Raw) > smtp.MaxMessageSize {
+		return mails.Mail{}, errors.New("message exceeds the maximum size")
+	}
+
+	raw := strings.ReplaceAll(string(m.Raw), "\r\n", "\n")
+	parsed, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil || len(parsed.Header) == 0 {
+		return mails.Mail{}, errors.New("message has no headers")
+	}
+
+	date := m.Date
+	if date.IsZero() {
+		if d, err := parsed.Header.Date(); err == nil {
+			date = d
+		} else {
+			date = time.Now()
+		}
+	}
+
+	flags := []string{}
+	for _, r := range parsed.Header.Get("Status") + parsed.Header.Get("X-Status") {
+		if flag, ok := statusFlags[r]; ok && !slices.Contains(flags, flag) {
+			flags = append(flags, flag)
+		}
+	}
+
+	stored := smtp.Mail{DataBuffer: strings.Split(strings.TrimSuffix(raw, "\n"), "\n")}
+	return mails.Mail{
+		MailboxUID: mailboxUID,
+		Flags:      flags,
+		Date:       date,
+		Size:       stored.Size(),
+		Headers:    stored.Headers(),
+		Body:       stored.Body(),
+	}, nil
+}
@@ -2,32 +2,129 @@ package mailhandler
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/auth"
+	"github.com/OliverSchlueter/mail-server/internal/compose"
+	"github.com/OliverSchlueter/mail-server/internal/events"
 	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+	"github.com/OliverSchlueter/mail-server/internal/search"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
 	"github.com/OliverSchlueter/mail-server/internal/smtp"
 	"github.com/OliverSchlueter/mail-server/internal/users"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+	"io"
+	"mime"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// maxCreateMailSize leaves room for the base64 encoding of attachments in JSON requests.
+	maxCreateMailSize = 2 * smtp.MaxMessageSize
+	maxFormMemory     = 32 << 20
+)
+
 type Handler struct {
-	mailStore mails.Store
-	userStore users.Store
+	mailStore   mails.Store
+	userStore   users.Store
+	auth        *auth.Service
+	searchIndex *search.Index
+	outbox      *outbox.Service
+	send        outbox.SendFunc
+	undoWindow  time.Duration
+	events      *events.Bus
+	vacation    *vacation.Service
+	sieve       *sieve.Store
+
+	// draftsMu serializes changes to drafts, so concurrent autosaves are detected by their version
+	draftsMu sync.Mutex
 }
 
-func New(mailStore mails.Store, userStore users.Store) *Handler {
+type Configuration struct {
+	MailStore   mails.Store
+	UserStore   users.Store
+	Auth        *auth.Service   // all endpoints are only available to the user they belong to and admins
+	SearchIndex *search.Index   // optional, enables the search endpoints
+	Outbox      *outbox.Service // optional, enables scheduled sending and the outbox endpoints
+	Send        outbox.SendFunc // sends mail that is not held in the outbox, defaults to smtp.SendMail
+	// UndoWindow holds every new mail in the outbox for this long before it
+	// is sent, so it can still be cancelled. Requires Outbox.
+	UndoWindow time.Duration
+	Events     *events.Bus       // optional, enables the event stream, must be the bus the MailStore publishes to
+	Vacation   *vacation.Service // optional, enables the vacation endpoints
+	Sieve      *sieve.Store      // optional, enables the Sieve script endpoints
+}
+
+func New(cfg Configuration) *Handler {
+	if cfg.Send == nil {
+		cfg.Send = smtp.SendMail
+	}
+
 	return &Handler{
-		mailStore: mailStore,
-		userStore: userStore,
+		mailStore:   cfg.MailStore,
+		userStore:   cfg.UserStore,
+		auth:        cfg.Auth,
+		searchIndex: cfg.SearchIndex,
+		outbox:      cfg.Outbox,
+		send:        cfg.Send,
+		undoWindow:  cfg.UndoWindow,
+		events:      cfg.Events,
+		vacation:    cfg.Vacation,
+		sieve:       cfg.Sieve,
 	}
 }
 
 func (h *Handler) Register(prefix string, mux *http.ServeMux) {
-	mux.HandleFunc(prefix+"/mailboxes/{user_id}/", h.handleMailboxes)
-	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}", h.handleMailbox)
-	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails", h.handleMails)
-	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}", h.handleMail)
+	mux.HandleFunc(prefix+"/openapi.json", h.handleOpenAPI(prefix))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/", h.auth.RequireUser(h.handleMailboxes))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}", h.auth.RequireUser(h.handleMailbox))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails", h.auth.RequireUser(h.handleMails))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/import", h.auth.RequireUser(h.handleImport))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}", h.auth.RequireUser(h.handleMail))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}/attachments", h.auth.RequireUser(h.handleAttachments))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}/attachments/zip", h.auth.RequireUser(h.handleAttachmentsZip))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}/attachments/{part}", h.auth.RequireUser(h.handleAttachment))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}/raw", h.auth.RequireUser(h.handleRawMail))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}/move", h.auth.RequireUser(h.handleMoveMail))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}/reply", h.auth.RequireUser(h.handleReply(false)))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}/reply-all", h.auth.RequireUser(h.handleReply(true)))
+	mux.HandleFunc(prefix+"/mailboxes/{user_id}/{mailbox}/mails/{mail}/forward", h.auth.RequireUser(h.handleForward))
+	mux.HandleFunc(prefix+"/drafts/{user_id}", h.auth.RequireUser(h.handleDrafts))
+	mux.HandleFunc(prefix+"/drafts/{user_id}/{draft}", h.auth.RequireUser(h.handleDraft))
+	mux.HandleFunc(prefix+"/drafts/{user_id}/{draft}/attachments", h.auth.RequireUser(h.handleDraftAttachments))
+	mux.HandleFunc(prefix+"/drafts/{user_id}/{draft}/attachments/{attachment}", h.auth.RequireUser(h.handleDraftAttachment))
+	mux.HandleFunc(prefix+"/drafts/{user_id}/{draft}/send", h.auth.RequireUser(h.handleSendDraft))
+	mux.HandleFunc(prefix+"/forwarding/{user_id}", h.auth.RequireUser(h.handleForwarding))
+
+	if h.outbox != nil {
+		mux.HandleFunc(prefix+"/outbox/{user_id}", h.auth.RequireUser(h.handleOutbox))
+		mux.HandleFunc(prefix+"/outbox/{user_id}/{id}", h.auth.RequireUser(h.handlePending))
+	}
+
+	if h.events != nil {
+		mux.HandleFunc(prefix+"/events/{user_id}", h.auth.RequireUser(h.handleEvents))
+	}
+
+	if h.vacation != nil {
+		mux.HandleFunc(prefix+"/vacation/{user_id}", h.auth.RequireUser(h.handleVacation))
+	}
+
+	if h.sieve != nil {
+		mux.HandleFunc(prefix+"/sieve/{user_id}", h.auth.RequireUser(h.handleSieveScripts))
+		mux.HandleFunc(prefix+"/sieve/{user_id}/{name}", h.auth.RequireUser(h.handleSieveScript))
+	}
+
+	if h.searchIndex != nil {
+		mux.HandleFunc(prefix+"/search/{user_id}", h.auth.RequireUser(h.handleSearch))
+		mux.HandleFunc(prefix+"/search/{user_id}/reindex", h.auth.RequireUser(h.handleReindex))
+	}
 }
 
 func (h *Handler) handleMailboxes(w http.ResponseWriter, r *http.Request) {
@@ -66,18 +163,116 @@ func (h *Handler) handleMailbox(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		h.getMailbox(w, r, userId, mailboxName)
+	case http.MethodPost:
+		h.createMailbox(w, r, userId, mailboxName)
+	case http.MethodPatch:
+		h.updateMailbox(w, r, userId, mailboxName)
+	case http.MethodDelete:
+		h.deleteMailbox(w, r, userId, mailboxName)
 	default:
-		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete}).WriteToHTTP(w)
 	}
 }
 
 func (h *Handler) getMailbox(w http.ResponseWriter, r *http.Request, userId string, mailboxName string) {
 	mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
 	if err != nil {
+		writeError(w, err, mailboxName, "")
+		return
+	}
+
+	data, err := json.Marshal(mailbox)
+	if err != nil {
+		problems.InternalServerError("Error marshalling mailbox").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (h *Handler) createMailbox(w http.ResponseWriter, r *http.Request, userId string, mailboxName string) {
+	var req CreateMailboxReq
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problems.CouldNotDecodeBody().WriteToHTTP(w)
+			return
+		}
+	}
+
+	if req.Flags == nil {
+		req.Flags = []string{}
+	}
+
+	mailbox := mails.Mailbox{
+		UserID: userId,
+		Name:   mailboxName,
+		Flags:  req.Flags,
+	}
+	if err := h.mailStore.CreateMailbox(mailbox); err != nil {
+		if errors.Is(err, mails.ErrMailboxAlreadyExists) {
+			problems.AlreadyExists("Mailbox", mailboxName).WriteToHTTP(w)
+			return
+		}
 		problems.InternalServerError(err.Error()).WriteToHTTP(w)
 		return
 	}
 
+	created, err := h.mailStore.GetMailboxByName(userId, mailboxName)
+	if err != nil {
+		writeError(w, err, mailboxName, "")
+		return
+	}
+
+	data, err := json.Marshal(created)
+	if err != nil {
+		problems.InternalServerError("Error marshalling mailbox").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+func (h *Handler) updateMailbox(w http.ResponseWriter, r *http.Request, userId string, mailboxName string) {
+	var req UpdateMailboxReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
+	if err != nil {
+		writeError(w, err, mailboxName, "")
+		return
+	}
+
+	if req.Name != nil && *req.Name != mailbox.Name {
+		if *req.Name == "" {
+			problems.ValidationError("name", "Name must not be empty").WriteToHTTP(w)
+			return
+		}
+		if mailbox.Name == mails.DefaultMailboxName {
+			problems.ValidationError("name", "The inbox can not be renamed").WriteToHTTP(w)
+			return
+		}
+		mailbox.Name = *req.Name
+	}
+	if req.Flags != nil {
+		mailbox.Flags = *req.Flags
+	}
+
+	if err := h.mailStore.UpdateMailbox(*mailbox); err != nil {
+		if errors.Is(err, mails.ErrMailboxAlreadyExists) {
+			problems.AlreadyExists("Mailbox", mailbox.Name).WriteToHTTP(w)
+			return
+		}
+		writeError(w, err, mailboxName, "")
+		return
+	}
+
 	data, err := json.Marshal(mailbox)
 	if err != nil {
 		problems.InternalServerError("Error marshalling mailbox").WriteToHTTP(w)
@@ -89,6 +284,26 @@ func (h *Handler) getMailbox(w http.ResponseWriter, r *http.Request, userId stri
 	w.Write(data)
 }
 
+func (h *Handler) deleteMailbox(w http.ResponseWriter, r *http.Request, userId string, mailboxName string) {
+	if mailboxName == mails.DefaultMailboxName {
+		problems.ValidationError("mailbox", "The inbox can not be deleted").WriteToHTTP(w)
+		return
+	}
+
+	mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
+	if err != nil {
+		writeError(w, err, mailboxName, "")
+		return
+	}
+
+	if err := h.mailStore.DeleteMailbox(userId, mailbox.UID); err != nil {
+		writeError(w, err, mailboxName, "")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *Handler) handleMails(w http.ResponseWriter, r *http.Request) {
 	userId := r.PathValue("user_id")
 	mailboxName := r.PathValue("mailbox")
@@ -106,17 +321,43 @@ func (h *Handler) handleMails(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) getMails(w http.ResponseWriter, r *http.Request, userId string, mailboxName string) {
 	mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
 	if err != nil {
-		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		writeError(w, err, mailboxName, "")
+		return
+	}
+
+	h.listMails(w, r, userId, mailbox)
+}
+
+// listMails writes a page of the mails in the mailbox, see parseListOptions.
+func (h *Handler) listMails(w http.ResponseWriter, r *http.Request, userId string, mailbox *mails.Mailbox) {
+	opts, ok := parseListOptions(w, r)
+	if !ok {
 		return
 	}
 
-	m, err := h.mailStore.GetMails(userId, mailbox.UID)
+	page, err := h.mailStore.ListMails(userId, mailbox.UID, opts)
 	if err != nil {
-		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		if errors.Is(err, mails.ErrInvalidCursor) {
+			problems.ValidationError("cursor", "Invalid cursor, it must be used with the same sort order").WriteToHTTP(w)
+			return
+		}
+		writeError(w, err, mailbox.Name, "")
 		return
 	}
 
-	data, err := json.Marshal(m)
+	var resp any = page
+	if !opts.WithBody {
+		summaries := MailSummaryPage{
+			Mails:      make([]mails.MailSummary, len(page.Mails)),
+			NextCursor: page.NextCursor,
+		}
+		for i, m := range page.Mails {
+			summaries.Mails[i] = m.Summary()
+		}
+		resp = summaries
+	}
+
+	data, err := json.Marshal(resp)
 	if err != nil {
 		problems.InternalServerError("Error marshalling mails").WriteToHTTP(w)
 		return
@@ -127,81 +368,280 @@ func (h *Handler) getMails(w http.ResponseWriter, r *http.Request, userId string
 	w.Write(data)
 }
 
+// parseListOptions reads the paging, sorting and filter parameters of the
+// mail listing. If they are invalid, the problem is written and false is returned.
+func parseListOptions(w http.ResponseWriter, r *http.Request) (mails.ListOptions, bool) {
+	q := r.URL.Query()
+	opts := mails.ListOptions{
+		Sort:   mails.SortField(q.Get("sort")),
+		Cursor: q.Get("cursor"),
+		Filter: mails.Filter{
+			From: q.Get("from"),
+			To:   q.Get("to"),
+		},
+	}
+
+	switch q.Get("order") {
+	case "", "desc":
+		opts.Descending = true
+	case "asc":
+	default:
+		problems.ValidationError("order", "Order must be asc or desc").WriteToHTTP(w)
+		return opts, false
+	}
+
+	switch q.Get("view") {
+	case "", "summary":
+	case "full":
+		opts.WithBody = true
+	default:
+		problems.ValidationError("view", "View must be summary or full").WriteToHTTP(w)
+		return opts, false
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > mails.MaxListLimit {
+			problems.ValidationError("limit", fmt.Sprintf("Limit must be between 1 and %d", mails.MaxListLimit)).WriteToHTTP(w)
+			return opts, false
+		}
+		opts.Limit = limit
+	}
+
+	bools := map[string]*bool{
+		"unread":          &opts.Filter.Unread,
+		"flagged":         &opts.Filter.Flagged,
+		"has_attachments": &opts.Filter.HasAttachments,
+	}
+	for name, target := range bools {
+		if v := q.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				problems.ValidationError(name, "Must be true or false").WriteToHTTP(w)
+				return opts, false
+			}
+			*target = b
+		}
+	}
+
+	times := map[string]*time.Time{
+		"since":  &opts.Filter.Since,
+		"before": &opts.Filter.Before,
+	}
+	for name, target := range times {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				problems.ValidationError(name, "Must be a RFC 3339 timestamp").WriteToHTTP(w)
+				return opts, false
+			}
+			*target = t
+		}
+	}
+
+	opts = opts.Normalize()
+	if err := opts.Validate(); err != nil {
+		if errors.Is(err, mails.ErrInvalidSort) {
+			problems.ValidationError("sort", "Sort must be any of date, size, from and subject").WriteToHTTP(w)
+			return opts, false
+		}
+		problems.ValidationError("cursor", "Invalid cursor, it must be used with the same sort order").WriteToHTTP(w)
+		return opts, false
+	}
+
+	return opts, true
+}
+
 func (h *Handler) createMail(w http.ResponseWriter, r *http.Request, userId string, mailboxName string) {
-	var req CreateMailReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		problems.CouldNotDecodeBody().WriteToHTTP(w)
+	req, ok := decodeCreateMailReq(w, r)
+	if !ok {
+		return
+	}
+
+	user, ok := h.lookupUser(w, userId)
+	if !ok {
 		return
 	}
 
-	user, err := h.userStore.GetByName(userId)
+	mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
 	if err != nil {
-		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		writeError(w, err, mailboxName, "")
 		return
 	}
 
-	msgID := time.Now().Format("20060102150405") + "@" + user.PrimaryEmail
-	date := time.Now().Format(time.RFC1123Z)
+	msg := req.message(user.PrimaryEmail)
 
-	dataBuffer := []string{
-		"Date: " + date,
-		"MIME-Version: 1.0",
-		"Message-ID: <" + msgID + ">",
-		"Subject: " + req.Subject,
-		"From: <" + user.PrimaryEmail + ">",
-		"To: <" + req.To[0] + ">", // Assuming single recipient for simplicity
-		"Content-Transfer-Encoding: quoted-printable",
-		"Content-Type: text/html; charset=UTF-8",
-		"",
-		req.Body,
+	if req.SendAt != nil && h.outbox == nil {
+		problems.ValidationError("send_at", "Scheduled sending is not enabled").WriteToHTTP(w)
+		return
+	}
+	if h.outbox == nil || (req.SendAt == nil && h.undoWindow == 0) {
+		if !h.sendMessage(w, userId, msg, mailbox) {
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
 	}
 
-	smtpMail := smtp.Mail{
-		Outgoing:    true,
-		From:        user.PrimaryEmail,
-		To:          req.To,
-		DataBuffer:  dataBuffer,
-		ReadingData: false,
+	// The message is held in the outbox, so it can still be cancelled until it is sent
+	pending, ok := pendingMessage(w, userId, msg, mailbox)
+	if !ok {
+		return
+	}
+	pending.SendAt = time.Now().Add(h.undoWindow)
+	if req.SendAt != nil && req.SendAt.After(pending.SendAt) {
+		pending.SendAt = *req.SendAt
 	}
 
-	recepientsCount, err := smtp.SendMail(smtpMail)
+	scheduled, err := h.outbox.Schedule(pending)
 	if err != nil {
-		problems.InternalServerError("Failed to send mail: " + err.Error()).WriteToHTTP(w)
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
 		return
 	}
 
-	if recepientsCount != len(req.To) {
-		problems.InternalServerError("Not all recipients were sent the mail").WriteToHTTP(w)
-		return
+	writePending(w, http.StatusAccepted, scheduled)
+}
+
+// sendMessage sends the message and keeps a copy in the mailbox. If this
+// fails, the problem is written and false is returned.
+func (h *Handler) sendMessage(w http.ResponseWriter, userId string, msg compose.Message, mailbox *mails.Mailbox) bool {
+	pending, ok := pendingMessage(w, userId, msg, mailbox)
+	if !ok {
+		return false
 	}
 
-	mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
+	if err := outbox.Deliver(h.mailStore, h.send, pending); err != nil {
+		if errors.Is(err, outbox.ErrNotStored) {
+			writeError(w, err, mailbox.Name, "")
+			return false
+		}
+		if errors.Is(err, outbox.ErrPartiallySent) {
+			problems.InternalServerError("Not all recipients were sent the mail").WriteToHTTP(w)
+			return false
+		}
+		problems.InternalServerError("Failed to send mail: " + err.Error()).WriteToHTTP(w)
+		return false
+	}
+
+	return true
+}
+
+// pendingMessage builds the message to be sent, with its copy kept in the
+// mailbox. If this fails, the problem is written and false is returned.
+func pendingMessage(w http.ResponseWriter, userId string, msg compose.Message, mailbox *mails.Mailbox) (outbox.Message, bool) {
+	raw, err := msg.Build()
 	if err != nil {
-		problems.InternalServerError(err.Error()).WriteToHTTP(w)
-		return
+		writeComposeError(w, err)
+		return outbox.Message{}, false
+	}
+	if len(raw) > smtp.MaxMessageSize {
+		problems.ValidationError("attachments", "The message exceeds the maximum size").WriteToHTTP(w)
+		return outbox.Message{}, false
 	}
 
-	mailsMail := mails.Mail{
-		UID:        mails.RandomUID(),
+	return outbox.Message{
+		UserID:     userId,
 		MailboxUID: mailbox.UID,
-		Flags:      []string{},
-		Date:       time.Now(),
-		Size:       len(req.Body),
-		Headers: map[string]string{
-			"From":       user.PrimaryEmail,
-			"To":         req.To[0], // Assuming single recipient for simplicity
-			"Subject":    req.Subject,
-			"Date":       date,
-			"Message-ID": msgID,
-		},
-		Body: req.Body,
+		From:       msg.From,
+		Recipients: msg.Recipients(),
+		Bcc:        msg.Bcc,
+		Subject:    msg.Subject,
+		Raw:        raw,
+	}, true
+}
+
+// lines splits an encoded message into its lines.
+func lines(raw []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(raw), "\r\n"), "\r\n")
+}
+
+// decodeCreateMailReq reads the request either from a JSON body or from a
+// multipart form, with the JSON in the "message" field and the files in the
+// "attachments" and "inline" fields. Inline files are referenced by their
+// filename as content ID. If the request is invalid, the problem is written
+// and false is returned.
+func decodeCreateMailReq(w http.ResponseWriter, r *http.Request) (CreateMailReq, bool) {
+	var req CreateMailReq
+	r.Body = http.MaxBytesReader(w, r.Body, maxCreateMailSize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			problems.CouldNotDecodeBody().WriteToHTTP(w)
+			return req, false
+		}
+		return req, true
 	}
-	if err := h.mailStore.CreateMail(userId, mailbox.UID, mailsMail); err != nil {
-		problems.InternalServerError(err.Error()).WriteToHTTP(w)
-		return
+
+	if err := r.ParseMultipartForm(maxFormMemory); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return req, false
 	}
+	defer r.MultipartForm.RemoveAll()
 
-	w.WriteHeader(http.StatusCreated)
+	if err := json.Unmarshal([]byte(r.FormValue("message")), &req); err != nil {
+		problems.ValidationError("message", "Must contain the message as JSON").WriteToHTTP(w)
+		return req, false
+	}
+
+	for _, field := range []string{"attachments", "inline"} {
+		files, err := formFiles(r, field, field == "inline")
+		if err != nil {
+			problems.CouldNotDecodeBody().WriteToHTTP(w)
+			return req, false
+		}
+		req.Attachments = append(req.Attachments, files...)
+	}
+
+	return req, true
+}
+
+// formFiles reads the files of the field of a parsed multipart form. Inline
+// files are referenced by their filename as content ID.
+func formFiles(r *http.Request, field string, inline bool) ([]AttachmentReq, error) {
+	var files []AttachmentReq
+	for _, fh := range r.MultipartForm.File[field] {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		a := AttachmentReq{
+			Filename:    fh.Filename,
+			ContentType: fh.Header.Get("Content-Type"),
+			Content:     data,
+		}
+		// Clients often send this for any file, detecting the type is more helpful
+		if a.ContentType == "application/octet-stream" {
+			a.ContentType = ""
+		}
+		if inline {
+			a.ContentID = fh.Filename
+		}
+		files = append(files, a)
+	}
+	return files, nil
+}
+
+// writeComposeError writes the problem matching an error of compose.Message.Validate.
+func writeComposeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, compose.ErrNoRecipients):
+		problems.ValidationError("to", "At least one recipient is required").WriteToHTTP(w)
+	case errors.Is(err, compose.ErrTooManyRecipients):
+		problems.ValidationError("to", fmt.Sprintf("At most %d recipients are allowed", compose.MaxRecipients)).WriteToHTTP(w)
+	case errors.Is(err, compose.ErrInvalidAddress):
+		problems.ValidationError("address", err.Error()).WriteToHTTP(w)
+	case errors.Is(err, compose.ErrNoBody):
+		problems.ValidationError("text", "The message needs a text or HTML body or an attachment").WriteToHTTP(w)
+	default:
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
 }
 
 func (h *Handler) handleMail(w http.ResponseWriter, r *http.Request) {
@@ -212,15 +652,19 @@ func (h *Handler) handleMail(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		h.getMail(w, r, userId, mailboxName, mailUID)
+	case http.MethodPatch:
+		h.updateMail(w, r, userId, mailboxName, mailUID)
+	case http.MethodDelete:
+		h.deleteMail(w, r, userId, mailboxName, mailUID)
 	default:
-		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPatch, http.MethodDelete}).WriteToHTTP(w)
 	}
 }
 
 func (h *Handler) getMail(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string) {
 	mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
 	if err != nil {
-		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		writeError(w, err, mailboxName, "")
 		return
 	}
 
@@ -232,7 +676,7 @@ func (h *Handler) getMail(w http.ResponseWriter, r *http.Request, userId string,
 
 	mail, err := h.mailStore.GetMailByUID(userId, mailbox.UID, uint32(uid))
 	if err != nil {
-		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		writeError(w, err, mailboxName, mailUID)
 		return
 	}
 
@@ -246,3 +690,256 @@ func (h *Handler) getMail(w http.ResponseWriter, r *http.Request, userId string,
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
+
+func (h *Handler) updateMail(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string) {
+	var req UpdateMailReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	mailbox, mail, ok := h.lookupMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return
+	}
+
+	if req.Flags != nil {
+		mail.Flags = *req.Flags
+	}
+	for _, flag := range req.AddFlags {
+		if !slices.Contains(mail.Flags, flag) {
+			mail.Flags = append(mail.Flags, flag)
+		}
+	}
+	mail.Flags = slices.DeleteFunc(mail.Flags, func(flag string) bool {
+		return slices.Contains(req.RemoveFlags, flag)
+	})
+	if mail.Flags == nil {
+		mail.Flags = []string{}
+	}
+
+	if err := h.mailStore.UpdateMail(userId, mailbox.UID, *mail); err != nil {
+		writeError(w, err, mailboxName, mailUID)
+		return
+	}
+
+	data, err := json.Marshal(mail)
+	if err != nil {
+		problems.InternalServerError("Error marshalling mail").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (h *Handler) deleteMail(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string) {
+	mailbox, mail, ok := h.lookupMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return
+	}
+
+	if err := h.mailStore.DeleteMail(userId, mailbox.UID, mail.UID); err != nil {
+		writeError(w, err, mailboxName, mailUID)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleMoveMail(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	mailboxName := r.PathValue("mailbox")
+	mailUID := r.PathValue("mail")
+
+	switch r.Method {
+	case http.MethodPost:
+		h.moveMail(w, r, userId, mailboxName, mailUID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+// moveMail moves the mail into the mailbox of the request. The moved mail
+// gets a new UID and is returned.
+func (h *Handler) moveMail(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string) {
+	var req MoveMailReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if req.Mailbox == "" {
+		problems.ValidationError("mailbox", "Target mailbox must not be empty").WriteToHTTP(w)
+		return
+	}
+
+	mailbox, mail, ok := h.lookupMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return
+	}
+
+	target, err := h.mailStore.GetMailboxByName(userId, req.Mailbox)
+	if err != nil {
+		writeError(w, err, req.Mailbox, "")
+		return
+	}
+
+	moved, err := h.mailStore.MoveMail(userId, mailbox.UID, mail.UID, target.UID)
+	if err != nil {
+		writeError(w, err, mailboxName, mailUID)
+		return
+	}
+
+	data, err := json.Marshal(moved)
+	if err != nil {
+		problems.InternalServerError("Error marshalling mail").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// lookupMail returns the mailbox and mail of the path. If they do not exist,
+// the problem is written and false is returned.
+func (h *Handler) lookupMail(w http.ResponseWriter, userId string, mailboxName string, mailUID string) (*mails.Mailbox, *mails.Mail, bool) {
+	uid, err := strconv.ParseUint(mailUID, 10, 32)
+	if err != nil {
+		problems.ValidationError("Mail UID", "Invalid mail UID").WriteToHTTP(w)
+		return nil, nil, false
+	}
+
+	mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
+	if err != nil {
+		writeError(w, err, mailboxName, mailUID)
+		return nil, nil, false
+	}
+
+	mail, err := h.mailStore.GetMailByUID(userId, mailbox.UID, uint32(uid))
+	if err != nil {
+		writeError(w, err, mailboxName, mailUID)
+		return nil, nil, false
+	}
+
+	return mailbox, mail, true
+}
+
+// writeError writes the problem matching an error of the mail store.
+func writeError(w http.ResponseWriter, err error, mailboxName string, mailUID string) {
+	switch {
+	case errors.Is(err, mails.ErrMailboxNotFound):
+		problems.NotFound("Mailbox", mailboxName).WriteToHTTP(w)
+	case errors.Is(err, mails.ErrMailNotFound):
+		problems.NotFound("Mail", mailUID).WriteToHTTP(w)
+	default:
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) handleSearch(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.search(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+	}
+}
+
+// search returns all mails matching the query parameter q. The optional parameters
+// fields (comma separated, e.g. "subject,from") and mailbox (a mailbox name) narrow the search.
+// Users with zero-access encryption get a conflict, as their mails are not indexed.
+func (h *Handler) search(w http.ResponseWriter, r *http.Request, userId string) {
+	if !h.mailStore.Indexable(userId) {
+		(&problems.Problem{
+			Type:      "Conflict",
+			Title:     "Search is not available",
+			Detail:    "Mails with zero-access encryption are not indexed, so they can not be searched.",
+			Status:    http.StatusConflict,
+			Timestamp: time.Now(),
+		}).WriteToHTTP(w)
+		return
+	}
+
+	fields, err := search.ParseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		problems.ValidationError("fields", "Fields must be any of subject, from, to, body and attachment").WriteToHTTP(w)
+		return
+	}
+
+	query := search.Query{
+		Text:   r.URL.Query().Get("q"),
+		Fields: fields,
+	}
+
+	if mailboxName := r.URL.Query().Get("mailbox"); mailboxName != "" {
+		mailbox, err := h.mailStore.GetMailboxByName(userId, mailboxName)
+		if err != nil {
+			if errors.Is(err, mails.ErrMailboxNotFound) {
+				problems.NotFound("Mailbox", mailboxName).WriteToHTTP(w)
+				return
+			}
+			problems.InternalServerError(err.Error()).WriteToHTTP(w)
+			return
+		}
+		query.MailboxUID = mailbox.UID
+	}
+
+	hits, err := h.searchIndex.Search(userId, query)
+	if err != nil {
+		if errors.Is(err, search.ErrEmptyQuery) {
+			problems.ValidationError("q", "Query must contain at least one word").WriteToHTTP(w)
+			return
+		}
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	result := []mails.Mail{}
+	for _, hit := range hits {
+		mail, err := h.mailStore.GetMailByUID(userId, hit.MailboxUID, hit.UID)
+		if err != nil {
+			if errors.Is(err, mails.ErrMailNotFound) || errors.Is(err, mails.ErrMailboxNotFound) {
+				// Deleted while searching
+				continue
+			}
+			problems.InternalServerError(err.Error()).WriteToHTTP(w)
+			return
+		}
+		result = append(result, *mail)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		problems.InternalServerError("Error marshalling mails").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (h *Handler) handleReindex(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodPost:
+		h.reindex(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) reindex(w http.ResponseWriter, r *http.Request, userId string) {
+	if err := h.mailStore.Reindex(userId); err != nil {
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
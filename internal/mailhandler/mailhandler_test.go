@@ -0,0 +1,470 @@
+package mailhandler_test
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/auth"
+	"github.com/OliverSchlueter/mail-server/internal/compose"
+	"github.com/OliverSchlueter/mail-server/internal/events"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	kdb "github.com/OliverSchlueter/mail-server/internal/keys/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/mailhandler"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+	odb "github.com/OliverSchlueter/mail-server/internal/outbox/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/search"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	udb "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func TestDrafts(t *testing.T) {
+	mux, userID, ms := setup(t)
+
+	// Create
+	w := do(t, mux, http.MethodPost, "/api/drafts/"+userID, map[string]any{
+		"to":      []string{"bob@example.com"},
+		"subject": "Plans",
+		"text":    "first version",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create draft: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var draft mailhandler.DraftResp
+	decode(t, w, &draft)
+	if draft.Version != 1 || draft.Subject != "Plans" || draft.Text != "first version" {
+		t.Fatalf("Create draft: unexpected draft %+v", draft)
+	}
+	path := fmt.Sprintf("/api/drafts/%s/%d", userID, draft.UID)
+
+	// Autosave based on the current version
+	w = do(t, mux, http.MethodPut, path, map[string]any{
+		"to":      []string{"bob@example.com"},
+		"bcc":     []string{"carol@example.com"},
+		"subject": "Plans",
+		"text":    "second version",
+		"version": 1,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Update draft: expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	// A stale autosave must not overwrite the newer version
+	w = do(t, mux, http.MethodPut, path, map[string]any{"text": "stale", "version": 1})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Stale update: expected 409, got %d", w.Code)
+	}
+
+	// Stage an attachment
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("some notes"))
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, path+"/attachments", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.SetBasicAuth("alice", "alice123")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Add attachment: expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	w = do(t, mux, http.MethodGet, path, nil)
+	decode(t, w, &draft)
+	if draft.Version != 3 || draft.Text != "second version" || len(draft.Bcc) != 1 {
+		t.Errorf("Get draft: unexpected draft %+v", draft)
+	}
+	if len(draft.Attachments) != 1 || draft.Attachments[0].Filename != "notes.txt" || draft.Attachments[0].Size != 10 || draft.Attachments[0].ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("Get draft: unexpected attachments %+v", draft.Attachments)
+	}
+
+	// The draft is a regular mail in the drafts mailbox
+	mailbox, err := ms.GetMailboxByName(userID, mails.DraftsMailboxName)
+	if err != nil {
+		t.Fatalf("Drafts mailbox: unexpected error: %v", err)
+	}
+	stored, err := ms.GetMailByUID(userID, mailbox.UID, draft.UID)
+	if err != nil {
+		t.Fatalf("Draft mail: unexpected error: %v", err)
+	}
+	if !stored.HasFlag(`\Draft`) || !stored.HasAttachments {
+		t.Errorf("Draft mail: expected \\Draft flag and attachment, got %+v", stored)
+	}
+
+	w = do(t, mux, http.MethodDelete, path+"/attachments/1", nil)
+	decode(t, w, &draft)
+	if len(draft.Attachments) != 0 {
+		t.Errorf("Remove attachment: expected no attachments, got %+v", draft.Attachments)
+	}
+
+	w = do(t, mux, http.MethodDelete, path, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Delete draft: expected 204, got %d", w.Code)
+	}
+	w = do(t, mux, http.MethodGet, path, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Get deleted draft: expected 404, got %d", w.Code)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ob := outbox.NewService(outbox.Configuration{DB: odb.NewDB()})
+	mux, userID, _ := setup(t, func(cfg *mailhandler.Configuration) {
+		cfg.Outbox = ob
+		cfg.UndoWindow = time.Minute
+	})
+
+	// Every mail is held for the undo window
+	w := do(t, mux, http.MethodPost, "/api/mailboxes/"+userID+"/INBOX/mails", map[string]any{
+		"to":      []string{"bob@example.com"},
+		"subject": "Oops",
+		"text":    "sent too early",
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Create mail: expected 202, got %d: %s", w.Code, w.Body)
+	}
+	var pending outbox.Message
+	decode(t, w, &pending)
+	if pending.ID == "" || pending.Subject != "Oops" || pending.SendAt.Before(time.Now().Add(50*time.Second)) {
+		t.Fatalf("Create mail: unexpected pending mail %+v", pending)
+	}
+
+	// A later send time schedules the mail
+	sendAt := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	w = do(t, mux, http.MethodPost, "/api/mailboxes/"+userID+"/INBOX/mails", map[string]any{
+		"to":      []string{"bob@example.com"},
+		"subject": "Tomorrow",
+		"text":    "scheduled",
+		"send_at": sendAt,
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Schedule mail: expected 202, got %d: %s", w.Code, w.Body)
+	}
+
+	w = do(t, mux, http.MethodGet, "/api/outbox/"+userID, nil)
+	var list []outbox.Message
+	decode(t, w, &list)
+	if len(list) != 2 || list[0].ID != pending.ID || !list[1].SendAt.Equal(sendAt) {
+		t.Fatalf("List outbox: unexpected pending mails %+v", list)
+	}
+
+	path := "/api/outbox/" + userID + "/" + pending.ID
+	w = do(t, mux, http.MethodPatch, path, map[string]any{"send_at": sendAt.Add(time.Hour)})
+	decode(t, w, &pending)
+	if !pending.SendAt.Equal(sendAt.Add(time.Hour)) {
+		t.Errorf("Reschedule: expected send time %v, got %v", sendAt.Add(time.Hour), pending.SendAt)
+	}
+
+	w = do(t, mux, http.MethodDelete, path, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Cancel: expected 204, got %d", w.Code)
+	}
+	w = do(t, mux, http.MethodGet, path, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Get cancelled mail: expected 404, got %d", w.Code)
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	mux, userID, ms := setup(t)
+
+	data := "From bob@example.com Mon May  6 10:00:00 2024\n" +
+		"From: bob@example.com\n" +
+		"Subject: Old news\n" +
+		"Status: RO\n" +
+		"\n" +
+		">From the archive\n" +
+		"\n" +
+		"From carol@example.com Tue May  7 11:30:00 2024\n" +
+		"From: carol@example.com\n" +
+		"Subject: Older news\n" +
+		"\n" +
+		"Hello\n"
+
+	r := httptest.NewRequest(http.MethodPost, "/api/mailboxes/"+userID+"/INBOX/import", strings.NewReader(data))
+	r.Header.Set("Content-Type", "application/mbox")
+	r.SetBasicAuth("alice", "alice123")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Import: expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	inbox, err := ms.GetMailboxByName(userID, "INBOX")
+	if err != nil {
+		t.Fatalf("Get mailbox: unexpected error: %v", err)
+	}
+	page, err := ms.ListMails(userID, inbox.UID, mails.ListOptions{Sort: mails.SortDate})
+	if err != nil {
+		t.Fatalf("List mails: unexpected error: %v", err)
+	}
+	if len(page.Mails) != 2 {
+		t.Fatalf("Expected 2 imported mails, got %d", len(page.Mails))
+	}
+	imported := page.Mails[0]
+	if !imported.Date.Equal(time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)) || !imported.HasFlag(`\Seen`) {
+		t.Errorf("Imported mail: expected original date and \\Seen flag, got %v %v", imported.Date, imported.Flags)
+	}
+
+	w = do(t, mux, http.MethodGet, fmt.Sprintf("/api/mailboxes/%s/INBOX/mails/%d/raw", userID, imported.UID), nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "message/rfc822" {
+		t.Fatalf("Raw: expected 200 with message/rfc822, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if want := "From: bob@example.com\r\nSubject: Old news\r\nStatus: RO\r\n\r\nFrom the archive\r\n"; w.Body.String() != want {
+		t.Errorf("Raw: expected %q, got %q", want, w.Body)
+	}
+
+	// Messages without headers are rejected, and nothing is imported
+	w = do(t, mux, http.MethodPost, "/api/mailboxes/"+userID+"/INBOX/import", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Empty import: expected 400, got %d", w.Code)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	mux, userID, _ := setup(t)
+
+	raw, err := compose.Message{
+		From:    "bob@example.com",
+		To:      []string{"alice@example.com"},
+		Subject: "Reports",
+		Text:    "See attached",
+		Attachments: []compose.Attachment{
+			{Filename: "report.pdf", Data: []byte("%PDF-1.4 first")},
+			{Filename: "report.pdf", Data: []byte("%PDF-1.4 second")},
+		},
+	}.Build()
+	if err != nil {
+		t.Fatalf("Build: unexpected error: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/mailboxes/"+userID+"/INBOX/import", bytes.NewReader(raw))
+	r.Header.Set("Content-Type", "message/rfc822")
+	r.SetBasicAuth("alice", "alice123")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Import: expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	w = do(t, mux, http.MethodGet, "/api/mailboxes/"+userID+"/INBOX/mails?view=summary", nil)
+	var page mailhandler.MailSummaryPage
+	decode(t, w, &page)
+	if len(page.Mails) != 1 {
+		t.Fatalf("List mails: expected 1 mail, got %d", len(page.Mails))
+	}
+	path := fmt.Sprintf("/api/mailboxes/%s/INBOX/mails/%d/attachments", userID, page.Mails[0].UID)
+
+	w = do(t, mux, http.MethodGet, path, nil)
+	var attachments []mailhandler.AttachmentResp
+	decode(t, w, &attachments)
+	if len(attachments) != 2 || attachments[0].ContentType != "application/pdf" || attachments[0].Size != 14 {
+		t.Fatalf("List attachments: unexpected attachments %+v", attachments)
+	}
+
+	w = do(t, mux, http.MethodGet, path+"/"+attachments[1].ID, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "%PDF-1.4 second" {
+		t.Errorf("Get attachment: expected decoded content, got %d %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != "attachment; filename=report.pdf" {
+		t.Errorf("Get attachment: unexpected Content-Disposition %q", got)
+	}
+
+	w = do(t, mux, http.MethodGet, path+"/9", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Get missing attachment: expected 404, got %d", w.Code)
+	}
+
+	w = do(t, mux, http.MethodGet, path+"/zip", nil)
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Zip: unexpected error: %v", err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "report.pdf" || zr.File[1].Name != "report (2).pdf" {
+		t.Errorf("Zip: unexpected files %v", zr.File)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	bus := events.NewBus(events.Configuration{})
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB(), Events: bus})
+	mux, userID, _ := setup(t, func(cfg *mailhandler.Configuration) {
+		cfg.MailStore = *ms
+		cfg.Events = bus
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	stream := func(lastEventID string) (*bufio.Reader, func()) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/api/events/"+userID, nil)
+		if err != nil {
+			t.Fatalf("New request: %v", err)
+		}
+		req.SetBasicAuth("alice", "alice123")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Stream: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("Stream: expected event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	// next returns the ID and type of the next event
+	next := func(r *bufio.Reader) (string, string) {
+		var id, event string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Read event: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && event != "":
+				return id, event
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			}
+		}
+	}
+
+	r, stop := stream("")
+	do(t, mux, http.MethodPost, "/api/mailboxes/"+userID+"/Work", nil)
+	id, event := next(r)
+	if event != "mailbox_created" {
+		t.Fatalf("Expected mailbox_created, got %q", event)
+	}
+	stop()
+
+	// Resume after the last received event
+	do(t, mux, http.MethodPatch, "/api/mailboxes/"+userID+"/Work", map[string]any{"name": "Projects"})
+	r, stop = stream(id)
+	if _, event := next(r); event != "mailbox_updated" {
+		t.Errorf("Expected missed mailbox_updated to be replayed, got %q", event)
+	}
+	stop()
+
+	r, stop = stream("999")
+	if _, event := next(r); event != "reset" {
+		t.Errorf("Expected reset for unknown event ID, got %q", event)
+	}
+	stop()
+}
+
+func TestSearchZeroAccess(t *testing.T) {
+	si, err := search.NewIndex(search.Configuration{})
+	if err != nil {
+		t.Fatalf("New index: unexpected error: %v", err)
+	}
+	ms := mails.NewStore(mails.Configuration{
+		DB:      mdb.NewDB(),
+		Keys:    keys.NewStore(keys.Configuration{DB: kdb.NewDB()}),
+		Indexer: si,
+	})
+	mux, userID, _ := setup(t, func(cfg *mailhandler.Configuration) {
+		cfg.MailStore = *ms
+		cfg.SearchIndex = si
+	})
+
+	mail := mails.Mail{UID: 1, Headers: map[string]string{"Subject": "Quarterly report"}, Body: "Numbers attached"}
+	if err := ms.CreateMail(userID, mails.DefaultMailboxUID, mail); err != nil {
+		t.Fatalf("Create mail: unexpected error: %v", err)
+	}
+
+	w := do(t, mux, http.MethodGet, "/api/search/"+userID+"?q=report", nil)
+	var found []mails.Mail
+	decode(t, w, &found)
+	if w.Code != http.StatusOK || len(found) != 1 {
+		t.Fatalf("Search: expected the mail, got %d: %s", w.Code, w.Body)
+	}
+
+	// Mails with zero-access encryption are not indexed, so they can not be searched
+	if err := ms.EnableZeroAccess(userID, "alice123"); err != nil {
+		t.Fatalf("Enable zero-access: unexpected error: %v", err)
+	}
+	if w := do(t, mux, http.MethodGet, "/api/search/"+userID+"?q=report", nil); w.Code != http.StatusConflict {
+		t.Errorf("Search: expected 409 for zero-access user, got %d: %s", w.Code, w.Body)
+	}
+}
+
+// setup registers the handler for the user alice. The configure functions may
+// change the configuration before the handler is created.
+func setup(t *testing.T, configure ...func(*mailhandler.Configuration)) (*http.ServeMux, string, *mails.Store) {
+	t.Helper()
+
+	us := users.NewStore(users.Configuration{DB: udb.NewDB()})
+	err := us.Create(users.User{
+		Name:         "alice",
+		Password:     "alice123",
+		PrimaryEmail: "alice@example.com",
+		Emails:       []string{"alice@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Create user: unexpected error: %v", err)
+	}
+	alice, err := us.GetByName("alice")
+	if err != nil {
+		t.Fatalf("Get user: unexpected error: %v", err)
+	}
+
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+
+	cfg := mailhandler.Configuration{
+		MailStore: *ms,
+		UserStore: *us,
+		Auth:      auth.NewService(auth.Configuration{Users: *us}),
+	}
+	for _, c := range configure {
+		c(&cfg)
+	}
+
+	mux := http.NewServeMux()
+	mailhandler.New(cfg).Register("/api", mux)
+
+	return mux, alice.ID, ms
+}
+
+func do(t *testing.T, mux *http.ServeMux, method string, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatalf("Marshal request: %v", err)
+		}
+	}
+
+	r := httptest.NewRequest(method, path, bytes.NewReader(data))
+	r.SetBasicAuth("alice", "alice123")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("Decode response %d: %v: %s", w.Code, err, w.Body)
+	}
+}
@@ -1,7 +1,206 @@
 package mailhandler
 
+import (
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/compose"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+)
+
 type CreateMailReq struct {
+	To          []string        `json:"to"`
+	Cc          []string        `json:"cc"`
+	Bcc         []string        `json:"bcc"`
+	ReplyTo     []string        `json:"reply_to"`
+	Subject     string          `json:"subject"`
+	Text        string          `json:"text"`
+	HTML        string          `json:"html"`
+	Attachments []AttachmentReq `json:"attachments"`
+	// SendAt schedules the mail instead of sending it right away. It is held
+	// in the outbox until then and can be rescheduled or cancelled.
+	SendAt *time.Time `json:"send_at"`
+
+	// Body is the HTML body.
+	//
+	// Deprecated: use HTML, Body is only used if HTML is empty.
+	Body string `json:"body"`
+}
+
+type AttachmentReq struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id"` // set for inline images, referenced as "cid:<content_id>" in the HTML
+	Content     []byte `json:"content"`    // base64 encoded in JSON
+}
+
+// message returns the message to send from the given address.
+func (req CreateMailReq) message(from string) compose.Message {
+	msg := compose.Message{
+		From:    from,
+		To:      req.To,
+		Cc:      req.Cc,
+		Bcc:     req.Bcc,
+		ReplyTo: req.ReplyTo,
+		Subject: req.Subject,
+		Text:    req.Text,
+		HTML:    req.HTML,
+	}
+	if msg.HTML == "" {
+		msg.HTML = req.Body
+	}
+
+	msg.Attachments = attachments(req.Attachments)
+	return msg
+}
+
+func attachments(reqs []AttachmentReq) []compose.Attachment {
+	var list []compose.Attachment
+	for _, a := range reqs {
+		list = append(list, compose.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			ContentID:   a.ContentID,
+			Data:        a.Content,
+		})
+	}
+	return list
+}
+
+// MailSummaryPage is a page of the mail listing without bodies.
+type MailSummaryPage struct {
+	Mails      []mails.MailSummary `json:"mails"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+type ReplyReq struct {
+	Text        string          `json:"text"`
+	HTML        string          `json:"html"`
+	Cc          []string        `json:"cc"` // in addition to the recipients of the reply
+	Bcc         []string        `json:"bcc"`
+	Attachments []AttachmentReq `json:"attachments"`
+	SentMailbox string          `json:"sent_mailbox"` // defaults to mails.SentMailboxName
+}
+
+type ForwardReq struct {
+	To           []string        `json:"to"`
+	Cc           []string        `json:"cc"`
+	Bcc          []string        `json:"bcc"`
+	Text         string          `json:"text"`
+	HTML         string          `json:"html"`
+	Attachments  []AttachmentReq `json:"attachments"`
+	AsAttachment bool            `json:"as_attachment"` // attach the original as message/rfc822 instead of including it
+	SentMailbox  string          `json:"sent_mailbox"`  // defaults to mails.SentMailboxName
+}
+
+type CreateMailboxReq struct {
+	Flags []string `json:"flags"`
+}
+
+// UpdateMailboxReq only changes the fields that are set.
+type UpdateMailboxReq struct {
+	Name  *string   `json:"name"`
+	Flags *[]string `json:"flags"`
+}
+
+// UpdateMailReq replaces the flags if Flags is set, then adds and removes the given flags.
+type UpdateMailReq struct {
+	Flags       *[]string `json:"flags"`
+	AddFlags    []string  `json:"add_flags"`
+	RemoveFlags []string  `json:"remove_flags"`
+}
+
+type MoveMailReq struct {
+	Mailbox string `json:"mailbox"` // name of the target mailbox
+}
+
+type DraftReq struct {
 	To      []string `json:"to"`
+	Cc      []string `json:"cc"`
+	Bcc     []string `json:"bcc"`
+	ReplyTo []string `json:"reply_to"`
 	Subject string   `json:"subject"`
-	Body    string   `json:"body"`
+	Text    string   `json:"text"`
+	HTML    string   `json:"html"`
+	// Version is the version of the draft the changes are based on. Updates of
+	// a draft that was changed in the meantime are rejected.
+	Version int `json:"version"`
+}
+
+type SendDraftReq struct {
+	Version     int    `json:"version"`      // optional, the version that is expected to be sent
+	SentMailbox string `json:"sent_mailbox"` // defaults to mails.SentMailboxName
+}
+
+type DraftResp struct {
+	UID         uint32            `json:"uid"`
+	Version     int               `json:"version"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	To          []string          `json:"to"`
+	Cc          []string          `json:"cc"`
+	Bcc         []string          `json:"bcc"`
+	ReplyTo     []string          `json:"reply_to"`
+	Subject     string            `json:"subject"`
+	Text        string            `json:"text"`
+	HTML        string            `json:"html"`
+	Attachments []DraftAttachment `json:"attachments"`
+}
+
+type DraftAttachment struct {
+	ID          string `json:"id"` // position of the attachment in the draft, starting at 1
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int    `json:"size"`
+}
+
+type RescheduleReq struct {
+	SendAt *time.Time `json:"send_at"` // a time in the past sends the mail right away
+}
+
+type ImportResp struct {
+	Imported int `json:"imported"` // number of messages stored in the mailbox
+}
+
+type AttachmentResp struct {
+	ID          string `json:"id"` // MIME part specifier, e.g. "2" or "1.2"
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Disposition string `json:"disposition"`
+	Size        int    `json:"size"` // decoded size in bytes
+}
+
+// VacationReq replaces the automatic reply of a user.
+type VacationReq struct {
+	Enabled bool       `json:"enabled"`
+	Subject string     `json:"subject"` // defaults to "Auto: " and the subject of the mail
+	Body    string     `json:"body"`
+	Start   *time.Time `json:"start"` // optional, replies are sent immediately if not set
+	End     *time.Time `json:"end"`   // optional, replies are sent until disabled if not set
+	Days    int        `json:"days"`  // days before the same sender gets another reply, defaults to vacation.DefaultDays
+}
+
+type VacationResp struct {
+	Enabled   bool       `json:"enabled"`
+	Active    bool       `json:"active"` // whether incoming mail is replied to right now
+	Subject   string     `json:"subject"`
+	Body      string     `json:"body"`
+	Start     *time.Time `json:"start,omitempty"`
+	End       *time.Time `json:"end,omitempty"`
+	Days      int        `json:"days"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// SieveScriptReq creates or replaces a Sieve script of a user.
+type SieveScriptReq struct {
+	Content string `json:"content"`
+	Active  bool   `json:"active"` // whether the script is run for incoming mail, only one script is active
+}
+
+type SieveScriptResp struct {
+	Name      string    `json:"name"`
+	Content   string    `json:"content"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -0,0 +1,48 @@
+package mailhandler
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/goutils/sloki"
+)
+
+// openAPISpec documents all endpoints, including the optional ones. It is
+// checked against the handler by the tests.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPI returns the OpenAPI document for the endpoints registered with the prefix.
+func OpenAPI(prefix string) ([]byte, error) {
+	var spec map[string]any
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, err
+	}
+	spec["servers"] = []map[string]string{{"url": prefix}}
+	return json.MarshalIndent(spec, "", "  ")
+}
+
+func (h *Handler) handleOpenAPI(prefix string) http.HandlerFunc {
+	spec, err := OpenAPI(prefix)
+	if err != nil {
+		slog.Error("Failed to load OpenAPI document", sloki.WrapError(err))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+			return
+		}
+		if spec == nil {
+			problems.InternalServerError("OpenAPI document is not available").WriteToHTTP(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}
+}
@@ -0,0 +1,442 @@
+package mailhandler_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/compose"
+	"github.com/OliverSchlueter/mail-server/internal/events"
+	"github.com/OliverSchlueter/mail-server/internal/mailhandler"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+	odb "github.com/OliverSchlueter/mail-server/internal/outbox/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/search"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	sdb "github.com/OliverSchlueter/mail-server/internal/sieve/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+	vdb "github.com/OliverSchlueter/mail-server/internal/vacation/database/fake"
+)
+
+var methods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// TestOpenAPIRoutes checks that the document lists exactly the routes of
+// Handler.Register and the methods each of them accepts.
+func TestOpenAPIRoutes(t *testing.T) {
+	spec := loadSpec(t)
+	paths := spec["paths"].(map[string]any)
+
+	registered := registeredRoutes(t)
+	for _, route := range registered {
+		if _, ok := paths[route]; !ok {
+			t.Errorf("Route %s is not documented", route)
+		}
+	}
+	for path := range paths {
+		if !slices.Contains(registered, path) {
+			t.Errorf("Documented path %s is not registered", path)
+		}
+	}
+
+	mux, userID, _ := setupFull(t)
+
+	// Requests are cancelled, so streaming endpoints return right away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for path, item := range paths {
+		documented := item.(map[string]any)
+		url := "/api" + strings.ReplaceAll(path, "{user_id}", userID)
+		url = strings.NewReplacer("{mailbox}", "INBOX", "{mail}", "1", "{draft}", "1", "{part}", "1", "{attachment}", "1", "{id}", "1").Replace(url)
+
+		for _, method := range methods {
+			r := httptest.NewRequest(method, url, nil).WithContext(ctx)
+			r.SetBasicAuth("alice", "alice123")
+
+			if _, pattern := mux.Handler(r); pattern != "/api"+path {
+				t.Errorf("%s %s: matched route %q", method, path, pattern)
+				continue
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			_, ok := documented[strings.ToLower(method)]
+			if ok && w.Code == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: documented but not allowed", method, path)
+			}
+			if !ok && w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: allowed with %d but not documented", method, path, w.Code)
+			}
+		}
+	}
+}
+
+// TestOpenAPIResponses checks the responses of the handler against the documented schemas.
+func TestOpenAPIResponses(t *testing.T) {
+	spec := loadSpec(t)
+	mux, userID, _ := setupFull(t)
+	base := "/api/mailboxes/" + userID
+
+	call := func(method string, path string, body any, status int) *httptest.ResponseRecorder {
+		t.Helper()
+		w := do(t, mux, method, path, body)
+		if w.Code != status {
+			t.Fatalf("%s %s: expected %d, got %d: %s", method, path, status, w.Code, w.Body)
+		}
+		checkResponse(t, spec, mux, method, path, w)
+		return w
+	}
+
+	call(http.MethodGet, "/api/openapi.json", nil, http.StatusOK)
+
+	// Mailboxes
+	call(http.MethodPost, base+"/Work", map[string]any{"flags": []string{}}, http.StatusCreated)
+	call(http.MethodGet, base+"/", nil, http.StatusOK)
+	call(http.MethodGet, base+"/Work", nil, http.StatusOK)
+	call(http.MethodPatch, base+"/Work", map[string]any{"name": "Projects"}, http.StatusOK)
+	call(http.MethodGet, base+"/Missing", nil, http.StatusNotFound)
+	call(http.MethodPost, base+"/Projects", nil, http.StatusConflict)
+
+	// Mails
+	raw, err := compose.Message{
+		From:        "bob@example.com",
+		To:          []string{"alice@example.com"},
+		Subject:     "Report",
+		Text:        "See attached",
+		Attachments: []compose.Attachment{{Filename: "report.pdf", Data: []byte("%PDF-1.4")}},
+	}.Build()
+	if err != nil {
+		t.Fatalf("Build: unexpected error: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, base+"/INBOX/import", bytes.NewReader(raw))
+	r.Header.Set("Content-Type", "message/rfc822")
+	r.SetBasicAuth("alice", "alice123")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Import: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	checkResponse(t, spec, mux, http.MethodPost, base+"/INBOX/import", w)
+
+	var page mailhandler.MailSummaryPage
+	decode(t, call(http.MethodGet, base+"/INBOX/mails", nil, http.StatusOK), &page)
+	call(http.MethodGet, base+"/INBOX/mails?view=full&limit=1", nil, http.StatusOK)
+	call(http.MethodGet, base+"/INBOX/mails?sort=nonsense", nil, http.StatusBadRequest)
+
+	mail := fmt.Sprintf("%s/INBOX/mails/%d", base, page.Mails[0].UID)
+	call(http.MethodGet, mail, nil, http.StatusOK)
+	call(http.MethodPatch, mail, map[string]any{"add_flags": []string{`\Seen`}}, http.StatusOK)
+	call(http.MethodGet, mail+"/attachments", nil, http.StatusOK)
+	call(http.MethodGet, mail+"/attachments/2", nil, http.StatusOK)
+	call(http.MethodGet, mail+"/attachments/zip", nil, http.StatusOK)
+	call(http.MethodGet, mail+"/raw", nil, http.StatusOK)
+
+	var moved struct {
+		UID uint32 `json:"uid"`
+	}
+	decode(t, call(http.MethodPost, mail+"/move", map[string]any{"mailbox": "Projects"}, http.StatusOK), &moved)
+	call(http.MethodGet, mail, nil, http.StatusNotFound)
+
+	// Search
+	call(http.MethodGet, "/api/search/"+userID+"?q=report", nil, http.StatusOK)
+	call(http.MethodPost, "/api/search/"+userID+"/reindex", nil, http.StatusNoContent)
+
+	// Drafts
+	var draft mailhandler.DraftResp
+	decode(t, call(http.MethodPost, "/api/drafts/"+userID, map[string]any{"subject": "Plans"}, http.StatusCreated), &draft)
+	path := fmt.Sprintf("/api/drafts/%s/%d", userID, draft.UID)
+	call(http.MethodGet, "/api/drafts/"+userID, nil, http.StatusOK)
+	call(http.MethodGet, path, nil, http.StatusOK)
+	call(http.MethodPut, path, map[string]any{"text": "more", "version": 1}, http.StatusOK)
+	call(http.MethodPut, path, map[string]any{"text": "stale", "version": 1}, http.StatusConflict)
+	call(http.MethodPost, path+"/attachments", map[string]any{"filename": "notes.txt", "content": []byte("notes")}, http.StatusCreated)
+	call(http.MethodDelete, path+"/attachments/1", nil, http.StatusOK)
+	call(http.MethodDelete, path, nil, http.StatusNoContent)
+
+	// Forwarding
+	call(http.MethodPut, "/api/forwarding/"+userID, map[string]any{"addresses": []string{"alice@example.org"}, "keep_copy": true}, http.StatusOK)
+	call(http.MethodGet, "/api/forwarding/"+userID, nil, http.StatusOK)
+	call(http.MethodPut, "/api/forwarding/"+userID, map[string]any{"addresses": []string{"alice"}}, http.StatusBadRequest)
+	call(http.MethodPut, "/api/forwarding/"+userID, map[string]any{"addresses": []string{}}, http.StatusOK)
+
+	// Vacation
+	call(http.MethodGet, "/api/vacation/"+userID, nil, http.StatusNotFound)
+	call(http.MethodPut, "/api/vacation/"+userID, map[string]any{"enabled": true, "body": "I am away.", "end": time.Now().Add(time.Hour)}, http.StatusOK)
+	call(http.MethodGet, "/api/vacation/"+userID, nil, http.StatusOK)
+	call(http.MethodPut, "/api/vacation/"+userID, map[string]any{"enabled": true, "body": "I am away.", "days": -1}, http.StatusBadRequest)
+	call(http.MethodDelete, "/api/vacation/"+userID, nil, http.StatusNoContent)
+
+	// Sieve
+	call(http.MethodGet, "/api/sieve/"+userID+"/filters", nil, http.StatusNotFound)
+	call(http.MethodPut, "/api/sieve/"+userID+"/filters", map[string]any{"content": `require "fileinto"; fileinto "Archive";`, "active": true}, http.StatusOK)
+	call(http.MethodPut, "/api/sieve/"+userID+"/filters", map[string]any{"content": "fileinto \"Archive\";"}, http.StatusBadRequest)
+	call(http.MethodGet, "/api/sieve/"+userID+"/filters", nil, http.StatusOK)
+	call(http.MethodGet, "/api/sieve/"+userID, nil, http.StatusOK)
+	call(http.MethodDelete, "/api/sieve/"+userID+"/filters", nil, http.StatusNoContent)
+
+	// Outbox
+	var pending outbox.Message
+	decode(t, call(http.MethodPost, base+"/INBOX/mails", map[string]any{
+		"to":      []string{"bob@example.com"},
+		"text":    "later",
+		"send_at": time.Now().Add(time.Hour),
+	}, http.StatusAccepted), &pending)
+	call(http.MethodGet, "/api/outbox/"+userID, nil, http.StatusOK)
+	call(http.MethodGet, "/api/outbox/"+userID+"/"+pending.ID, nil, http.StatusOK)
+	call(http.MethodPatch, "/api/outbox/"+userID+"/"+pending.ID, map[string]any{"send_at": time.Now().Add(2 * time.Hour)}, http.StatusOK)
+	call(http.MethodDelete, "/api/outbox/"+userID+"/"+pending.ID, nil, http.StatusNoContent)
+	call(http.MethodGet, "/api/outbox/"+userID+"/"+pending.ID, nil, http.StatusNotFound)
+
+	// Cleanup
+	call(http.MethodDelete, fmt.Sprintf("%s/Projects/mails/%d", base, moved.UID), nil, http.StatusNoContent)
+	call(http.MethodDelete, base+"/Projects", nil, http.StatusNoContent)
+}
+
+// setupFull registers the handler with all optional endpoints enabled.
+func setupFull(t *testing.T) (*http.ServeMux, string, *mails.Store) {
+	t.Helper()
+
+	si, err := search.NewIndex(search.Configuration{})
+	if err != nil {
+		t.Fatalf("New index: unexpected error: %v", err)
+	}
+
+	return setup(t, func(cfg *mailhandler.Configuration) {
+		cfg.Outbox = outbox.NewService(outbox.Configuration{DB: odb.NewDB(), Mails: cfg.MailStore})
+		cfg.Events = events.NewBus(events.Configuration{})
+		cfg.SearchIndex = si
+		cfg.Vacation = vacation.NewService(vacation.Configuration{DB: vdb.NewDB()})
+		cfg.Sieve = sieve.NewStore(sieve.Configuration{DB: sdb.NewDB()})
+	})
+}
+
+func loadSpec(t *testing.T) map[string]any {
+	t.Helper()
+
+	data, err := mailhandler.OpenAPI("/api")
+	if err != nil {
+		t.Fatalf("OpenAPI: unexpected error: %v", err)
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("OpenAPI: invalid document: %v", err)
+	}
+	return spec
+}
+
+// registeredRoutes returns the paths passed to mux.HandleFunc in Handler.Register.
+func registeredRoutes(t *testing.T) []string {
+	t.Helper()
+
+	f, err := parser.ParseFile(token.NewFileSet(), "mailhandler.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	var routes []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "HandleFunc" {
+			return true
+		}
+		bin, ok := call.Args[0].(*ast.BinaryExpr)
+		if !ok {
+			return true
+		}
+		if lit, ok := bin.Y.(*ast.BasicLit); ok {
+			route, _ := strconv.Unquote(lit.Value)
+			routes = append(routes, route)
+		}
+		return true
+	})
+
+	if len(routes) == 0 {
+		t.Fatalf("No routes found in Handler.Register")
+	}
+	return routes
+}
+
+// checkResponse validates the status, content type and JSON body of the
+// response against the documented operation.
+func checkResponse(t *testing.T, spec map[string]any, mux *http.ServeMux, method string, path string, w *httptest.ResponseRecorder) {
+	t.Helper()
+
+	_, pattern := mux.Handler(httptest.NewRequest(method, path, nil))
+	item, ok := spec["paths"].(map[string]any)[strings.TrimPrefix(pattern, "/api")].(map[string]any)
+	if !ok {
+		t.Errorf("%s %s: path %q is not documented", method, path, pattern)
+		return
+	}
+	operation, ok := item[strings.ToLower(method)].(map[string]any)
+	if !ok {
+		t.Errorf("%s %s: operation is not documented", method, path)
+		return
+	}
+
+	responses := operation["responses"].(map[string]any)
+	response, ok := responses[strconv.Itoa(w.Code)]
+	if !ok && w.Code >= 400 {
+		response, ok = responses["default"]
+	}
+	if !ok {
+		t.Errorf("%s %s: status %d is not documented", method, path, w.Code)
+		return
+	}
+	resp := resolve(spec, response)
+
+	content, _ := resp["content"].(map[string]any)
+	if len(content) == 0 {
+		if w.Body.Len() > 0 {
+			t.Errorf("%s %s: expected no content, got %q", method, path, w.Body)
+		}
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	media, ok := content[mediaType].(map[string]any)
+	if !ok {
+		media, ok = content["*/*"].(map[string]any)
+	}
+	if !ok {
+		t.Errorf("%s %s: content type %q is not documented", method, path, mediaType)
+		return
+	}
+	if !strings.HasSuffix(mediaType, "json") {
+		return
+	}
+
+	var body any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Errorf("%s %s: invalid JSON: %v", method, path, err)
+		return
+	}
+	for _, err := range validate(spec, media["schema"], body, "body") {
+		t.Errorf("%s %s: %s", method, path, err)
+	}
+}
+
+// validate returns the violations of the value against the schema. Unlike
+// plain JSON Schema, objects must not have properties that are not documented.
+func validate(spec map[string]any, schemaRef any, value any, at string) []string {
+	schema := resolve(spec, schemaRef)
+
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		matches := 0
+		for _, s := range oneOf {
+			if len(validate(spec, s, value, at)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return []string{fmt.Sprintf("%s: matches %d of the oneOf schemas", at, matches)}
+		}
+		return nil
+	}
+
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); !nullable {
+			return []string{at + ": is null"}
+		}
+		return nil
+	}
+
+	var errs []string
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return []string{at + ": expected object"}
+		}
+		for _, name := range asStrings(schema["required"]) {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, at+": missing required property "+name)
+			}
+		}
+		properties, hasProperties := schema["properties"].(map[string]any)
+		for name, v := range obj {
+			if prop, ok := properties[name]; ok {
+				errs = append(errs, validate(spec, prop, v, at+"."+name)...)
+			} else if additional, ok := schema["additionalProperties"].(map[string]any); ok {
+				errs = append(errs, validate(spec, additional, v, at+"."+name)...)
+			} else if hasProperties {
+				errs = append(errs, at+": undocumented property "+name)
+			}
+		}
+	case "array":
+		list, ok := value.([]any)
+		if !ok {
+			return []string{at + ": expected array"}
+		}
+		for i, v := range list {
+			errs = append(errs, validate(spec, schema["items"], v, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return []string{at + ": expected string"}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				errs = append(errs, at+": invalid date-time "+s)
+			}
+		}
+		if enum := asStrings(schema["enum"]); len(enum) > 0 && !slices.Contains(enum, s) {
+			errs = append(errs, at+": "+s+" is not one of "+strings.Join(enum, ", "))
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return []string{at + ": expected integer"}
+		}
+		if minimum, ok := schema["minimum"].(float64); ok && n < minimum {
+			errs = append(errs, fmt.Sprintf("%s: %v is less than %v", at, n, minimum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{at + ": expected boolean"}
+		}
+	}
+	return errs
+}
+
+// resolve follows the $ref of the object, if it has one.
+func resolve(spec map[string]any, v any) map[string]any {
+	obj, _ := v.(map[string]any)
+	ref, ok := obj["$ref"].(string)
+	if !ok {
+		return obj
+	}
+
+	var current any = spec
+	for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		current = current.(map[string]any)[key]
+	}
+	return resolve(spec, current)
+}
+
+func asStrings(v any) []string {
+	var list []string
+	values, _ := v.([]any)
+	for _, s := range values {
+		list = append(list, s.(string))
+	}
+	return list
+}
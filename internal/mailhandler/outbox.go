@@ -0,0 +1,127 @@
+package mailhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+)
+
+func (h *Handler) handleOutbox(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getOutbox(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getOutbox(w http.ResponseWriter, r *http.Request, userId string) {
+	pending, err := h.outbox.List(userId)
+	if err != nil {
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	data, err := json.Marshal(pending)
+	if err != nil {
+		problems.InternalServerError("Error marshalling outbox").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (h *Handler) handlePending(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getPending(w, r, userId, id)
+	case http.MethodPatch:
+		h.reschedulePending(w, r, userId, id)
+	case http.MethodDelete:
+		h.cancelPending(w, r, userId, id)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPatch, http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getPending(w http.ResponseWriter, r *http.Request, userId string, id string) {
+	pending, err := h.outbox.Get(userId, id)
+	if err != nil {
+		writeOutboxError(w, err, id)
+		return
+	}
+
+	writePending(w, http.StatusOK, pending)
+}
+
+func (h *Handler) reschedulePending(w http.ResponseWriter, r *http.Request, userId string, id string) {
+	var req RescheduleReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if req.SendAt == nil {
+		problems.ValidationError("send_at", "Send time is required").WriteToHTTP(w)
+		return
+	}
+
+	pending, err := h.outbox.Reschedule(userId, id, *req.SendAt)
+	if err != nil {
+		writeOutboxError(w, err, id)
+		return
+	}
+
+	writePending(w, http.StatusOK, pending)
+}
+
+func (h *Handler) cancelPending(w http.ResponseWriter, r *http.Request, userId string, id string) {
+	if err := h.outbox.Cancel(userId, id); err != nil {
+		writeOutboxError(w, err, id)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writePending(w http.ResponseWriter, status int, pending *outbox.Message) {
+	data, err := json.Marshal(pending)
+	if err != nil {
+		problems.InternalServerError("Error marshalling pending mail").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeOutboxError writes the problem for an outbox error. Mails that were
+// already sent are no longer in the outbox, so they are not found.
+func writeOutboxError(w http.ResponseWriter, err error, id string) {
+	if errors.Is(err, outbox.ErrMessageNotFound) {
+		problems.NotFound("Pending mail", id).WriteToHTTP(w)
+		return
+	}
+	if errors.Is(err, outbox.ErrMessageClaimed) {
+		(&problems.Problem{
+			Type:      "Conflict",
+			Title:     "Mail is being sent",
+			Detail:    "The mail is being sent and can no longer be changed or cancelled.",
+			Status:    http.StatusConflict,
+			Timestamp: time.Now(),
+		}).WriteToHTTP(w)
+		return
+	}
+	problems.InternalServerError(err.Error()).WriteToHTTP(w)
+}
@@ -0,0 +1,205 @@
+package mailhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/compose"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+func (h *Handler) handleReply(all bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := r.PathValue("user_id")
+		mailboxName := r.PathValue("mailbox")
+		mailUID := r.PathValue("mail")
+
+		switch r.Method {
+		case http.MethodPost:
+			h.reply(w, r, userId, mailboxName, mailUID, all)
+		default:
+			problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+		}
+	}
+}
+
+// reply sends a reply to the mail and marks it as answered.
+func (h *Handler) reply(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string, all bool) {
+	var req ReplyReq
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCreateMailSize)).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	user, ok := h.lookupUser(w, userId)
+	if !ok {
+		return
+	}
+
+	mailbox, original, ok := h.lookupMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return
+	}
+
+	msg, err := compose.Reply(*original, user.PrimaryEmail, ownAddresses(user), all)
+	if err != nil {
+		problems.InternalServerError("Failed to parse the original mail: " + err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	msg.Cc = append(msg.Cc, req.Cc...)
+	msg.Bcc = req.Bcc
+	msg.Attachments = attachments(req.Attachments)
+	msg.Text, msg.HTML = withOriginal(req.Text, req.HTML, msg.Text)
+
+	sent, err := h.sentMailbox(userId, req.SentMailbox)
+	if err != nil {
+		writeError(w, err, req.SentMailbox, "")
+		return
+	}
+
+	if !h.sendMessage(w, userId, msg, sent) {
+		return
+	}
+
+	h.addFlag(userId, mailbox.UID, *original, `\Answered`)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) handleForward(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	mailboxName := r.PathValue("mailbox")
+	mailUID := r.PathValue("mail")
+
+	switch r.Method {
+	case http.MethodPost:
+		h.forward(w, r, userId, mailboxName, mailUID)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodPost}).WriteToHTTP(w)
+	}
+}
+
+// forward forwards the mail to new recipients and marks it as forwarded.
+func (h *Handler) forward(w http.ResponseWriter, r *http.Request, userId string, mailboxName string, mailUID string) {
+	var req ForwardReq
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCreateMailSize)).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	user, ok := h.lookupUser(w, userId)
+	if !ok {
+		return
+	}
+
+	mailbox, original, ok := h.lookupMail(w, userId, mailboxName, mailUID)
+	if !ok {
+		return
+	}
+
+	msg, err := compose.Forward(*original, user.PrimaryEmail, req.AsAttachment)
+	if err != nil {
+		problems.InternalServerError("Failed to parse the original mail: " + err.Error()).WriteToHTTP(w)
+		return
+	}
+
+	msg.To = req.To
+	msg.Cc = req.Cc
+	msg.Bcc = req.Bcc
+	msg.Attachments = append(attachments(req.Attachments), msg.Attachments...)
+	msg.Text, msg.HTML = withOriginal(req.Text, req.HTML, msg.Text)
+
+	sent, err := h.sentMailbox(userId, req.SentMailbox)
+	if err != nil {
+		writeError(w, err, req.SentMailbox, "")
+		return
+	}
+
+	if !h.sendMessage(w, userId, msg, sent) {
+		return
+	}
+
+	h.addFlag(userId, mailbox.UID, *original, "$Forwarded")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// withOriginal appends the quoted or forwarded original to the text and, if
+// set, the HTML written by the user.
+func withOriginal(text string, htmlBody string, original string) (string, string) {
+	if text == "" && htmlBody != "" {
+		text = strings.TrimSpace(message.StripHTML(htmlBody))
+	}
+	text += original
+
+	if htmlBody != "" {
+		escaped := strings.ReplaceAll(html.EscapeString(strings.TrimSpace(original)), "\n", "<br>\n")
+		htmlBody += "<br>\n<blockquote>" + escaped + "</blockquote>"
+	}
+	return text, htmlBody
+}
+
+// sentMailbox returns the mailbox for the copy of a sent mail. The default
+// mailbox for sent mails is created if it does not exist yet.
+func (h *Handler) sentMailbox(userId string, name string) (*mails.Mailbox, error) {
+	if name == "" || name == mails.SentMailboxName {
+		return h.specialMailbox(userId, mails.SentMailboxName, `\Sent`)
+	}
+	return h.mailStore.GetMailboxByName(userId, name)
+}
+
+// specialMailbox returns the mailbox with the special-use flag (RFC 6154) and
+// creates it if it does not exist yet.
+func (h *Handler) specialMailbox(userId string, name string, flag string) (*mails.Mailbox, error) {
+	mailbox, err := h.mailStore.GetMailboxByName(userId, name)
+	if !errors.Is(err, mails.ErrMailboxNotFound) {
+		return mailbox, err
+	}
+
+	err = h.mailStore.CreateMailbox(mails.Mailbox{UserID: userId, Name: name, Flags: []string{flag}})
+	if err != nil && !errors.Is(err, mails.ErrMailboxAlreadyExists) {
+		return nil, err
+	}
+	return h.mailStore.GetMailboxByName(userId, name)
+}
+
+// addFlag adds the flag to the mail. Failures are only logged, as the mail
+// was already sent.
+func (h *Handler) addFlag(userId string, mailboxUID uint32, mail mails.Mail, flag string) {
+	if slices.Contains(mail.Flags, flag) {
+		return
+	}
+
+	mail.Flags = append(mail.Flags, flag)
+	if err := h.mailStore.UpdateMail(userId, mailboxUID, mail); err != nil {
+		slog.Warn("Failed to flag mail", slog.String("user_id", userId), slog.String("flag", flag), sloki.WrapError(err))
+	}
+}
+
+// lookupUser returns the user. If it does not exist, the problem is written
+// and false is returned.
+func (h *Handler) lookupUser(w http.ResponseWriter, userId string) (*users.User, bool) {
+	user, err := h.userStore.GetByID(userId)
+	if err != nil {
+		if errors.Is(err, users.ErrUserNotFound) {
+			problems.NotFound("User", userId).WriteToHTTP(w)
+			return nil, false
+		}
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+		return nil, false
+	}
+	return user, true
+}
+
+// ownAddresses returns all addresses of the user, which are never replied to.
+func ownAddresses(user *users.User) []string {
+	return append([]string{user.PrimaryEmail}, user.Emails...)
+}
@@ -0,0 +1,148 @@
+package mailhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+)
+
+func (h *Handler) handleSieveScripts(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	if r.Method != http.MethodGet {
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet}).WriteToHTTP(w)
+		return
+	}
+
+	scripts, err := h.sieve.List(userId)
+	if err != nil {
+		writeSieveError(w, err, "")
+		return
+	}
+
+	resp := make([]SieveScriptResp, 0, len(scripts))
+	for _, s := range scripts {
+		resp = append(resp, sieveScriptResp(&s))
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		problems.InternalServerError("Error marshalling sieve scripts").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (h *Handler) handleSieveScript(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+	name := r.PathValue("name")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getSieveScript(w, r, userId, name)
+	case http.MethodPut:
+		h.putSieveScript(w, r, userId, name)
+	case http.MethodDelete:
+		h.removeSieveScript(w, r, userId, name)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPut, http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getSieveScript(w http.ResponseWriter, r *http.Request, userId, name string) {
+	script, err := h.sieve.Get(userId, name)
+	if err != nil {
+		writeSieveError(w, err, name)
+		return
+	}
+
+	writeSieveScript(w, script)
+}
+
+// putSieveScript creates or replaces the script. It becomes the active script
+// of the user if requested, and stops being active if it was and is not
+// requested to be anymore.
+func (h *Handler) putSieveScript(w http.ResponseWriter, r *http.Request, userId, name string) {
+	var req SieveScriptReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if _, ok := h.lookupUser(w, userId); !ok {
+		return
+	}
+
+	script, err := h.sieve.Put(userId, name, req.Content)
+	if err != nil {
+		writeSieveError(w, err, name)
+		return
+	}
+
+	if req.Active != script.Active {
+		activate := ""
+		if req.Active {
+			activate = name
+		}
+		if err := h.sieve.Activate(userId, activate); err != nil {
+			writeSieveError(w, err, name)
+			return
+		}
+		script.Active = req.Active
+	}
+
+	writeSieveScript(w, script)
+}
+
+func (h *Handler) removeSieveScript(w http.ResponseWriter, r *http.Request, userId, name string) {
+	if err := h.sieve.Remove(userId, name); err != nil {
+		writeSieveError(w, err, name)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sieveScriptResp(s *sieve.UserScript) SieveScriptResp {
+	return SieveScriptResp{
+		Name:      s.Name,
+		Content:   s.Content,
+		Active:    s.Active,
+		CreatedAt: s.CreatedAt,
+		UpdatedAt: s.UpdatedAt,
+	}
+}
+
+func writeSieveScript(w http.ResponseWriter, s *sieve.UserScript) {
+	data, err := json.Marshal(sieveScriptResp(s))
+	if err != nil {
+		problems.InternalServerError("Error marshalling sieve script").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func writeSieveError(w http.ResponseWriter, err error, name string) {
+	switch {
+	case errors.Is(err, sieve.ErrScriptNotFound):
+		problems.NotFound("Sieve script", name).WriteToHTTP(w)
+	case errors.Is(err, sieve.ErrInvalidName):
+		problems.ValidationError("name", fmt.Sprintf("Name must be 1 to %d characters without slashes or control characters", sieve.MaxNameLength)).WriteToHTTP(w)
+	case errors.Is(err, sieve.ErrInvalidScript):
+		problems.ValidationError("content", err.Error()).WriteToHTTP(w)
+	case errors.Is(err, sieve.ErrScriptTooLarge):
+		problems.ValidationError("content", fmt.Sprintf("Script must not exceed %d bytes", sieve.MaxScriptSize)).WriteToHTTP(w)
+	case errors.Is(err, sieve.ErrTooManyScripts):
+		problems.ValidationError("name", fmt.Sprintf("Users can have at most %d scripts", sieve.MaxScripts)).WriteToHTTP(w)
+	default:
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
+}
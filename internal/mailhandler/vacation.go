@@ -0,0 +1,125 @@
+package mailhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/problems"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+)
+
+func (h *Handler) handleVacation(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getVacation(w, r, userId)
+	case http.MethodPut:
+		h.setVacation(w, r, userId)
+	case http.MethodDelete:
+		h.removeVacation(w, r, userId)
+	default:
+		problems.MethodNotAllowed(r.Method, []string{http.MethodGet, http.MethodPut, http.MethodDelete}).WriteToHTTP(w)
+	}
+}
+
+func (h *Handler) getVacation(w http.ResponseWriter, r *http.Request, userId string) {
+	responder, err := h.vacation.Get(userId)
+	if err != nil {
+		writeVacationError(w, err, userId)
+		return
+	}
+
+	writeVacation(w, responder)
+}
+
+// setVacation replaces the automatic reply of the user. Senders that already
+// got a reply get the new one.
+func (h *Handler) setVacation(w http.ResponseWriter, r *http.Request, userId string) {
+	var req VacationReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		problems.CouldNotDecodeBody().WriteToHTTP(w)
+		return
+	}
+
+	if _, ok := h.lookupUser(w, userId); !ok {
+		return
+	}
+
+	responder := vacation.Responder{
+		UserID:  userId,
+		Enabled: req.Enabled,
+		Subject: req.Subject,
+		Body:    req.Body,
+		Days:    req.Days,
+	}
+	if req.Start != nil {
+		responder.Start = *req.Start
+	}
+	if req.End != nil {
+		responder.End = *req.End
+	}
+
+	saved, err := h.vacation.Set(responder)
+	if err != nil {
+		writeVacationError(w, err, userId)
+		return
+	}
+
+	writeVacation(w, saved)
+}
+
+func (h *Handler) removeVacation(w http.ResponseWriter, r *http.Request, userId string) {
+	if err := h.vacation.Remove(userId); err != nil {
+		writeVacationError(w, err, userId)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeVacation(w http.ResponseWriter, r *vacation.Responder) {
+	resp := VacationResp{
+		Enabled:   r.Enabled,
+		Active:    r.IsActive(time.Now()),
+		Subject:   r.Subject,
+		Body:      r.Body,
+		Days:      r.Days,
+		UpdatedAt: r.UpdatedAt,
+	}
+	if !r.Start.IsZero() {
+		resp.Start = &r.Start
+	}
+	if !r.End.IsZero() {
+		resp.End = &r.End
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		problems.InternalServerError("Error marshalling vacation").WriteToHTTP(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func writeVacationError(w http.ResponseWriter, err error, userId string) {
+	switch {
+	case errors.Is(err, vacation.ErrResponderNotFound):
+		problems.NotFound("Vacation", userId).WriteToHTTP(w)
+	case errors.Is(err, vacation.ErrInvalidSubject):
+		problems.ValidationError("subject", "Subject must be a single line").WriteToHTTP(w)
+	case errors.Is(err, vacation.ErrEmptyBody):
+		problems.ValidationError("body", "Body is required").WriteToHTTP(w)
+	case errors.Is(err, vacation.ErrInvalidDays):
+		problems.ValidationError("days", fmt.Sprintf("Days must be between 1 and %d", vacation.MaxDays)).WriteToHTTP(w)
+	case errors.Is(err, vacation.ErrInvalidDateRange):
+		problems.ValidationError("end", "End must not be before start").WriteToHTTP(w)
+	default:
+		problems.InternalServerError(err.Error()).WriteToHTTP(w)
+	}
+}
@@ -2,36 +2,55 @@ package fake
 
 import (
 	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"maps"
+	"slices"
 	"sync"
 )
 
 type DB struct {
 	Mailboxes []mails.Mailbox
-	Mails     []mails.Mail
+	Mails     map[string][]mails.Mail // user ID -> mails of all mailboxes of that user
 	mu        sync.Mutex
+
+	mailboxUIDNext map[string]uint32            // user ID -> next mailbox UID
+	mailUIDNext    map[string]map[uint32]uint32 // user ID -> mailbox UID -> next mail UID
 }
 
 func NewDB() *DB {
 	return &DB{
-		Mailboxes: []mails.Mailbox{},
-		Mails:     []mails.Mail{},
-		mu:        sync.Mutex{},
+		Mailboxes:      []mails.Mailbox{},
+		Mails:          make(map[string][]mails.Mail),
+		mu:             sync.Mutex{},
+		mailboxUIDNext: make(map[string]uint32),
+		mailUIDNext:    make(map[string]map[uint32]uint32),
 	}
 }
 
 func (db *DB) GetMailboxes(userID string) ([]mails.Mailbox, error) {
-	var userMailboxes []mails.Mailbox
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	userMailboxes := []mails.Mailbox{}
 	for _, mailbox := range db.Mailboxes {
 		if mailbox.UserID == userID {
-			userMailboxes = append(userMailboxes, mailbox)
+			userMailboxes = append(userMailboxes, cloneMailbox(mailbox))
 		}
 	}
 	return userMailboxes, nil
 }
 
 func (db *DB) GetMailboxByUID(userID string, uid uint32) (*mails.Mailbox, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.getMailboxByUID(userID, uid)
+}
+
+// getMailboxByUID expects the caller to hold db.mu.
+func (db *DB) getMailboxByUID(userID string, uid uint32) (*mails.Mailbox, error) {
 	for _, mailbox := range db.Mailboxes {
 		if mailbox.UserID == userID && mailbox.UID == uid {
+			mailbox = cloneMailbox(mailbox)
 			return &mailbox, nil
 		}
 	}
@@ -39,8 +58,12 @@ func (db *DB) GetMailboxByUID(userID string, uid uint32) (*mails.Mailbox, error)
 }
 
 func (db *DB) GetMailboxByName(userID string, name string) (*mails.Mailbox, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	for _, mailbox := range db.Mailboxes {
 		if mailbox.UserID == userID && mailbox.Name == name {
+			mailbox = cloneMailbox(mailbox)
 			return &mailbox, nil
 		}
 	}
@@ -53,17 +76,27 @@ func (db *DB) InsertMailbox(mailbox mails.Mailbox) error {
 
 	// Check if mailbox already exists
 	for _, existing := range db.Mailboxes {
-		if existing.UserID == mailbox.UserID && existing.Name == mailbox.Name {
+		if existing.UserID != mailbox.UserID {
+			continue
+		}
+		if existing.Name == mailbox.Name || (mailbox.UID != 0 && existing.UID == mailbox.UID) {
 			return mails.ErrMailboxAlreadyExists
 		}
 	}
 
-	// Assign a new UID if not set
+	// Assign a new UID if not set, UIDs are never reused
+	next := db.mailboxUIDNext[mailbox.UserID]
+	if next == 0 {
+		next = 1
+	}
 	if mailbox.UID == 0 {
-		mailbox.UID = uint32(len(db.Mailboxes) + 1)
+		mailbox.UID = next
+	}
+	if mailbox.UID >= next {
+		db.mailboxUIDNext[mailbox.UserID] = mailbox.UID + 1
 	}
 
-	db.Mailboxes = append(db.Mailboxes, mailbox)
+	db.Mailboxes = append(db.Mailboxes, cloneMailbox(mailbox))
 	return nil
 }
 
@@ -71,9 +104,33 @@ func (db *DB) UpdateMailbox(mailbox mails.Mailbox) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	index := -1
+	for i, existing := range db.Mailboxes {
+		if existing.UserID != mailbox.UserID {
+			continue
+		}
+		if existing.UID == mailbox.UID {
+			index = i
+		} else if existing.Name == mailbox.Name {
+			return mails.ErrMailboxAlreadyExists
+		}
+	}
+	if index < 0 {
+		return mails.ErrMailboxNotFound
+	}
+
+	mailbox.Size = db.Mailboxes[index].Size
+	db.Mailboxes[index] = cloneMailbox(mailbox)
+	return nil
+}
+
+func (db *DB) AddMailboxSize(userID string, uid uint32, delta int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	for i, existing := range db.Mailboxes {
-		if existing.UserID == mailbox.UserID && existing.UID == mailbox.UID {
-			db.Mailboxes[i] = mailbox
+		if existing.UserID == userID && existing.UID == uid {
+			db.Mailboxes[i].Size += delta
 			return nil
 		}
 	}
@@ -87,6 +144,15 @@ func (db *DB) DeleteMailbox(userID string, uid uint32) error {
 	for i, mailbox := range db.Mailboxes {
 		if mailbox.UserID == userID && mailbox.UID == uid {
 			db.Mailboxes = append(db.Mailboxes[:i], db.Mailboxes[i+1:]...)
+
+			// Delete all mails of the mailbox
+			var remaining []mails.Mail
+			for _, mail := range db.Mails[userID] {
+				if mail.MailboxUID != uid {
+					remaining = append(remaining, mail)
+				}
+			}
+			db.Mails[userID] = remaining
 			return nil
 		}
 	}
@@ -94,23 +160,83 @@ func (db *DB) DeleteMailbox(userID string, uid uint32) error {
 }
 
 func (db *DB) GetMails(userID string, mailboxUID uint32) ([]mails.Mail, error) {
-	var userMails []mails.Mail
-	for _, mail := range db.Mails {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, err := db.getMailboxByUID(userID, mailboxUID); err != nil {
+		return nil, err
+	}
+
+	userMails := []mails.Mail{}
+	for _, mail := range db.Mails[userID] {
 		if mail.MailboxUID == mailboxUID {
-			userMails = append(userMails, mail)
+			userMails = append(userMails, cloneMail(mail))
 		}
 	}
 	return userMails, nil
 }
 
+func (db *DB) ListMails(userID string, mailboxUID uint32, opts mails.ListOptions) (*mails.MailPage, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, err := db.getMailboxByUID(userID, mailboxUID); err != nil {
+		return nil, err
+	}
+
+	compare := func(a, b mails.Mail) int {
+		if opts.Descending {
+			return mails.CompareMails(b, a, opts.Sort)
+		}
+		return mails.CompareMails(a, b, opts.Sort)
+	}
+
+	var after *mails.Mail
+	if opts.Cursor != "" {
+		m, err := mails.DecodeCursor(opts)
+		if err != nil {
+			return nil, err
+		}
+		after = &m
+	}
+
+	matching := []mails.Mail{}
+	for _, mail := range db.Mails[userID] {
+		if mail.MailboxUID != mailboxUID || !opts.Filter.Matches(mail) {
+			continue
+		}
+		if after != nil && compare(mail, *after) <= 0 {
+			continue
+		}
+
+		mail = cloneMail(mail)
+		if !opts.WithBody {
+			mail.Body = ""
+		}
+		matching = append(matching, mail)
+	}
+	slices.SortFunc(matching, compare)
+
+	page := &mails.MailPage{Mails: matching}
+	if len(matching) > opts.Limit {
+		page.Mails = matching[:opts.Limit]
+		page.NextCursor = mails.EncodeCursor(page.Mails[opts.Limit-1], opts)
+	}
+	return page, nil
+}
+
 func (db *DB) GetMailByUID(userID string, mailboxUID uint32, uid uint32) (*mails.Mail, error) {
-	mb, err := db.GetMailboxByUID(userID, mailboxUID)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	mb, err := db.getMailboxByUID(userID, mailboxUID)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, mail := range db.Mails {
+	for _, mail := range db.Mails[userID] {
 		if mail.MailboxUID == mb.UID && mail.UID == uid {
+			mail = cloneMail(mail)
 			return &mail, nil
 		}
 	}
@@ -118,45 +244,57 @@ func (db *DB) GetMailByUID(userID string, mailboxUID uint32, uid uint32) (*mails
 	return nil, mails.ErrMailNotFound
 }
 
-func (db *DB) InsertMail(userID string, mailboxUID uint32, mail mails.Mail) error {
+func (db *DB) InsertMail(userID string, mailboxUID uint32, mail mails.Mail) (uint32, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	// Check if mailbox exists
-	mb, err := db.GetMailboxByUID(userID, mailboxUID)
+	mb, err := db.getMailboxByUID(userID, mailboxUID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Check if mail already exists
-	for _, existing := range db.Mails {
+	for _, existing := range db.Mails[userID] {
 		if existing.MailboxUID == mb.UID && existing.UID == mail.UID {
-			return mails.ErrMailAlreadyExists
+			return 0, mails.ErrMailAlreadyExists
 		}
 	}
 
-	// Assign a new UID if not set
+	// Assign a new UID if not set, UIDs are never reused within a mailbox
+	if db.mailUIDNext[userID] == nil {
+		db.mailUIDNext[userID] = make(map[uint32]uint32)
+	}
+	next := db.mailUIDNext[userID][mb.UID]
+	if next == 0 {
+		next = 1
+	}
 	if mail.UID == 0 {
-		mail.UID = uint32(len(db.Mails) + 1)
+		mail.UID = next
+	}
+	if mail.UID >= next {
+		db.mailUIDNext[userID][mb.UID] = mail.UID + 1
 	}
 
 	mail.MailboxUID = mb.UID
-	db.Mails = append(db.Mails, mail)
-	return nil
+	db.Mails[userID] = append(db.Mails[userID], cloneMail(mail))
+	return mail.UID, nil
 }
 
 func (db *DB) UpdateMail(userID string, mailboxUID uint32, mail mails.Mail) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	mb, err := db.GetMailboxByUID(userID, mailboxUID)
+	mb, err := db.getMailboxByUID(userID, mailboxUID)
 	if err != nil {
 		return err
 	}
 
-	for i, existing := range db.Mails {
+	userMails := db.Mails[userID]
+	for i, existing := range userMails {
 		if existing.MailboxUID == mb.UID && existing.UID == mail.UID {
-			db.Mails[i] = mail
+			mail.MailboxUID = mb.UID
+			userMails[i] = cloneMail(mail)
 			return nil
 		}
 	}
@@ -167,16 +305,30 @@ func (db *DB) DeleteMail(userID string, mailboxUID uint32, uid uint32) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	mb, err := db.GetMailboxByUID(userID, mailboxUID)
+	mb, err := db.getMailboxByUID(userID, mailboxUID)
 	if err != nil {
 		return err
 	}
 
-	for i, mail := range db.Mails {
+	userMails := db.Mails[userID]
+	for i, mail := range userMails {
 		if mail.MailboxUID == mb.UID && mail.UID == uid {
-			db.Mails = append(db.Mails[:i], db.Mails[i+1:]...)
+			db.Mails[userID] = append(userMails[:i], userMails[i+1:]...)
 			return nil
 		}
 	}
 	return mails.ErrMailNotFound
 }
+
+// cloneMailbox returns a copy of the mailbox that does not share any slices with mb.
+func cloneMailbox(mb mails.Mailbox) mails.Mailbox {
+	mb.Flags = slices.Clone(mb.Flags)
+	return mb
+}
+
+// cloneMail returns a copy of the mail that does not share any slices or maps with m.
+func cloneMail(m mails.Mail) mails.Mail {
+	m.Flags = slices.Clone(m.Flags)
+	m.Headers = maps.Clone(m.Headers)
+	return m
+}
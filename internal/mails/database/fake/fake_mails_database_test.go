@@ -0,0 +1,14 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/mails/mailstest"
+)
+
+func TestDB(t *testing.T) {
+	mailstest.RunDBSuite(t, func() mails.DB {
+		return NewDB()
+	})
+}
@@ -7,4 +7,6 @@ var (
 	ErrMailboxAlreadyExists = errors.New("mailbox already exists")
 	ErrMailNotFound         = errors.New("mail not found")
 	ErrMailAlreadyExists    = errors.New("mail already exists")
+	ErrInvalidSort          = errors.New("invalid sort field")
+	ErrInvalidCursor        = errors.New("invalid cursor")
 )
@@ -0,0 +1,265 @@
+package mails
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+type SortField string
+
+const (
+	SortDate    SortField = "date"
+	SortSize    SortField = "size"
+	SortFrom    SortField = "from"
+	SortSubject SortField = "subject"
+)
+
+var SortFields = []SortField{SortDate, SortSize, SortFrom, SortSubject}
+
+// ListOptions selects a page of the mails of a mailbox.
+type ListOptions struct {
+	Sort       SortField // defaults to SortDate
+	Descending bool
+	Limit      int    // defaults to DefaultListLimit, at most MaxListLimit
+	Cursor     string // NextCursor of the previous page, empty for the first page
+	Filter     Filter
+	// WithBody loads the bodies of the mails. Without it, backends may skip
+	// reading them, which is enough for a summary.
+	WithBody bool
+}
+
+// Filter restricts the listed mails. Zero values do not restrict anything.
+type Filter struct {
+	Unread         bool      // only mails without the \Seen flag
+	Flagged        bool      // only mails with the \Flagged flag
+	HasAttachments bool      // only mails with attachments
+	Since          time.Time // only mails received at or after this time
+	Before         time.Time // only mails received before this time
+	From           string    // case-insensitive substring of the From header
+	To             string    // case-insensitive substring of the To or Cc header
+}
+
+type MailPage struct {
+	Mails      []Mail `json:"mails"`
+	NextCursor string `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+// MailSummary is a mail without its body and raw headers.
+type MailSummary struct {
+	UID            uint32    `json:"uid"`
+	MailboxUID     uint32    `json:"mailbox_uid"`
+	Flags          []string  `json:"flags"`
+	Date           time.Time `json:"date"`
+	Size           int       `json:"size"`
+	From           string    `json:"from"`
+	To             string    `json:"to"`
+	Subject        string    `json:"subject"`
+	HasAttachments bool      `json:"has_attachments"`
+}
+
+// Summary returns the summary of the mail.
+func (m Mail) Summary() MailSummary {
+	flags := m.Flags
+	if flags == nil {
+		flags = []string{}
+	}
+
+	return MailSummary{
+		UID:            m.UID,
+		MailboxUID:     m.MailboxUID,
+		Flags:          flags,
+		Date:           m.Date,
+		Size:           m.Size,
+		From:           m.Header("From"),
+		To:             m.Header("To"),
+		Subject:        m.Header("Subject"),
+		HasAttachments: m.HasAttachments,
+	}
+}
+
+// Header returns the value of the header, ignoring the case of its name.
+func (m Mail) Header(name string) string {
+	if v, ok := m.Headers[name]; ok {
+		return v
+	}
+	for k, v := range m.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// HasFlag reports whether the mail has the flag.
+func (m Mail) HasFlag(flag string) bool {
+	for _, f := range m.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize applies the defaults to the options.
+func (o ListOptions) Normalize() ListOptions {
+	if o.Sort == "" {
+		o.Sort = SortDate
+	}
+	if o.Limit <= 0 {
+		o.Limit = DefaultListLimit
+	}
+	if o.Limit > MaxListLimit {
+		o.Limit = MaxListLimit
+	}
+	return o
+}
+
+// Validate checks the sort field and the cursor of normalized options.
+func (o ListOptions) Validate() error {
+	valid := false
+	for _, f := range SortFields {
+		if o.Sort == f {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrInvalidSort
+	}
+
+	if o.Cursor != "" {
+		if _, err := DecodeCursor(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the mail passes the filter.
+func (f Filter) Matches(m Mail) bool {
+	if f.Unread && m.HasFlag(`\Seen`) {
+		return false
+	}
+	if f.Flagged && !m.HasFlag(`\Flagged`) {
+		return false
+	}
+	if f.HasAttachments && !m.HasAttachments {
+		return false
+	}
+	if !f.Since.IsZero() && m.Date.Before(f.Since) {
+		return false
+	}
+	if !f.Before.IsZero() && !m.Date.Before(f.Before) {
+		return false
+	}
+	if f.From != "" && !containsFold(m.Header("From"), f.From) {
+		return false
+	}
+	if f.To != "" && !containsFold(m.Header("To"), f.To) && !containsFold(m.Header("Cc"), f.To) {
+		return false
+	}
+	return true
+}
+
+// CompareMails orders the mails by the sort field in ascending order. Mails
+// with the same value are ordered by UID, so the order is stable across pages.
+func CompareMails(a, b Mail, sort SortField) int {
+	var c int
+	switch sort {
+	case SortSize:
+		c = cmp.Compare(a.Size, b.Size)
+	case SortFrom:
+		c = strings.Compare(strings.ToLower(a.Header("From")), strings.ToLower(b.Header("From")))
+	case SortSubject:
+		c = strings.Compare(strings.ToLower(a.Header("Subject")), strings.ToLower(b.Header("Subject")))
+	default:
+		c = a.Date.Compare(b.Date)
+	}
+
+	if c != 0 {
+		return c
+	}
+	return cmp.Compare(a.UID, b.UID)
+}
+
+// cursor is the position after the last mail of a page.
+type cursor struct {
+	Sort       SortField `json:"s"`
+	Descending bool      `json:"d,omitempty"`
+	UID        uint32    `json:"u"`
+	Date       time.Time `json:"t,omitempty"`
+	Size       int       `json:"n,omitempty"`
+	Text       string    `json:"x,omitempty"`
+}
+
+// EncodeCursor returns the cursor pointing after the mail, for listings with the options.
+func EncodeCursor(m Mail, opts ListOptions) string {
+	c := cursor{
+		Sort:       opts.Sort,
+		Descending: opts.Descending,
+		UID:        m.UID,
+	}
+	switch opts.Sort {
+	case SortSize:
+		c.Size = m.Size
+	case SortFrom:
+		c.Text = m.Header("From")
+	case SortSubject:
+		c.Text = m.Header("Subject")
+	default:
+		c.Date = m.Date
+	}
+
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor returns a mail with the sort key of the cursor of the options,
+// to be compared to other mails with CompareMails. Cursors are only valid for
+// the sort order they were created with.
+func DecodeCursor(opts ListOptions) (Mail, error) {
+	data, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return Mail{}, ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Mail{}, ErrInvalidCursor
+	}
+	if c.Sort != opts.Sort || c.Descending != opts.Descending {
+		return Mail{}, ErrInvalidCursor
+	}
+
+	m := Mail{UID: c.UID, Date: c.Date, Size: c.Size}
+	switch c.Sort {
+	case SortFrom:
+		m.Headers = map[string]string{"From": c.Text}
+	case SortSubject:
+		m.Headers = map[string]string{"Subject": c.Text}
+	}
+	return m, nil
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// hasAttachments guesses from the headers and the body whether the mail has
+// attachments, without parsing its MIME structure.
+func hasAttachments(m Mail) bool {
+	if strings.HasPrefix(strings.ToLower(m.Header("Content-Type")), "multipart/mixed") {
+		return true
+	}
+
+	body := strings.ToLower(m.Body)
+	return strings.Contains(body, "content-disposition: attachment") ||
+		strings.Contains(body, "content-type: multipart/mixed")
+}
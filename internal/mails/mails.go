@@ -1,8 +1,15 @@
 package mails
 
 import (
+	"encoding/base64"
 	"errors"
+	"log/slog"
 	"math/rand"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/blobs"
+	"github.com/OliverSchlueter/mail-server/internal/events"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
 )
 
 type DB interface {
@@ -10,27 +17,63 @@ type DB interface {
 	GetMailboxByUID(userID string, uid uint32) (*Mailbox, error)
 	GetMailboxByName(userID string, name string) (*Mailbox, error)
 	InsertMailbox(mailbox Mailbox) error
+	// UpdateMailbox updates the mailbox, but must leave its Size untouched.
 	UpdateMailbox(mailbox Mailbox) error
 	DeleteMailbox(userID string, uid uint32) error
+	// AddMailboxSize atomically adds delta (which may be negative) to the size of the mailbox.
+	AddMailboxSize(userID string, uid uint32, delta int64) error
 
 	GetMails(userID string, mailboxUID uint32) ([]Mail, error)
+	// ListMails returns a page of the mails in the mailbox matching the filter of
+	// the normalized options, in their sort order. Bodies may be left empty unless
+	// WithBody is set. ErrInvalidCursor is returned if the cursor can not be decoded.
+	ListMails(userID string, mailboxUID uint32, opts ListOptions) (*MailPage, error)
 	GetMailByUID(userID string, mailboxUID uint32, uid uint32) (*Mail, error)
-	InsertMail(userID string, mailboxUID uint32, mail Mail) error
+	// InsertMail inserts the mail and returns its UID, which is assigned if the mail has none.
+	InsertMail(userID string, mailboxUID uint32, mail Mail) (uint32, error)
 	UpdateMail(userID string, mailboxUID uint32, mail Mail) error
 	DeleteMail(userID string, mailboxUID uint32, uid uint32) error
 }
 
+// Indexer is notified about every change to the content of mails, e.g. to
+// maintain a search index.
+type Indexer interface {
+	Index(userID string, mail Mail) error
+	Remove(userID string, mailboxUID uint32, uid uint32) error
+	RemoveMailbox(userID string, mailboxUID uint32) error
+	Clear(userID string) error
+}
+
 type Store struct {
-	db DB
+	db      DB
+	blobs   *blobs.Store
+	keys    *keys.Store
+	indexer Indexer
+	events  *events.Bus
 }
 
 type Configuration struct {
-	DB DB
+	DB    DB
+	Blobs *blobs.Store // optional, mail bodies are kept in the DB if not set
+	// Keys is optional, mail bodies are encrypted at rest if set. Encrypted bodies
+	// differ per recipient, so they are not deduplicated by the blob store.
+	// Only the body is encrypted: the parsed headers like Subject, From and To,
+	// the flags, date and size are stored in plaintext, so mailboxes can be
+	// listed and sorted without the key of the user.
+	Keys *keys.Store
+	// Indexer is optional. Mail of users with zero-access encryption is never
+	// passed to it, as the server can always read the index.
+	Indexer Indexer
+	Events  *events.Bus // optional, receives every change to mailboxes and mails
 }
 
 func NewStore(cfg Configuration) *Store {
 	return &Store{
-		db: cfg.DB,
+		db:      cfg.DB,
+		blobs:   cfg.Blobs,
+		keys:    cfg.Keys,
+		indexer: cfg.Indexer,
+		events:  cfg.Events,
 	}
 }
 
@@ -85,42 +128,534 @@ func (s *Store) GetMailboxByName(userID string, name string) (*Mailbox, error) {
 }
 
 func (s *Store) CreateMailbox(mailbox Mailbox) error {
-	return s.db.InsertMailbox(mailbox)
+	// Create the default mailbox first, otherwise the new mailbox could be assigned its UID
+	if mailbox.Name != DefaultMailboxName {
+		if _, err := s.GetMailboxByUID(mailbox.UserID, DefaultMailboxUID); err != nil {
+			return err
+		}
+	}
+
+	if err := s.db.InsertMailbox(mailbox); err != nil {
+		return err
+	}
+
+	if s.events != nil {
+		if created, err := s.db.GetMailboxByName(mailbox.UserID, mailbox.Name); err == nil {
+			s.publish(events.Event{UserID: created.UserID, Type: events.MailboxCreated, MailboxUID: created.UID, Mailbox: created.Name, Flags: created.Flags})
+		}
+	}
+	return nil
 }
 
 func (s *Store) UpdateMailbox(mailbox Mailbox) error {
-	return s.db.UpdateMailbox(mailbox)
+	existing, err := s.db.GetMailboxByUID(mailbox.UserID, mailbox.UID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.UpdateMailbox(mailbox); err != nil {
+		return err
+	}
+
+	e := events.Event{UserID: mailbox.UserID, Type: events.MailboxUpdated, MailboxUID: mailbox.UID, Mailbox: mailbox.Name, Flags: mailbox.Flags}
+	if existing.Name != mailbox.Name {
+		e.OldName = existing.Name
+	}
+	s.publish(e)
+	return nil
 }
 
 func (s *Store) DeleteMailbox(userID string, uid uint32) error {
-	return s.db.DeleteMailbox(userID, uid)
+	// Remember the blobs of the mails in the mailbox, so they can be released afterward
+	ms, err := s.db.GetMails(userID, uid)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.DeleteMailbox(userID, uid); err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		s.releaseBody(m)
+	}
+
+	if s.indexer != nil {
+		if err := s.indexer.RemoveMailbox(userID, uid); err != nil {
+			slog.Warn("Failed to remove mailbox from index", slog.String("user_id", userID), sloki.WrapError(err))
+		}
+	}
+
+	s.publish(events.Event{UserID: userID, Type: events.MailboxDeleted, MailboxUID: uid})
+	return nil
+}
+
+// DeleteMailboxes deletes all mailboxes of the user with their mails, e.g.
+// when the user is deleted.
+func (s *Store) DeleteMailboxes(userID string) error {
+	mailboxes, err := s.db.GetMailboxes(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, mb := range mailboxes {
+		if err := s.DeleteMailbox(userID, mb.UID); err != nil && !errors.Is(err, ErrMailboxNotFound) {
+			return err
+		}
+	}
+
+	if s.indexer != nil {
+		if err := s.indexer.Clear(userID); err != nil {
+			slog.Warn("Failed to clear index", slog.String("user_id", userID), sloki.WrapError(err))
+		}
+	}
+	return nil
 }
 
 func (s *Store) GetMails(userID string, mailboxUID uint32) ([]Mail, error) {
-	return s.db.GetMails(userID, mailboxUID)
+	ms, err := s.db.GetMails(userID, mailboxUID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ms {
+		if err := s.loadBody(userID, &ms[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return ms, nil
+}
+
+// ListMails returns a page of the mails in the mailbox, see ListOptions.
+func (s *Store) ListMails(userID string, mailboxUID uint32, opts ListOptions) (*MailPage, error) {
+	opts = opts.Normalize()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	page, err := s.db.ListMails(userID, mailboxUID, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.WithBody {
+		for i := range page.Mails {
+			if err := s.loadBody(userID, &page.Mails[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return page, nil
 }
 
 func (s *Store) GetMailByUID(userID string, mailboxUID uint32, uid uint32) (*Mail, error) {
-	return s.db.GetMailByUID(userID, mailboxUID, uid)
+	m, err := s.db.GetMailByUID(userID, mailboxUID, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.loadBody(userID, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
 }
 
 func (s *Store) CreateMail(userID string, mailboxUID uint32, mail Mail) error {
+	_, err := s.createMail(userID, mailboxUID, mail)
+	return err
+}
+
+// MoveMail moves the mail into another mailbox of the user, where it gets a
+// new UID. The moved mail is returned.
+func (s *Store) MoveMail(userID string, mailboxUID uint32, uid uint32, targetMailboxUID uint32) (*Mail, error) {
+	m, err := s.GetMailByUID(userID, mailboxUID, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	if mailboxUID == targetMailboxUID {
+		return m, nil
+	}
+
+	moved := *m
+	moved.UID = 0
+	moved.MailboxUID = targetMailboxUID
+	moved.BlobID = ""
+	moved.KeyVersion = 0
+
+	newUID, err := s.createMail(userID, targetMailboxUID, moved)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.DeleteMail(userID, mailboxUID, uid); err != nil {
+		// Do not leave a copy behind
+		if err := s.DeleteMail(userID, targetMailboxUID, newUID); err != nil {
+			slog.Error("Failed to roll back move of mail", slog.String("user_id", userID), sloki.WrapError(err))
+		}
+		return nil, err
+	}
+
+	moved.UID = newUID
+	return &moved, nil
+}
+
+// createMail creates the mail and returns its UID.
+func (s *Store) createMail(userID string, mailboxUID uint32, mail Mail) (uint32, error) {
 	_, err := s.GetMailboxByUID(userID, mailboxUID)
 	if err != nil {
-		return ErrMailboxNotFound
+		return 0, ErrMailboxNotFound
+	}
+
+	if mail.Size == 0 {
+		mail.Size = len(mail.Body)
 	}
+	mail.HasAttachments = hasAttachments(mail)
 
-	return s.db.InsertMail(userID, mailboxUID, mail)
+	plain := mail
+	if err := s.storeBody(userID, &mail); err != nil {
+		return 0, err
+	}
+
+	uid, err := s.db.InsertMail(userID, mailboxUID, mail)
+	if err != nil {
+		s.releaseBody(mail)
+		return 0, err
+	}
+
+	s.addUsage(userID, mailboxUID, int64(mail.Size))
+
+	plain.UID = uid
+	plain.MailboxUID = mailboxUID
+	s.index(userID, plain)
+	s.publish(events.Event{UserID: userID, Type: events.MailCreated, MailboxUID: mailboxUID, UID: uid, Flags: mail.Flags})
+	return uid, nil
 }
 
 func (s *Store) UpdateMail(userID string, mailboxUID uint32, mail Mail) error {
-	return s.db.UpdateMail(userID, mailboxUID, mail)
+	existing, err := s.db.GetMailByUID(userID, mailboxUID, mail.UID)
+	if err != nil {
+		return err
+	}
+
+	// Keep the stored body if it did not change
+	current := *existing
+	if err := s.loadBody(userID, &current); err != nil {
+		return err
+	}
+	if current.Body == mail.Body {
+		mail.Body = existing.Body
+		mail.BlobID = existing.BlobID
+		mail.KeyVersion = existing.KeyVersion
+		mail.Size = existing.Size
+		mail.HasAttachments = existing.HasAttachments
+		if err := s.db.UpdateMail(userID, mailboxUID, mail); err != nil {
+			return err
+		}
+		s.publish(events.Event{UserID: userID, Type: events.MailUpdated, MailboxUID: mailboxUID, UID: mail.UID, Flags: mail.Flags})
+		return nil
+	}
+
+	if mail.Size == 0 {
+		mail.Size = len(mail.Body)
+	}
+	mail.HasAttachments = hasAttachments(mail)
+
+	plain := mail
+	if err := s.storeBody(userID, &mail); err != nil {
+		return err
+	}
+
+	if err := s.db.UpdateMail(userID, mailboxUID, mail); err != nil {
+		s.releaseBody(mail)
+		return err
+	}
+
+	s.releaseBody(*existing)
+	s.addUsage(userID, mailboxUID, int64(mail.Size-existing.Size))
+
+	plain.MailboxUID = mailboxUID
+	s.index(userID, plain)
+	s.publish(events.Event{UserID: userID, Type: events.MailUpdated, MailboxUID: mailboxUID, UID: mail.UID, Flags: mail.Flags})
+	return nil
 }
 
 func (s *Store) DeleteMail(userID string, mailboxUID uint32, uid uint32) error {
-	return s.db.DeleteMail(userID, mailboxUID, uid)
+	existing, err := s.db.GetMailByUID(userID, mailboxUID, uid)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.DeleteMail(userID, mailboxUID, uid); err != nil {
+		return err
+	}
+
+	s.releaseBody(*existing)
+	s.addUsage(userID, mailboxUID, -int64(existing.Size))
+
+	if s.indexer != nil {
+		if err := s.indexer.Remove(userID, mailboxUID, uid); err != nil {
+			slog.Warn("Failed to remove mail from index", slog.String("user_id", userID), sloki.WrapError(err))
+		}
+	}
+
+	s.publish(events.Event{UserID: userID, Type: events.MailDeleted, MailboxUID: mailboxUID, UID: uid})
+	return nil
+}
+
+// Reindex rebuilds the index of all mails of the user.
+func (s *Store) Reindex(userID string) error {
+	if s.indexer == nil {
+		return nil
+	}
+
+	if err := s.indexer.Clear(userID); err != nil {
+		return err
+	}
+
+	if !s.Indexable(userID) {
+		return nil
+	}
+
+	mailboxes, err := s.db.GetMailboxes(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, mb := range mailboxes {
+		ms, err := s.GetMails(userID, mb.UID)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range ms {
+			s.index(userID, m)
+		}
+	}
+
+	return nil
+}
+
+// GetUsage returns the total size of all mails of the user in bytes.
+func (s *Store) GetUsage(userID string) (int64, error) {
+	mailboxes, err := s.db.GetMailboxes(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, mb := range mailboxes {
+		total += mb.Size
+	}
+	return total, nil
+}
+
+// RotateUserKey re-encrypts all mail of the user with a new key and retires the old key.
+func (s *Store) RotateUserKey(userID string) error {
+	if s.keys == nil {
+		return nil
+	}
+
+	oldVersion, err := s.keys.Rotate(userID)
+	if err != nil {
+		return err
+	}
+
+	err = s.reencrypt(userID, func(m Mail) bool {
+		return m.KeyVersion != 0 && m.KeyVersion <= oldVersion
+	})
+	if err != nil {
+		return err
+	}
+
+	for v := oldVersion; v > 0; v-- {
+		if err := s.keys.Retire(userID, v); err != nil && !errors.Is(err, keys.ErrKeyNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnableZeroAccess wraps the keys of the user with their password, so the
+// server can only read their mail bodies while they are logged in. The parsed
+// headers of their mail stay readable, see Configuration.Keys. Mail that was
+// stored in plaintext is encrypted, and the mail of the user is removed from
+// the index, as the server can always read the index.
+func (s *Store) EnableZeroAccess(userID string, password string) error {
+	if s.keys == nil {
+		return keys.ErrKeyNotFound
+	}
+
+	if err := s.keys.EnableZeroAccess(userID, password); err != nil {
+		return err
+	}
+
+	err := s.reencrypt(userID, func(m Mail) bool {
+		return m.KeyVersion == 0
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.indexer != nil {
+		return s.indexer.Clear(userID)
+	}
+	return nil
+}
+
+// reencrypt stores the bodies of the mails of the user that match again,
+// encrypted with the latest key of the user.
+func (s *Store) reencrypt(userID string, match func(m Mail) bool) error {
+	mailboxes, err := s.db.GetMailboxes(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, mb := range mailboxes {
+		ms, err := s.db.GetMails(userID, mb.UID)
+		if err != nil {
+			return err
+		}
+
+		for _, existing := range ms {
+			if !match(existing) {
+				continue
+			}
+
+			m := existing
+			if err := s.loadBody(userID, &m); err != nil {
+				return err
+			}
+			if err := s.storeBody(userID, &m); err != nil {
+				return err
+			}
+			if err := s.db.UpdateMail(userID, mb.UID, m); err != nil {
+				s.releaseBody(m)
+				return err
+			}
+			s.releaseBody(existing)
+		}
+	}
+
+	return nil
+}
+
+// storeBody encrypts the body of the mail and moves it into the blob store, if configured.
+func (s *Store) storeBody(userID string, m *Mail) error {
+	m.KeyVersion = 0
+	m.BlobID = ""
+
+	if s.keys != nil {
+		sealed, version, err := s.keys.Seal(userID, []byte(m.Body))
+		if err != nil && !errors.Is(err, keys.ErrKeyNotFound) {
+			return err
+		}
+		// Users without a key have their mail stored in plaintext
+		if err == nil {
+			m.Body = base64.StdEncoding.EncodeToString(sealed)
+			m.KeyVersion = version
+		}
+	}
+
+	if s.blobs == nil {
+		return nil
+	}
+
+	id, err := s.blobs.Put([]byte(m.Body))
+	if err != nil {
+		return err
+	}
+
+	m.BlobID = id
+	m.Body = ""
+	return nil
+}
+
+// loadBody resolves the body of the mail from the blob store and decrypts it, if needed.
+func (s *Store) loadBody(userID string, m *Mail) error {
+	if s.blobs != nil && m.BlobID != "" {
+		content, err := s.blobs.Get(m.BlobID)
+		if err != nil {
+			return err
+		}
+		m.Body = string(content)
+	}
+
+	if m.KeyVersion != 0 {
+		if s.keys == nil {
+			return keys.ErrKeyNotFound
+		}
+
+		sealed, err := base64.StdEncoding.DecodeString(m.Body)
+		if err != nil {
+			return keys.ErrInvalidData
+		}
+
+		plaintext, err := s.keys.Open(userID, m.KeyVersion, sealed)
+		if err != nil {
+			return err
+		}
+		m.Body = string(plaintext)
+	}
+
+	return nil
+}
+
+// index passes the decrypted mail to the indexer, unless the user has zero-access encryption.
+func (s *Store) index(userID string, m Mail) {
+	if s.indexer == nil || !s.Indexable(userID) {
+		return
+	}
+
+	if err := s.indexer.Index(userID, m); err != nil {
+		slog.Warn("Failed to index mail", slog.String("user_id", userID), slog.Int("uid", int(m.UID)), sloki.WrapError(err))
+	}
+}
+
+// Indexable reports whether mails of the user may be indexed. Mails of users
+// with zero-access encryption are not, so they can not be searched through the
+// index.
+func (s *Store) Indexable(userID string) bool {
+	if s.keys == nil {
+		return true
+	}
+
+	zeroAccess, err := s.keys.IsZeroAccess(userID)
+	return err == nil && !zeroAccess
+}
+
+// addUsage updates the size of the mailbox after a mail was added, changed or removed.
+func (s *Store) addUsage(userID string, mailboxUID uint32, delta int64) {
+	if delta == 0 {
+		return
+	}
+
+	if err := s.db.AddMailboxSize(userID, mailboxUID, delta); err != nil {
+		slog.Warn("Failed to update mailbox size", slog.String("user_id", userID), slog.Int("mailbox_uid", int(mailboxUID)), sloki.WrapError(err))
+	}
+}
+
+// releaseBody drops the reference of the mail to its blob.
+func (s *Store) releaseBody(m Mail) {
+	if s.blobs == nil || m.BlobID == "" {
+		return
+	}
+
+	if err := s.blobs.Release(m.BlobID); err != nil {
+		slog.Warn("Failed to release mail body blob", slog.String("blob_id", m.BlobID), sloki.WrapError(err))
+	}
 }
 
 func RandomUID() uint32 {
 	return rand.Uint32()
 }
+
+func (s *Store) publish(e events.Event) {
+	if s.events != nil {
+		s.events.Publish(e)
+	}
+}
@@ -0,0 +1,300 @@
+package mails_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/blobs"
+	bdb "github.com/OliverSchlueter/mail-server/internal/blobs/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/keys"
+	kdb "github.com/OliverSchlueter/mail-server/internal/keys/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+)
+
+func TestStoreBlobDeduplication(t *testing.T) {
+	blobDB := bdb.NewDB()
+	ms := mails.NewStore(mails.Configuration{
+		DB: mdb.NewDB(),
+		Blobs: blobs.NewStore(blobs.Configuration{
+			DB:          blobDB,
+			Compression: true,
+		}),
+	})
+
+	body := strings.Repeat("This is a newsletter sent to everyone.\n", 200)
+	for _, userID := range []string{"alice", "bob"} {
+		err := ms.CreateMail(userID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: body})
+		if err != nil {
+			t.Fatalf("Failed to create mail for %s: %v", userID, err)
+		}
+	}
+
+	if len(blobDB.Items) != 1 {
+		t.Fatalf("Expected 1 blob, got %d", len(blobDB.Items))
+	}
+	for _, b := range blobDB.Items {
+		if !b.Compressed {
+			t.Errorf("Expected blob to be compressed")
+		}
+		if b.RefCount != 2 {
+			t.Errorf("Expected 2 references, got %d", b.RefCount)
+		}
+	}
+
+	m, err := ms.GetMailByUID("bob", mails.DefaultMailboxUID, 1)
+	if err != nil {
+		t.Fatalf("Failed to get mail: %v", err)
+	}
+	if m.Body != body {
+		t.Errorf("Expected body to be resolved from blob store")
+	}
+
+	// Updating flags must keep the blob
+	m.Flags = []string{`\Seen`}
+	if err := ms.UpdateMail("bob", mails.DefaultMailboxUID, *m); err != nil {
+		t.Fatalf("Failed to update mail: %v", err)
+	}
+	if len(blobDB.Items) != 1 {
+		t.Fatalf("Expected 1 blob after update, got %d", len(blobDB.Items))
+	}
+
+	list, err := ms.GetMails("alice", mails.DefaultMailboxUID)
+	if err != nil {
+		t.Fatalf("Failed to get mails: %v", err)
+	}
+	if len(list) != 1 || list[0].Body != body {
+		t.Errorf("Expected body to be resolved from blob store in listing")
+	}
+
+	if err := ms.DeleteMail("alice", mails.DefaultMailboxUID, 1); err != nil {
+		t.Fatalf("Failed to delete mail: %v", err)
+	}
+	if len(blobDB.Items) != 1 {
+		t.Fatalf("Expected blob to be kept while still referenced, got %d blobs", len(blobDB.Items))
+	}
+
+	if err := ms.DeleteMailbox("bob", mails.DefaultMailboxUID); err != nil {
+		t.Fatalf("Failed to delete mailbox: %v", err)
+	}
+	if len(blobDB.Items) != 0 {
+		t.Errorf("Expected unreferenced blob to be garbage collected, got %d blobs", len(blobDB.Items))
+	}
+}
+
+func TestStoreBlobBodyChange(t *testing.T) {
+	blobDB := bdb.NewDB()
+	ms := mails.NewStore(mails.Configuration{
+		DB:    mdb.NewDB(),
+		Blobs: blobs.NewStore(blobs.Configuration{DB: blobDB}),
+	})
+
+	if err := ms.CreateMail("alice", mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "first"}); err != nil {
+		t.Fatalf("Failed to create mail: %v", err)
+	}
+
+	if err := ms.UpdateMail("alice", mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "second"}); err != nil {
+		t.Fatalf("Failed to update mail: %v", err)
+	}
+
+	if _, ok := blobDB.Items[blobs.ID([]byte("first"))]; ok {
+		t.Errorf("Expected old body blob to be released")
+	}
+
+	m, err := ms.GetMailByUID("alice", mails.DefaultMailboxUID, 1)
+	if err != nil {
+		t.Fatalf("Failed to get mail: %v", err)
+	}
+	if m.Body != "second" {
+		t.Errorf("Expected body 'second', got %q", m.Body)
+	}
+}
+
+func TestStoreEncryption(t *testing.T) {
+	mailDB := mdb.NewDB()
+	ms := mails.NewStore(mails.Configuration{
+		DB: mailDB,
+		Keys: keys.NewStore(keys.Configuration{
+			DB:              kdb.NewDB(),
+			MasterKeys:      map[string][]byte{"m1": bytes.Repeat([]byte{1}, 32)},
+			ActiveMasterKey: "m1",
+		}),
+	})
+
+	if err := ms.CreateMail("alice", mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "top secret"}); err != nil {
+		t.Fatalf("Failed to create mail: %v", err)
+	}
+
+	stored := mailDB.Mails["alice"][0]
+	if stored.KeyVersion != 1 || strings.Contains(stored.Body, "top secret") {
+		t.Fatalf("Expected body to be encrypted at rest, got %+v", stored)
+	}
+
+	m, err := ms.GetMailByUID("alice", mails.DefaultMailboxUID, 1)
+	if err != nil {
+		t.Fatalf("Failed to get mail: %v", err)
+	}
+	if m.Body != "top secret" {
+		t.Errorf("Expected body to be decrypted, got %q", m.Body)
+	}
+
+	if err := ms.RotateUserKey("alice"); err != nil {
+		t.Fatalf("Failed to rotate key: %v", err)
+	}
+
+	stored = mailDB.Mails["alice"][0]
+	if stored.KeyVersion != 2 {
+		t.Errorf("Expected mail to be re-encrypted with key version 2, got %d", stored.KeyVersion)
+	}
+
+	m, err = ms.GetMailByUID("alice", mails.DefaultMailboxUID, 1)
+	if err != nil {
+		t.Fatalf("Failed to get mail after rotation: %v", err)
+	}
+	if m.Body != "top secret" {
+		t.Errorf("Expected body to be decrypted after rotation, got %q", m.Body)
+	}
+}
+
+func TestStoreEnableZeroAccess(t *testing.T) {
+	mailDB := mdb.NewDB()
+	ks := keys.NewStore(keys.Configuration{DB: kdb.NewDB()})
+	ms := mails.NewStore(mails.Configuration{DB: mailDB, Keys: ks})
+
+	// Without a master key, mail is stored in plaintext until zero-access is enabled
+	if err := ms.CreateMail("alice", mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "top secret"}); err != nil {
+		t.Fatalf("Failed to create mail: %v", err)
+	}
+	if stored := mailDB.Mails["alice"][0]; stored.KeyVersion != 0 {
+		t.Fatalf("Expected body to be stored in plaintext, got %+v", stored)
+	}
+
+	if err := ms.EnableZeroAccess("alice", "alice123"); err != nil {
+		t.Fatalf("Failed to enable zero-access: %v", err)
+	}
+	if err := ms.EnableZeroAccess("alice", "alice123"); !errors.Is(err, keys.ErrKeyAlreadyExists) {
+		t.Errorf("Enable twice: expected ErrKeyAlreadyExists, got %v", err)
+	}
+
+	stored := mailDB.Mails["alice"][0]
+	if stored.KeyVersion != 1 || strings.Contains(stored.Body, "top secret") {
+		t.Fatalf("Expected body to be encrypted at rest, got %+v", stored)
+	}
+
+	ks.Lock("alice")
+	if _, err := ms.GetMailByUID("alice", mails.DefaultMailboxUID, 1); !errors.Is(err, keys.ErrKeyLocked) {
+		t.Errorf("Expected ErrKeyLocked while locked, got %v", err)
+	}
+	if err := ks.Unlock("alice", "alice123"); err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+	m, err := ms.GetMailByUID("alice", mails.DefaultMailboxUID, 1)
+	if err != nil || m.Body != "top secret" {
+		t.Errorf("Expected body to be decrypted after unlocking, got %v, %v", m, err)
+	}
+}
+
+func TestStoreMoveMail(t *testing.T) {
+	blobDB := bdb.NewDB()
+	ms := mails.NewStore(mails.Configuration{
+		DB:    mdb.NewDB(),
+		Blobs: blobs.NewStore(blobs.Configuration{DB: blobDB}),
+	})
+
+	if err := ms.CreateMailbox(mails.Mailbox{UserID: "alice", Name: "Archive", Flags: []string{}}); err != nil {
+		t.Fatalf("Failed to create mailbox: %v", err)
+	}
+	archive, err := ms.GetMailboxByName("alice", "Archive")
+	if err != nil {
+		t.Fatalf("Failed to get mailbox: %v", err)
+	}
+	if archive.UID == mails.DefaultMailboxUID {
+		t.Fatalf("Expected mailbox not to take the UID of the inbox")
+	}
+
+	err = ms.CreateMail("alice", mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "hello", Flags: []string{`\Seen`}})
+	if err != nil {
+		t.Fatalf("Failed to create mail: %v", err)
+	}
+
+	moved, err := ms.MoveMail("alice", mails.DefaultMailboxUID, 1, archive.UID)
+	if err != nil {
+		t.Fatalf("Failed to move mail: %v", err)
+	}
+	if moved.MailboxUID != archive.UID || moved.Body != "hello" {
+		t.Errorf("Unexpected moved mail: %+v", moved)
+	}
+
+	if _, err := ms.GetMailByUID("alice", mails.DefaultMailboxUID, 1); !errors.Is(err, mails.ErrMailNotFound) {
+		t.Errorf("Expected mail to be removed from the inbox, got %v", err)
+	}
+
+	m, err := ms.GetMailByUID("alice", archive.UID, moved.UID)
+	if err != nil {
+		t.Fatalf("Failed to get moved mail: %v", err)
+	}
+	if m.Body != "hello" || len(m.Flags) != 1 {
+		t.Errorf("Expected body and flags to be kept, got %+v", m)
+	}
+	if len(blobDB.Items) != 1 {
+		t.Errorf("Expected 1 blob after move, got %d", len(blobDB.Items))
+	}
+
+	if _, err := ms.MoveMail("alice", archive.UID, moved.UID, 99); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("Expected ErrMailboxNotFound for unknown target, got %v", err)
+	}
+	if _, err := ms.GetMailByUID("alice", archive.UID, moved.UID); err != nil {
+		t.Errorf("Expected mail to stay after failed move, got %v", err)
+	}
+}
+
+func TestStoreDeleteMailboxes(t *testing.T) {
+	blobDB := bdb.NewDB()
+	ms := mails.NewStore(mails.Configuration{
+		DB:    mdb.NewDB(),
+		Blobs: blobs.NewStore(blobs.Configuration{DB: blobDB}),
+	})
+
+	if err := ms.CreateMailbox(mails.Mailbox{UserID: "alice", Name: "Archive", Flags: []string{}}); err != nil {
+		t.Fatalf("Failed to create mailbox: %v", err)
+	}
+	archive, err := ms.GetMailboxByName("alice", "Archive")
+	if err != nil {
+		t.Fatalf("Failed to get mailbox: %v", err)
+	}
+	for _, c := range []struct {
+		userID     string
+		mailboxUID uint32
+		body       string
+	}{
+		{"alice", mails.DefaultMailboxUID, "shared"},
+		{"alice", archive.UID, "archived"},
+		{"bob", mails.DefaultMailboxUID, "shared"},
+	} {
+		if err := ms.CreateMail(c.userID, c.mailboxUID, mails.Mail{UID: 1, Body: c.body}); err != nil {
+			t.Fatalf("Failed to create mail: %v", err)
+		}
+	}
+
+	if err := ms.DeleteMailboxes("alice"); err != nil {
+		t.Fatalf("Failed to delete mailboxes: %v", err)
+	}
+
+	mailboxes, err := ms.GetMailboxes("alice")
+	if err != nil {
+		t.Fatalf("Failed to get mailboxes: %v", err)
+	}
+	if len(mailboxes) != 0 {
+		t.Errorf("Expected no mailboxes, got %+v", mailboxes)
+	}
+
+	// Only the blob shared with bob is left
+	if len(blobDB.Items) != 1 {
+		t.Errorf("Expected 1 blob, got %d", len(blobDB.Items))
+	}
+	if m, err := ms.GetMailByUID("bob", mails.DefaultMailboxUID, 1); err != nil || m.Body != "shared" {
+		t.Errorf("Expected mail of bob to be kept, got %v, %v", m, err)
+	}
+}
@@ -0,0 +1,629 @@
+// Package mailstest provides a conformance test suite that every mails.DB
+// implementation is expected to pass.
+package mailstest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+)
+
+// RunDBSuite runs all conformance tests against the mails.DB returned by newDB.
+// newDB is called once per test and must return an empty database.
+func RunDBSuite(t *testing.T, newDB func() mails.DB) {
+	t.Run("MailboxNotFound", func(t *testing.T) { TestMailboxNotFound(t, newDB()) })
+	t.Run("MailboxCRUD", func(t *testing.T) { TestMailboxCRUD(t, newDB()) })
+	t.Run("MailboxUIDs", func(t *testing.T) { TestMailboxUIDs(t, newDB()) })
+	t.Run("MailboxSize", func(t *testing.T) { TestMailboxSize(t, newDB()) })
+	t.Run("MailNotFound", func(t *testing.T) { TestMailNotFound(t, newDB()) })
+	t.Run("MailCRUD", func(t *testing.T) { TestMailCRUD(t, newDB()) })
+	t.Run("MailUIDs", func(t *testing.T) { TestMailUIDs(t, newDB()) })
+	t.Run("ListMails", func(t *testing.T) { TestListMails(t, newDB()) })
+	t.Run("UserIsolation", func(t *testing.T) { TestUserIsolation(t, newDB()) })
+	t.Run("Concurrency", func(t *testing.T) { TestConcurrency(t, newDB()) })
+}
+
+func TestMailboxNotFound(t *testing.T, db mails.DB) {
+	if _, err := db.GetMailboxByUID("alice", 1); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("GetMailboxByUID: expected ErrMailboxNotFound, got %v", err)
+	}
+	if _, err := db.GetMailboxByName("alice", "INBOX"); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("GetMailboxByName: expected ErrMailboxNotFound, got %v", err)
+	}
+	if err := db.UpdateMailbox(mails.Mailbox{UserID: "alice", UID: 1, Name: "INBOX"}); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("UpdateMailbox: expected ErrMailboxNotFound, got %v", err)
+	}
+	if err := db.DeleteMailbox("alice", 1); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("DeleteMailbox: expected ErrMailboxNotFound, got %v", err)
+	}
+
+	mailboxes, err := db.GetMailboxes("alice")
+	if err != nil {
+		t.Fatalf("GetMailboxes: unexpected error: %v", err)
+	}
+	if len(mailboxes) != 0 {
+		t.Errorf("GetMailboxes: expected no mailboxes, got %d", len(mailboxes))
+	}
+}
+
+func TestMailboxCRUD(t *testing.T, db mails.DB) {
+	mb := mails.Mailbox{UserID: "alice", Name: "INBOX", UID: 1, Flags: []string{}}
+	if err := db.InsertMailbox(mb); err != nil {
+		t.Fatalf("InsertMailbox: unexpected error: %v", err)
+	}
+
+	if err := db.InsertMailbox(mails.Mailbox{UserID: "alice", Name: "INBOX"}); !errors.Is(err, mails.ErrMailboxAlreadyExists) {
+		t.Errorf("InsertMailbox with duplicate name: expected ErrMailboxAlreadyExists, got %v", err)
+	}
+	if err := db.InsertMailbox(mails.Mailbox{UserID: "alice", Name: "Other", UID: 1}); !errors.Is(err, mails.ErrMailboxAlreadyExists) {
+		t.Errorf("InsertMailbox with duplicate UID: expected ErrMailboxAlreadyExists, got %v", err)
+	}
+
+	got, err := db.GetMailboxByUID("alice", 1)
+	if err != nil {
+		t.Fatalf("GetMailboxByUID: unexpected error: %v", err)
+	}
+	if got.Name != "INBOX" || got.UserID != "alice" {
+		t.Errorf("GetMailboxByUID: expected alice/INBOX, got %s/%s", got.UserID, got.Name)
+	}
+
+	got, err = db.GetMailboxByName("alice", "INBOX")
+	if err != nil {
+		t.Fatalf("GetMailboxByName: unexpected error: %v", err)
+	}
+	if got.UID != 1 {
+		t.Errorf("GetMailboxByName: expected UID 1, got %d", got.UID)
+	}
+
+	mb.Name = "Renamed"
+	if err := db.UpdateMailbox(mb); err != nil {
+		t.Fatalf("UpdateMailbox: unexpected error: %v", err)
+	}
+	if _, err := db.GetMailboxByName("alice", "INBOX"); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("GetMailboxByName after rename: expected ErrMailboxNotFound, got %v", err)
+	}
+	if _, err := db.GetMailboxByName("alice", "Renamed"); err != nil {
+		t.Errorf("GetMailboxByName after rename: unexpected error: %v", err)
+	}
+
+	// Renaming to the name of another mailbox is rejected
+	insertMailbox(t, db, "alice", 2)
+	other, err := db.GetMailboxByUID("alice", 2)
+	if err != nil {
+		t.Fatalf("GetMailboxByUID: unexpected error: %v", err)
+	}
+	other.Name = "Renamed"
+	if err := db.UpdateMailbox(*other); !errors.Is(err, mails.ErrMailboxAlreadyExists) {
+		t.Errorf("UpdateMailbox to existing name: expected ErrMailboxAlreadyExists, got %v", err)
+	}
+	if err := db.DeleteMailbox("alice", 2); err != nil {
+		t.Fatalf("DeleteMailbox: unexpected error: %v", err)
+	}
+
+	mailboxes, err := db.GetMailboxes("alice")
+	if err != nil {
+		t.Fatalf("GetMailboxes: unexpected error: %v", err)
+	}
+	if len(mailboxes) != 1 {
+		t.Errorf("GetMailboxes: expected 1 mailbox, got %d", len(mailboxes))
+	}
+
+	if _, err := db.InsertMail("alice", 1, mails.Mail{UID: 1, Body: "hello"}); err != nil {
+		t.Fatalf("InsertMail: unexpected error: %v", err)
+	}
+
+	if err := db.DeleteMailbox("alice", 1); err != nil {
+		t.Fatalf("DeleteMailbox: unexpected error: %v", err)
+	}
+	if _, err := db.GetMailboxByUID("alice", 1); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("GetMailboxByUID after delete: expected ErrMailboxNotFound, got %v", err)
+	}
+	if _, err := db.GetMailByUID("alice", 1, 1); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("GetMailByUID after mailbox delete: expected ErrMailboxNotFound, got %v", err)
+	}
+}
+
+func TestMailboxUIDs(t *testing.T, db mails.DB) {
+	seen := map[uint32]bool{}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("box-%d", i)
+		if err := db.InsertMailbox(mails.Mailbox{UserID: "alice", Name: name}); err != nil {
+			t.Fatalf("InsertMailbox: unexpected error: %v", err)
+		}
+
+		mb, err := db.GetMailboxByName("alice", name)
+		if err != nil {
+			t.Fatalf("GetMailboxByName: unexpected error: %v", err)
+		}
+		if mb.UID == 0 {
+			t.Errorf("InsertMailbox: expected a UID to be assigned to %s", name)
+		}
+		if seen[mb.UID] {
+			t.Errorf("InsertMailbox: UID %d assigned twice", mb.UID)
+		}
+		seen[mb.UID] = true
+	}
+
+	// Deleting a mailbox must not lead to its UID being handed out again
+	first, err := db.GetMailboxByName("alice", "box-0")
+	if err != nil {
+		t.Fatalf("GetMailboxByName: unexpected error: %v", err)
+	}
+	if err := db.DeleteMailbox("alice", first.UID); err != nil {
+		t.Fatalf("DeleteMailbox: unexpected error: %v", err)
+	}
+	if err := db.InsertMailbox(mails.Mailbox{UserID: "alice", Name: "box-new"}); err != nil {
+		t.Fatalf("InsertMailbox: unexpected error: %v", err)
+	}
+	mb, err := db.GetMailboxByName("alice", "box-new")
+	if err != nil {
+		t.Fatalf("GetMailboxByName: unexpected error: %v", err)
+	}
+	if seen[mb.UID] {
+		t.Errorf("InsertMailbox: UID %d was reused", mb.UID)
+	}
+
+	// The default mailbox UID must be available to every user
+	if err := db.InsertMailbox(mails.Mailbox{UserID: "bob", Name: mails.DefaultMailboxName, UID: mails.DefaultMailboxUID}); err != nil {
+		t.Errorf("InsertMailbox for second user with default UID: unexpected error: %v", err)
+	}
+}
+
+func TestMailboxSize(t *testing.T, db mails.DB) {
+	if err := db.AddMailboxSize("alice", 1, 10); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("AddMailboxSize without mailbox: expected ErrMailboxNotFound, got %v", err)
+	}
+
+	insertMailbox(t, db, "alice", 1)
+	insertMailbox(t, db, "bob", 1)
+
+	for _, delta := range []int64{100, 50, -30} {
+		if err := db.AddMailboxSize("alice", 1, delta); err != nil {
+			t.Fatalf("AddMailboxSize: unexpected error: %v", err)
+		}
+	}
+
+	mb, err := db.GetMailboxByUID("alice", 1)
+	if err != nil {
+		t.Fatalf("GetMailboxByUID: unexpected error: %v", err)
+	}
+	if mb.Size != 120 {
+		t.Errorf("AddMailboxSize: expected size 120, got %d", mb.Size)
+	}
+
+	// Updating the mailbox must not reset its size
+	mb.Name = "Renamed"
+	mb.Size = 0
+	if err := db.UpdateMailbox(*mb); err != nil {
+		t.Fatalf("UpdateMailbox: unexpected error: %v", err)
+	}
+	mb, err = db.GetMailboxByUID("alice", 1)
+	if err != nil {
+		t.Fatalf("GetMailboxByUID: unexpected error: %v", err)
+	}
+	if mb.Size != 120 {
+		t.Errorf("UpdateMailbox: expected size 120 to be kept, got %d", mb.Size)
+	}
+
+	other, err := db.GetMailboxByUID("bob", 1)
+	if err != nil {
+		t.Fatalf("GetMailboxByUID: unexpected error: %v", err)
+	}
+	if other.Size != 0 {
+		t.Errorf("AddMailboxSize changed size of other user's mailbox: %d", other.Size)
+	}
+
+	// Concurrent updates must not get lost
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.AddMailboxSize("bob", 1, 2); err != nil {
+				t.Errorf("AddMailboxSize: unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	other, err = db.GetMailboxByUID("bob", 1)
+	if err != nil {
+		t.Fatalf("GetMailboxByUID: unexpected error: %v", err)
+	}
+	if other.Size != 100 {
+		t.Errorf("AddMailboxSize: expected size 100 after concurrent updates, got %d", other.Size)
+	}
+}
+
+func TestMailNotFound(t *testing.T, db mails.DB) {
+	if _, err := db.GetMails("alice", 1); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("GetMails without mailbox: expected ErrMailboxNotFound, got %v", err)
+	}
+	if _, err := db.InsertMail("alice", 1, mails.Mail{UID: 1}); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("InsertMail without mailbox: expected ErrMailboxNotFound, got %v", err)
+	}
+
+	insertMailbox(t, db, "alice", 1)
+
+	if _, err := db.GetMailByUID("alice", 1, 42); !errors.Is(err, mails.ErrMailNotFound) {
+		t.Errorf("GetMailByUID: expected ErrMailNotFound, got %v", err)
+	}
+	if err := db.UpdateMail("alice", 1, mails.Mail{UID: 42}); !errors.Is(err, mails.ErrMailNotFound) {
+		t.Errorf("UpdateMail: expected ErrMailNotFound, got %v", err)
+	}
+	if err := db.DeleteMail("alice", 1, 42); !errors.Is(err, mails.ErrMailNotFound) {
+		t.Errorf("DeleteMail: expected ErrMailNotFound, got %v", err)
+	}
+	if _, err := db.GetMailByUID("alice", 2, 42); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("GetMailByUID with unknown mailbox: expected ErrMailboxNotFound, got %v", err)
+	}
+
+	list, err := db.GetMails("alice", 1)
+	if err != nil {
+		t.Fatalf("GetMails: unexpected error: %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("GetMails: expected no mails, got %d", len(list))
+	}
+}
+
+func TestMailCRUD(t *testing.T, db mails.DB) {
+	insertMailbox(t, db, "alice", 1)
+	insertMailbox(t, db, "alice", 2)
+
+	m := mails.Mail{
+		UID:     7,
+		Flags:   []string{},
+		Date:    time.Now().UTC().Truncate(time.Second),
+		Size:    5,
+		Headers: map[string]string{"Subject": "Hi"},
+		Body:    "hello",
+	}
+	if _, err := db.InsertMail("alice", 1, m); err != nil {
+		t.Fatalf("InsertMail: unexpected error: %v", err)
+	}
+	if _, err := db.InsertMail("alice", 1, m); !errors.Is(err, mails.ErrMailAlreadyExists) {
+		t.Errorf("InsertMail with duplicate UID: expected ErrMailAlreadyExists, got %v", err)
+	}
+
+	got, err := db.GetMailByUID("alice", 1, 7)
+	if err != nil {
+		t.Fatalf("GetMailByUID: unexpected error: %v", err)
+	}
+	if got.Body != "hello" || got.Headers["Subject"] != "Hi" || got.MailboxUID != 1 || !got.Date.Equal(m.Date) {
+		t.Errorf("GetMailByUID: stored mail does not match inserted mail: %+v", got)
+	}
+
+	// The same UID may exist in another mailbox
+	if _, err := db.GetMailByUID("alice", 2, 7); !errors.Is(err, mails.ErrMailNotFound) {
+		t.Errorf("GetMailByUID in other mailbox: expected ErrMailNotFound, got %v", err)
+	}
+	if _, err := db.InsertMail("alice", 2, m); err != nil {
+		t.Errorf("InsertMail with same UID in other mailbox: unexpected error: %v", err)
+	}
+
+	m.Flags = []string{`\Seen`}
+	if err := db.UpdateMail("alice", 1, m); err != nil {
+		t.Fatalf("UpdateMail: unexpected error: %v", err)
+	}
+	got, err = db.GetMailByUID("alice", 1, 7)
+	if err != nil {
+		t.Fatalf("GetMailByUID: unexpected error: %v", err)
+	}
+	if len(got.Flags) != 1 || got.Flags[0] != `\Seen` {
+		t.Errorf("UpdateMail: expected flags [\\Seen], got %v", got.Flags)
+	}
+
+	// Modifying a returned mail must not modify the stored mail
+	got.Flags[0] = `\Deleted`
+	got.Headers["Subject"] = "Changed"
+	got, err = db.GetMailByUID("alice", 1, 7)
+	if err != nil {
+		t.Fatalf("GetMailByUID: unexpected error: %v", err)
+	}
+	if got.Flags[0] != `\Seen` || got.Headers["Subject"] != "Hi" {
+		t.Errorf("GetMailByUID: stored mail was modified through returned value")
+	}
+
+	other, err := db.GetMailByUID("alice", 2, 7)
+	if err != nil {
+		t.Fatalf("GetMailByUID: unexpected error: %v", err)
+	}
+	if len(other.Flags) != 0 {
+		t.Errorf("UpdateMail changed mail in other mailbox: %v", other.Flags)
+	}
+
+	if err := db.DeleteMail("alice", 1, 7); err != nil {
+		t.Fatalf("DeleteMail: unexpected error: %v", err)
+	}
+	if _, err := db.GetMailByUID("alice", 1, 7); !errors.Is(err, mails.ErrMailNotFound) {
+		t.Errorf("GetMailByUID after delete: expected ErrMailNotFound, got %v", err)
+	}
+	if _, err := db.GetMailByUID("alice", 2, 7); err != nil {
+		t.Errorf("DeleteMail removed mail from other mailbox: %v", err)
+	}
+}
+
+func TestMailUIDs(t *testing.T, db mails.DB) {
+	insertMailbox(t, db, "alice", 1)
+
+	var last uint32
+	for i := 0; i < 5; i++ {
+		assigned, err := db.InsertMail("alice", 1, mails.Mail{Body: fmt.Sprintf("mail %d", i)})
+		if err != nil {
+			t.Fatalf("InsertMail: unexpected error: %v", err)
+		}
+
+		uid := mailUIDByBody(t, db, "alice", 1, fmt.Sprintf("mail %d", i))
+		if uid == 0 {
+			t.Fatalf("InsertMail: expected a UID to be assigned")
+		}
+		if assigned != uid {
+			t.Errorf("InsertMail: returned UID %d, but mail was stored with UID %d", assigned, uid)
+		}
+		if uid <= last {
+			t.Errorf("InsertMail: expected ascending UIDs, got %d after %d", uid, last)
+		}
+		last = uid
+	}
+
+	// UIDs must not be reused after the newest mail was deleted
+	if err := db.DeleteMail("alice", 1, last); err != nil {
+		t.Fatalf("DeleteMail: unexpected error: %v", err)
+	}
+	if _, err := db.InsertMail("alice", 1, mails.Mail{Body: "after delete"}); err != nil {
+		t.Fatalf("InsertMail: unexpected error: %v", err)
+	}
+	if uid := mailUIDByBody(t, db, "alice", 1, "after delete"); uid <= last {
+		t.Errorf("InsertMail: expected UID greater than %d, got %d", last, uid)
+	}
+}
+
+func TestUserIsolation(t *testing.T, db mails.DB) {
+	// Both users own a mailbox with the same UID and name
+	insertMailbox(t, db, "alice", mails.DefaultMailboxUID)
+	insertMailbox(t, db, "bob", mails.DefaultMailboxUID)
+
+	if _, err := db.InsertMail("alice", mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "for alice"}); err != nil {
+		t.Fatalf("InsertMail: unexpected error: %v", err)
+	}
+
+	bobMails, err := db.GetMails("bob", mails.DefaultMailboxUID)
+	if err != nil {
+		t.Fatalf("GetMails: unexpected error: %v", err)
+	}
+	if len(bobMails) != 0 {
+		t.Errorf("GetMails: bob can see %d mails of alice", len(bobMails))
+	}
+
+	if _, err := db.GetMailByUID("bob", mails.DefaultMailboxUID, 1); !errors.Is(err, mails.ErrMailNotFound) {
+		t.Errorf("GetMailByUID: expected ErrMailNotFound for bob, got %v", err)
+	}
+	if err := db.UpdateMail("bob", mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "changed"}); !errors.Is(err, mails.ErrMailNotFound) {
+		t.Errorf("UpdateMail: expected ErrMailNotFound for bob, got %v", err)
+	}
+	if err := db.DeleteMail("bob", mails.DefaultMailboxUID, 1); !errors.Is(err, mails.ErrMailNotFound) {
+		t.Errorf("DeleteMail: expected ErrMailNotFound for bob, got %v", err)
+	}
+
+	// Bob may use the same mail UID in his own mailbox
+	if _, err := db.InsertMail("bob", mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "for bob"}); err != nil {
+		t.Fatalf("InsertMail: unexpected error: %v", err)
+	}
+
+	got, err := db.GetMailByUID("alice", mails.DefaultMailboxUID, 1)
+	if err != nil {
+		t.Fatalf("GetMailByUID: unexpected error: %v", err)
+	}
+	if got.Body != "for alice" {
+		t.Errorf("GetMailByUID: expected alice's mail, got %q", got.Body)
+	}
+
+	bobMailboxes, err := db.GetMailboxes("bob")
+	if err != nil {
+		t.Fatalf("GetMailboxes: unexpected error: %v", err)
+	}
+	if len(bobMailboxes) != 1 || bobMailboxes[0].UserID != "bob" {
+		t.Errorf("GetMailboxes: expected exactly bob's mailbox, got %+v", bobMailboxes)
+	}
+
+	if err := db.DeleteMailbox("bob", mails.DefaultMailboxUID); err != nil {
+		t.Fatalf("DeleteMailbox: unexpected error: %v", err)
+	}
+	if _, err := db.GetMailboxByUID("alice", mails.DefaultMailboxUID); err != nil {
+		t.Errorf("DeleteMailbox removed alice's mailbox: %v", err)
+	}
+	if _, err := db.GetMailByUID("alice", mails.DefaultMailboxUID, 1); err != nil {
+		t.Errorf("DeleteMailbox removed alice's mail: %v", err)
+	}
+}
+
+func TestConcurrency(t *testing.T, db mails.DB) {
+	const workers = 8
+	const perWorker = 25
+
+	insertMailbox(t, db, "alice", 1)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < perWorker; i++ {
+				if _, err := db.InsertMail("alice", 1, mails.Mail{Body: fmt.Sprintf("%d-%d", w, i)}); err != nil {
+					t.Errorf("InsertMail: unexpected error: %v", err)
+				}
+				if _, err := db.GetMails("alice", 1); err != nil {
+					t.Errorf("GetMails: unexpected error: %v", err)
+				}
+				if _, err := db.GetMailboxes("alice"); err != nil {
+					t.Errorf("GetMailboxes: unexpected error: %v", err)
+				}
+				if _, err := db.GetMailByUID("alice", 1, uint32(i+1)); err != nil && !errors.Is(err, mails.ErrMailNotFound) {
+					t.Errorf("GetMailByUID: unexpected error: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	list, err := db.GetMails("alice", 1)
+	if err != nil {
+		t.Fatalf("GetMails: unexpected error: %v", err)
+	}
+	if len(list) != workers*perWorker {
+		t.Fatalf("GetMails: expected %d mails, got %d", workers*perWorker, len(list))
+	}
+
+	seen := map[uint32]bool{}
+	for _, m := range list {
+		if seen[m.UID] {
+			t.Errorf("InsertMail: UID %d assigned twice", m.UID)
+		}
+		seen[m.UID] = true
+	}
+}
+
+func TestListMails(t *testing.T, db mails.DB) {
+	if _, err := db.ListMails("alice", 1, mails.ListOptions{}.Normalize()); !errors.Is(err, mails.ErrMailboxNotFound) {
+		t.Errorf("ListMails without mailbox: expected ErrMailboxNotFound, got %v", err)
+	}
+
+	insertMailbox(t, db, "alice", 1)
+	insertMailbox(t, db, "alice", 2)
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		m := mails.Mail{
+			Flags: []string{},
+			Date:  base.Add(time.Duration(i) * time.Hour),
+			Size:  100 - i,
+			Headers: map[string]string{
+				"From":    fmt.Sprintf("sender%d@example.com", i%2),
+				"To":      "alice@example.com",
+				"Subject": fmt.Sprintf("Subject %d", 4-i),
+			},
+			Body: fmt.Sprintf("body %d", i),
+		}
+		if i%2 == 0 {
+			m.Flags = []string{`\Seen`}
+		}
+		if i == 3 {
+			m.Flags = []string{`\Flagged`}
+			m.HasAttachments = true
+		}
+		if _, err := db.InsertMail("alice", 1, m); err != nil {
+			t.Fatalf("InsertMail: unexpected error: %v", err)
+		}
+	}
+	if _, err := db.InsertMail("alice", 2, mails.Mail{Date: base, Body: "other mailbox"}); err != nil {
+		t.Fatalf("InsertMail: unexpected error: %v", err)
+	}
+
+	// Page through all mails by date
+	opts := mails.ListOptions{Limit: 2}.Normalize()
+	var bodies []string
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("ListMails: expected 3 pages, cursor does not advance")
+		}
+
+		page, err := db.ListMails("alice", 1, opts)
+		if err != nil {
+			t.Fatalf("ListMails: unexpected error: %v", err)
+		}
+		for _, m := range page.Mails {
+			if m.Body != "" {
+				t.Errorf("ListMails without WithBody: expected no body, got %q", m.Body)
+			}
+			bodies = append(bodies, m.Headers["Subject"])
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if fmt.Sprint(bodies) != "[Subject 4 Subject 3 Subject 2 Subject 1 Subject 0]" {
+		t.Errorf("ListMails by date: unexpected order %v", bodies)
+	}
+
+	// Sorting by subject descending reverses the order
+	page, err := db.ListMails("alice", 1, mails.ListOptions{Sort: mails.SortSubject, Descending: true, WithBody: true}.Normalize())
+	if err != nil {
+		t.Fatalf("ListMails: unexpected error: %v", err)
+	}
+	if len(page.Mails) != 5 || page.Mails[0].Body != "body 0" || page.NextCursor != "" {
+		t.Errorf("ListMails by subject: unexpected page %+v", page)
+	}
+
+	// Filters
+	filters := []struct {
+		name   string
+		filter mails.Filter
+		want   int
+	}{
+		{"unread", mails.Filter{Unread: true}, 2},
+		{"flagged", mails.Filter{Flagged: true}, 1},
+		{"attachments", mails.Filter{HasAttachments: true}, 1},
+		{"since", mails.Filter{Since: base.Add(3 * time.Hour)}, 2},
+		{"before", mails.Filter{Before: base.Add(3 * time.Hour)}, 3},
+		{"from", mails.Filter{From: "SENDER1"}, 2},
+		{"to", mails.Filter{To: "alice@"}, 5},
+		{"combined", mails.Filter{Unread: true, From: "sender1"}, 2},
+	}
+	for _, tc := range filters {
+		page, err := db.ListMails("alice", 1, mails.ListOptions{Filter: tc.filter}.Normalize())
+		if err != nil {
+			t.Fatalf("ListMails with %s filter: unexpected error: %v", tc.name, err)
+		}
+		if len(page.Mails) != tc.want {
+			t.Errorf("ListMails with %s filter: expected %d mails, got %d", tc.name, tc.want, len(page.Mails))
+		}
+	}
+
+	// Cursors are tied to their sort order
+	first, err := db.ListMails("alice", 1, mails.ListOptions{Limit: 1}.Normalize())
+	if err != nil {
+		t.Fatalf("ListMails: unexpected error: %v", err)
+	}
+	_, err = db.ListMails("alice", 1, mails.ListOptions{Sort: mails.SortSize, Cursor: first.NextCursor}.Normalize())
+	if !errors.Is(err, mails.ErrInvalidCursor) {
+		t.Errorf("ListMails with cursor of other sort order: expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func insertMailbox(t *testing.T, db mails.DB, userID string, uid uint32) {
+	t.Helper()
+
+	err := db.InsertMailbox(mails.Mailbox{
+		UserID: userID,
+		Name:   fmt.Sprintf("mailbox-%d", uid),
+		UID:    uid,
+		Flags:  []string{},
+	})
+	if err != nil {
+		t.Fatalf("InsertMailbox: unexpected error: %v", err)
+	}
+}
+
+func mailUIDByBody(t *testing.T, db mails.DB, userID string, mailboxUID uint32, body string) uint32 {
+	t.Helper()
+
+	list, err := db.GetMails(userID, mailboxUID)
+	if err != nil {
+		t.Fatalf("GetMails: unexpected error: %v", err)
+	}
+	for _, m := range list {
+		if m.Body == body {
+			return m.UID
+		}
+	}
+
+	t.Fatalf("GetMails: mail with body %q not found", body)
+	return 0
+}
@@ -5,11 +5,18 @@ import "time"
 const DefaultMailboxName = "INBOX"
 const DefaultMailboxUID uint32 = 1
 
+// SentMailboxName is the mailbox that keeps a copy of sent mails, unless another one is chosen.
+const SentMailboxName = "Sent"
+
+// DraftsMailboxName is the mailbox that keeps unfinished mails.
+const DraftsMailboxName = "Drafts"
+
 type Mailbox struct {
 	UserID string   `json:"user_id"`
 	Name   string   `json:"name"`
 	UID    uint32   `json:"uid"`
 	Flags  []string `json:"flags"`
+	Size   int64    `json:"size"` // total size of all mails in the mailbox, maintained by the store
 }
 
 type Mail struct {
@@ -20,4 +27,8 @@ type Mail struct {
 	Size       int               `json:"size"`
 	Headers    map[string]string `json:"headers"`
 	Body       string            `json:"body"`
+	// HasAttachments is set by the store when the mail is created
+	HasAttachments bool   `json:"has_attachments"`
+	BlobID         string `json:"-"` // set if the body is kept in the blob store
+	KeyVersion     int    `json:"-"` // set if the body is encrypted at rest
 }
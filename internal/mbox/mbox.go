@@ -0,0 +1,95 @@
+// Package mbox reads mailbox files in the mbox format, where every message
+// starts with a "From " separator line. Escaped "From " lines in the message
+// bodies are unescaped as in the mboxrd variant, which also covers mboxo.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"time"
+)
+
+// maxLineLength is the longest line that is read, messages with longer lines are rejected.
+const maxLineLength = 1 << 20
+
+// separatorLayouts are the date formats used in the separator lines.
+var separatorLayouts = []string{
+	time.ANSIC,
+	time.UnixDate,
+	"Mon Jan _2 15:04:05 2006 -0700",
+	"Mon Jan _2 15:04 2006",
+}
+
+// Message is a message read from an mbox file.
+type Message struct {
+	Sender string    // envelope sender from the separator line
+	Date   time.Time // delivery date from the separator line, zero if it could not be parsed
+	Raw    []byte    // the message with LF line endings
+}
+
+// IsMbox reports whether the data starts with an mbox separator line.
+func IsMbox(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("From "))
+}
+
+// Read reads all messages of the mbox file. Content before the first
+// separator line is ignored.
+func Read(r io.Reader) ([]Message, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+
+	var messages []Message
+	var current *Message
+	var body bytes.Buffer
+
+	flush := func() {
+		if current == nil {
+			return
+		}
+		// The empty line before the next separator belongs to the format, not the message
+		raw := bytes.TrimSuffix(body.Bytes(), []byte("\n"))
+		current.Raw = bytes.Clone(raw)
+		messages = append(messages, *current)
+		body.Reset()
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		if strings.HasPrefix(line, "From ") {
+			flush()
+			sender, date := parseSeparator(line)
+			current = &Message{Sender: sender, Date: date}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		if unescaped, ok := strings.CutPrefix(line, ">"); ok && strings.HasPrefix(strings.TrimLeft(unescaped, ">"), "From ") {
+			line = unescaped
+		}
+		body.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	return messages, nil
+}
+
+func parseSeparator(line string) (string, time.Time) {
+	rest := strings.TrimPrefix(line, "From ")
+	sender, date, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	date = strings.TrimSpace(date)
+
+	for _, layout := range separatorLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return sender, t
+		}
+	}
+	return sender, time.Time{}
+}
@@ -0,0 +1,45 @@
+package mbox
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRead(t *testing.T) {
+	data := "From alice@example.com Mon May  6 10:00:00 2024\n" +
+		"From: alice@example.com\n" +
+		"Subject: First\n" +
+		"\n" +
+		">From the start\n" +
+		">>From quoted\n" +
+		"\n" +
+		"From MAILER-DAEMON Tue May  7 11:30:00 2024\r\n" +
+		"Subject: Second\r\n" +
+		"\r\n" +
+		"Body\r\n"
+
+	if !IsMbox([]byte(data)) {
+		t.Fatalf("Expected data to be detected as mbox")
+	}
+
+	messages, err := Read(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+
+	first := messages[0]
+	if first.Sender != "alice@example.com" || !first.Date.Equal(time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected separator of first message: %q %v", first.Sender, first.Date)
+	}
+	if want := "From: alice@example.com\nSubject: First\n\nFrom the start\n>From quoted\n"; string(first.Raw) != want {
+		t.Errorf("Unexpected first message %q", first.Raw)
+	}
+
+	if want := "Subject: Second\n\nBody"; string(messages[1].Raw) != want {
+		t.Errorf("Unexpected second message %q", messages[1].Raw)
+	}
+}
@@ -0,0 +1,7 @@
+package message
+
+import "errors"
+
+var (
+	ErrPartNotFound = errors.New("part not found")
+)
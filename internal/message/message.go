@@ -0,0 +1,325 @@
+// Package message parses stored mails into their MIME structure.
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxDepth limits how deeply nested multipart messages are parsed.
+const maxDepth = 10
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// Parse parses the mail into its MIME structure. The body of a mail either
+// contains the full message including headers (as received via SMTP) or only
+// the content, in which case the headers of the mail are used.
+func Parse(m mails.Mail) (*Message, error) {
+	header, body := split(m)
+
+	msg := &Message{Header: header}
+	if err := msg.walk(header, body, "", 0); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Raw returns the full message including its headers with CRLF line endings,
+// e.g. to forward or export it.
+func Raw(m mails.Mail) []byte {
+	body := strings.ReplaceAll(m.Body, "\r\n", "\n")
+
+	var b strings.Builder
+	if !hasHeaders(body, m.Headers) {
+		keys := make([]string, 0, len(m.Headers))
+		for k := range m.Headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			b.WriteString(k + ": " + m.Headers[k] + "\n")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(body)
+
+	return []byte(strings.ReplaceAll(b.String(), "\n", "\r\n"))
+}
+
+// Subject returns the decoded subject of the message.
+func (m *Message) Subject() string {
+	return DecodeHeader(m.Header.Get("Subject"))
+}
+
+// Addresses returns the decoded addresses of the given header field, e.g. "To".
+func (m *Message) Addresses(field string) []*mail.Address {
+	value := m.Header.Get(field)
+	if value == "" {
+		return nil
+	}
+
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	list, err := parser.ParseList(value)
+	if err != nil {
+		// Fall back to the raw value, so it is not lost
+		return []*mail.Address{{Address: strings.TrimSpace(value)}}
+	}
+	return list
+}
+
+// Text returns the readable text of the message. Plain text parts are
+// preferred, HTML parts are only used if there is no plain text.
+func (m *Message) Text() string {
+	var plain, htmlText []string
+	for _, p := range m.Parts {
+		if p.IsMultipart() || p.IsAttachment() {
+			continue
+		}
+
+		switch p.ContentType {
+		case "text/plain":
+			plain = append(plain, decodeCharset(p.Content, p.Params["charset"]))
+		case "text/html":
+			htmlText = append(htmlText, StripHTML(decodeCharset(p.Content, p.Params["charset"])))
+		}
+	}
+
+	if len(plain) > 0 {
+		return strings.Join(plain, "\n")
+	}
+	return strings.Join(htmlText, "\n")
+}
+
+// Body returns the decoded content of the first part with the content type,
+// e.g. "text/html", that is not an attachment.
+func (m *Message) Body(contentType string) string {
+	for _, p := range m.Parts {
+		if p.ContentType == contentType && !p.IsAttachment() {
+			return decodeCharset(p.Content, p.Params["charset"])
+		}
+	}
+	return ""
+}
+
+// Attachments returns all parts that are files.
+func (m *Message) Attachments() []Part {
+	var attachments []Part
+	for _, p := range m.Parts {
+		if p.IsAttachment() {
+			attachments = append(attachments, p)
+		}
+	}
+	return attachments
+}
+
+// Part returns the part with the given IMAP part specifier.
+func (m *Message) Part(id string) (*Part, error) {
+	for _, p := range m.Parts {
+		if p.ID == id {
+			return &p, nil
+		}
+	}
+	return nil, ErrPartNotFound
+}
+
+// DecodeHeader decodes RFC 2047 encoded words in a header value.
+func DecodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// StripHTML removes all tags from the HTML document and unescapes entities.
+func StripHTML(s string) string {
+	var b strings.Builder
+	inTag := false
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>' && inTag:
+			inTag = false
+			b.WriteRune(' ')
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+	return html.UnescapeString(b.String())
+}
+
+func (m *Message) walk(header textproto.MIMEHeader, body []byte, id string, depth int) error {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		contentType = "text/plain"
+		params = map[string]string{}
+	}
+
+	// The top level part of a single part message is numbered "1"
+	partID := id
+	if partID == "" {
+		partID = "1"
+	}
+
+	p := Part{
+		ID:          partID,
+		Header:      header,
+		ContentType: strings.ToLower(contentType),
+		Params:      params,
+		ContentID:   strings.Trim(header.Get("Content-Id"), "<> "),
+	}
+
+	if disposition, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		p.Disposition = strings.ToLower(disposition)
+		p.Filename = DecodeHeader(dparams["filename"])
+	}
+	if p.Filename == "" && params["name"] != "" {
+		p.Filename = DecodeHeader(params["name"])
+	}
+
+	if !p.IsMultipart() || depth >= maxDepth {
+		p.Content = decodeTransfer(body, header.Get("Content-Transfer-Encoding"))
+		m.Parts = append(m.Parts, p)
+		return nil
+	}
+
+	if id != "" {
+		m.Parts = append(m.Parts, p)
+	}
+
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for i := 1; ; i++ {
+		child, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Keep what could be parsed of broken messages
+			break
+		}
+
+		content, err := io.ReadAll(child)
+		if err != nil {
+			break
+		}
+
+		childID := fmt.Sprintf("%d", i)
+		if id != "" {
+			childID = id + "." + childID
+		}
+
+		if err := m.walk(child.Header, content, childID, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// split separates the headers from the content of the mail.
+func split(m mails.Mail) (textproto.MIMEHeader, []byte) {
+	body := strings.ReplaceAll(m.Body, "\r\n", "\n")
+
+	if hasHeaders(body, m.Headers) {
+		parsed, _ := mail.ReadMessage(strings.NewReader(body))
+		content, _ := io.ReadAll(parsed.Body)
+		return textproto.MIMEHeader(parsed.Header), content
+	}
+
+	header := textproto.MIMEHeader{}
+	for k, v := range m.Headers {
+		header.Set(k, v)
+	}
+	return header, []byte(body)
+}
+
+// hasHeaders reports whether the body starts with the headers of the mail.
+func hasHeaders(body string, stored map[string]string) bool {
+	parsed, err := mail.ReadMessage(strings.NewReader(body))
+	return err == nil && len(parsed.Header) > 0 && matchesHeaders(parsed.Header, stored)
+}
+
+// matchesHeaders reports whether the parsed headers belong to the stored mail,
+// so a body that merely looks like it starts with headers is not mistaken for them.
+func matchesHeaders(parsed mail.Header, stored map[string]string) bool {
+	if len(stored) == 0 {
+		return true
+	}
+
+	for k := range stored {
+		if parsed.Get(k) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeTransfer(content []byte, encoding string) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		cleaned := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, string(content))
+
+		decoded, err := base64.StdEncoding.DecodeString(cleaned)
+		if err != nil {
+			return content
+		}
+		return decoded
+
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(content)))
+		if err != nil {
+			return content
+		}
+		return decoded
+	}
+
+	return content
+}
+
+func decodeCharset(content []byte, charset string) string {
+	r, err := charsetReader(charset, bytes.NewReader(content))
+	if err != nil {
+		return string(content)
+	}
+
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return string(content)
+	}
+	return string(decoded)
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset == "" || charset == "utf-8" || charset == "us-ascii" {
+		return input, nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(bufio.NewReader(input)), nil
+}
@@ -0,0 +1,94 @@
+package message
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+)
+
+func TestParseMultipart(t *testing.T) {
+	m := mails.Mail{
+		Headers: map[string]string{"Subject": "=?ISO-8859-1?Q?Gr=FC=DFe?="},
+		Body: "Subject: =?ISO-8859-1?Q?Gr=FC=DFe?=\r\n" +
+			"From: \"Bob\" <bob@example.com>\r\n" +
+			"Content-Type: multipart/mixed; boundary=outer\r\n" +
+			"\r\n" +
+			"--outer\r\n" +
+			"Content-Type: multipart/alternative; boundary=inner\r\n" +
+			"\r\n" +
+			"--inner\r\n" +
+			"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Sch=F6ne Gr=FC=DFe\r\n" +
+			"--inner\r\n" +
+			"Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<p>Sch&ouml;ne Gr&uuml;&szlig;e</p>\r\n" +
+			"--inner--\r\n" +
+			"--outer\r\n" +
+			"Content-Type: text/plain; name=\"notes.txt\"\r\n" +
+			"Content-Disposition: attachment\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"aGVsbG8=\r\n" +
+			"--outer--\r\n",
+	}
+
+	msg, err := Parse(m)
+	if err != nil {
+		t.Fatalf("Parse: unexpected error: %v", err)
+	}
+
+	if got := msg.Subject(); got != "Grüße" {
+		t.Errorf("Subject: expected %q, got %q", "Grüße", got)
+	}
+	if from := msg.Addresses("From"); len(from) != 1 || from[0].Address != "bob@example.com" || from[0].Name != "Bob" {
+		t.Errorf("Addresses: unexpected result %v", from)
+	}
+	if got := msg.Text(); got != "Schöne Grüße" {
+		t.Errorf("Text: expected plain text part, got %q", got)
+	}
+
+	attachments := msg.Attachments()
+	if len(attachments) != 1 || attachments[0].Filename != "notes.txt" || string(attachments[0].Content) != "hello" {
+		t.Fatalf("Attachments: unexpected result %+v", attachments)
+	}
+	if attachments[0].ID != "2" {
+		t.Errorf("Attachments: expected part ID 2, got %q", attachments[0].ID)
+	}
+
+	p, err := msg.Part("1.2")
+	if err != nil {
+		t.Fatalf("Part: unexpected error: %v", err)
+	}
+	if p.ContentType != "text/html" {
+		t.Errorf("Part: expected text/html, got %q", p.ContentType)
+	}
+	if _, err := msg.Part("3"); !errors.Is(err, ErrPartNotFound) {
+		t.Errorf("Part: expected ErrPartNotFound, got %v", err)
+	}
+}
+
+func TestParseBodyWithoutHeaders(t *testing.T) {
+	m := mails.Mail{
+		Headers: map[string]string{
+			"Subject":      "Hello",
+			"Content-Type": "text/html; charset=UTF-8",
+		},
+		Body: "Note: this is <b>important</b>",
+	}
+
+	msg, err := Parse(m)
+	if err != nil {
+		t.Fatalf("Parse: unexpected error: %v", err)
+	}
+
+	if got := msg.Subject(); got != "Hello" {
+		t.Errorf("Subject: expected stored header, got %q", got)
+	}
+	if got := msg.Text(); got != "Note: this is  important " {
+		t.Errorf("Text: expected body without tags, got %q", got)
+	}
+}
@@ -0,0 +1,32 @@
+package message
+
+import "net/textproto"
+
+type Message struct {
+	Header textproto.MIMEHeader
+	Parts  []Part // all parts in depth-first order, including multipart containers
+}
+
+type Part struct {
+	ID          string               // IMAP part specifier, e.g. "1" or "2.1"
+	Header      textproto.MIMEHeader // headers of the part
+	ContentType string               // media type in lower case, e.g. "text/plain"
+	Params      map[string]string    // parameters of the content type, e.g. charset
+	Disposition string               // "inline", "attachment" or empty
+	Filename    string               // decoded filename, if any
+	ContentID   string               // Content-ID without angle brackets, if any
+	Content     []byte               // transfer-decoded content, nil for multipart containers
+}
+
+// IsMultipart reports whether the part is a container for other parts.
+func (p Part) IsMultipart() bool {
+	return len(p.ContentType) > 10 && p.ContentType[:10] == "multipart/"
+}
+
+// IsAttachment reports whether the part is a file rather than message text.
+func (p Part) IsAttachment() bool {
+	if p.IsMultipart() {
+		return false
+	}
+	return p.Disposition == "attachment" || p.Filename != ""
+}
@@ -0,0 +1,128 @@
+package fake
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+)
+
+type DB struct {
+	Items map[string]outbox.Message
+	mu    sync.Mutex
+}
+
+func NewDB() *DB {
+	return &DB{
+		Items: make(map[string]outbox.Message),
+		mu:    sync.Mutex{},
+	}
+}
+
+func (db *DB) Insert(m outbox.Message) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[m.ID]; exists {
+		return outbox.ErrMessageAlreadyExists
+	}
+	db.Items[m.ID] = clone(m)
+	return nil
+}
+
+func (db *DB) Get(userID, id string) (*outbox.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, exists := db.Items[id]
+	if !exists || m.UserID != userID {
+		return nil, outbox.ErrMessageNotFound
+	}
+	m = clone(m)
+	return &m, nil
+}
+
+func (db *DB) List(userID string) ([]outbox.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	list := []outbox.Message{}
+	for _, m := range db.Items {
+		if m.UserID == userID {
+			list = append(list, clone(m))
+		}
+	}
+	sortBySendAt(list)
+	return list, nil
+}
+
+func (db *DB) Update(m outbox.Message) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	existing, exists := db.Items[m.ID]
+	if !exists || existing.UserID != m.UserID {
+		return outbox.ErrMessageNotFound
+	}
+	db.Items[m.ID] = clone(m)
+	return nil
+}
+
+func (db *DB) Delete(userID, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, exists := db.Items[id]
+	if !exists || m.UserID != userID {
+		return outbox.ErrMessageNotFound
+	}
+	delete(db.Items, id)
+	return nil
+}
+
+func (db *DB) Claim(userID, id string, now, until time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, exists := db.Items[id]
+	if !exists || m.UserID != userID {
+		return outbox.ErrMessageNotFound
+	}
+	if m.ClaimedUntil.After(now) {
+		return outbox.ErrMessageClaimed
+	}
+	m.ClaimedUntil = until
+	db.Items[id] = m
+	return nil
+}
+
+func (db *DB) Due(now time.Time) ([]outbox.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	due := []outbox.Message{}
+	for _, m := range db.Items {
+		if !m.SendAt.After(now) && !m.ClaimedUntil.After(now) {
+			due = append(due, clone(m))
+		}
+	}
+	sortBySendAt(due)
+	return due, nil
+}
+
+func sortBySendAt(list []outbox.Message) {
+	slices.SortFunc(list, func(a, b outbox.Message) int {
+		if c := a.SendAt.Compare(b.SendAt); c != 0 {
+			return c
+		}
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+}
+
+func clone(m outbox.Message) outbox.Message {
+	m.Recipients = slices.Clone(m.Recipients)
+	m.Bcc = slices.Clone(m.Bcc)
+	m.Raw = slices.Clone(m.Raw)
+	return m
+}
@@ -0,0 +1,14 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+	"github.com/OliverSchlueter/mail-server/internal/outbox/outboxtest"
+)
+
+func TestDB(t *testing.T) {
+	outboxtest.RunDBSuite(t, func() outbox.DB {
+		return NewDB()
+	})
+}
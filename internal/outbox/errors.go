@@ -0,0 +1,11 @@
+package outbox
+
+import "errors"
+
+var (
+	ErrMessageNotFound      = errors.New("message not found")
+	ErrMessageAlreadyExists = errors.New("message already exists")
+	ErrMessageClaimed       = errors.New("message is being sent")
+	ErrPartiallySent        = errors.New("not all recipients were sent the mail")
+	ErrNotStored            = errors.New("mail was sent but could not be stored")
+)
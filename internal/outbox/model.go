@@ -0,0 +1,21 @@
+package outbox
+
+import "time"
+
+// Message is an outgoing mail that waits to be sent.
+type Message struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	MailboxUID uint32    `json:"mailbox_uid"` // mailbox that keeps the copy once it was sent
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	Bcc        []string  `json:"bcc"` // only listed in the copy, they are part of Recipients
+	Subject    string    `json:"subject"`
+	Raw        []byte    `json:"-"` // the encoded message with CRLF line endings
+	SendAt     time.Time `json:"send_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	Attempts   int       `json:"attempts"` // failed attempts to send the message
+
+	// ClaimedUntil is set while the message is sent or changed
+	ClaimedUntil time.Time `json:"-"`
+}
@@ -0,0 +1,335 @@
+// Package outbox holds outgoing mails until their send time and dispatches
+// them through SMTP, so sends can be scheduled or undone within a hold window.
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/idgen"
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/smtp"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+const (
+	DefaultInterval    = 5 * time.Second
+	DefaultMaxAttempts = 5
+	DefaultRetryDelay  = time.Minute
+
+	// claimDuration is how long a message is claimed while it is sent or
+	// changed. If the server stops in the meantime, the message is sent once
+	// the claim expired.
+	claimDuration = 10 * time.Minute
+)
+
+type DB interface {
+	Insert(m Message) error
+	Get(userID, id string) (*Message, error)
+	// List returns the pending messages of the user, ordered by their send time.
+	List(userID string) ([]Message, error)
+	Update(m Message) error
+	Delete(userID, id string) error
+	// Claim marks the message as being sent until the given time. It fails
+	// with ErrMessageClaimed if the message is still claimed at now.
+	Claim(userID, id string, now, until time.Time) error
+	// Due returns the pending messages of all users with a send time not after
+	// now, that are not claimed at now.
+	Due(now time.Time) ([]Message, error)
+}
+
+// SendFunc delivers the mail and returns the number of recipients it was sent to.
+type SendFunc func(m smtp.Mail) (int, error)
+
+type Service struct {
+	db          DB
+	mails       mails.Store
+	users       *users.Store
+	send        SendFunc
+	interval    time.Duration
+	maxAttempts int
+	retryDelay  time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+type Configuration struct {
+	DB          DB
+	Mails       mails.Store   // keeps the copy of sent messages
+	Users       *users.Store  // optional, messages of users that were disabled or deleted in the meantime are dropped
+	Send        SendFunc      // defaults to smtp.SendMail
+	Interval    time.Duration // how often due messages are dispatched
+	MaxAttempts int           // attempts to send a message before it is dropped
+	RetryDelay  time.Duration // delay after the first failed attempt, doubled with every further attempt
+}
+
+func NewService(cfg Configuration) *Service {
+	if cfg.Send == nil {
+		cfg.Send = smtp.SendMail
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if cfg.RetryDelay == 0 {
+		cfg.RetryDelay = DefaultRetryDelay
+	}
+
+	return &Service{
+		db:          cfg.DB,
+		mails:       cfg.Mails,
+		users:       cfg.Users,
+		send:        cfg.Send,
+		interval:    cfg.Interval,
+		maxAttempts: cfg.MaxAttempts,
+		retryDelay:  cfg.RetryDelay,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Schedule stores the message until its send time and returns it with its
+// assigned ID.
+func (s *Service) Schedule(m Message) (*Message, error) {
+	m.ID = idgen.GenerateID(20)
+	m.CreatedAt = time.Now()
+	m.Attempts = 0
+	if m.SendAt.IsZero() {
+		m.SendAt = m.CreatedAt
+	}
+
+	if err := s.db.Insert(m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *Service) List(userID string) ([]Message, error) {
+	return s.db.List(userID)
+}
+
+func (s *Service) Get(userID, id string) (*Message, error) {
+	return s.db.Get(userID, id)
+}
+
+// Reschedule changes the send time of a pending message. A send time in the
+// past sends the message with the next dispatch. Messages that are being sent
+// can not be changed, they fail with ErrMessageClaimed.
+func (s *Service) Reschedule(userID, id string, sendAt time.Time) (*Message, error) {
+	now := time.Now()
+	if err := s.db.Claim(userID, id, now, now.Add(claimDuration)); err != nil {
+		return nil, err
+	}
+
+	m, err := s.db.Get(userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	m.SendAt = sendAt
+	m.ClaimedUntil = time.Time{}
+	if err := s.db.Update(*m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Cancel removes a pending message, so it is never sent. Messages that are
+// being sent can not be cancelled, they fail with ErrMessageClaimed.
+func (s *Service) Cancel(userID, id string) error {
+	now := time.Now()
+	if err := s.db.Claim(userID, id, now, now.Add(claimDuration)); err != nil {
+		return err
+	}
+	return s.db.Delete(userID, id)
+}
+
+// Start dispatches due messages until Stop is called.
+func (s *Service) Start() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.Dispatch(now)
+		}
+	}
+}
+
+func (s *Service) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// Dispatch sends all messages that are due at the given time. Messages that
+// fail to send are retried later, until they ran out of attempts.
+func (s *Service) Dispatch(now time.Time) {
+	due, err := s.db.Due(now)
+	if err != nil {
+		slog.Error("Failed to get due messages", sloki.WrapError(err))
+		return
+	}
+
+	for _, m := range due {
+		// Claim the message first, so it can not be cancelled while it is sent.
+		// It is only removed once it was sent, so it is not lost if the server
+		// stops in the meantime.
+		if err := s.db.Claim(m.UserID, m.ID, now, now.Add(claimDuration)); err != nil {
+			if !errors.Is(err, ErrMessageNotFound) && !errors.Is(err, ErrMessageClaimed) {
+				slog.Error("Failed to claim due message", slog.String("user_id", m.UserID), slog.String("id", m.ID), sloki.WrapError(err))
+			}
+			continue
+		}
+		m.ClaimedUntil = time.Time{}
+
+		disabled, err := s.userDisabled(m.UserID)
+		if err != nil {
+			slog.Error("Failed to get user of due message", slog.String("user_id", m.UserID), slog.String("id", m.ID), sloki.WrapError(err))
+			s.update(m)
+			continue
+		}
+		if disabled {
+			slog.Warn("Dropped scheduled message of disabled user", slog.String("user_id", m.UserID), slog.String("id", m.ID))
+			s.remove(m)
+			continue
+		}
+
+		// The message is dated when it is sent, not when it was scheduled
+		m.Raw = withDate(m.Raw, now)
+
+		err = Deliver(s.mails, s.send, m)
+		if err == nil {
+			s.remove(m)
+			continue
+		}
+
+		// A message that reached some recipients is not sent again, to not duplicate it
+		m.Attempts++
+		if m.Attempts >= s.maxAttempts || errors.Is(err, ErrPartiallySent) || errors.Is(err, ErrNotStored) {
+			slog.Error("Failed to send scheduled message", slog.String("user_id", m.UserID), slog.String("id", m.ID), slog.Int("attempts", m.Attempts), sloki.WrapError(err))
+			s.remove(m)
+			continue
+		}
+
+		m.SendAt = now.Add(s.retryDelay << (m.Attempts - 1))
+		if s.update(m) {
+			slog.Warn("Failed to send scheduled message, retrying later", slog.String("user_id", m.UserID), slog.String("id", m.ID), slog.Int("attempts", m.Attempts), sloki.WrapError(err))
+		}
+	}
+}
+
+// userDisabled reports whether the user was disabled or deleted after the
+// message was scheduled.
+func (s *Service) userDisabled(userID string) (bool, error) {
+	if s.users == nil {
+		return false, nil
+	}
+
+	u, err := s.users.GetByID(userID)
+	if errors.Is(err, users.ErrUserNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return u.Disabled, nil
+}
+
+// update stores the claimed message again, which releases the claim.
+func (s *Service) update(m Message) bool {
+	if err := s.db.Update(m); err != nil {
+		slog.Error("Failed to reschedule message", slog.String("user_id", m.UserID), slog.String("id", m.ID), sloki.WrapError(err))
+		return false
+	}
+	return true
+}
+
+// remove deletes the claimed message once it was sent or dropped.
+func (s *Service) remove(m Message) {
+	if err := s.db.Delete(m.UserID, m.ID); err != nil {
+		slog.Error("Failed to remove dispatched message", slog.String("user_id", m.UserID), slog.String("id", m.ID), sloki.WrapError(err))
+	}
+}
+
+// Deliver sends the message and keeps a copy in its mailbox. The copy lists
+// the Bcc recipients, which are not part of the sent message.
+func Deliver(ms mails.Store, send SendFunc, m Message) error {
+	smtpMail := smtp.Mail{
+		Outgoing:    true,
+		From:        m.From,
+		To:          m.Recipients,
+		DataBuffer:  strings.Split(strings.TrimSuffix(string(m.Raw), "\r\n"), "\r\n"),
+		ReadingData: false,
+	}
+
+	count, err := send(smtpMail)
+	if err != nil {
+		return err
+	}
+	if count != len(m.Recipients) {
+		return ErrPartiallySent
+	}
+
+	headers := smtpMail.Headers()
+	if len(m.Bcc) > 0 {
+		headers["Bcc"] = strings.Join(m.Bcc, ", ")
+	}
+
+	copied := mails.Mail{
+		UID:        mails.RandomUID(),
+		MailboxUID: m.MailboxUID,
+		Flags:      []string{},
+		Date:       time.Now(),
+		Size:       smtpMail.Size(),
+		Headers:    headers,
+		Body:       smtpMail.Body(),
+	}
+	if err := ms.CreateMail(m.UserID, m.MailboxUID, copied); err != nil {
+		return fmt.Errorf("%w: %w", ErrNotStored, err)
+	}
+
+	return nil
+}
+
+// withDate replaces the Date header of the encoded message, or adds one if it
+// has none.
+func withDate(raw []byte, date time.Time) []byte {
+	head, body, found := strings.Cut(string(raw), "\r\n\r\n")
+	field := "Date: " + date.Format(time.RFC1123Z)
+
+	var lines []string
+	replaced, inDate := false, false
+	for _, line := range strings.Split(head, "\r\n") {
+		// Folded lines continue the header before them
+		if inDate && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		inDate = strings.EqualFold(strings.TrimSpace(name), "Date")
+		switch {
+		case !inDate:
+			lines = append(lines, line)
+		case !replaced:
+			lines = append(lines, field)
+			replaced = true
+		}
+	}
+	if !replaced {
+		lines = append([]string{field}, lines...)
+	}
+
+	out := strings.Join(lines, "\r\n")
+	if found {
+		out += "\r\n\r\n" + body
+	}
+	return []byte(out)
+}
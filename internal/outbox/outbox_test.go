@@ -0,0 +1,205 @@
+package outbox_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+	"github.com/OliverSchlueter/mail-server/internal/outbox/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/smtp"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	udb "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func TestDispatch(t *testing.T) {
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+	if err := ms.CreateMailbox(mails.Mailbox{UserID: "alice", Name: mails.SentMailboxName, Flags: []string{}}); err != nil {
+		t.Fatalf("CreateMailbox: unexpected error: %v", err)
+	}
+	sent, err := ms.GetMailboxByName("alice", mails.SentMailboxName)
+	if err != nil {
+		t.Fatalf("GetMailboxByName: unexpected error: %v", err)
+	}
+
+	var delivered []smtp.Mail
+	fail := true
+	s := outbox.NewService(outbox.Configuration{
+		DB:    fake.NewDB(),
+		Mails: *ms,
+		Send: func(m smtp.Mail) (int, error) {
+			if fail {
+				return 0, errors.New("connection refused")
+			}
+			delivered = append(delivered, m)
+			return len(m.To), nil
+		},
+		RetryDelay: time.Minute,
+	})
+
+	now := time.Now()
+	scheduled, err := s.Schedule(outbox.Message{
+		UserID:     "alice",
+		MailboxUID: sent.UID,
+		From:       "alice@example.com",
+		Recipients: []string{"bob@example.com", "carol@example.com"},
+		Bcc:        []string{"carol@example.com"},
+		Subject:    "Hello",
+		Raw:        []byte("From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Hello\r\n\r\nHi Bob\r\n"),
+		SendAt:     now.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("Schedule: unexpected error: %v", err)
+	}
+	cancelled, err := s.Schedule(outbox.Message{UserID: "alice", SendAt: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("Schedule: unexpected error: %v", err)
+	}
+
+	// Nothing is sent before the send time
+	s.Dispatch(now)
+	if list, _ := s.List("alice"); len(list) != 2 {
+		t.Fatalf("List: expected 2 pending messages, got %d", len(list))
+	}
+
+	if err := s.Cancel("alice", cancelled.ID); err != nil {
+		t.Fatalf("Cancel: unexpected error: %v", err)
+	}
+
+	// A failed attempt is retried after the retry delay
+	s.Dispatch(now.Add(time.Minute))
+	retried, err := s.Get("alice", scheduled.ID)
+	if err != nil {
+		t.Fatalf("Get: expected message to be kept for a retry, got %v", err)
+	}
+	if retried.Attempts != 1 || !retried.SendAt.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("Get: unexpected retry %+v", retried)
+	}
+
+	fail = false
+	if _, err := s.Reschedule("alice", scheduled.ID, now); err != nil {
+		t.Fatalf("Reschedule: unexpected error: %v", err)
+	}
+	s.Dispatch(now.Add(time.Minute))
+
+	if len(delivered) != 1 || len(delivered[0].To) != 2 {
+		t.Fatalf("Expected message to be delivered once to both recipients, got %+v", delivered)
+	}
+	if date := delivered[0].Headers()["Date"]; date != now.Add(time.Minute).Format(time.RFC1123Z) {
+		t.Errorf("Expected message to be dated at its dispatch, got %q", date)
+	}
+	if _, err := s.Get("alice", scheduled.ID); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Get: expected sent message to be removed, got %v", err)
+	}
+	if err := s.Cancel("alice", scheduled.ID); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Cancel: expected sent message to not be cancellable, got %v", err)
+	}
+
+	copies, err := ms.ListMails("alice", sent.UID, mails.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListMails: unexpected error: %v", err)
+	}
+	if len(copies.Mails) != 1 || copies.Mails[0].Header("Bcc") != "carol@example.com" {
+		t.Errorf("Expected a copy with the Bcc recipients in the sent mailbox, got %+v", copies.Mails)
+	}
+}
+
+func TestDispatchClaims(t *testing.T) {
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+	if err := ms.CreateMailbox(mails.Mailbox{UserID: "alice", Name: mails.SentMailboxName, Flags: []string{}}); err != nil {
+		t.Fatalf("CreateMailbox: unexpected error: %v", err)
+	}
+	sent, err := ms.GetMailboxByName("alice", mails.SentMailboxName)
+	if err != nil {
+		t.Fatalf("GetMailboxByName: unexpected error: %v", err)
+	}
+
+	var s *outbox.Service
+	var sending *outbox.Message
+	sends := 0
+	s = outbox.NewService(outbox.Configuration{
+		DB:    fake.NewDB(),
+		Mails: *ms,
+		Send: func(m smtp.Mail) (int, error) {
+			sends++
+
+			// The message stays in the outbox while it is sent, but can no longer be changed
+			if _, err := s.Get("alice", sending.ID); err != nil {
+				t.Errorf("Get: expected message to be kept while it is sent, got %v", err)
+			}
+			if err := s.Cancel("alice", sending.ID); !errors.Is(err, outbox.ErrMessageClaimed) {
+				t.Errorf("Cancel: expected ErrMessageClaimed while sending, got %v", err)
+			}
+			if _, err := s.Reschedule("alice", sending.ID, time.Now().Add(time.Hour)); !errors.Is(err, outbox.ErrMessageClaimed) {
+				t.Errorf("Reschedule: expected ErrMessageClaimed while sending, got %v", err)
+			}
+
+			// A dispatch that overlaps with the running one does not send the message again
+			s.Dispatch(time.Now())
+			return len(m.To), nil
+		},
+	})
+
+	sending, err = s.Schedule(outbox.Message{
+		UserID:     "alice",
+		MailboxUID: sent.UID,
+		From:       "alice@example.com",
+		Recipients: []string{"bob@example.com"},
+		Raw:        []byte("From: alice@example.com\r\nTo: bob@example.com\r\n\r\nHi Bob\r\n"),
+	})
+	if err != nil {
+		t.Fatalf("Schedule: unexpected error: %v", err)
+	}
+
+	s.Dispatch(time.Now())
+	if sends != 1 {
+		t.Errorf("Expected message to be sent once, got %d sends", sends)
+	}
+	if _, err := s.Get("alice", sending.ID); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Get: expected sent message to be removed, got %v", err)
+	}
+}
+
+func TestDispatchDisabledUser(t *testing.T) {
+	us := users.NewStore(users.Configuration{DB: udb.NewDB()})
+	alice, err := us.CreateUser(users.User{Name: "alice", Password: "alice123", PrimaryEmail: "alice@example.com", Emails: []string{"alice@example.com"}})
+	if err != nil {
+		t.Fatalf("CreateUser: unexpected error: %v", err)
+	}
+
+	sends := 0
+	s := outbox.NewService(outbox.Configuration{
+		DB:    fake.NewDB(),
+		Mails: *mails.NewStore(mails.Configuration{DB: mdb.NewDB()}),
+		Users: us,
+		Send: func(m smtp.Mail) (int, error) {
+			sends++
+			return len(m.To), nil
+		},
+	})
+
+	scheduled, err := s.Schedule(outbox.Message{
+		UserID:     alice.ID,
+		From:       "alice@example.com",
+		Recipients: []string{"bob@example.com"},
+		Raw:        []byte("From: alice@example.com\r\nTo: bob@example.com\r\n\r\nHi Bob\r\n"),
+	})
+	if err != nil {
+		t.Fatalf("Schedule: unexpected error: %v", err)
+	}
+
+	// Users that were disabled after scheduling a message do not send it
+	if err := us.SetDisabled(alice.ID, true); err != nil {
+		t.Fatalf("SetDisabled: unexpected error: %v", err)
+	}
+	s.Dispatch(time.Now())
+
+	if sends != 0 {
+		t.Errorf("Expected message of disabled user to not be sent, got %d sends", sends)
+	}
+	if _, err := s.Get(alice.ID, scheduled.ID); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Get: expected message of disabled user to be dropped, got %v", err)
+	}
+}
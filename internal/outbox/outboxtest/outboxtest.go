@@ -0,0 +1,178 @@
+// Package outboxtest provides a conformance test suite that every outbox.DB
+// implementation is expected to pass.
+package outboxtest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/outbox"
+)
+
+// RunDBSuite runs all conformance tests against the outbox.DB returned by newDB.
+// newDB is called once per test and must return an empty database.
+func RunDBSuite(t *testing.T, newDB func() outbox.DB) {
+	t.Run("NotFound", func(t *testing.T) { TestNotFound(t, newDB()) })
+	t.Run("InsertGet", func(t *testing.T) { TestInsertGet(t, newDB()) })
+	t.Run("ListAndDue", func(t *testing.T) { TestListAndDue(t, newDB()) })
+	t.Run("UpdateDelete", func(t *testing.T) { TestUpdateDelete(t, newDB()) })
+	t.Run("Claim", func(t *testing.T) { TestClaim(t, newDB()) })
+}
+
+func TestNotFound(t *testing.T, db outbox.DB) {
+	if _, err := db.Get("user", "missing"); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Get: expected ErrMessageNotFound, got %v", err)
+	}
+	if err := db.Update(outbox.Message{ID: "missing", UserID: "user"}); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Update: expected ErrMessageNotFound, got %v", err)
+	}
+	if err := db.Delete("user", "missing"); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Delete: expected ErrMessageNotFound, got %v", err)
+	}
+	if err := db.Claim("user", "missing", time.Now(), time.Now()); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Claim: expected ErrMessageNotFound, got %v", err)
+	}
+}
+
+func TestInsertGet(t *testing.T, db outbox.DB) {
+	m := message("1", "alice", time.Now())
+	if err := db.Insert(m); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+	if err := db.Insert(m); !errors.Is(err, outbox.ErrMessageAlreadyExists) {
+		t.Errorf("Insert: expected ErrMessageAlreadyExists, got %v", err)
+	}
+
+	got, err := db.Get("alice", "1")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if !bytes.Equal(got.Raw, m.Raw) || len(got.Recipients) != 1 || got.Recipients[0] != m.Recipients[0] || !got.SendAt.Equal(m.SendAt) {
+		t.Errorf("Get: stored message does not match: %+v", got)
+	}
+
+	// Messages are only visible to the user they belong to
+	if _, err := db.Get("bob", "1"); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Get: expected ErrMessageNotFound for other user, got %v", err)
+	}
+}
+
+func TestListAndDue(t *testing.T, db outbox.DB) {
+	now := time.Now()
+	for _, m := range []outbox.Message{
+		message("later", "alice", now.Add(time.Hour)),
+		message("due", "alice", now.Add(-time.Minute)),
+		message("other", "bob", now),
+	} {
+		if err := db.Insert(m); err != nil {
+			t.Fatalf("Insert: unexpected error: %v", err)
+		}
+	}
+
+	list, err := db.List("alice")
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(list) != 2 || list[0].ID != "due" || list[1].ID != "later" {
+		t.Errorf("List: expected [due later], got %v", ids(list))
+	}
+
+	due, err := db.Due(now)
+	if err != nil {
+		t.Fatalf("Due: unexpected error: %v", err)
+	}
+	if len(due) != 2 || due[0].ID != "due" || due[1].ID != "other" {
+		t.Errorf("Due: expected [due other], got %v", ids(due))
+	}
+}
+
+func TestUpdateDelete(t *testing.T, db outbox.DB) {
+	m := message("1", "alice", time.Now())
+	if err := db.Insert(m); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+
+	m.SendAt = m.SendAt.Add(time.Hour)
+	m.Attempts = 2
+	if err := db.Update(m); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+	got, err := db.Get("alice", "1")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if !got.SendAt.Equal(m.SendAt) || got.Attempts != 2 {
+		t.Errorf("Get: update not stored: %+v", got)
+	}
+
+	if err := db.Delete("bob", "1"); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Delete: expected ErrMessageNotFound for other user, got %v", err)
+	}
+	if err := db.Delete("alice", "1"); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	if _, err := db.Get("alice", "1"); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Get: expected ErrMessageNotFound after delete, got %v", err)
+	}
+}
+
+func TestClaim(t *testing.T, db outbox.DB) {
+	now := time.Now()
+	m := message("1", "alice", now)
+	if err := db.Insert(m); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+
+	if err := db.Claim("bob", "1", now, now.Add(time.Minute)); !errors.Is(err, outbox.ErrMessageNotFound) {
+		t.Errorf("Claim: expected ErrMessageNotFound for other user, got %v", err)
+	}
+	if err := db.Claim("alice", "1", now, now.Add(time.Minute)); err != nil {
+		t.Fatalf("Claim: unexpected error: %v", err)
+	}
+	if err := db.Claim("alice", "1", now, now.Add(time.Minute)); !errors.Is(err, outbox.ErrMessageClaimed) {
+		t.Errorf("Claim: expected ErrMessageClaimed while claimed, got %v", err)
+	}
+
+	// Claimed messages are not due until their claim expired
+	if due, err := db.Due(now); err != nil || len(due) != 0 {
+		t.Errorf("Due: expected no claimed messages, got %v (%v)", ids(due), err)
+	}
+	later := now.Add(2 * time.Minute)
+	if due, err := db.Due(later); err != nil || len(due) != 1 {
+		t.Errorf("Due: expected message once the claim expired, got %v (%v)", ids(due), err)
+	}
+	if err := db.Claim("alice", "1", later, later.Add(time.Minute)); err != nil {
+		t.Errorf("Claim: expected expired claim to be claimable, got %v", err)
+	}
+
+	// Updating the message releases the claim
+	if err := db.Update(m); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+	if err := db.Claim("alice", "1", now, now.Add(time.Minute)); err != nil {
+		t.Errorf("Claim: expected updated message to be claimable, got %v", err)
+	}
+}
+
+func message(id, userID string, sendAt time.Time) outbox.Message {
+	return outbox.Message{
+		ID:         id,
+		UserID:     userID,
+		From:       userID + "@example.com",
+		Recipients: []string{"carol@example.com"},
+		Subject:    "Hello",
+		Raw:        []byte("Subject: Hello\r\n\r\nHi\r\n"),
+		SendAt:     sendAt,
+		CreatedAt:  time.Now(),
+	}
+}
+
+func ids(list []outbox.Message) []string {
+	var ids []string
+	for _, m := range list {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
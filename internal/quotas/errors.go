@@ -0,0 +1,7 @@
+package quotas
+
+import "errors"
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
@@ -0,0 +1,18 @@
+package quotas
+
+// UserRoot is the name of the quota root covering all mailboxes of a user.
+const UserRoot = ""
+
+type Usage struct {
+	Root  string `json:"root"`  // UserRoot or the name of a mailbox with its own limit
+	Used  int64  `json:"used"`  // in bytes
+	Limit int64  `json:"limit"` // in bytes, 0 means unlimited
+}
+
+// Percent returns how much of the limit is used, or 0 if there is no limit.
+func (u Usage) Percent() int {
+	if u.Limit <= 0 {
+		return 0
+	}
+	return int(u.Used * 100 / u.Limit)
+}
@@ -0,0 +1,215 @@
+package quotas
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+var DefaultWarningThresholds = []int{80, 90, 100}
+
+type Service struct {
+	hostname          string
+	mails             mails.Store
+	warningThresholds []int
+	domains           *domains.Store
+
+	mu     *sync.Mutex
+	warned map[string]int // user ID -> highest threshold the user was warned about
+}
+
+type Configuration struct {
+	Hostname string
+	Mails    mails.Store
+	// WarningThresholds are the percentages of the storage limit at which a
+	// warning mail is delivered to the user.
+	WarningThresholds []int
+	// Domains is optional. If set, users without a storage limit of their own
+	// get the default limit of the domain of their primary address.
+	Domains *domains.Store
+}
+
+func NewService(cfg Configuration) *Service {
+	if cfg.WarningThresholds == nil {
+		cfg.WarningThresholds = DefaultWarningThresholds
+	}
+
+	thresholds := slices.Clone(cfg.WarningThresholds)
+	slices.Sort(thresholds)
+
+	return &Service{
+		hostname:          cfg.Hostname,
+		mails:             cfg.Mails,
+		warningThresholds: thresholds,
+		domains:           cfg.Domains,
+		mu:                &sync.Mutex{},
+		warned:            map[string]int{},
+	}
+}
+
+// GetUsage returns the usage of all mailboxes of the user.
+func (s *Service) GetUsage(u *users.User) (*Usage, error) {
+	used, err := s.mails.GetUsage(u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Usage{
+		Root:  UserRoot,
+		Used:  used,
+		Limit: s.StorageLimit(u),
+	}, nil
+}
+
+// StorageLimit returns the storage limit of the user in bytes, 0 means unlimited.
+func (s *Service) StorageLimit(u *users.User) int64 {
+	if u.Quota.StorageLimit > 0 || s.domains == nil {
+		return u.Quota.StorageLimit
+	}
+
+	d, err := s.domains.Get(domains.DomainOf(u.PrimaryEmail))
+	if err != nil {
+		if !errors.Is(err, domains.ErrDomainNotFound) {
+			slog.Warn("Failed to get domain of user", slog.String("user_id", u.ID), sloki.WrapError(err))
+		}
+		return u.Quota.StorageLimit
+	}
+	return d.DefaultStorageLimit
+}
+
+// GetMailboxUsage returns the usage of the mailbox, if it has its own limit.
+func (s *Service) GetMailboxUsage(u *users.User, mailboxName string) (*Usage, error) {
+	limit, ok := u.Quota.MailboxLimits[mailboxName]
+	if !ok {
+		return nil, mails.ErrMailboxNotFound
+	}
+
+	mb, err := s.mails.GetMailboxByName(u.ID, mailboxName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Usage{
+		Root:  mailboxName,
+		Used:  mb.Size,
+		Limit: limit,
+	}, nil
+}
+
+// GetRoots returns the quota roots that apply to the mailbox.
+func (s *Service) GetRoots(u *users.User, mailboxName string) []string {
+	var roots []string
+	if s.StorageLimit(u) > 0 {
+		roots = append(roots, UserRoot)
+	}
+	if _, ok := u.Quota.MailboxLimits[mailboxName]; ok {
+		roots = append(roots, mailboxName)
+	}
+	return roots
+}
+
+// IsFull reports whether the user has no storage left at all.
+func (s *Service) IsFull(u *users.User) (bool, error) {
+	usage, err := s.GetUsage(u)
+	if err != nil {
+		return false, err
+	}
+
+	return usage.Limit > 0 && usage.Used >= usage.Limit, nil
+}
+
+// Check returns ErrQuotaExceeded if adding a mail of the given size to the
+// mailbox would exceed the storage limit of the user or the mailbox.
+func (s *Service) Check(u *users.User, mailboxUID uint32, size int64) error {
+	usage, err := s.GetUsage(u)
+	if err != nil {
+		return err
+	}
+	if usage.Limit > 0 && usage.Used+size > usage.Limit {
+		return ErrQuotaExceeded
+	}
+
+	if len(u.Quota.MailboxLimits) == 0 {
+		return nil
+	}
+
+	mb, err := s.mails.GetMailboxByUID(u.ID, mailboxUID)
+	if err != nil {
+		return err
+	}
+	if limit, ok := u.Quota.MailboxLimits[mb.Name]; ok && mb.Size+size > limit {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// Notify delivers a warning mail to the user once the usage crosses one of the
+// warning thresholds. Every threshold is only warned about once, until the
+// usage drops below it again.
+func (s *Service) Notify(u *users.User) {
+	usage, err := s.GetUsage(u)
+	if err != nil {
+		slog.Warn("Failed to get quota usage", slog.String("user_id", u.ID), sloki.WrapError(err))
+		return
+	}
+	if usage.Limit <= 0 {
+		return
+	}
+
+	reached := 0
+	for _, threshold := range s.warningThresholds {
+		if usage.Percent() >= threshold {
+			reached = threshold
+		}
+	}
+
+	s.mu.Lock()
+	warned := s.warned[u.ID]
+	s.warned[u.ID] = reached
+	s.mu.Unlock()
+
+	if reached == 0 || reached <= warned {
+		return
+	}
+
+	if err := s.mails.CreateMail(u.ID, mails.DefaultMailboxUID, warningMail(s.hostname, u, *usage)); err != nil {
+		slog.Error("Failed to deliver quota warning", slog.String("user_id", u.ID), sloki.WrapError(err))
+		return
+	}
+
+	slog.Info("Delivered quota warning", slog.String("user_id", u.ID), slog.Int("percent", usage.Percent()))
+}
+
+func warningMail(hostname string, u *users.User, usage Usage) mails.Mail {
+	now := time.Now()
+	subject := fmt.Sprintf("Your mailbox is %d%% full", usage.Percent())
+	body := fmt.Sprintf(
+		"You are using %d KiB of your %d KiB storage.\n\nPlease delete some messages, otherwise new mail may be rejected.\n",
+		usage.Used/1024,
+		usage.Limit/1024,
+	)
+
+	return mails.Mail{
+		UID:   mails.RandomUID(),
+		Flags: []string{},
+		Date:  now,
+		Size:  len(body),
+		Headers: map[string]string{
+			"From":           "postmaster@" + hostname,
+			"To":             u.PrimaryEmail,
+			"Subject":        subject,
+			"Date":           now.Format(time.RFC1123Z),
+			"Auto-Submitted": "auto-generated",
+		},
+		Body: body,
+	}
+}
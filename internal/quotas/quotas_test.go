@@ -0,0 +1,147 @@
+package quotas_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	ddb "github.com/OliverSchlueter/mail-server/internal/domains/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/quotas"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	udb "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func TestCheck(t *testing.T) {
+	s, ms, u := setup(t, users.Quota{
+		StorageLimit:  1000,
+		MailboxLimits: map[string]int64{mails.DefaultMailboxName: 500},
+	})
+
+	if err := s.Check(u, mails.DefaultMailboxUID, 400); err != nil {
+		t.Errorf("Expected mail to fit into quota, got %v", err)
+	}
+
+	if err := ms.CreateMail(u.ID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: strings.Repeat("x", 400)}); err != nil {
+		t.Fatalf("Failed to create mail: %v", err)
+	}
+
+	// Mailbox limit
+	if err := s.Check(u, mails.DefaultMailboxUID, 200); !errors.Is(err, quotas.ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded for mailbox limit, got %v", err)
+	}
+
+	// User limit
+	if err := ms.CreateMailbox(mails.Mailbox{UserID: u.ID, Name: "Archive", UID: 2}); err != nil {
+		t.Fatalf("Failed to create mailbox: %v", err)
+	}
+	if err := s.Check(u, 2, 500); err != nil {
+		t.Errorf("Expected mail to fit into quota, got %v", err)
+	}
+	if err := s.Check(u, 2, 700); !errors.Is(err, quotas.ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded for user limit, got %v", err)
+	}
+
+	// Usage is released on delete
+	if err := ms.DeleteMail(u.ID, mails.DefaultMailboxUID, 1); err != nil {
+		t.Fatalf("Failed to delete mail: %v", err)
+	}
+	if err := s.Check(u, mails.DefaultMailboxUID, 500); err != nil {
+		t.Errorf("Expected mail to fit into quota after delete, got %v", err)
+	}
+}
+
+func TestIsFullAndRoots(t *testing.T) {
+	s, ms, u := setup(t, users.Quota{StorageLimit: 100})
+
+	if full, err := s.IsFull(u); err != nil || full {
+		t.Errorf("Expected empty mailbox not to be full, got %v, %v", full, err)
+	}
+
+	if err := ms.CreateMail(u.ID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: strings.Repeat("x", 100)}); err != nil {
+		t.Fatalf("Failed to create mail: %v", err)
+	}
+	if full, err := s.IsFull(u); err != nil || !full {
+		t.Errorf("Expected mailbox to be full, got %v, %v", full, err)
+	}
+
+	roots := s.GetRoots(u, mails.DefaultMailboxName)
+	if len(roots) != 1 || roots[0] != quotas.UserRoot {
+		t.Errorf("Expected only the user root, got %v", roots)
+	}
+}
+
+func TestDomainDefaultLimit(t *testing.T) {
+	_, ms, u := setup(t, users.Quota{})
+
+	ds := domains.NewStore(domains.Configuration{DB: ddb.NewDB()})
+	if _, err := ds.Add(domains.Domain{Name: "localhost", DefaultStorageLimit: 50}); err != nil {
+		t.Fatalf("Failed to add domain: %v", err)
+	}
+	s := quotas.NewService(quotas.Configuration{Hostname: "localhost", Mails: *ms, Domains: ds})
+
+	if limit := s.StorageLimit(u); limit != 50 {
+		t.Errorf("Expected default limit of domain, got %d", limit)
+	}
+	if err := s.Check(u, mails.DefaultMailboxUID, 51); !errors.Is(err, quotas.ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	// The user's own limit takes precedence
+	u.Quota.StorageLimit = 100
+	if err := s.Check(u, mails.DefaultMailboxUID, 51); err != nil {
+		t.Errorf("Expected mail to fit into the user's limit, got %v", err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	s, ms, u := setup(t, users.Quota{StorageLimit: 10000})
+
+	if err := ms.CreateMail(u.ID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: strings.Repeat("x", 8500)}); err != nil {
+		t.Fatalf("Failed to create mail: %v", err)
+	}
+
+	// Warnings are only delivered once per threshold
+	s.Notify(u)
+	s.Notify(u)
+
+	list, err := ms.GetMails(u.ID, mails.DefaultMailboxUID)
+	if err != nil {
+		t.Fatalf("Failed to get mails: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected 1 warning mail, got %d mails", len(list)-1)
+	}
+
+	var warning mails.Mail
+	for _, m := range list {
+		if m.UID != 1 {
+			warning = m
+		}
+	}
+	if !strings.Contains(warning.Headers["Subject"], "85%") {
+		t.Errorf("Expected warning subject to contain usage, got %q", warning.Headers["Subject"])
+	}
+}
+
+func setup(t *testing.T, quota users.Quota) (*quotas.Service, *mails.Store, *users.User) {
+	us := users.NewStore(users.Configuration{DB: udb.NewDB()})
+	if err := us.Create(users.User{Name: "oliver", PrimaryEmail: "oliver@localhost", Quota: quota}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	u, err := us.GetByName("oliver")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+
+	s := quotas.NewService(quotas.Configuration{
+		Hostname: "localhost",
+		Mails:    *ms,
+	})
+
+	return s, ms, u
+}
@@ -0,0 +1,83 @@
+package fake
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+)
+
+type DB struct {
+	Items map[string]routing.Route
+	mu    sync.Mutex
+}
+
+func NewDB() *DB {
+	return &DB{
+		Items: make(map[string]routing.Route),
+		mu:    sync.Mutex{},
+	}
+}
+
+func (db *DB) Get(address string) (*routing.Route, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r, exists := db.Items[address]
+	if !exists {
+		return nil, routing.ErrRouteNotFound
+	}
+	r = clone(r)
+	return &r, nil
+}
+
+func (db *DB) List() ([]routing.Route, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	list := make([]routing.Route, 0, len(db.Items))
+	for _, address := range slices.Sorted(maps.Keys(db.Items)) {
+		list = append(list, clone(db.Items[address]))
+	}
+	return list, nil
+}
+
+func (db *DB) Insert(r routing.Route) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[r.Address]; exists {
+		return routing.ErrRouteAlreadyExists
+	}
+	db.Items[r.Address] = clone(r)
+	return nil
+}
+
+func (db *DB) Update(r routing.Route) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[r.Address]; !exists {
+		return routing.ErrRouteNotFound
+	}
+	db.Items[r.Address] = clone(r)
+	return nil
+}
+
+func (db *DB) Delete(address string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[address]; !exists {
+		return routing.ErrRouteNotFound
+	}
+	delete(db.Items, address)
+	return nil
+}
+
+// clone copies the targets, so callers can not modify stored routes.
+func clone(r routing.Route) routing.Route {
+	r.Targets = slices.Clone(r.Targets)
+	return r
+}
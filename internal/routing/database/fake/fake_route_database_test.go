@@ -0,0 +1,14 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+	"github.com/OliverSchlueter/mail-server/internal/routing/routingtest"
+)
+
+func TestDB(t *testing.T) {
+	routingtest.RunDBSuite(t, func() routing.DB {
+		return NewDB()
+	})
+}
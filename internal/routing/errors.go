@@ -0,0 +1,15 @@
+package routing
+
+import "errors"
+
+var (
+	ErrRouteNotFound      = errors.New("route not found")
+	ErrRouteAlreadyExists = errors.New("route already exists")
+	ErrInvalidAddress     = errors.New("invalid address")
+	ErrInvalidKind        = errors.New("invalid route kind")
+	ErrNoTargets          = errors.New("route has no targets")
+	ErrAddressInUse       = errors.New("address belongs to a user")
+	ErrDomainNotHosted    = errors.New("domain is not hosted")
+	ErrAddressNotFound    = errors.New("address not found")
+	ErrRoutingLoop        = errors.New("routing loop")
+)
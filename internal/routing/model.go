@@ -0,0 +1,27 @@
+package routing
+
+import "time"
+
+type Kind string
+
+const (
+	// KindAlias forwards to other addresses, which may be external.
+	KindAlias Kind = "alias"
+	// KindGroup distributes mail to its members, which must be local addresses.
+	KindGroup Kind = "group"
+)
+
+// Route maps an address that belongs to no user to other addresses.
+type Route struct {
+	Address   string    `json:"address"` // lower case
+	Kind      Kind      `json:"kind"`
+	Targets   []string  `json:"targets"` // addresses of users, other routes or external addresses
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Resolution is where mail to an address is delivered to.
+type Resolution struct {
+	UserIDs  []string // local users, without duplicates
+	External []string // external addresses the mail is forwarded to, without duplicates
+	CatchAll bool     // set if the address itself is unknown and was resolved through the catch-all address of its domain
+}
@@ -0,0 +1,135 @@
+package routing
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+// Resolve returns the users and external addresses mail to the local address
+// is delivered to. Addresses of users are delivered to the user, addresses of
+// routes are expanded recursively and unknown addresses fall back to the
+// catch-all address of their domain. Route targets outside the local domains
+// are external. Every address is expanded at most once, so routes that refer
+// to each other are delivered once. ErrRoutingLoop is returned if nothing is
+// left to deliver to because of such a loop, or if an address is nested deeper
+// than MaxDepth. ErrAddressNotFound is returned if the address does not lead
+// to any user or external address.
+func (s *Store) Resolve(address string) (*Resolution, error) {
+	r := &resolver{store: s, visited: map[string]bool{}}
+	if err := r.resolve(address, 0); err != nil {
+		return nil, err
+	}
+
+	if len(r.res.UserIDs) == 0 && len(r.res.External) == 0 {
+		if r.loop {
+			return nil, ErrRoutingLoop
+		}
+		return nil, ErrAddressNotFound
+	}
+	return &r.res, nil
+}
+
+type resolver struct {
+	store   *Store
+	visited map[string]bool
+	loop    bool
+	res     Resolution
+}
+
+func (r *resolver) resolve(address string, depth int) error {
+	if depth > MaxDepth {
+		return ErrRoutingLoop
+	}
+
+	key := Normalize(address)
+	if r.visited[key] {
+		r.loop = true
+		return nil
+	}
+	r.visited[key] = true
+
+	u, err := r.store.users.GetByEmail(address)
+	if err == nil {
+		if !slices.Contains(r.res.UserIDs, u.ID) {
+			r.res.UserIDs = append(r.res.UserIDs, u.ID)
+		}
+		return nil
+	}
+	if !errors.Is(err, users.ErrUserNotFound) {
+		return err
+	}
+
+	route, err := r.store.getRoute(key)
+	if err != nil {
+		return err
+	}
+	if route != nil {
+		for _, target := range route.Targets {
+			if err := r.resolve(target, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	domain := domains.DomainOf(key)
+	local, err := r.store.isLocal(domain)
+	if err != nil {
+		return err
+	}
+	if !local {
+		// Only targets of routes may leave the server
+		if depth > 0 && !slices.Contains(r.res.External, key) {
+			r.res.External = append(r.res.External, key)
+		}
+		return nil
+	}
+
+	catchAll, err := r.store.catchAll(domain)
+	if err != nil {
+		return err
+	}
+	if catchAll != "" && Normalize(catchAll) != key {
+		if depth == 0 {
+			r.res.CatchAll = true
+		}
+		return r.resolve(catchAll, depth+1)
+	}
+
+	if depth > 0 {
+		slog.Warn("Route target does not exist", slog.String("address", key))
+	}
+	return nil
+}
+
+// isLocal reports whether mail to the domain is delivered by this server.
+func (s *Store) isLocal(domain string) (bool, error) {
+	if domain == domains.Normalize(s.hostname) {
+		return true, nil
+	}
+	if s.domains == nil {
+		return false, nil
+	}
+	return s.domains.IsHosted(domain)
+}
+
+// catchAll returns the catch-all address of the domain, or an empty string if
+// it has none.
+func (s *Store) catchAll(domain string) (string, error) {
+	if s.domains == nil {
+		return "", nil
+	}
+
+	d, err := s.domains.Get(domain)
+	if err != nil {
+		if errors.Is(err, domains.ErrDomainNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	return d.CatchAll, nil
+}
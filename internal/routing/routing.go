@@ -0,0 +1,202 @@
+// Package routing maps addresses that belong to no user to the users and
+// external addresses mail to them is delivered to. Aliases forward to one or
+// many addresses, groups distribute mail to their members and the catch-all
+// address of a hosted domain receives mail to all unknown addresses in it.
+package routing
+
+import (
+	"errors"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+// MaxDepth is the maximum number of routes an address is expanded through.
+const MaxDepth = 10
+
+type DB interface {
+	Get(address string) (*Route, error)
+	// List returns all routes, sorted by address.
+	List() ([]Route, error)
+	Insert(route Route) error
+	// Update replaces the route with the same address.
+	Update(route Route) error
+	Delete(address string) error
+}
+
+type Store struct {
+	hostname string
+	db       DB
+	users    users.Store
+	domains  *domains.Store
+}
+
+type Configuration struct {
+	// Hostname is the domain of the server, addresses in it are local like
+	// those in hosted domains.
+	Hostname string
+	DB       DB
+	Users    users.Store
+	// Domains is optional. If set, addresses in hosted domains are local too,
+	// and unknown local addresses fall back to the catch-all address of their
+	// domain.
+	Domains *domains.Store
+}
+
+func NewStore(cfg Configuration) *Store {
+	return &Store{
+		hostname: cfg.Hostname,
+		db:       cfg.DB,
+		users:    cfg.Users,
+		domains:  cfg.Domains,
+	}
+}
+
+func (s *Store) Get(address string) (*Route, error) {
+	return s.db.Get(Normalize(address))
+}
+
+func (s *Store) List() ([]Route, error) {
+	return s.db.List()
+}
+
+// Add validates the route and adds it.
+func (s *Store) Add(r Route) (*Route, error) {
+	if err := s.validate(&r); err != nil {
+		return nil, err
+	}
+	r.CreatedAt = time.Now().UTC()
+
+	if err := s.db.Insert(r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Update validates the route and replaces its kind and targets.
+func (s *Store) Update(r Route) error {
+	if err := s.validate(&r); err != nil {
+		return err
+	}
+	return s.db.Update(r)
+}
+
+func (s *Store) Remove(address string) error {
+	return s.db.Delete(Normalize(address))
+}
+
+// RemoveTargets removes the addresses from the targets of all routes. Routes
+// that are left without targets are deleted.
+func (s *Store) RemoveTargets(addresses ...string) error {
+	remove := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		remove = append(remove, Normalize(address))
+	}
+
+	list, err := s.db.List()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range list {
+		targets := slices.DeleteFunc(slices.Clone(r.Targets), func(target string) bool {
+			return slices.Contains(remove, target)
+		})
+		if len(targets) == len(r.Targets) {
+			continue
+		}
+
+		if len(targets) == 0 {
+			err = s.db.Delete(r.Address)
+		} else {
+			r.Targets = targets
+			err = s.db.Update(r)
+		}
+		if err != nil && !errors.Is(err, ErrRouteNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Normalize returns the address in lower case without surrounding spaces.
+func Normalize(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// validate checks the route and normalizes its address and targets. Loops
+// between routes are not rejected here, they are detected when resolving.
+func (s *Store) validate(r *Route) error {
+	r.Address = Normalize(r.Address)
+	if !validAddress(r.Address) {
+		return ErrInvalidAddress
+	}
+	if r.Kind != KindAlias && r.Kind != KindGroup {
+		return ErrInvalidKind
+	}
+
+	local, err := s.isLocal(domains.DomainOf(r.Address))
+	if err != nil {
+		return err
+	}
+	if !local {
+		return ErrDomainNotHosted
+	}
+
+	exists, err := s.users.DoesUserExistByEmail(r.Address)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrAddressInUse
+	}
+
+	targets := make([]string, 0, len(r.Targets))
+	for _, target := range r.Targets {
+		target = Normalize(target)
+		if !validAddress(target) || target == r.Address {
+			return ErrInvalidAddress
+		}
+		if slices.Contains(targets, target) {
+			continue
+		}
+
+		// Groups are distribution lists of local addresses
+		if r.Kind == KindGroup {
+			local, err := s.isLocal(domains.DomainOf(target))
+			if err != nil {
+				return err
+			}
+			if !local {
+				return ErrDomainNotHosted
+			}
+		}
+
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return ErrNoTargets
+	}
+	r.Targets = targets
+
+	return nil
+}
+
+// validAddress reports whether the address is a plain email address.
+func validAddress(address string) bool {
+	addr, err := mail.ParseAddress(address)
+	return err == nil && addr.Address == address
+}
+
+// getRoute returns the route of the address, or nil if there is none.
+func (s *Store) getRoute(address string) (*Route, error) {
+	r, err := s.db.Get(address)
+	if errors.Is(err, ErrRouteNotFound) {
+		return nil, nil
+	}
+	return r, err
+}
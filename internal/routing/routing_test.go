@@ -0,0 +1,163 @@
+package routing_test
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	fake2 "github.com/OliverSchlueter/mail-server/internal/domains/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+	"github.com/OliverSchlueter/mail-server/internal/routing/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	fake3 "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func setup(t *testing.T) (*routing.Store, *users.Store, *domains.Store) {
+	t.Helper()
+
+	us := users.NewStore(users.Configuration{DB: fake3.NewDB()})
+	for _, name := range []string{"alice", "bob"} {
+		if err := us.Create(users.User{Name: name, PrimaryEmail: name + "@example.com", Emails: []string{name + "@example.com"}}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	ds := domains.NewStore(domains.Configuration{DB: fake2.NewDB()})
+	for _, name := range []string{"example.com", "example.net"} {
+		if _, err := ds.Add(domains.Domain{Name: name}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	rs := routing.NewStore(routing.Configuration{
+		Hostname: "mail.example.com",
+		DB:       fake.NewDB(),
+		Users:    *us,
+		Domains:  ds,
+	})
+	return rs, us, ds
+}
+
+func TestStore(t *testing.T) {
+	rs, _, _ := setup(t)
+
+	r, err := rs.Add(routing.Route{Address: " Team@Example.COM ", Kind: routing.KindGroup, Targets: []string{"Alice@example.com", "bob@example.com", "alice@example.com"}})
+	if err != nil {
+		t.Fatalf("Add: unexpected error: %v", err)
+	}
+	if r.Address != "team@example.com" || !slices.Equal(r.Targets, []string{"alice@example.com", "bob@example.com"}) || r.CreatedAt.IsZero() {
+		t.Errorf("Add: expected normalized route, got %+v", r)
+	}
+	if _, err := rs.Add(routing.Route{Address: "team@example.com", Kind: routing.KindAlias, Targets: []string{"alice@example.com"}}); !errors.Is(err, routing.ErrRouteAlreadyExists) {
+		t.Errorf("Add twice: expected ErrRouteAlreadyExists, got %v", err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		route routing.Route
+		err   error
+	}{
+		{"invalid address", routing.Route{Address: "Team <team@example.com>", Kind: routing.KindAlias, Targets: []string{"alice@example.com"}}, routing.ErrInvalidAddress},
+		{"invalid kind", routing.Route{Address: "info@example.com", Kind: "list", Targets: []string{"alice@example.com"}}, routing.ErrInvalidKind},
+		{"no targets", routing.Route{Address: "info@example.com", Kind: routing.KindAlias}, routing.ErrNoTargets},
+		{"invalid target", routing.Route{Address: "info@example.com", Kind: routing.KindAlias, Targets: []string{"alice"}}, routing.ErrInvalidAddress},
+		{"itself as target", routing.Route{Address: "info@example.com", Kind: routing.KindAlias, Targets: []string{"INFO@example.com"}}, routing.ErrInvalidAddress},
+		{"user address", routing.Route{Address: "alice@example.com", Kind: routing.KindAlias, Targets: []string{"bob@example.com"}}, routing.ErrAddressInUse},
+		{"foreign domain", routing.Route{Address: "info@example.org", Kind: routing.KindAlias, Targets: []string{"alice@example.com"}}, routing.ErrDomainNotHosted},
+		{"external group member", routing.Route{Address: "info@example.com", Kind: routing.KindGroup, Targets: []string{"carol@example.org"}}, routing.ErrDomainNotHosted},
+	} {
+		if _, err := rs.Add(c.route); !errors.Is(err, c.err) {
+			t.Errorf("Add with %s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	if _, err := rs.Add(routing.Route{Address: "info@mail.example.com", Kind: routing.KindAlias, Targets: []string{"carol@example.org"}}); err != nil {
+		t.Errorf("Add for hostname with external target: unexpected error: %v", err)
+	}
+
+	if err := rs.Remove("TEAM@example.com"); err != nil {
+		t.Fatalf("Remove: unexpected error: %v", err)
+	}
+	if _, err := rs.Get("team@example.com"); !errors.Is(err, routing.ErrRouteNotFound) {
+		t.Errorf("Get after Remove: expected ErrRouteNotFound, got %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	rs, us, ds := setup(t)
+
+	alice, _ := us.GetByEmail("alice@example.com")
+	bob, _ := us.GetByEmail("bob@example.com")
+
+	for _, r := range []routing.Route{
+		{Address: "team@example.com", Kind: routing.KindGroup, Targets: []string{"alice@example.com", "bob@example.com"}},
+		{Address: "all@example.com", Kind: routing.KindGroup, Targets: []string{"team@example.com", "alice@example.com", "board@example.com"}},
+		{Address: "board@example.com", Kind: routing.KindGroup, Targets: []string{"all@example.com"}},
+		{Address: "info@example.com", Kind: routing.KindAlias, Targets: []string{"bob@example.com", "carol@example.org", "Carol@example.org"}},
+		{Address: "ping@example.com", Kind: routing.KindAlias, Targets: []string{"pong@example.com"}},
+		{Address: "pong@example.com", Kind: routing.KindAlias, Targets: []string{"ping@example.com"}},
+		{Address: "old@example.com", Kind: routing.KindAlias, Targets: []string{"gone@example.com"}},
+	} {
+		if _, err := rs.Add(r); err != nil {
+			t.Fatalf("Add %s: unexpected error: %v", r.Address, err)
+		}
+	}
+
+	d, _ := ds.Get("example.net")
+	d.CatchAll = "info@example.com"
+	if err := ds.Update(*d); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	for _, c := range []struct {
+		address  string
+		userIDs  []string
+		external []string
+		err      error
+	}{
+		{address: "alice@example.com", userIDs: []string{alice.ID}},
+		{address: "Team@Example.com", userIDs: []string{alice.ID, bob.ID}},
+		{address: "all@example.com", userIDs: []string{alice.ID, bob.ID}},
+		{address: "board@example.com", userIDs: []string{alice.ID, bob.ID}},
+		{address: "info@example.com", userIDs: []string{bob.ID}, external: []string{"carol@example.org"}},
+		{address: "anything@example.net", userIDs: []string{bob.ID}, external: []string{"carol@example.org"}},
+		{address: "nobody@example.com", err: routing.ErrAddressNotFound},
+		{address: "old@example.com", err: routing.ErrAddressNotFound},
+		{address: "ping@example.com", err: routing.ErrRoutingLoop},
+	} {
+		res, err := rs.Resolve(c.address)
+		if !errors.Is(err, c.err) {
+			t.Errorf("Resolve(%s): expected %v, got %v", c.address, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !slices.Equal(res.UserIDs, c.userIDs) || !slices.Equal(res.External, c.external) || res.CatchAll != strings.HasSuffix(c.address, "@example.net") {
+			t.Errorf("Resolve(%s): expected %v and %v, got %+v", c.address, c.userIDs, c.external, res)
+		}
+	}
+}
+
+func TestResolveMaxDepth(t *testing.T) {
+	rs, _, _ := setup(t)
+
+	target := "alice@example.com"
+	for i := range routing.MaxDepth + 1 {
+		address := fmt.Sprintf("level%d@example.com", i)
+		if _, err := rs.Add(routing.Route{Address: address, Kind: routing.KindAlias, Targets: []string{target}}); err != nil {
+			t.Fatalf("Add %s: unexpected error: %v", address, err)
+		}
+		target = address
+	}
+
+	if _, err := rs.Resolve(fmt.Sprintf("level%d@example.com", routing.MaxDepth-1)); err != nil {
+		t.Errorf("Resolve at MaxDepth: unexpected error: %v", err)
+	}
+	if _, err := rs.Resolve(fmt.Sprintf("level%d@example.com", routing.MaxDepth)); !errors.Is(err, routing.ErrRoutingLoop) {
+		t.Errorf("Resolve beyond MaxDepth: expected ErrRoutingLoop, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+// Package routingtest provides a conformance test suite that every routing.DB
+// implementation is expected to pass.
+package routingtest
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+)
+
+// RunDBSuite runs all conformance tests against the routing.DB returned by newDB.
+// newDB is called once per test and must return an empty database.
+func RunDBSuite(t *testing.T, newDB func() routing.DB) {
+	t.Run("NotFound", func(t *testing.T) { TestNotFound(t, newDB()) })
+	t.Run("InsertGet", func(t *testing.T) { TestInsertGet(t, newDB()) })
+	t.Run("ListUpdateDelete", func(t *testing.T) { TestListUpdateDelete(t, newDB()) })
+}
+
+func TestNotFound(t *testing.T, db routing.DB) {
+	if _, err := db.Get("team@example.com"); !errors.Is(err, routing.ErrRouteNotFound) {
+		t.Errorf("Get: expected ErrRouteNotFound, got %v", err)
+	}
+	if err := db.Update(route("team@example.com")); !errors.Is(err, routing.ErrRouteNotFound) {
+		t.Errorf("Update: expected ErrRouteNotFound, got %v", err)
+	}
+	if err := db.Delete("team@example.com"); !errors.Is(err, routing.ErrRouteNotFound) {
+		t.Errorf("Delete: expected ErrRouteNotFound, got %v", err)
+	}
+}
+
+func TestInsertGet(t *testing.T, db routing.DB) {
+	r := route("team@example.com")
+	if err := db.Insert(r); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+	if err := db.Insert(r); !errors.Is(err, routing.ErrRouteAlreadyExists) {
+		t.Errorf("Insert twice: expected ErrRouteAlreadyExists, got %v", err)
+	}
+
+	got, err := db.Get("team@example.com")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if got.Address != r.Address || got.Kind != r.Kind || !slices.Equal(got.Targets, r.Targets) || !got.CreatedAt.Equal(r.CreatedAt) {
+		t.Errorf("Get: stored route does not match inserted route: %+v", got)
+	}
+
+	got.Targets[0] = "mallory@example.org"
+	if got, _ := db.Get("team@example.com"); got.Targets[0] != r.Targets[0] {
+		t.Errorf("Get: modifying a returned route changed the stored route")
+	}
+}
+
+func TestListUpdateDelete(t *testing.T, db routing.DB) {
+	for _, address := range []string{"sales@example.com", "info@example.com", "team@example.com"} {
+		if err := db.Insert(route(address)); err != nil {
+			t.Fatalf("Insert: unexpected error: %v", err)
+		}
+	}
+
+	list, err := db.List()
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(list) != 3 || list[0].Address != "info@example.com" || list[1].Address != "sales@example.com" || list[2].Address != "team@example.com" {
+		t.Errorf("List: expected routes sorted by address, got %+v", list)
+	}
+
+	r := route("team@example.com")
+	r.Kind = routing.KindAlias
+	r.Targets = []string{"carol@example.org"}
+	if err := db.Update(r); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+	if got, err := db.Get("team@example.com"); err != nil || got.Kind != routing.KindAlias || !slices.Equal(got.Targets, r.Targets) {
+		t.Errorf("Get after Update: expected %+v, got %+v, %v", r, got, err)
+	}
+
+	if err := db.Delete("sales@example.com"); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	if _, err := db.Get("sales@example.com"); !errors.Is(err, routing.ErrRouteNotFound) {
+		t.Errorf("Get after Delete: expected ErrRouteNotFound, got %v", err)
+	}
+	if list, err := db.List(); err != nil || len(list) != 2 {
+		t.Errorf("List after Delete: expected 2 routes, got %v, %v", list, err)
+	}
+}
+
+func route(address string) routing.Route {
+	return routing.Route{
+		Address:   address,
+		Kind:      routing.KindGroup,
+		Targets:   []string{"alice@example.com", "bob@example.com"},
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+}
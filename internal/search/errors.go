@@ -0,0 +1,10 @@
+package search
+
+import "errors"
+
+var (
+	ErrInvalidField = errors.New("invalid field")
+	ErrEmptyQuery   = errors.New("empty query")
+	ErrInvalidKey   = errors.New("invalid key, it must be 32 bytes long")
+	ErrCorrupted    = errors.New("index file is corrupted")
+)
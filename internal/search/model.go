@@ -0,0 +1,53 @@
+package search
+
+import "strings"
+
+// Field is a bitmask of the parts of a mail a term was found in.
+type Field uint8
+
+const (
+	FieldSubject Field = 1 << iota
+	FieldFrom
+	FieldTo // To, Cc and Bcc
+	FieldBody
+	FieldAttachment // names of attached files
+
+	FieldAll = FieldSubject | FieldFrom | FieldTo | FieldBody | FieldAttachment
+)
+
+var fieldNames = map[string]Field{
+	"subject":    FieldSubject,
+	"from":       FieldFrom,
+	"to":         FieldTo,
+	"body":       FieldBody,
+	"attachment": FieldAttachment,
+}
+
+// ParseFields parses a comma separated list of field names, e.g. "subject,from".
+// An empty list selects all fields.
+func ParseFields(s string) (Field, error) {
+	if strings.TrimSpace(s) == "" {
+		return FieldAll, nil
+	}
+
+	var fields Field
+	for _, name := range strings.Split(s, ",") {
+		f, ok := fieldNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, ErrInvalidField
+		}
+		fields |= f
+	}
+	return fields, nil
+}
+
+type Query struct {
+	Text       string // all terms must match, each term matches as a prefix
+	Fields     Field  // fields to search in, 0 means all fields
+	MailboxUID uint32 // mailbox to search in, 0 means all mailboxes
+}
+
+type Hit struct {
+	MailboxUID uint32 `json:"mailbox_uid"`
+	UID        uint32 `json:"uid"`
+}
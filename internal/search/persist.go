@@ -0,0 +1,302 @@
+package search
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// minCompaction is the number of changes the log of a user may hold before it
+// is compacted into the snapshot. Larger indexes compact once the log holds as
+// many changes as there are documents, so replaying it never costs more than
+// loading the snapshot.
+const minCompaction = 1000
+
+type changeKind uint8
+
+const (
+	changeIndex changeKind = iota
+	changeRemove
+	changeRemoveMailbox
+)
+
+// change is an entry of the log of a user. Every change sets the final state
+// of its documents, so replaying the log on a snapshot that already contains
+// some of the changes gives the same index.
+type change struct {
+	Kind       changeKind
+	Doc        uint64           // changeIndex and changeRemove
+	Terms      map[string]Field // changeIndex
+	MailboxUID uint32           // changeRemoveMailbox
+}
+
+// lock returns the locked index of the user, without reading it from disk.
+// It has to be released with release.
+func (i *Index) lock(userID string) *userIndex {
+	i.mu.Lock()
+	now := i.now()
+	i.evictIdle(now)
+
+	ui, ok := i.users[userID]
+	if !ok {
+		ui = newUserIndex()
+		i.users[userID] = ui
+	}
+	ui.refs++
+	ui.lastUsed = now
+	i.mu.Unlock()
+
+	ui.mu.Lock()
+	return ui
+}
+
+// acquire returns the locked index of the user, reading it from disk on first
+// use. It has to be released with release.
+func (i *Index) acquire(userID string) (*userIndex, error) {
+	ui := i.lock(userID)
+	if ui.loaded {
+		return ui, nil
+	}
+
+	if err := i.load(userID, ui); err != nil {
+		ui.reset()
+		i.release(ui)
+		return nil, err
+	}
+	ui.loaded = true
+	return ui, nil
+}
+
+// release unlocks the index of the user again.
+func (i *Index) release(ui *userIndex) {
+	ui.mu.Unlock()
+
+	i.mu.Lock()
+	ui.refs--
+	i.mu.Unlock()
+}
+
+// load reads the index of the user from disk. It expects the caller to hold
+// ui.mu.
+func (i *Index) load(userID string, ui *userIndex) error {
+	if i.dir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(i.snapshotPath(userID))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		plaintext, err := i.open(userID, data)
+		if err != nil {
+			return err
+		}
+		if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(ui); err != nil {
+			return err
+		}
+	}
+
+	return i.replay(userID, ui)
+}
+
+// evictIdle drops the indexes of users that were not used within the idle
+// timeout from memory, at most once per timeout. Indexes that are not
+// persisted or in use are kept. It expects the caller to hold i.mu.
+func (i *Index) evictIdle(now time.Time) {
+	if i.dir == "" || now.Sub(i.lastSweep) < i.idleTimeout {
+		return
+	}
+	i.lastSweep = now
+
+	for userID, ui := range i.users {
+		if ui.refs == 0 && now.Sub(ui.lastUsed) >= i.idleTimeout {
+			delete(i.users, userID)
+		}
+	}
+}
+
+// replay applies the log of the user to the index. A change that was only
+// partially written, e.g. because of a crash, is dropped by compacting the
+// index right away.
+func (i *Index) replay(userID string, ui *userIndex) error {
+	f, err := os.Open(i.logPath(userID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		c, err := i.readChange(userID, r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return i.compact(userID, ui)
+		}
+		if err != nil {
+			return err
+		}
+
+		ui.apply(*c)
+		ui.changes++
+	}
+}
+
+// record appends the change, which was applied to the index already, to the
+// log of the user, or compacts the log if it grew too large.
+// It expects the caller to hold ui.mu.
+func (i *Index) record(userID string, ui *userIndex, c change) error {
+	if i.dir == "" {
+		return nil
+	}
+
+	if ui.changes+1 >= max(minCompaction, len(ui.Docs)) {
+		return i.compact(userID, ui)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		return err
+	}
+	data, err := i.seal(userID, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	entry := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	entry = append(entry, data...)
+
+	f, err := os.OpenFile(i.logPath(userID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(entry); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	ui.changes++
+	return nil
+}
+
+// compact writes the snapshot of the index of the user and empties the log.
+// The snapshot is replaced atomically, so a crash never leaves a partially
+// written index behind. It expects the caller to hold ui.mu.
+func (i *Index) compact(userID string, ui *userIndex) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(ui); err != nil {
+		return err
+	}
+	data, err := i.seal(userID, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(i.dir, "index-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), i.snapshotPath(userID)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(i.logPath(userID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	ui.changes = 0
+	return nil
+}
+
+// readChange reads the next change of the log of the user. io.EOF is returned
+// at the end of the log, io.ErrUnexpectedEOF if the last change is incomplete.
+func (i *Index) readChange(userID string, r io.Reader) (*change, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	plaintext, err := i.open(userID, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var c change
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// seal encrypts the data of a file of the index of the user, if the index is
+// encrypted. The data is bound to the user, so files can not be swapped
+// between users.
+func (i *Index) seal(userID string, data []byte) ([]byte, error) {
+	if i.aead == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, i.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return i.aead.Seal(nonce, nonce, data, []byte(userID)), nil
+}
+
+// open decrypts the data that was sealed with seal.
+func (i *Index) open(userID string, data []byte) ([]byte, error) {
+	if i.aead == nil {
+		return data, nil
+	}
+
+	if len(data) < i.aead.NonceSize() {
+		return nil, ErrCorrupted
+	}
+	nonce, ciphertext := data[:i.aead.NonceSize()], data[i.aead.NonceSize():]
+	plaintext, err := i.aead.Open(nil, nonce, ciphertext, []byte(userID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	return plaintext, nil
+}
+
+func (i *Index) snapshotPath(userID string) string {
+	return filepath.Join(i.dir, hex.EncodeToString([]byte(userID))+".idx")
+}
+
+func (i *Index) logPath(userID string) string {
+	return filepath.Join(i.dir, hex.EncodeToString([]byte(userID))+".log")
+}
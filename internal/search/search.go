@@ -0,0 +1,325 @@
+// Package search maintains an inverted index over the mails of every user.
+package search
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+)
+
+// DefaultIdleTimeout is the time after which the index of a user that was not
+// used is dropped from memory.
+const DefaultIdleTimeout = 30 * time.Minute
+
+// Index is an inverted index of terms to mails. It implements mails.Indexer.
+type Index struct {
+	dir         string
+	aead        cipher.AEAD // encrypts the files in dir, nil if they are stored in plaintext
+	idleTimeout time.Duration
+	now         func() time.Time
+
+	// mu only guards the loaded indexes, every index has a lock of its own for
+	// its terms and files, so users do not wait for the disk I/O of others
+	mu        sync.Mutex
+	users     map[string]*userIndex
+	lastSweep time.Time
+}
+
+type Configuration struct {
+	Dir string // directory to persist the index in, it is only kept in memory if empty
+	// IdleTimeout is the time after which the index of a user that was not used
+	// is dropped from memory, defaults to DefaultIdleTimeout. It is loaded from
+	// Dir again when needed, so indexes are only dropped if Dir is set.
+	IdleTimeout time.Duration
+	Now         func() time.Time // defaults to time.Now
+	// Key is optional, a 32 byte AES key the files in Dir are encrypted with.
+	// Without it, the terms of every indexed mail are stored in plaintext, even
+	// if its body is encrypted at rest. The index has to be rebuilt, see
+	// mails.Store.Reindex, after the key changed.
+	Key []byte
+}
+
+// userIndex is the index of a single user. It is persisted as a snapshot and a
+// log of the changes since, see persist.go.
+type userIndex struct {
+	Terms map[string]map[uint64]Field // term -> document -> fields the term occurs in
+	Docs  map[uint64][]string         // document -> terms, to remove a document from Terms
+
+	mu      sync.Mutex // guards the index and its files
+	loaded  bool       // the index was read from disk
+	sorted  []string   // all terms in order for prefix lookups, nil if it has to be rebuilt
+	changes int        // number of changes in the log
+
+	refs     int       // callers that use the index, guarded by Index.mu
+	lastUsed time.Time // guarded by Index.mu
+}
+
+func NewIndex(cfg Configuration) (*Index, error) {
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = DefaultIdleTimeout
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	var aead cipher.AEAD
+	if cfg.Key != nil {
+		if len(cfg.Key) != 32 {
+			return nil, ErrInvalidKey
+		}
+		block, err := aes.NewCipher(cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Index{
+		dir:         cfg.Dir,
+		aead:        aead,
+		idleTimeout: cfg.IdleTimeout,
+		now:         cfg.Now,
+		users:       make(map[string]*userIndex),
+	}, nil
+}
+
+func newUserIndex() *userIndex {
+	return &userIndex{
+		Terms: make(map[string]map[uint64]Field),
+		Docs:  make(map[uint64][]string),
+	}
+}
+
+// Index adds the mail to the index, replacing any previous version of it.
+func (i *Index) Index(userID string, mail mails.Mail) error {
+	msg, err := message.Parse(mail)
+	if err != nil {
+		return err
+	}
+
+	terms := make(map[string]Field)
+	add := func(f Field, text string) {
+		for _, t := range Tokenize(text) {
+			terms[t] |= f
+		}
+	}
+
+	add(FieldSubject, msg.Subject())
+	for _, a := range msg.Addresses("From") {
+		add(FieldFrom, a.Name+" "+a.Address)
+	}
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, a := range msg.Addresses(field) {
+			add(FieldTo, a.Name+" "+a.Address)
+		}
+	}
+	add(FieldBody, msg.Text())
+	for _, a := range msg.Attachments() {
+		add(FieldAttachment, a.Filename)
+	}
+
+	ui, err := i.acquire(userID)
+	if err != nil {
+		return err
+	}
+	defer i.release(ui)
+
+	c := change{Kind: changeIndex, Doc: docKey(mail.MailboxUID, mail.UID), Terms: terms}
+	ui.apply(c)
+	return i.record(userID, ui, c)
+}
+
+// Remove removes the mail from the index.
+func (i *Index) Remove(userID string, mailboxUID uint32, uid uint32) error {
+	ui, err := i.acquire(userID)
+	if err != nil {
+		return err
+	}
+	defer i.release(ui)
+
+	c := change{Kind: changeRemove, Doc: docKey(mailboxUID, uid)}
+	ui.apply(c)
+	return i.record(userID, ui, c)
+}
+
+// RemoveMailbox removes all mails of the mailbox from the index.
+func (i *Index) RemoveMailbox(userID string, mailboxUID uint32) error {
+	ui, err := i.acquire(userID)
+	if err != nil {
+		return err
+	}
+	defer i.release(ui)
+
+	c := change{Kind: changeRemoveMailbox, MailboxUID: mailboxUID}
+	ui.apply(c)
+	return i.record(userID, ui, c)
+}
+
+// Clear removes all mails of the user from the index. It also drops the files
+// of the index that can not be read, e.g. after the key changed.
+func (i *Index) Clear(userID string) error {
+	ui := i.lock(userID)
+	defer i.release(ui)
+
+	ui.reset()
+	ui.loaded = true
+	if i.dir == "" {
+		return nil
+	}
+
+	for _, path := range []string{i.snapshotPath(userID), i.logPath(userID)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns the mails that match all terms of the query, ordered by
+// mailbox and UID.
+func (i *Index) Search(userID string, q Query) ([]Hit, error) {
+	terms := Tokenize(q.Text)
+	if len(terms) == 0 {
+		return nil, ErrEmptyQuery
+	}
+
+	fields := q.Fields
+	if fields == 0 {
+		fields = FieldAll
+	}
+
+	ui, err := i.acquire(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer i.release(ui)
+
+	var result map[uint64]struct{}
+	for _, t := range terms {
+		matches := ui.match(t, fields, q.MailboxUID)
+
+		if result == nil {
+			result = matches
+		} else {
+			for doc := range result {
+				if _, ok := matches[doc]; !ok {
+					delete(result, doc)
+				}
+			}
+		}
+
+		if len(result) == 0 {
+			return []Hit{}, nil
+		}
+	}
+
+	docs := make([]uint64, 0, len(result))
+	for doc := range result {
+		docs = append(docs, doc)
+	}
+	slices.Sort(docs)
+
+	hits := make([]Hit, len(docs))
+	for j, doc := range docs {
+		hits[j] = Hit{
+			MailboxUID: uint32(doc >> 32),
+			UID:        uint32(doc),
+		}
+	}
+	return hits, nil
+}
+
+// match returns all documents with a term that starts with the prefix in one of the fields.
+func (ui *userIndex) match(prefix string, fields Field, mailboxUID uint32) map[uint64]struct{} {
+	if ui.sorted == nil {
+		ui.sorted = slices.Sorted(maps.Keys(ui.Terms))
+	}
+
+	matches := make(map[uint64]struct{})
+	start, _ := slices.BinarySearch(ui.sorted, prefix)
+	for _, term := range ui.sorted[start:] {
+		if !strings.HasPrefix(term, prefix) {
+			break
+		}
+
+		for doc, f := range ui.Terms[term] {
+			if f&fields == 0 {
+				continue
+			}
+			if mailboxUID != 0 && uint32(doc>>32) != mailboxUID {
+				continue
+			}
+			matches[doc] = struct{}{}
+		}
+	}
+	return matches
+}
+
+// reset empties the index.
+func (ui *userIndex) reset() {
+	ui.Terms = make(map[string]map[uint64]Field)
+	ui.Docs = make(map[uint64][]string)
+	ui.sorted = nil
+	ui.changes = 0
+}
+
+// apply changes the index like the change describes.
+func (ui *userIndex) apply(c change) {
+	switch c.Kind {
+	case changeIndex:
+		ui.remove(c.Doc)
+		ui.add(c.Doc, c.Terms)
+	case changeRemove:
+		ui.remove(c.Doc)
+	case changeRemoveMailbox:
+		for doc := range ui.Docs {
+			if uint32(doc>>32) == c.MailboxUID {
+				ui.remove(doc)
+			}
+		}
+	}
+}
+
+func (ui *userIndex) add(doc uint64, terms map[string]Field) {
+	docTerms := make([]string, 0, len(terms))
+	for t, f := range terms {
+		if ui.Terms[t] == nil {
+			ui.Terms[t] = make(map[uint64]Field)
+			ui.sorted = nil
+		}
+		ui.Terms[t][doc] = f
+		docTerms = append(docTerms, t)
+	}
+	ui.Docs[doc] = docTerms
+}
+
+func (ui *userIndex) remove(doc uint64) {
+	for _, t := range ui.Docs[doc] {
+		delete(ui.Terms[t], doc)
+		if len(ui.Terms[t]) == 0 {
+			delete(ui.Terms, t)
+			ui.sorted = nil
+		}
+	}
+	delete(ui.Docs, doc)
+}
+
+func docKey(mailboxUID uint32, uid uint32) uint64 {
+	return uint64(mailboxUID)<<32 | uint64(uid)
+}
@@ -0,0 +1,396 @@
+package search_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/search"
+)
+
+const multipartMail = "From: =?UTF-8?Q?J=C3=BCrgen?= <juergen@example.com>\r\n" +
+	"To: Alice <alice@example.com>\r\n" +
+	"Subject: Quarterly report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=b1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"The numbers look gr=C3=BCn this time.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"revenue-2024.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQ=\r\n" +
+	"--b1--\r\n"
+
+func TestSearch(t *testing.T) {
+	idx, ms := setup(t, "")
+
+	createMail(t, ms, 1, "Subject: Lunch\r\nFrom: bob@example.com\r\n\r\nPizza at noon?")
+	createMail(t, ms, 1, multipartMail)
+
+	tests := []struct {
+		name  string
+		query search.Query
+		want  []uint32
+	}{
+		{"body", search.Query{Text: "pizza"}, []uint32{1}},
+		{"case insensitive", search.Query{Text: "QUARTERLY"}, []uint32{2}},
+		{"prefix", search.Query{Text: "quart"}, []uint32{2}},
+		{"all terms must match", search.Query{Text: "quarterly pizza"}, nil},
+		{"decoded header", search.Query{Text: "jürgen", Fields: search.FieldFrom}, []uint32{2}},
+		{"address", search.Query{Text: "alice@example.com", Fields: search.FieldTo}, []uint32{2}},
+		{"decoded body", search.Query{Text: "grün", Fields: search.FieldBody}, []uint32{2}},
+		{"attachment name", search.Query{Text: "revenue", Fields: search.FieldAttachment}, []uint32{2}},
+		{"other field", search.Query{Text: "pizza", Fields: search.FieldSubject}, nil},
+		{"other mailbox", search.Query{Text: "pizza", MailboxUID: 2}, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hits, err := idx.Search("alice", tc.query)
+			if err != nil {
+				t.Fatalf("Search: unexpected error: %v", err)
+			}
+			if got := uids(hits); !slices.Equal(got, tc.want) {
+				t.Errorf("Search: expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := idx.Search("alice", search.Query{Text: " ... "}); !errors.Is(err, search.ErrEmptyQuery) {
+		t.Errorf("Search without terms: expected ErrEmptyQuery, got %v", err)
+	}
+
+	if hits, err := idx.Search("bob", search.Query{Text: "pizza"}); err != nil || len(hits) != 0 {
+		t.Errorf("Search of other user: expected no hits, got %v, %v", hits, err)
+	}
+}
+
+func TestIndexFollowsStore(t *testing.T) {
+	idx, ms := setup(t, "")
+
+	createMail(t, ms, 1, "Subject: Lunch\r\n\r\nPizza at noon?")
+	createMail(t, ms, 1, "Subject: Dinner\r\n\r\nPasta tonight?")
+
+	// Updated bodies are reindexed
+	m, err := ms.GetMailByUID("alice", 1, 1)
+	if err != nil {
+		t.Fatalf("GetMailByUID: unexpected error: %v", err)
+	}
+	m.Body = "Subject: Lunch\r\n\r\nSushi at noon?"
+	if err := ms.UpdateMail("alice", 1, *m); err != nil {
+		t.Fatalf("UpdateMail: unexpected error: %v", err)
+	}
+	expectHits(t, idx, "pizza", nil)
+	expectHits(t, idx, "sushi", []uint32{1})
+
+	if err := ms.DeleteMail("alice", 1, 1); err != nil {
+		t.Fatalf("DeleteMail: unexpected error: %v", err)
+	}
+	expectHits(t, idx, "sushi", nil)
+
+	if err := ms.DeleteMailbox("alice", 1); err != nil {
+		t.Fatalf("DeleteMailbox: unexpected error: %v", err)
+	}
+	expectHits(t, idx, "pasta", nil)
+}
+
+func TestPersistenceAndReindex(t *testing.T) {
+	dir := t.TempDir()
+	idx, ms := setup(t, dir)
+
+	createMail(t, ms, 1, "Subject: Lunch\r\n\r\nPizza at noon?")
+
+	// A new index on the same directory loads the persisted terms
+	reopened, err := search.NewIndex(search.Configuration{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewIndex: unexpected error: %v", err)
+	}
+	expectHits(t, reopened, "pizza", []uint32{1})
+
+	if err := idx.Clear("alice"); err != nil {
+		t.Fatalf("Clear: unexpected error: %v", err)
+	}
+	expectHits(t, idx, "pizza", nil)
+
+	if err := ms.Reindex("alice"); err != nil {
+		t.Fatalf("Reindex: unexpected error: %v", err)
+	}
+	expectHits(t, idx, "pizza", []uint32{1})
+}
+
+func TestPersistenceLog(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := search.NewIndex(search.Configuration{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewIndex: unexpected error: %v", err)
+	}
+
+	index := func(mailboxUID, uid uint32, body string) {
+		t.Helper()
+		if err := idx.Index("alice", mails.Mail{MailboxUID: mailboxUID, UID: uid, Body: body}); err != nil {
+			t.Fatalf("Index: unexpected error: %v", err)
+		}
+	}
+	reopen := func() *search.Index {
+		t.Helper()
+		reopened, err := search.NewIndex(search.Configuration{Dir: dir})
+		if err != nil {
+			t.Fatalf("NewIndex: unexpected error: %v", err)
+		}
+		return reopened
+	}
+
+	index(1, 1, "Subject: Lunch\r\n\r\nPizza at noon?")
+	index(1, 2, "Subject: Dinner\r\n\r\nPasta tonight?")
+	index(2, 3, "Subject: Breakfast\r\n\r\nPancakes?")
+	index(1, 1, "Subject: Lunch\r\n\r\nSushi at noon?")
+	if err := idx.Remove("alice", 1, 2); err != nil {
+		t.Fatalf("Remove: unexpected error: %v", err)
+	}
+	if err := idx.RemoveMailbox("alice", 2); err != nil {
+		t.Fatalf("RemoveMailbox: unexpected error: %v", err)
+	}
+
+	// Changes are appended to the log instead of rewriting the index
+	logPath := filepath.Join(dir, hex.EncodeToString([]byte("alice"))+".log")
+	snapshotPath := filepath.Join(dir, hex.EncodeToString([]byte("alice"))+".idx")
+	if _, err := os.Stat(snapshotPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no snapshot before compaction, got %v", err)
+	}
+
+	reopened := reopen()
+	expectHits(t, reopened, "sushi", []uint32{1})
+	expectHits(t, reopened, "pizza", nil)
+	expectHits(t, reopened, "pasta", nil)
+	expectHits(t, reopened, "pancakes", nil)
+
+	// An incomplete change at the end of the log, e.g. after a crash, is dropped
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatalf("Open log: unexpected error: %v", err)
+	}
+	f.Write([]byte{0, 0, 0, 100, 1, 2, 3})
+	f.Close()
+	expectHits(t, reopen(), "sushi", []uint32{1})
+	index(1, 4, "Subject: Snack\r\n\r\nCookies?")
+	expectHits(t, reopen(), "cookies", []uint32{4})
+
+	// A long log is compacted into the snapshot
+	for uid := uint32(10); uid < 1010; uid++ {
+		index(1, uid, fmt.Sprintf("Subject: Mail %d\r\n\r\nNumber n%d", uid, uid))
+	}
+	if _, err := os.Stat(snapshotPath); err != nil {
+		t.Errorf("Expected a snapshot after compaction, got %v", err)
+	}
+	reopened = reopen()
+	expectHits(t, reopened, "n1009", []uint32{1009})
+	expectHits(t, reopened, "sushi", []uint32{1})
+}
+
+func TestEvictIdleUsers(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	idx, err := search.NewIndex(search.Configuration{Dir: dir, IdleTimeout: time.Minute, Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatalf("NewIndex: unexpected error: %v", err)
+	}
+	if err := idx.Index("alice", mails.Mail{MailboxUID: 1, UID: 1, Body: "Subject: Lunch\r\n\r\nPizza at noon?"}); err != nil {
+		t.Fatalf("Index: unexpected error: %v", err)
+	}
+
+	// Another index changes the persisted index, which is only seen once the
+	// index of alice was dropped from memory and is loaded again
+	other, err := search.NewIndex(search.Configuration{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewIndex: unexpected error: %v", err)
+	}
+	if err := other.Index("alice", mails.Mail{MailboxUID: 1, UID: 2, Body: "Subject: Dinner\r\n\r\nPasta tonight?"}); err != nil {
+		t.Fatalf("Index: unexpected error: %v", err)
+	}
+
+	now = now.Add(30 * time.Second)
+	expectHits(t, idx, "pasta", nil)
+
+	now = now.Add(2 * time.Minute)
+	expectHits(t, idx, "pasta", []uint32{2})
+	expectHits(t, idx, "pizza", []uint32{1})
+}
+
+func TestEncryptedFiles(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	open := func(key []byte) *search.Index {
+		t.Helper()
+		idx, err := search.NewIndex(search.Configuration{Dir: dir, Key: key})
+		if err != nil {
+			t.Fatalf("NewIndex: unexpected error: %v", err)
+		}
+		return idx
+	}
+
+	if _, err := search.NewIndex(search.Configuration{Dir: dir, Key: []byte("short")}); !errors.Is(err, search.ErrInvalidKey) {
+		t.Errorf("NewIndex: expected ErrInvalidKey, got %v", err)
+	}
+
+	idx := open(key)
+	for uid := uint32(1); uid <= 1000; uid++ {
+		if err := idx.Index("alice", mails.Mail{MailboxUID: 1, UID: uid, Body: "Subject: Lunch\r\n\r\nPizza at noon?"}); err != nil {
+			t.Fatalf("Index: unexpected error: %v", err)
+		}
+	}
+	if err := idx.Index("alice", mails.Mail{MailboxUID: 1, UID: 1001, Body: "Subject: Dinner\r\n\r\nPasta tonight?"}); err != nil {
+		t.Fatalf("Index: unexpected error: %v", err)
+	}
+
+	// Neither the snapshot nor the log contain the terms in plaintext
+	for _, ext := range []string{".idx", ".log"} {
+		data, err := os.ReadFile(filepath.Join(dir, hex.EncodeToString([]byte("alice"))+ext))
+		if err != nil {
+			t.Fatalf("ReadFile: unexpected error: %v", err)
+		}
+		if bytes.Contains(data, []byte("pizza")) || bytes.Contains(data, []byte("pasta")) {
+			t.Errorf("Expected %s file to be encrypted", ext)
+		}
+	}
+
+	expectHits(t, open(key), "pasta", []uint32{1001})
+
+	// Files of one user can not be read as the files of another
+	for _, ext := range []string{".idx", ".log"} {
+		data, err := os.ReadFile(filepath.Join(dir, hex.EncodeToString([]byte("alice"))+ext))
+		if err != nil {
+			t.Fatalf("ReadFile: unexpected error: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, hex.EncodeToString([]byte("bob"))+ext), data, 0o600); err != nil {
+			t.Fatalf("WriteFile: unexpected error: %v", err)
+		}
+	}
+	if _, err := open(key).Search("bob", search.Query{Text: "pizza"}); !errors.Is(err, search.ErrCorrupted) {
+		t.Errorf("Search: expected ErrCorrupted for files of another user, got %v", err)
+	}
+
+	// After the key changed, the index can only be cleared and rebuilt
+	other := open(bytes.Repeat([]byte{8}, 32))
+	if _, err := other.Search("alice", search.Query{Text: "pizza"}); !errors.Is(err, search.ErrCorrupted) {
+		t.Errorf("Search: expected ErrCorrupted with another key, got %v", err)
+	}
+	if err := other.Clear("alice"); err != nil {
+		t.Fatalf("Clear: unexpected error: %v", err)
+	}
+	expectHits(t, other, "pizza", nil)
+}
+
+func TestConcurrentUsers(t *testing.T) {
+	idx, err := search.NewIndex(search.Configuration{Dir: t.TempDir(), IdleTimeout: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewIndex: unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, userID := range []string{"alice", "bob", "carol"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uid := uint32(1); uid <= 50; uid++ {
+				body := fmt.Sprintf("Subject: Mail %d\r\n\r\nFor %s", uid, userID)
+				if err := idx.Index(userID, mails.Mail{MailboxUID: 1, UID: uid, Body: body}); err != nil {
+					t.Errorf("Index: unexpected error: %v", err)
+					return
+				}
+				if _, err := idx.Search(userID, search.Query{Text: userID}); err != nil {
+					t.Errorf("Search: unexpected error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Indexes that were dropped from memory while in use lost no changes
+	for _, userID := range []string{"alice", "bob", "carol"} {
+		hits, err := idx.Search(userID, search.Query{Text: userID})
+		if err != nil || len(hits) != 50 {
+			t.Errorf("Search %s: expected 50 hits, got %d, %v", userID, len(hits), err)
+		}
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	fields, err := search.ParseFields("Subject, from")
+	if err != nil {
+		t.Fatalf("ParseFields: unexpected error: %v", err)
+	}
+	if fields != search.FieldSubject|search.FieldFrom {
+		t.Errorf("ParseFields: expected subject and from, got %b", fields)
+	}
+
+	if fields, err := search.ParseFields(""); err != nil || fields != search.FieldAll {
+		t.Errorf("ParseFields: expected all fields for empty list, got %b, %v", fields, err)
+	}
+
+	if _, err := search.ParseFields("subject,date"); !errors.Is(err, search.ErrInvalidField) {
+		t.Errorf("ParseFields: expected ErrInvalidField, got %v", err)
+	}
+}
+
+func setup(t *testing.T, dir string) (*search.Index, *mails.Store) {
+	t.Helper()
+
+	idx, err := search.NewIndex(search.Configuration{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewIndex: unexpected error: %v", err)
+	}
+
+	ms := mails.NewStore(mails.Configuration{
+		DB:      mdb.NewDB(),
+		Indexer: idx,
+	})
+	if _, err := ms.GetMailboxByUID("alice", mails.DefaultMailboxUID); err != nil {
+		t.Fatalf("GetMailboxByUID: unexpected error: %v", err)
+	}
+
+	return idx, ms
+}
+
+func createMail(t *testing.T, ms *mails.Store, mailboxUID uint32, body string) {
+	t.Helper()
+
+	if err := ms.CreateMail("alice", mailboxUID, mails.Mail{Body: body}); err != nil {
+		t.Fatalf("CreateMail: unexpected error: %v", err)
+	}
+}
+
+func expectHits(t *testing.T, idx *search.Index, text string, want []uint32) {
+	t.Helper()
+
+	hits, err := idx.Search("alice", search.Query{Text: text})
+	if err != nil {
+		t.Fatalf("Search: unexpected error: %v", err)
+	}
+	if got := uids(hits); !slices.Equal(got, want) {
+		t.Errorf("Search %q: expected %v, got %v", text, want, got)
+	}
+}
+
+func uids(hits []search.Hit) []uint32 {
+	var uids []uint32
+	for _, h := range hits {
+		uids = append(uids, h.UID)
+	}
+	return uids
+}
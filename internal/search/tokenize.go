@@ -0,0 +1,25 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxTermLength skips tokens that are unlikely to be searched for, e.g. encoded data.
+const maxTermLength = 64
+
+// Tokenize splits the text into lower case terms of letters and digits.
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		if len([]rune(w)) > maxTermLength {
+			continue
+		}
+		terms = append(terms, strings.ToLower(w))
+	}
+	return terms
+}
@@ -0,0 +1,82 @@
+package fake
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+)
+
+type DB struct {
+	Items map[string]map[string]sieve.UserScript // user ID -> name -> script
+	mu    sync.Mutex
+}
+
+func NewDB() *DB {
+	return &DB{
+		Items: make(map[string]map[string]sieve.UserScript),
+		mu:    sync.Mutex{},
+	}
+}
+
+func (db *DB) Get(userID, name string) (*sieve.UserScript, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, exists := db.Items[userID][name]
+	if !exists {
+		return nil, sieve.ErrScriptNotFound
+	}
+	return &s, nil
+}
+
+func (db *DB) List(userID string) ([]sieve.UserScript, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	list := []sieve.UserScript{}
+	for _, s := range db.Items[userID] {
+		list = append(list, s)
+	}
+	slices.SortFunc(list, func(a, b sieve.UserScript) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list, nil
+}
+
+func (db *DB) Insert(s sieve.UserScript) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[s.UserID][s.Name]; exists {
+		return sieve.ErrScriptAlreadyExists
+	}
+	if db.Items[s.UserID] == nil {
+		db.Items[s.UserID] = make(map[string]sieve.UserScript)
+	}
+	db.Items[s.UserID][s.Name] = s
+	return nil
+}
+
+func (db *DB) Update(s sieve.UserScript) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[s.UserID][s.Name]; !exists {
+		return sieve.ErrScriptNotFound
+	}
+	db.Items[s.UserID][s.Name] = s
+	return nil
+}
+
+func (db *DB) Delete(userID, name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Items[userID][name]; !exists {
+		return sieve.ErrScriptNotFound
+	}
+	delete(db.Items[userID], name)
+	return nil
+}
@@ -0,0 +1,14 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	"github.com/OliverSchlueter/mail-server/internal/sieve/sievetest"
+)
+
+func TestDB(t *testing.T) {
+	sievetest.RunDBSuite(t, func() sieve.DB {
+		return NewDB()
+	})
+}
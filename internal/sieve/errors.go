@@ -0,0 +1,34 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrScriptNotFound      = errors.New("script not found")
+	ErrScriptAlreadyExists = errors.New("script already exists")
+	ErrInvalidName         = errors.New("invalid script name")
+	ErrInvalidScript       = errors.New("invalid script")
+	ErrScriptTooLarge      = errors.New("script too large")
+	ErrTooManyScripts      = errors.New("too many scripts")
+)
+
+// ParseError is an error in a script, with the line it was found on.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Unwrap makes every parse error an ErrInvalidScript.
+func (e *ParseError) Unwrap() error {
+	return ErrInvalidScript
+}
+
+func errorf(line int, format string, args ...any) error {
+	return &ParseError{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,234 @@
+package sieve
+
+import (
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenSemicolon
+	tokenComma
+	tokenLeftBracket
+	tokenRightBracket
+	tokenLeftBrace
+	tokenRightBrace
+	tokenLeftParen
+	tokenRightParen
+)
+
+type token struct {
+	kind   tokenKind
+	text   string // identifier or tag in lower case, or the value of a string
+	number int64
+	line   int
+}
+
+// lexer splits a script into tokens, see RFC 5228 section 8.1.
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skip(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokenEOF, line: l.line}, nil
+	}
+
+	line := l.line
+	c := l.src[l.pos]
+	switch {
+	case c == ';':
+		l.pos++
+		return token{kind: tokenSemicolon, line: line}, nil
+	case c == ',':
+		l.pos++
+		return token{kind: tokenComma, line: line}, nil
+	case c == '[':
+		l.pos++
+		return token{kind: tokenLeftBracket, line: line}, nil
+	case c == ']':
+		l.pos++
+		return token{kind: tokenRightBracket, line: line}, nil
+	case c == '{':
+		l.pos++
+		return token{kind: tokenLeftBrace, line: line}, nil
+	case c == '}':
+		l.pos++
+		return token{kind: tokenRightBrace, line: line}, nil
+	case c == '(':
+		l.pos++
+		return token{kind: tokenLeftParen, line: line}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokenRightParen, line: line}, nil
+	case c == '"':
+		return l.quoted()
+	case c == ':':
+		l.pos++
+		name := l.identifier()
+		if name == "" {
+			return token{}, errorf(line, "expected tag name after ':'")
+		}
+		return token{kind: tokenTag, text: strings.ToLower(name), line: line}, nil
+	case c >= '0' && c <= '9':
+		return l.number()
+	case isIdentifierStart(c):
+		name := l.identifier()
+		if strings.EqualFold(name, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multiLine(line)
+		}
+		return token{kind: tokenIdentifier, text: strings.ToLower(name), line: line}, nil
+	}
+	return token{}, errorf(line, "unexpected character %q", c)
+}
+
+// skip skips white space and comments.
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			end := strings.IndexByte(l.src[l.pos:], '\n')
+			if end < 0 {
+				l.pos = len(l.src)
+			} else {
+				l.pos += end
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return errorf(l.line, "unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.src) && (isIdentifierStart(l.src[l.pos]) || (l.pos > start && l.src[l.pos] >= '0' && l.src[l.pos] <= '9')) {
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+// number reads a number with an optional K, M or G quantifier.
+func (l *lexer) number() (token, error) {
+	line := l.line
+	start := l.pos
+	for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+		l.pos++
+	}
+
+	n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+	if err != nil {
+		return token{}, errorf(line, "invalid number %s", l.src[start:l.pos])
+	}
+
+	if l.pos < len(l.src) {
+		shift := 0
+		switch l.src[l.pos] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		}
+		if shift > 0 {
+			l.pos++
+			if n > (1<<63-1)>>shift {
+				return token{}, errorf(line, "number too large")
+			}
+			n <<= shift
+		}
+	}
+	return token{kind: tokenNumber, number: n, line: line}, nil
+}
+
+// quoted reads a quoted string, in which a backslash escapes the next character.
+func (l *lexer) quoted() (token, error) {
+	line := l.line
+	l.pos++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokenString, text: b.String(), line: line}, nil
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.src) {
+				break
+			}
+			c = l.src[l.pos]
+		}
+		if c == '\n' {
+			l.line++
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return token{}, errorf(line, "unterminated string")
+}
+
+// multiLine reads a string that starts after "text:" and ends with a line
+// that only contains a dot. Lines starting with a dot have it doubled.
+func (l *lexer) multiLine(line int) (token, error) {
+	end := strings.IndexByte(l.src[l.pos:], '\n')
+	if end < 0 {
+		return token{}, errorf(line, "unterminated multi-line string")
+	}
+	if rest := strings.TrimSpace(l.src[l.pos : l.pos+end]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return token{}, errorf(line, "unexpected text after text:")
+	}
+	l.pos += end + 1
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			end = len(l.src) - l.pos
+		}
+		text := strings.TrimSuffix(l.src[l.pos:l.pos+end], "\r")
+		l.pos += end
+		if l.pos < len(l.src) {
+			l.pos++
+			l.line++
+		}
+
+		if text == "." {
+			return token{kind: tokenString, text: b.String(), line: line}, nil
+		}
+		b.WriteString(strings.TrimPrefix(text, "."))
+		b.WriteString("\n")
+	}
+	return token{}, errorf(line, "unterminated multi-line string")
+}
+
+func isIdentifierStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
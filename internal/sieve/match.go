@@ -0,0 +1,106 @@
+package sieve
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// globPart is a literal, or a * or ? wildcard of a :matches pattern.
+type globPart struct {
+	literal string
+	star    bool
+	any     bool
+}
+
+// glob matches a value against the parts of a pattern and records what the
+// wildcards matched.
+type glob struct {
+	parts    []globPart
+	value    string // folded if the comparison ignores case
+	original string
+	captures []string
+	failed   map[[2]int]bool
+}
+
+// matchGlob reports whether the value matches the pattern of :matches, in
+// which * matches any sequence and ? any single character, and a backslash
+// escapes the next character. It returns what each wildcard matched, where
+// every * matches as few characters as possible, see RFC 5229 section 3.2.
+func matchGlob(pattern string, value string, fold bool) ([]string, bool) {
+	g := &glob{value: value, original: value, failed: map[[2]int]bool{}}
+	if fold {
+		pattern = foldASCII(pattern)
+		g.value = foldASCII(value)
+	}
+
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			g.parts = append(g.parts, globPart{literal: literal.String()})
+			literal.Reset()
+		}
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*':
+			flush()
+			g.parts = append(g.parts, globPart{star: true})
+		case c == '?':
+			flush()
+			g.parts = append(g.parts, globPart{any: true})
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			literal.WriteByte(pattern[i])
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	flush()
+
+	if !g.match(0, 0) {
+		return nil, false
+	}
+	return g.captures, true
+}
+
+func (g *glob) match(pi, si int) bool {
+	if pi == len(g.parts) {
+		return si == len(g.value)
+	}
+	if g.failed[[2]int{pi, si}] {
+		return false
+	}
+
+	switch p := g.parts[pi]; {
+	case p.star:
+		for end := si; ; {
+			g.captures = append(g.captures, g.original[si:end])
+			if g.match(pi+1, end) {
+				return true
+			}
+			g.captures = g.captures[:len(g.captures)-1]
+
+			if end == len(g.value) {
+				break
+			}
+			_, size := utf8.DecodeRuneInString(g.value[end:])
+			end += size
+		}
+	case p.any:
+		if si < len(g.value) {
+			_, size := utf8.DecodeRuneInString(g.value[si:])
+			g.captures = append(g.captures, g.original[si:si+size])
+			if g.match(pi+1, si+size) {
+				return true
+			}
+			g.captures = g.captures[:len(g.captures)-1]
+		}
+	default:
+		if strings.HasPrefix(g.value[si:], p.literal) && g.match(pi+1, si+len(p.literal)) {
+			return true
+		}
+	}
+
+	g.failed[[2]int{pi, si}] = true
+	return false
+}
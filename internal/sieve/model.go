@@ -0,0 +1,66 @@
+package sieve
+
+import "time"
+
+// UserScript is a Sieve script of a user. Only the active script of a user is
+// run for incoming mail.
+type UserScript struct {
+	UserID    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Content   string    `json:"content"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Envelope is the SMTP envelope of a mail.
+type Envelope struct {
+	From string // empty for the null sender
+	To   string // the recipient the script is run for
+}
+
+type ActionKind string
+
+const (
+	ActionKeep     ActionKind = "keep"
+	ActionFileInto ActionKind = "fileinto"
+	ActionRedirect ActionKind = "redirect"
+	ActionReject   ActionKind = "reject"
+	ActionVacation ActionKind = "vacation"
+)
+
+// Action is something a script does with the mail.
+type Action struct {
+	Kind     ActionKind
+	Mailbox  string    // fileinto
+	Flags    []string  // keep and fileinto, the IMAP flags to store the mail with
+	Address  string    // redirect
+	Reason   string    // reject
+	Vacation *Vacation // vacation
+}
+
+// Vacation is an automatic reply, see RFC 5230.
+type Vacation struct {
+	Days      int      // defaults to DefaultVacationDays
+	Subject   string   // empty for the default subject
+	From      string   // empty for the address of the user
+	Addresses []string // additional addresses of the user
+	Handle    string   // identifies the reply, to track who got it
+	Reason    string
+}
+
+// Result are the actions of a run. It contains a keep action if the implicit
+// keep was not cancelled, the mail is discarded if it contains no actions.
+type Result struct {
+	Actions []Action
+}
+
+// Has reports whether the result contains an action of the kind.
+func (r *Result) Has(kind ActionKind) bool {
+	for _, a := range r.Actions {
+		if a.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,491 @@
+package sieve
+
+import (
+	"slices"
+	"strings"
+)
+
+// maxNesting limits how deeply blocks and tests may be nested.
+const maxNesting = 32
+
+// Capabilities are the extensions scripts can require, besides the comparators.
+var Capabilities = []string{"body", "envelope", "fileinto", "imap4flags", "reject", "vacation", "variables"}
+
+// comparators are the supported comparators, see RFC 4790.
+var comparators = []string{"i;ascii-casemap", "i;octet"}
+
+type argType int
+
+const (
+	argString  argType = iota // a single string
+	argStrings                // a string list, a single string is a list of one
+	argNumber
+)
+
+type tagSpec struct {
+	group      string  // only one tag of the group may be used
+	value      argType // type of the value that follows the tag
+	hasValue   bool
+	capability string // extension that must be required, empty for the base spec
+}
+
+// grammar describes the arguments of a command or test.
+type grammar struct {
+	capability string
+	tags       map[string]tagSpec
+	args       []argType
+	optional   int  // number of leading arguments that may be omitted
+	tests      int  // 0 for none, 1 for a single test, -1 for a test list
+	block      bool // whether the command is followed by a block
+	test       bool // whether it is a test instead of a command
+}
+
+var (
+	comparatorTags  = map[string]tagSpec{"comparator": {group: "comparator", value: argString, hasValue: true}}
+	matchTags       = map[string]tagSpec{"is": {group: "match"}, "contains": {group: "match"}, "matches": {group: "match"}}
+	addressPartTags = map[string]tagSpec{"all": {group: "part"}, "localpart": {group: "part"}, "domain": {group: "part"}}
+	flagsTags       = map[string]tagSpec{"flags": {value: argStrings, hasValue: true, capability: "imap4flags"}}
+)
+
+var grammars = map[string]grammar{
+	// Control, see RFC 5228 section 3
+	"require": {args: []argType{argStrings}},
+	"if":      {tests: 1, block: true},
+	"elsif":   {tests: 1, block: true},
+	"else":    {block: true},
+	"stop":    {},
+
+	// Actions, see RFC 5228 section 4 and the extensions
+	"keep":     {tags: flagsTags},
+	"discard":  {},
+	"fileinto": {capability: "fileinto", tags: flagsTags, args: []argType{argString}},
+	"redirect": {args: []argType{argString}},
+	"reject":   {capability: "reject", args: []argType{argString}},
+	"vacation": {capability: "vacation", args: []argType{argString}, tags: map[string]tagSpec{
+		"days":      {value: argNumber, hasValue: true},
+		"subject":   {value: argString, hasValue: true},
+		"from":      {value: argString, hasValue: true},
+		"addresses": {value: argStrings, hasValue: true},
+		"handle":    {value: argString, hasValue: true},
+	}},
+	"setflag":    {capability: "imap4flags", args: []argType{argString, argStrings}, optional: 1},
+	"addflag":    {capability: "imap4flags", args: []argType{argString, argStrings}, optional: 1},
+	"removeflag": {capability: "imap4flags", args: []argType{argString, argStrings}, optional: 1},
+	"set": {capability: "variables", args: []argType{argString, argString}, tags: map[string]tagSpec{
+		"lower":         {group: "case"},
+		"upper":         {group: "case"},
+		"lowerfirst":    {group: "first"},
+		"upperfirst":    {group: "first"},
+		"quotewildcard": {group: "quote"},
+		"length":        {group: "length"},
+	}},
+
+	// Tests, see RFC 5228 section 5 and the extensions
+	"address":  {test: true, args: []argType{argStrings, argStrings}, tags: merge(comparatorTags, matchTags, addressPartTags)},
+	"envelope": {test: true, capability: "envelope", args: []argType{argStrings, argStrings}, tags: merge(comparatorTags, matchTags, addressPartTags)},
+	"header":   {test: true, args: []argType{argStrings, argStrings}, tags: merge(comparatorTags, matchTags)},
+	"exists":   {test: true, args: []argType{argStrings}},
+	"size":     {test: true, args: []argType{argNumber}, tags: map[string]tagSpec{"over": {group: "size"}, "under": {group: "size"}}},
+	"body": {test: true, capability: "body", args: []argType{argStrings}, tags: merge(comparatorTags, matchTags, map[string]tagSpec{
+		"raw":     {group: "transform"},
+		"text":    {group: "transform"},
+		"content": {group: "transform", value: argStrings, hasValue: true},
+	})},
+	"hasflag": {test: true, capability: "imap4flags", args: []argType{argStrings, argStrings}, optional: 1, tags: merge(comparatorTags, matchTags)},
+	"string":  {test: true, capability: "variables", args: []argType{argStrings, argStrings}, tags: merge(comparatorTags, matchTags)},
+	"true":    {test: true},
+	"false":   {test: true},
+	"not":     {test: true, tests: 1},
+	"allof":   {test: true, tests: -1},
+	"anyof":   {test: true, tests: -1},
+}
+
+// Script is a parsed Sieve script (RFC 5228).
+type Script struct {
+	commands     []*node
+	capabilities map[string]bool
+}
+
+// node is a command or test with its arguments.
+type node struct {
+	name  string
+	line  int
+	tags  map[string]*value // nil for tags without a value
+	args  []*value          // nil for omitted optional arguments
+	tests []*node
+	block []*node
+}
+
+type value struct {
+	strings []string
+	number  int64
+}
+
+// str returns the first string of the value.
+func (v *value) str() string {
+	if v == nil || len(v.strings) == 0 {
+		return ""
+	}
+	return v.strings[0]
+}
+
+// tag returns the value of the tag and whether the node has it.
+func (n *node) tag(name string) (*value, bool) {
+	v, ok := n.tags[name]
+	return v, ok
+}
+
+// group returns the tag of the group the node has, or the default.
+func (n *node) group(group string, fallback string) string {
+	g := grammars[n.name]
+	for name := range n.tags {
+		if g.tags[name].group == group {
+			return name
+		}
+	}
+	return fallback
+}
+
+// Parse parses the script and checks that it only uses the commands, tests
+// and arguments of the required extensions.
+func Parse(src string) (*Script, error) {
+	p := &parser{
+		lexer:  lexer{src: src, line: 1},
+		script: &Script{capabilities: map[string]bool{}},
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	commands, err := p.commands(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenEOF {
+		return nil, errorf(p.tok.line, "unexpected '}'")
+	}
+	p.script.commands = commands
+	return p.script, nil
+}
+
+type parser struct {
+	lexer  lexer
+	tok    token
+	script *Script
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) expect(kind tokenKind, what string) error {
+	if p.tok.kind != kind {
+		return errorf(p.tok.line, "expected %s", what)
+	}
+	return p.advance()
+}
+
+// commands parses commands until the end of the script or block.
+func (p *parser) commands(depth int) ([]*node, error) {
+	if depth > maxNesting {
+		return nil, errorf(p.tok.line, "blocks are nested too deeply")
+	}
+
+	var commands []*node
+	for p.tok.kind != tokenEOF && p.tok.kind != tokenRightBrace {
+		if p.tok.kind != tokenIdentifier {
+			return nil, errorf(p.tok.line, "expected command")
+		}
+		if grammars[p.tok.text].test {
+			return nil, errorf(p.tok.line, "%s is not a command", p.tok.text)
+		}
+
+		n, err := p.node(depth)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkCommand(n, commands, depth); err != nil {
+			return nil, err
+		}
+		commands = append(commands, n)
+	}
+	return commands, nil
+}
+
+// node parses a command or test with its arguments.
+func (p *parser) node(depth int) (*node, error) {
+	n := &node{name: p.tok.text, line: p.tok.line, tags: map[string]*value{}}
+	g, ok := grammars[n.name]
+	if !ok {
+		return nil, errorf(n.line, "unknown command or test %s", n.name)
+	}
+	if g.capability != "" && !p.script.capabilities[g.capability] {
+		return nil, errorf(n.line, "%s requires the %s extension", n.name, g.capability)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var args []*value
+	for {
+		switch p.tok.kind {
+		case tokenTag:
+			if err := p.tag(n, g); err != nil {
+				return nil, err
+			}
+			continue
+		case tokenString, tokenLeftBracket:
+			v, err := p.strings()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, v)
+			continue
+		case tokenNumber:
+			args = append(args, &value{number: p.tok.number})
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		break
+	}
+
+	if err := p.checkArgs(n, g, args); err != nil {
+		return nil, err
+	}
+
+	switch g.tests {
+	case 1:
+		if p.tok.kind != tokenIdentifier {
+			return nil, errorf(p.tok.line, "%s expects a test", n.name)
+		}
+		t, err := p.test(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		n.tests = []*node{t}
+	case -1:
+		if err := p.expect(tokenLeftParen, "'(' after "+n.name); err != nil {
+			return nil, err
+		}
+		for {
+			t, err := p.test(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			n.tests = append(n.tests, t)
+			if p.tok.kind != tokenComma {
+				break
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect(tokenRightParen, "')'"); err != nil {
+			return nil, err
+		}
+	}
+
+	if g.test {
+		return n, nil
+	}
+
+	if !g.block {
+		if err := p.expect(tokenSemicolon, "';' after "+n.name); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	if err := p.expect(tokenLeftBrace, "'{' after "+n.name); err != nil {
+		return nil, err
+	}
+	block, err := p.commands(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenRightBrace, "'}'"); err != nil {
+		return nil, err
+	}
+	n.block = block
+	return n, nil
+}
+
+func (p *parser) test(depth int) (*node, error) {
+	if depth > maxNesting {
+		return nil, errorf(p.tok.line, "tests are nested too deeply")
+	}
+	if p.tok.kind != tokenIdentifier {
+		return nil, errorf(p.tok.line, "expected test")
+	}
+
+	line := p.tok.line
+	t, err := p.node(depth)
+	if err != nil {
+		return nil, err
+	}
+	if !grammars[t.name].test {
+		return nil, errorf(line, "%s is not a test", t.name)
+	}
+	return t, nil
+}
+
+// tag parses a tag and its value.
+func (p *parser) tag(n *node, g grammar) error {
+	name, line := p.tok.text, p.tok.line
+	spec, ok := g.tags[name]
+	if !ok {
+		return errorf(line, "unknown tag :%s for %s", name, n.name)
+	}
+	if spec.capability != "" && !p.script.capabilities[spec.capability] {
+		return errorf(line, ":%s requires the %s extension", name, spec.capability)
+	}
+	if _, exists := n.tags[name]; exists {
+		return errorf(line, "duplicate tag :%s", name)
+	}
+	if spec.group != "" && n.group(spec.group, "") != "" {
+		return errorf(line, "conflicting tag :%s", name)
+	}
+	if err := p.advance(); err != nil {
+		return err
+	}
+
+	if !spec.hasValue {
+		n.tags[name] = nil
+		return nil
+	}
+
+	var v *value
+	switch spec.value {
+	case argNumber:
+		if p.tok.kind != tokenNumber {
+			return errorf(p.tok.line, ":%s expects a number", name)
+		}
+		v = &value{number: p.tok.number}
+		if err := p.advance(); err != nil {
+			return err
+		}
+	default:
+		var err error
+		if v, err = p.strings(); err != nil {
+			return err
+		}
+		if spec.value == argString && len(v.strings) != 1 {
+			return errorf(line, ":%s expects a string", name)
+		}
+	}
+
+	if name == "comparator" && !slices.Contains(comparators, strings.ToLower(v.str())) {
+		return errorf(line, "unsupported comparator %s", v.str())
+	}
+	n.tags[name] = v
+	return nil
+}
+
+// strings parses a string or string list.
+func (p *parser) strings() (*value, error) {
+	if p.tok.kind == tokenString {
+		v := &value{strings: []string{p.tok.text}}
+		return v, p.advance()
+	}
+
+	if err := p.expect(tokenLeftBracket, "string list"); err != nil {
+		return nil, err
+	}
+	v := &value{}
+	for {
+		if p.tok.kind != tokenString {
+			return nil, errorf(p.tok.line, "expected string")
+		}
+		v.strings = append(v.strings, p.tok.text)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenComma {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return v, p.expect(tokenRightBracket, "']'")
+}
+
+// checkArgs checks the positional arguments against the grammar and stores
+// them, with nil for omitted optional ones.
+func (p *parser) checkArgs(n *node, g grammar, args []*value) error {
+	omitted := len(g.args) - len(args)
+	if omitted < 0 || omitted > g.optional {
+		return errorf(n.line, "wrong number of arguments for %s", n.name)
+	}
+
+	if g.optional > 0 && omitted == 0 && !p.script.capabilities["variables"] {
+		return errorf(n.line, "variable names of %s require the variables extension", n.name)
+	}
+
+	n.args = make([]*value, omitted, len(g.args))
+	for i, arg := range args {
+		want := g.args[omitted+i]
+		switch {
+		case want == argNumber && arg.strings != nil:
+			return errorf(n.line, "argument %d of %s must be a number", omitted+i+1, n.name)
+		case want != argNumber && arg.strings == nil:
+			return errorf(n.line, "argument %d of %s must be a string", omitted+i+1, n.name)
+		case want == argString && len(arg.strings) != 1:
+			return errorf(n.line, "argument %d of %s must be a single string", omitted+i+1, n.name)
+		}
+		n.args = append(n.args, arg)
+	}
+
+	if n.name == "size" && n.group("size", "") == "" {
+		return errorf(n.line, "size requires :over or :under")
+	}
+	return nil
+}
+
+// checkCommand checks the placement of the command and registers the
+// extensions of require commands.
+func (p *parser) checkCommand(n *node, previous []*node, depth int) error {
+	var last string
+	if len(previous) > 0 {
+		last = previous[len(previous)-1].name
+	}
+
+	switch n.name {
+	case "require":
+		if depth > 0 || (last != "" && last != "require") {
+			return errorf(n.line, "require must be at the beginning of the script")
+		}
+		for _, capability := range n.args[0].strings {
+			capability = strings.ToLower(capability)
+			if name, ok := strings.CutPrefix(capability, "comparator-"); ok && slices.Contains(comparators, name) {
+				continue
+			}
+			if !slices.Contains(Capabilities, capability) {
+				return errorf(n.line, "unsupported extension %s", capability)
+			}
+			p.script.capabilities[capability] = true
+		}
+	case "elsif", "else":
+		if last != "if" && last != "elsif" {
+			return errorf(n.line, "%s without if", n.name)
+		}
+	}
+	return nil
+}
+
+func merge(specs ...map[string]tagSpec) map[string]tagSpec {
+	merged := map[string]tagSpec{}
+	for _, spec := range specs {
+		for name, s := range spec {
+			merged[name] = s
+		}
+	}
+	return merged
+}
@@ -0,0 +1,577 @@
+package sieve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+)
+
+const (
+	MaxRedirects        = 4
+	DefaultVacationDays = 7
+	MaxVacationDays     = 365
+
+	// maxVariableLength truncates longer values of variables, see RFC 5229 section 3.
+	maxVariableLength = 4096
+)
+
+// errStop ends the script, see RFC 5228 section 3.3.
+var errStop = errors.New("stop")
+
+// Run executes the script for the mail and returns its actions. The mail
+// must be kept if the script fails, see RFC 5228 section 2.10.6.
+func (s *Script) Run(m mails.Mail, env Envelope) (*Result, error) {
+	r := &runner{
+		script:       s,
+		mail:         m,
+		env:          env,
+		variables:    map[string]string{},
+		implicitKeep: true,
+	}
+
+	if err := r.commands(s.commands); err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+
+	if r.implicitKeep {
+		r.store(ActionKeep, "", r.flags)
+	}
+	return &Result{Actions: r.actions}, nil
+}
+
+type runner struct {
+	script *Script
+	mail   mails.Mail
+	env    Envelope
+	msg    *message.Message // parsed on first use
+
+	actions      []Action
+	implicitKeep bool
+	redirects    int
+	flags        []string          // the internal flags of imap4flags
+	variables    map[string]string // names in lower case
+	matches      []string          // the match variables of the last successful :matches
+}
+
+func (r *runner) commands(commands []*node) error {
+	// ran is set once a test of an if, elsif chain succeeded
+	ran := false
+	for _, n := range commands {
+		switch n.name {
+		case "if", "elsif":
+			if n.name == "if" {
+				ran = false
+			}
+			if ran {
+				continue
+			}
+			ok, err := r.test(n.tests[0])
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			ran = true
+			if err := r.commands(n.block); err != nil {
+				return err
+			}
+		case "else":
+			if ran {
+				continue
+			}
+			if err := r.commands(n.block); err != nil {
+				return err
+			}
+		default:
+			if err := r.command(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *runner) command(n *node) error {
+	switch n.name {
+	case "require":
+		return nil
+	case "stop":
+		return errStop
+	case "keep":
+		if err := r.checkReject(n); err != nil {
+			return err
+		}
+		r.implicitKeep = false
+		r.store(ActionKeep, "", r.actionFlags(n))
+	case "fileinto":
+		if err := r.checkReject(n); err != nil {
+			return err
+		}
+		mailbox := r.expand(n.args[0].str())
+		if mailbox == "" {
+			return runtimeErrorf(n, "empty mailbox name")
+		}
+		r.implicitKeep = false
+		r.store(ActionFileInto, mailbox, r.actionFlags(n))
+	case "redirect":
+		address := strings.TrimSpace(r.expand(n.args[0].str()))
+		if addr, err := mail.ParseAddress(address); err != nil || addr.Address != address {
+			return runtimeErrorf(n, "invalid address %q", address)
+		}
+		r.implicitKeep = false
+		if slices.ContainsFunc(r.actions, func(a Action) bool { return a.Kind == ActionRedirect && strings.EqualFold(a.Address, address) }) {
+			return nil
+		}
+		if r.redirects++; r.redirects > MaxRedirects {
+			return runtimeErrorf(n, "more than %d redirects", MaxRedirects)
+		}
+		r.actions = append(r.actions, Action{Kind: ActionRedirect, Address: address})
+	case "discard":
+		r.implicitKeep = false
+	case "reject":
+		for _, a := range r.actions {
+			if a.Kind != ActionRedirect {
+				return runtimeErrorf(n, "reject can not be combined with %s", a.Kind)
+			}
+		}
+		r.implicitKeep = false
+		r.actions = append(r.actions, Action{Kind: ActionReject, Reason: r.expand(n.args[0].str())})
+	case "vacation":
+		if err := r.checkReject(n); err != nil {
+			return err
+		}
+		if slices.ContainsFunc(r.actions, func(a Action) bool { return a.Kind == ActionVacation }) {
+			return runtimeErrorf(n, "only one vacation action is allowed")
+		}
+		r.actions = append(r.actions, Action{Kind: ActionVacation, Vacation: r.vacation(n)})
+	case "setflag", "addflag", "removeflag":
+		current := r.flags
+		if n.args[0] != nil {
+			current = normalizeFlags([]string{r.variables[strings.ToLower(n.args[0].str())]})
+		}
+
+		flags := normalizeFlags(r.expandAll(n.args[1].strings))
+		switch n.name {
+		case "addflag":
+			flags = normalizeFlags(append(slices.Clone(current), flags...))
+		case "removeflag":
+			flags = slices.DeleteFunc(slices.Clone(current), func(f string) bool {
+				return slices.ContainsFunc(flags, func(o string) bool { return strings.EqualFold(f, o) })
+			})
+		}
+
+		if n.args[0] != nil {
+			r.setVariable(n.args[0].str(), strings.Join(flags, " "))
+		} else {
+			r.flags = flags
+		}
+	case "set":
+		r.setVariable(n.args[0].str(), modify(n, r.expand(n.args[1].str())))
+	default:
+		return runtimeErrorf(n, "%s is not a command", n.name)
+	}
+	return nil
+}
+
+// checkReject fails if the script already rejected the mail, which can not be
+// combined with storing it or replying to it, see RFC 5429 section 2.1.
+func (r *runner) checkReject(n *node) error {
+	if slices.ContainsFunc(r.actions, func(a Action) bool { return a.Kind == ActionReject }) {
+		return runtimeErrorf(n, "%s can not be combined with reject", n.name)
+	}
+	return nil
+}
+
+// store adds a keep or fileinto action. The mail is only stored once per
+// mailbox, with the flags of the first action.
+func (r *runner) store(kind ActionKind, mailbox string, flags []string) {
+	same := func(a Action) bool {
+		if a.Kind != kind {
+			return false
+		}
+		return a.Mailbox == mailbox || (strings.EqualFold(a.Mailbox, mails.DefaultMailboxName) && strings.EqualFold(mailbox, mails.DefaultMailboxName))
+	}
+	if slices.ContainsFunc(r.actions, same) {
+		return
+	}
+	r.actions = append(r.actions, Action{Kind: kind, Mailbox: mailbox, Flags: slices.Clone(flags)})
+}
+
+// actionFlags returns the flags of the :flags tag or the internal flags.
+func (r *runner) actionFlags(n *node) []string {
+	if v, ok := n.tag("flags"); ok {
+		return normalizeFlags(r.expandAll(v.strings))
+	}
+	return r.flags
+}
+
+func (r *runner) vacation(n *node) *Vacation {
+	v := &Vacation{
+		Days:   DefaultVacationDays,
+		Reason: r.expand(n.args[0].str()),
+	}
+	if days, ok := n.tag("days"); ok {
+		v.Days = int(min(max(days.number, 1), MaxVacationDays))
+	}
+	if subject, ok := n.tag("subject"); ok {
+		v.Subject = r.expand(subject.str())
+	}
+	if from, ok := n.tag("from"); ok {
+		v.From = r.expand(from.str())
+	}
+	if addresses, ok := n.tag("addresses"); ok {
+		v.Addresses = r.expandAll(addresses.strings)
+	}
+
+	if handle, ok := n.tag("handle"); ok {
+		v.Handle = r.expand(handle.str())
+	} else {
+		// Replies with the same content share the same handle, see RFC 5230 section 4.2
+		sum := sha256.Sum256([]byte(v.Subject + "\x00" + v.From + "\x00" + v.Reason))
+		v.Handle = hex.EncodeToString(sum[:8])
+	}
+	return v
+}
+
+func (r *runner) test(n *node) (bool, error) {
+	switch n.name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		ok, err := r.test(n.tests[0])
+		return !ok, err
+	case "allof", "anyof":
+		for _, t := range n.tests {
+			ok, err := r.test(t)
+			if err != nil {
+				return false, err
+			}
+			if ok != (n.name == "allof") {
+				return ok, nil
+			}
+		}
+		return n.name == "allof", nil
+	case "exists":
+		header := r.message().Header
+		for _, name := range r.expandAll(n.args[0].strings) {
+			if len(header.Values(name)) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		size := int64(len(r.mail.Body))
+		if _, over := n.tag("over"); over {
+			return size > n.args[0].number, nil
+		}
+		return size < n.args[0].number, nil
+	case "header":
+		var values []string
+		for _, name := range r.expandAll(n.args[0].strings) {
+			for _, v := range r.message().Header.Values(name) {
+				values = append(values, message.DecodeHeader(v))
+			}
+		}
+		return r.match(n, values, n.args[1].strings), nil
+	case "address":
+		var values []string
+		for _, name := range r.expandAll(n.args[0].strings) {
+			for _, v := range r.message().Header.Values(name) {
+				values = append(values, addressPart(n, addresses(v))...)
+			}
+		}
+		return r.match(n, values, n.args[1].strings), nil
+	case "envelope":
+		var values []string
+		for _, part := range r.expandAll(n.args[0].strings) {
+			switch strings.ToLower(part) {
+			case "from":
+				values = append(values, addressPart(n, []string{r.env.From})...)
+			case "to":
+				values = append(values, addressPart(n, []string{r.env.To})...)
+			}
+		}
+		return r.match(n, values, n.args[1].strings), nil
+	case "body":
+		return r.match(n, r.body(n), n.args[0].strings), nil
+	case "hasflag":
+		flags := r.flags
+		if n.args[0] != nil {
+			flags = nil
+			for _, name := range n.args[0].strings {
+				flags = append(flags, normalizeFlags([]string{r.variables[strings.ToLower(name)]})...)
+			}
+		}
+		return r.match(n, flags, n.args[1].strings), nil
+	case "string":
+		return r.match(n, r.expandAll(n.args[0].strings), n.args[1].strings), nil
+	}
+	return false, runtimeErrorf(n, "%s is not a test", n.name)
+}
+
+// message returns the parsed mail. Mail that can not be parsed as MIME is
+// only matched by its headers.
+func (r *runner) message() *message.Message {
+	if r.msg != nil {
+		return r.msg
+	}
+
+	msg, err := message.Parse(r.mail)
+	if err != nil {
+		msg = &message.Message{Header: textproto.MIMEHeader{}}
+		if parsed, err := mail.ReadMessage(bytes.NewReader(message.Raw(r.mail))); err == nil {
+			msg.Header = textproto.MIMEHeader(parsed.Header)
+		}
+	}
+	r.msg = msg
+	return msg
+}
+
+// body returns the parts of the body the body test matches, see RFC 5173.
+func (r *runner) body(n *node) []string {
+	switch n.group("transform", "text") {
+	case "raw":
+		raw := message.Raw(r.mail)
+		if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+			return []string{string(raw[i+4:])}
+		}
+		return []string{""}
+	case "content":
+		types, _ := n.tag("content")
+		var values []string
+		for _, p := range r.message().Parts {
+			if p.IsMultipart() {
+				continue
+			}
+			for _, t := range r.expandAll(types.strings) {
+				t = strings.ToLower(t)
+				if t == "" || p.ContentType == t || (!strings.Contains(t, "/") && strings.HasPrefix(p.ContentType, t+"/")) {
+					values = append(values, string(p.Content))
+					break
+				}
+			}
+		}
+		return values
+	}
+	return []string{r.message().Text()}
+}
+
+// match reports whether one of the values matches one of the keys, with the
+// match type and comparator of the node. A successful :matches sets the
+// match variables.
+func (r *runner) match(n *node, values []string, keys []string) bool {
+	fold := true
+	if c, ok := n.tag("comparator"); ok && strings.EqualFold(c.str(), "i;octet") {
+		fold = false
+	}
+	matchType := n.group("match", "is")
+
+	for _, key := range r.expandAll(keys) {
+		for _, v := range values {
+			switch matchType {
+			case "is":
+				if equal(v, key, fold) {
+					return true
+				}
+			case "contains":
+				if fold {
+					if strings.Contains(foldASCII(v), foldASCII(key)) {
+						return true
+					}
+				} else if strings.Contains(v, key) {
+					return true
+				}
+			case "matches":
+				if captures, ok := matchGlob(key, v, fold); ok {
+					r.matches = append([]string{v}, captures...)
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// expand replaces the variables in the string, if the script uses variables.
+// Unknown variables are empty, see RFC 5229 section 3.
+func (r *runner) expand(s string) string {
+	if !r.script.capabilities["variables"] || !strings.Contains(s, "${") {
+		return s
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			break
+		}
+
+		name := s[start+2 : start+end]
+		b.WriteString(s[:start])
+		if v, ok := r.variable(name); ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(s[start : start+end+1])
+		}
+		s = s[start+end+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func (r *runner) expandAll(list []string) []string {
+	expanded := make([]string, len(list))
+	for i, s := range list {
+		expanded[i] = r.expand(s)
+	}
+	return expanded
+}
+
+// variable returns the value of the variable, ok is false if the name is not
+// a valid variable name.
+func (r *runner) variable(name string) (string, bool) {
+	if n, err := strconv.Atoi(name); err == nil && name[0] >= '0' && name[0] <= '9' {
+		if n < len(r.matches) {
+			return r.matches[n], true
+		}
+		return "", true
+	}
+	if !validVariableName(name) {
+		return "", false
+	}
+	return r.variables[strings.ToLower(name)], true
+}
+
+func (r *runner) setVariable(name string, v string) {
+	if len(v) > maxVariableLength {
+		v = strings.ToValidUTF8(v[:maxVariableLength], "")
+	}
+	r.variables[strings.ToLower(name)] = v
+}
+
+// modify applies the modifiers of a set command by their precedence, see RFC
+// 5229 section 4.1.
+func modify(n *node, v string) string {
+	switch n.group("case", "") {
+	case "lower":
+		v = strings.ToLower(v)
+	case "upper":
+		v = strings.ToUpper(v)
+	}
+	if first, size := utf8.DecodeRuneInString(v); size > 0 {
+		switch n.group("first", "") {
+		case "lowerfirst":
+			v = strings.ToLower(string(first)) + v[size:]
+		case "upperfirst":
+			v = strings.ToUpper(string(first)) + v[size:]
+		}
+	}
+	if _, ok := n.tag("quotewildcard"); ok {
+		v = strings.NewReplacer(`*`, `\*`, `?`, `\?`, `\`, `\\`).Replace(v)
+	}
+	if _, ok := n.tag("length"); ok {
+		v = strconv.Itoa(utf8.RuneCountInString(v))
+	}
+	return v
+}
+
+func validVariableName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isIdentifierStart(name[i]) && (name[i] < '0' || name[i] > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// addresses returns the addresses of a header value, or the trimmed value if
+// it is not an address list.
+func addresses(v string) []string {
+	list, err := (&mail.AddressParser{}).ParseList(v)
+	if err != nil {
+		return []string{strings.TrimSpace(v)}
+	}
+
+	result := make([]string, 0, len(list))
+	for _, a := range list {
+		result = append(result, a.Address)
+	}
+	return result
+}
+
+// addressPart returns the part of the addresses the node matches.
+func addressPart(n *node, list []string) []string {
+	part := n.group("part", "all")
+	result := make([]string, 0, len(list))
+	for _, a := range list {
+		at := strings.LastIndex(a, "@")
+		switch {
+		case part == "localpart" && at >= 0:
+			a = a[:at]
+		case part == "domain" && at >= 0:
+			a = a[at+1:]
+		case part == "domain":
+			a = ""
+		}
+		result = append(result, a)
+	}
+	return result
+}
+
+// normalizeFlags splits the space separated flags and removes duplicates, see
+// RFC 5232 section 3.
+func normalizeFlags(list []string) []string {
+	flags := []string{}
+	for _, s := range list {
+		for _, f := range strings.Fields(s) {
+			if !slices.ContainsFunc(flags, func(o string) bool { return strings.EqualFold(o, f) }) {
+				flags = append(flags, f)
+			}
+		}
+	}
+	return flags
+}
+
+// foldASCII maps ASCII letters to lower case, as the i;ascii-casemap
+// comparator does. The length of the string does not change.
+func foldASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+func equal(a, b string, fold bool) bool {
+	if fold {
+		return foldASCII(a) == foldASCII(b)
+	}
+	return a == b
+}
+
+func runtimeErrorf(n *node, format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", n.line, fmt.Sprintf(format, args...))
+}
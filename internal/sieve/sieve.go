@@ -0,0 +1,173 @@
+// Package sieve filters incoming mail with Sieve scripts (RFC 5228) and
+// stores the scripts of users. Besides the base language, the extensions
+// body, envelope, fileinto, imap4flags, reject, vacation and variables are
+// supported.
+package sieve
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	MaxScriptSize = 64 * 1024
+	MaxScripts    = 20 // per user
+	MaxNameLength = 128
+)
+
+type DB interface {
+	Get(userID, name string) (*UserScript, error)
+	// List returns the scripts of the user, sorted by name.
+	List(userID string) ([]UserScript, error)
+	Insert(s UserScript) error
+	Update(s UserScript) error
+	Delete(userID, name string) error
+}
+
+type Store struct {
+	db DB
+}
+
+type Configuration struct {
+	DB DB
+}
+
+func NewStore(cfg Configuration) *Store {
+	return &Store{
+		db: cfg.DB,
+	}
+}
+
+func (s *Store) Get(userID, name string) (*UserScript, error) {
+	return s.db.Get(userID, name)
+}
+
+func (s *Store) List(userID string) ([]UserScript, error) {
+	return s.db.List(userID)
+}
+
+// Put creates or replaces the script with the name. The script must parse,
+// errors wrap ErrInvalidScript and name the line of the error. Replacing a
+// script keeps it active if it was.
+func (s *Store) Put(userID, name, content string) (*UserScript, error) {
+	if !validName(name) {
+		return nil, ErrInvalidName
+	}
+	if len(content) > MaxScriptSize {
+		return nil, ErrScriptTooLarge
+	}
+	if _, err := Parse(content); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	existing, err := s.db.Get(userID, name)
+	if err == nil {
+		existing.Content = content
+		existing.UpdatedAt = now
+		if err := s.db.Update(*existing); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	}
+	if !errors.Is(err, ErrScriptNotFound) {
+		return nil, err
+	}
+
+	list, err := s.db.List(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) >= MaxScripts {
+		return nil, ErrTooManyScripts
+	}
+
+	script := UserScript{
+		UserID:    userID,
+		Name:      name,
+		Content:   content,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.db.Insert(script); err != nil {
+		return nil, err
+	}
+	return &script, nil
+}
+
+// Activate makes the script with the name the active script of the user. An
+// empty name deactivates all scripts, so no script is run.
+func (s *Store) Activate(userID, name string) error {
+	if name != "" {
+		if _, err := s.db.Get(userID, name); err != nil {
+			return err
+		}
+	}
+
+	list, err := s.db.List(userID)
+	if err != nil {
+		return err
+	}
+	for _, script := range list {
+		active := script.Name == name
+		if script.Active == active {
+			continue
+		}
+		script.Active = active
+		if err := s.db.Update(script); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) Remove(userID, name string) error {
+	return s.db.Delete(userID, name)
+}
+
+// RemoveAll deletes all scripts of the user.
+func (s *Store) RemoveAll(userID string) error {
+	list, err := s.db.List(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, script := range list {
+		if err := s.db.Delete(userID, script.Name); err != nil && !errors.Is(err, ErrScriptNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Active returns the parsed active script of the user, or nil if the user has
+// none.
+func (s *Store) Active(userID string) (*Script, error) {
+	list, err := s.db.List(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, script := range list {
+		if script.Active {
+			return Parse(script.Content)
+		}
+	}
+	return nil, nil
+}
+
+// validName reports whether the name can be used for a script, see RFC 5804
+// section 1.6.
+func validName(name string) bool {
+	if name == "" || len(name) > MaxNameLength || strings.TrimSpace(name) != name {
+		return false
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) || c == '/' || c == unicode.ReplacementChar {
+			return false
+		}
+	}
+	return true
+}
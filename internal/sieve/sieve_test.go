@@ -0,0 +1,282 @@
+package sieve_test
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	"github.com/OliverSchlueter/mail-server/internal/sieve/database/fake"
+)
+
+const testMail = "From: GitHub <notifications@github.com>\r\n" +
+	"To: Oliver <oliver@example.com>, team@example.com\r\n" +
+	"Subject: [mail-server] Fix the parser (#42)\r\n" +
+	"List-Id: <mail-server.github.com>\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"The build is broken again.\r\n"
+
+var testEnvelope = sieve.Envelope{From: "bounce@github.com", To: "oliver+git@example.com"}
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		script string
+		line   int
+	}{
+		{"unknown command", "foo;", 1},
+		{"missing semicolon", "keep", 1},
+		{"missing require", "fileinto \"Work\";", 1},
+		{"unsupported extension", "require \"editheader\";", 1},
+		{"late require", "keep;\nrequire \"fileinto\";", 2},
+		{"else without if", "else { keep; }", 1},
+		{"test as command", "true;", 1},
+		{"command as test", "if keep { stop; }", 1},
+		{"unknown tag", "if header :regex \"subject\" \"x\" { stop; }", 1},
+		{"conflicting tags", "if header :is :contains \"subject\" \"x\" { stop; }", 1},
+		{"wrong argument", "if size 10 { stop; }", 1},
+		{"unsupported comparator", "if header :comparator \"i;unicode\" \"subject\" \"x\" { stop; }", 1},
+		{"flags without extension", "keep :flags \"\\\\Seen\";", 1},
+		{"unterminated string", "redirect \"a@example.com;\n", 1},
+		{"unterminated block", "if true {\nkeep;\n", 3},
+	} {
+		_, err := sieve.Parse(c.script)
+		var parseErr *sieve.ParseError
+		if !errors.As(err, &parseErr) || !errors.Is(err, sieve.ErrInvalidScript) {
+			t.Errorf("Parse with %s: expected parse error, got %v", c.name, err)
+			continue
+		}
+		if parseErr.Line != c.line {
+			t.Errorf("Parse with %s: expected error on line %d, got %v", c.name, c.line, err)
+		}
+	}
+
+	script := `require ["fileinto", "imap4flags", "variables", "vacation", "body", "envelope", "reject", "comparator-i;octet"];
+# comment
+/* multi-line
+   comment */
+if anyof (not exists "x-spam", size :over 1M) {
+	vacation :days 3 :subject "Away" text:
+I am away.
+..
+.
+;
+}`
+	if _, err := sieve.Parse(script); err != nil {
+		t.Errorf("Parse: unexpected error: %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		script  string
+		actions []sieve.Action
+	}{
+		{
+			name:    "implicit keep",
+			script:  "",
+			actions: []sieve.Action{{Kind: sieve.ActionKeep, Flags: []string{}}},
+		},
+		{
+			name: "fileinto by list",
+			script: `require "fileinto";
+if header :contains "list-id" "github.com" { fileinto "GitHub"; }`,
+			actions: []sieve.Action{{Kind: sieve.ActionFileInto, Mailbox: "GitHub", Flags: []string{}}},
+		},
+		{
+			name:    "discard by sender",
+			script:  `if address :is :domain "from" "GITHUB.com" { discard; stop; } keep;`,
+			actions: nil,
+		},
+		{
+			name:    "address localpart",
+			script:  `if address :localpart "to" "team" { redirect "team@example.org"; }`,
+			actions: []sieve.Action{{Kind: sieve.ActionRedirect, Address: "team@example.org"}},
+		},
+		{
+			name: "envelope and elsif",
+			script: `require ["envelope", "fileinto"];
+if envelope :is "to" "nobody@example.com" { discard; }
+elsif envelope :matches "to" "*+git@*" { fileinto "Git"; }
+else { keep; }`,
+			actions: []sieve.Action{{Kind: sieve.ActionFileInto, Mailbox: "Git", Flags: []string{}}},
+		},
+		{
+			name:    "octet comparator",
+			script:  `if header :comparator "i;octet" :contains "subject" "PARSER" { discard; }`,
+			actions: []sieve.Action{{Kind: sieve.ActionKeep, Flags: []string{}}},
+		},
+		{
+			name: "body",
+			script: `require ["body", "fileinto"];
+if body :text :contains "broken" { fileinto "Alerts"; }`,
+			actions: []sieve.Action{{Kind: sieve.ActionFileInto, Mailbox: "Alerts", Flags: []string{}}},
+		},
+		{
+			name: "imap4flags",
+			script: `require ["imap4flags", "fileinto"];
+setflag "\\Seen";
+addflag ["$Work", "\\Flagged \\Seen"];
+removeflag "\\Flagged";
+fileinto "Work";
+keep :flags "\\Answered";`,
+			actions: []sieve.Action{
+				{Kind: sieve.ActionFileInto, Mailbox: "Work", Flags: []string{"\\Seen", "$Work"}},
+				{Kind: sieve.ActionKeep, Flags: []string{"\\Answered"}},
+			},
+		},
+		{
+			name: "variables",
+			script: `require ["variables", "fileinto"];
+if header :matches "subject" "[*] *" {
+	set :upperfirst "project" "${1}";
+	fileinto "Projects/${project}";
+}`,
+			actions: []sieve.Action{{Kind: sieve.ActionFileInto, Mailbox: "Projects/Mail-server", Flags: []string{}}},
+		},
+		{
+			name: "string test",
+			script: `require "variables";
+set :lower "who" "GitHub";
+if string :is "${who}" "github" { discard; }`,
+			actions: nil,
+		},
+		{
+			name:   "reject",
+			script: `require "reject"; if size :over 10 { reject "Too large"; }`,
+			actions: []sieve.Action{
+				{Kind: sieve.ActionReject, Reason: "Too large"},
+			},
+		},
+	} {
+		script, err := sieve.Parse(c.script)
+		if err != nil {
+			t.Errorf("%s: unexpected parse error: %v", c.name, err)
+			continue
+		}
+
+		result, err := script.Run(mails.Mail{Body: testMail}, testEnvelope)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if !slices.EqualFunc(result.Actions, c.actions, equalAction) {
+			t.Errorf("%s: expected actions %+v, got %+v", c.name, c.actions, result.Actions)
+		}
+	}
+}
+
+func TestRunVacation(t *testing.T) {
+	script, err := sieve.Parse(`require "vacation";
+vacation :days 500 :subject "Away" :addresses ["oliver@example.org"] "I am away.";`)
+	if err != nil {
+		t.Fatalf("Parse: unexpected error: %v", err)
+	}
+
+	result, err := script.Run(mails.Mail{Body: testMail}, testEnvelope)
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if len(result.Actions) != 2 || result.Actions[0].Kind != sieve.ActionVacation || result.Actions[1].Kind != sieve.ActionKeep {
+		t.Fatalf("Run: expected vacation and implicit keep, got %+v", result.Actions)
+	}
+
+	v := result.Actions[0].Vacation
+	if v.Days != sieve.MaxVacationDays || v.Subject != "Away" || v.Reason != "I am away." || v.Handle == "" || !slices.Equal(v.Addresses, []string{"oliver@example.org"}) {
+		t.Errorf("Run: unexpected vacation %+v", v)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		script string
+	}{
+		{"invalid redirect", `redirect "not an address";`},
+		{"reject and keep", `require "reject"; keep; reject "no";`},
+		{"keep after reject", `require "reject"; reject "no"; keep;`},
+		{"two vacations", `require "vacation"; vacation "a"; vacation "b";`},
+		{"too many redirects", `redirect "a@example.org"; redirect "b@example.org"; redirect "c@example.org"; redirect "d@example.org"; redirect "e@example.org";`},
+	} {
+		script, err := sieve.Parse(c.script)
+		if err != nil {
+			t.Errorf("%s: unexpected parse error: %v", c.name, err)
+			continue
+		}
+		if _, err := script.Run(mails.Mail{Body: testMail}, testEnvelope); err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := sieve.NewStore(sieve.Configuration{DB: fake.NewDB()})
+
+	if _, err := s.Put("alice", "filters", "discard"); !errors.Is(err, sieve.ErrInvalidScript) {
+		t.Errorf("Put with invalid script: expected ErrInvalidScript, got %v", err)
+	}
+	if _, err := s.Put("alice", "a/b", "keep;"); !errors.Is(err, sieve.ErrInvalidName) {
+		t.Errorf("Put with invalid name: expected ErrInvalidName, got %v", err)
+	}
+	if _, err := s.Put("alice", "filters", strings.Repeat("#", sieve.MaxScriptSize+1)); !errors.Is(err, sieve.ErrScriptTooLarge) {
+		t.Errorf("Put with large script: expected ErrScriptTooLarge, got %v", err)
+	}
+
+	if active, err := s.Active("alice"); err != nil || active != nil {
+		t.Errorf("Active without scripts: expected none, got %v, %v", active, err)
+	}
+
+	for _, name := range []string{"filters", "other"} {
+		if _, err := s.Put("alice", name, "discard;"); err != nil {
+			t.Fatalf("Put %s: unexpected error: %v", name, err)
+		}
+	}
+	if err := s.Activate("alice", "filters"); err != nil {
+		t.Fatalf("Activate: unexpected error: %v", err)
+	}
+	if err := s.Activate("alice", "missing"); !errors.Is(err, sieve.ErrScriptNotFound) {
+		t.Errorf("Activate missing: expected ErrScriptNotFound, got %v", err)
+	}
+
+	// Replacing the script keeps it active
+	if _, err := s.Put("alice", "filters", "keep;"); err != nil {
+		t.Fatalf("Put again: unexpected error: %v", err)
+	}
+	active, err := s.Active("alice")
+	if err != nil || active == nil {
+		t.Fatalf("Active: expected script, got %v, %v", active, err)
+	}
+	if result, _ := active.Run(mails.Mail{Body: testMail}, testEnvelope); !result.Has(sieve.ActionKeep) {
+		t.Errorf("Active: expected the replaced script, got %+v", result.Actions)
+	}
+
+	if err := s.Activate("alice", "other"); err != nil {
+		t.Fatalf("Activate other: unexpected error: %v", err)
+	}
+	list, _ := s.List("alice")
+	if len(list) != 2 || list[0].Active || !list[1].Active {
+		t.Errorf("List: expected only other to be active, got %+v", list)
+	}
+
+	if err := s.Activate("alice", ""); err != nil {
+		t.Fatalf("Deactivate: unexpected error: %v", err)
+	}
+	if active, err := s.Active("alice"); err != nil || active != nil {
+		t.Errorf("Active after deactivating: expected none, got %v, %v", active, err)
+	}
+
+	if err := s.Remove("alice", "other"); err != nil {
+		t.Fatalf("Remove: unexpected error: %v", err)
+	}
+	if _, err := s.Get("alice", "other"); !errors.Is(err, sieve.ErrScriptNotFound) {
+		t.Errorf("Get after Remove: expected ErrScriptNotFound, got %v", err)
+	}
+}
+
+func equalAction(a, b sieve.Action) bool {
+	return a.Kind == b.Kind && a.Mailbox == b.Mailbox && a.Address == b.Address && a.Reason == b.Reason && slices.Equal(a.Flags, b.Flags)
+}
@@ -0,0 +1,105 @@
+// Package sievetest provides a conformance test suite that every sieve.DB
+// implementation is expected to pass.
+package sievetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+)
+
+// RunDBSuite runs all conformance tests against the sieve.DB returned by newDB.
+// newDB is called once per test and must return an empty database.
+func RunDBSuite(t *testing.T, newDB func() sieve.DB) {
+	t.Run("NotFound", func(t *testing.T) { TestNotFound(t, newDB()) })
+	t.Run("InsertGet", func(t *testing.T) { TestInsertGet(t, newDB()) })
+	t.Run("ListUpdateDelete", func(t *testing.T) { TestListUpdateDelete(t, newDB()) })
+}
+
+func TestNotFound(t *testing.T, db sieve.DB) {
+	if _, err := db.Get("alice", "filters"); !errors.Is(err, sieve.ErrScriptNotFound) {
+		t.Errorf("Get: expected ErrScriptNotFound, got %v", err)
+	}
+	if err := db.Update(script("alice", "filters")); !errors.Is(err, sieve.ErrScriptNotFound) {
+		t.Errorf("Update: expected ErrScriptNotFound, got %v", err)
+	}
+	if err := db.Delete("alice", "filters"); !errors.Is(err, sieve.ErrScriptNotFound) {
+		t.Errorf("Delete: expected ErrScriptNotFound, got %v", err)
+	}
+	if list, err := db.List("alice"); err != nil || list == nil || len(list) != 0 {
+		t.Errorf("List: expected empty list, got %v, %v", list, err)
+	}
+}
+
+func TestInsertGet(t *testing.T, db sieve.DB) {
+	s := script("alice", "filters")
+	if err := db.Insert(s); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+	if err := db.Insert(s); !errors.Is(err, sieve.ErrScriptAlreadyExists) {
+		t.Errorf("Insert twice: expected ErrScriptAlreadyExists, got %v", err)
+	}
+
+	got, err := db.Get("alice", "filters")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if got.Content != s.Content || got.Active != s.Active || !got.CreatedAt.Equal(s.CreatedAt) {
+		t.Errorf("Get: stored script does not match: %+v", got)
+	}
+
+	// Scripts are only visible to the user they belong to
+	if _, err := db.Get("bob", "filters"); !errors.Is(err, sieve.ErrScriptNotFound) {
+		t.Errorf("Get: expected ErrScriptNotFound for other user, got %v", err)
+	}
+	if err := db.Insert(script("bob", "filters")); err != nil {
+		t.Errorf("Insert with the same name for other user: unexpected error: %v", err)
+	}
+}
+
+func TestListUpdateDelete(t *testing.T, db sieve.DB) {
+	for _, name := range []string{"work", "filters", "vacation"} {
+		if err := db.Insert(script("alice", name)); err != nil {
+			t.Fatalf("Insert %s: unexpected error: %v", name, err)
+		}
+	}
+
+	list, err := db.List("alice")
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(list) != 3 || list[0].Name != "filters" || list[1].Name != "vacation" || list[2].Name != "work" {
+		t.Errorf("List: expected scripts sorted by name, got %+v", list)
+	}
+
+	s := list[0]
+	s.Content = "discard;"
+	s.Active = false
+	if err := db.Update(s); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+	if got, err := db.Get("alice", "filters"); err != nil || got.Content != "discard;" || got.Active {
+		t.Errorf("Get after Update: expected updated script, got %+v, %v", got, err)
+	}
+
+	if err := db.Delete("alice", "filters"); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	if list, _ := db.List("alice"); len(list) != 2 {
+		t.Errorf("List after Delete: expected 2 scripts, got %d", len(list))
+	}
+}
+
+func script(userID, name string) sieve.UserScript {
+	now := time.Now().Truncate(time.Second)
+	return sieve.UserScript{
+		UserID:    userID,
+		Name:      name,
+		Content:   "keep;",
+		Active:    true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
@@ -13,10 +13,28 @@ import (
 	"strings"
 
 	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
 )
 
 var dkimPrivateKey *rsa.PrivateKey
 
+// Client sends mail to the servers of the recipients.
+type Client struct {
+	domains *domains.Store
+}
+
+type ClientConfiguration struct {
+	// Domains is optional. If set, mail of hosted domains that have their own
+	// DKIM key is signed with it instead of the key of LoadDKIMPrivateKey.
+	Domains *domains.Store
+}
+
+func NewClient(config ClientConfiguration) *Client {
+	return &Client{
+		domains: config.Domains,
+	}
+}
+
 func LoadDKIMPrivateKey(path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -37,7 +55,12 @@ func LoadDKIMPrivateKey(path string) error {
 	return nil
 }
 
+// SendMail sends the mail signed with the key of LoadDKIMPrivateKey.
 func SendMail(m Mail) (int, error) {
+	return NewClient(ClientConfiguration{}).SendMail(m)
+}
+
+func (c *Client) SendMail(m Mail) (int, error) {
 	emailsSent := 0
 
 	for _, recipient := range m.To {
@@ -65,7 +88,7 @@ func SendMail(m Mail) (int, error) {
 			return emailsSent, fmt.Errorf("no MX records found for %s", host)
 		}
 
-		signedLines, err := signMail(m)
+		signedLines, err := c.signMail(m)
 		if err != nil {
 			slog.Error("Failed to sign email", sloki.WrapError(err))
 			continue // Skip sending this email
@@ -1,12 +1,15 @@
 package smtp
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"fmt"
 	"github.com/OliverSchlueter/mail-server/internal/mails"
 	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
 	"github.com/OliverSchlueter/mail-server/internal/users"
 	"github.com/OliverSchlueter/mail-server/internal/users/database/fake"
 	"log/slog"
+	"net"
 	"testing"
 )
 
@@ -45,18 +48,41 @@ func TestSendMail(t *testing.T) {
 		t.Fatalf("Failed to create mailbox: %v", err)
 	}
 
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate DKIM key: %v", err)
+	}
+	dkimPrivateKey = key
+	defer func() { dkimPrivateKey = nil }()
+
 	srv := NewServer(Configuration{
 		Hostname: "localhost",
 		Port:     "2525",
 		Users:    *us,
 		Mails:    *ms,
 	})
-	go srv.Start()
+
+	// SendMail delivers mail for localhost to port 2525
+	listener, err := net.Listen("tcp", ":"+srv.port)
+	if err != nil {
+		t.Fatalf("Failed to start test server: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // Exit if listener is closed
+			}
+			go srv.handle(conn)
+		}
+	}()
 	fmt.Printf("SMTP server started on %s:%s\n", srv.hostname, srv.port)
 
 	mail := Mail{
 		Outgoing:    true,
-		From:        "peter@fancyinnovations.com",
+		From:        "peter@localhost",
+		Domain:      "localhost",
 		To:          []string{"oliver@localhost"},
 		DataBuffer:  []string{"Subject: Test Mail", "", "This is a test mail."},
 		ReadingData: false,
@@ -71,7 +97,7 @@ func TestSendMail(t *testing.T) {
 		t.Errorf("Expected to send 1 email, but sent %d", n)
 	}
 
-	gotMails, err := ms.GetMails("oliver", mails.DefaultMailboxUID)
+	gotMails, err := ms.GetMails(u.ID, mails.DefaultMailboxUID)
 	if err != nil {
 		t.Fatalf("Failed to get mails: %v", err)
 	}
@@ -12,6 +12,8 @@ const (
 	StatusAuthPassword   = "334 UGFzc3dvcmQ6" // Base64 encoded "Password:"
 	StatusStartMailInput = "354 Start mail input; end with <CRLF>.<CRLF>"
 
+	StatusInsufficientStorage = "452 Insufficient system storage" // recipient's mailbox is full
+
 	StatusBadCommand           = "500 Unrecognized command"
 	StatusLineTooLong          = "500 Line too long" // line exceeds maximum length
 	StatusMessageTooLarge      = "500 Message size exceeds fixed maximum message size"
@@ -20,9 +22,13 @@ const (
 	StatusBadSequence          = "503 Bad sequence: '%s' required first" // required command
 	StatusTooManyRecipients    = "503 Too many recipients"               // exceeds MaxRecipients
 	StatusAuthRequired         = "530 Authentication required"
-	StatusAuthenticationFailed = "535 Authentication failed" // invalid credentials
+	StatusAppPasswordRequired  = "534 Application-specific password required" // user has two-factor authentication enabled
+	StatusAuthenticationFailed = "535 Authentication failed"                  // invalid credentials
 	StatusEncryptionRequired   = "538 Encryption required for requested authentication mechanism"
 	StatusNoSuchUser           = "550 No such user here"
 	StatusRelayDenied          = "550 Relaying denied"
-	StatusInternalServerError  = "550 Internal server error" // general error, e.g. database issue
+	StatusRejected             = "550 Message rejected by the recipient" // rejected by the Sieve scripts of all recipients
+	StatusInternalServerError  = "550 Internal server error"             // general error, e.g. database issue
+	StatusExceededStorage      = "552 Exceeded storage allocation"       // message would exceed recipient's quota
+	StatusRoutingLoop          = "554 Routing loop detected"             // aliases or groups of the recipient refer to each other
 )
@@ -0,0 +1,250 @@
+package smtp
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+// resolveRecipient returns the users and external addresses mail to the
+// recipient is delivered to, and the detail of the recipient if it was
+// resolved without it. The detail is only stripped if the full address is
+// unknown, so addresses that contain a separator keep working, and catch-all
+// addresses only receive mail if the address without the detail is unknown too.
+func (s *Server) resolveRecipient(recipient string) (*routing.Resolution, string, error) {
+	res, err := s.resolveAddress(recipient)
+	if err != nil && !isUnknownAddress(err) {
+		return nil, "", err
+	}
+	if err == nil && !res.CatchAll {
+		return res, "", nil
+	}
+
+	base, detail, ok := splitDetail(recipient, s.subaddressSeparators)
+	if !ok {
+		return res, "", err
+	}
+
+	baseRes, baseErr := s.resolveAddress(base)
+	if baseErr != nil && !isUnknownAddress(baseErr) {
+		return nil, "", baseErr
+	}
+	if baseErr != nil || baseRes.CatchAll {
+		return res, "", err
+	}
+	return baseRes, detail, nil
+}
+
+// resolveAddress returns the users and external addresses mail to the address
+// is delivered to. Without routes, that is the user with the address or the
+// user of the catch-all address of its domain.
+func (s *Server) resolveAddress(address string) (*routing.Resolution, error) {
+	if s.routes != nil {
+		return s.routes.Resolve(address)
+	}
+
+	u, err := s.users.GetByEmail(address)
+	if err == nil {
+		return &routing.Resolution{UserIDs: []string{u.ID}}, nil
+	}
+	if !errors.Is(err, users.ErrUserNotFound) || s.domains == nil {
+		return nil, err
+	}
+
+	d, derr := s.domains.Get(domains.DomainOf(address))
+	if derr != nil {
+		if errors.Is(derr, domains.ErrDomainNotFound) {
+			return nil, err
+		}
+		return nil, derr
+	}
+	if d.CatchAll == "" || d.CatchAll == address {
+		return nil, err
+	}
+
+	u, err = s.users.GetByEmail(d.CatchAll)
+	if err != nil {
+		return nil, err
+	}
+	return &routing.Resolution{UserIDs: []string{u.ID}, CatchAll: true}, nil
+}
+
+// isUnknownAddress reports whether the error means that nobody receives mail
+// to the address.
+func isUnknownAddress(err error) bool {
+	return errors.Is(err, users.ErrUserNotFound) || errors.Is(err, routing.ErrAddressNotFound)
+}
+
+// withStorage returns the users whose storage is not full.
+func (s *Server) withStorage(userIDs []string) ([]string, error) {
+	if s.quotas == nil {
+		return userIDs, nil
+	}
+
+	var ids []string
+	for _, id := range userIDs {
+		u, err := s.users.GetByID(id)
+		if err != nil {
+			return nil, err
+		}
+
+		// Users that forward without keeping a copy do not need storage
+		if u.IsForwarding() && !u.Forwarding.KeepCopy {
+			ids = append(ids, id)
+			continue
+		}
+
+		full, err := s.quotas.IsFull(u)
+		if err != nil {
+			return nil, err
+		}
+		if !full {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// deliver runs the Sieve scripts of the users for the mail and stores it in
+// the mailboxes they file it into, the mailbox of the delivery if they keep
+// it. The mail is forwarded to the external addresses of the session, of the
+// users that forward their mail and of the redirects of the scripts. Users
+// that are away reply to the mail once they received it. The mail counts as
+// delivered if at least one user received, forwarded or discarded it. If all
+// users rejected it, errRejected is returned, otherwise the last error.
+func (s *Server) deliver(session *Session) error {
+	body := session.Mail.Body()
+	headers := session.Mail.Headers()
+
+	var lastErr error
+	var rejections []rejection
+	delivered := len(session.Forwards) > 0
+	for _, d := range session.Deliveries {
+		u, err := s.users.GetByID(d.UserID)
+		if err != nil {
+			slog.Warn("Failed to deliver incoming email", slog.String("user_id", d.UserID), sloki.WrapError(err))
+			lastErr = err
+			continue
+		}
+
+		forwarded, keepCopy := s.forwardForUser(session.Mail, u)
+		if forwarded {
+			delivered = true
+			if !keepCopy {
+				s.autoReply(session.Mail, d.UserID)
+				continue
+			}
+		}
+
+		received, replied := forwarded, false
+		var redirects []string
+		actions := s.filter(session.Mail, d, u)
+		if !slices.ContainsFunc(actions, func(a sieve.Action) bool { return a.Kind != sieve.ActionVacation }) {
+			delivered = true // discarded
+		}
+		for _, a := range actions {
+			switch a.Kind {
+			case sieve.ActionKeep, sieve.ActionFileInto:
+				mailbox := d.Mailbox
+				if a.Kind == sieve.ActionFileInto {
+					mailbox = a.Mailbox
+				}
+				if err := s.store(d.UserID, mailbox, a.Flags, headers, body); err != nil {
+					slog.Warn("Failed to deliver incoming email", slog.String("user_id", d.UserID), slog.String("mailbox", mailbox), sloki.WrapError(err))
+					lastErr = err
+					continue
+				}
+				received = true
+				s.notifyQuota(d.UserID)
+			case sieve.ActionRedirect:
+				redirects = append(redirects, a.Address)
+			case sieve.ActionReject:
+				rejections = append(rejections, rejection{user: u, reason: a.Reason})
+			case sieve.ActionVacation:
+				s.sieveReply(session.Mail, u, a.Vacation)
+				replied = true
+			}
+		}
+
+		if len(redirects) > 0 {
+			if s.forwardAs(session.Mail, u, redirects) {
+				received = true
+			} else if !received {
+				// Mail that was redirected by the user before is kept instead
+				if err := s.store(d.UserID, d.Mailbox, []string{}, headers, body); err != nil {
+					slog.Warn("Failed to deliver incoming email", slog.String("user_id", d.UserID), sloki.WrapError(err))
+					lastErr = err
+					continue
+				}
+				received = true
+			}
+		}
+
+		if received {
+			delivered = true
+			if !replied {
+				s.autoReply(session.Mail, d.UserID)
+			}
+		}
+	}
+
+	if len(session.Forwards) > 0 {
+		s.forward(session.Mail, session.Forwards)
+	}
+
+	if !delivered && len(rejections) > 0 {
+		return errRejected
+	}
+	for _, r := range rejections {
+		s.rejectionNotice(session.Mail, r.user, r.reason)
+	}
+
+	if !delivered {
+		if lastErr == nil {
+			lastErr = errors.New("no recipients to deliver to")
+		}
+		return lastErr
+	}
+	return nil
+}
+
+// rejection is the reject action of the Sieve script of a user.
+type rejection struct {
+	user   *users.User
+	reason string
+}
+
+// forward sends the mail to the external addresses in the background. It is
+// signed by the server, as the original signature may not survive, and the
+// envelope sender is rewritten with SRS if configured.
+//
+// With SRS the mail is signed for the domain of the rewritten sender, so the
+// signature aligns with the domain SPF is checked for, and with the key of that
+// domain if it is a hosted domain with its own key. Without SRS the original
+// sender is kept, which the server can not sign for, so the hostname is used.
+func (s *Server) forward(m Mail, to []string) {
+	from, domain := m.From, s.hostname
+	if s.srs != nil {
+		from, domain = s.srs.Forward(from), s.srs.Domain()
+	}
+
+	fwd := Mail{
+		From:       from,
+		To:         slices.Clone(to),
+		DataBuffer: slices.Clone(m.DataBuffer),
+		Domain:     domain,
+	}
+
+	go func() {
+		sent, err := s.send(fwd)
+		if err != nil || sent < len(fwd.To) {
+			slog.Warn("Failed to forward email", slog.Any("to", fwd.To), slog.Int("sent", sent), sloki.WrapError(err))
+		}
+	}()
+}
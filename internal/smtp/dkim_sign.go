@@ -2,24 +2,36 @@ package smtp
 
 import (
 	"bytes"
+	"crypto"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/OliverSchlueter/goutils/idgen"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
 	"github.com/emersion/go-msgauth/dkim"
 )
 
-func signMail(m Mail) ([]string, error) {
+func (c *Client) signMail(m Mail) ([]string, error) {
+	domain := signingDomain(m)
+	signer, selector, err := c.dkimSigner(domain)
+	if err != nil {
+		return nil, err
+	}
+
 	var buf bytes.Buffer
 
-	// ---- Required headers ----
-	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
-	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.To, ", "))
-	fmt.Fprintf(&buf, "Subject: %s\r\n", m.Subject)
-	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
-	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", idgen.GenerateID(20), m.Domain)
-	buf.WriteString("\r\n")
+	// Messages that were composed with their own headers are signed as they are,
+	// so headers like Cc are kept and Bcc recipients are not disclosed
+	if _, ok := m.Headers()["From"]; !ok {
+		// ---- Required headers ----
+		fmt.Fprintf(&buf, "From: %s\r\n", m.From)
+		fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.To, ", "))
+		fmt.Fprintf(&buf, "Subject: %s\r\n", m.Subject)
+		fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+		fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", idgen.GenerateID(20), m.Domain)
+		buf.WriteString("\r\n")
+	}
 
 	// ---- Body ----
 	for _, line := range m.DataBuffer {
@@ -29,9 +41,9 @@ func signMail(m Mail) ([]string, error) {
 	raw := buf.Bytes()
 
 	opts := &dkim.SignOptions{
-		Domain:   m.Domain, // MUST match From domain
-		Selector: "mail",   // DNS selector
-		Signer:   dkimPrivateKey,
+		Domain:   domain,   // MUST match From domain
+		Selector: selector, // DNS selector
+		Signer:   signer,
 		HeaderKeys: []string{
 			"from",
 			"to",
@@ -48,3 +60,30 @@ func signMail(m Mail) ([]string, error) {
 
 	return strings.Split(strings.TrimRight(signed.String(), "\r\n"), "\r\n"), nil
 }
+
+// dkimSigner returns the key and selector to sign mail from the domain with.
+// Hosted domains with their own key use it, all others the server-wide key.
+func (c *Client) dkimSigner(domain string) (crypto.Signer, string, error) {
+	if c.domains != nil {
+		signer, selector, err := c.domains.DKIMSigner(domain)
+		if err != nil {
+			return nil, "", err
+		}
+		if signer != nil {
+			return signer, selector, nil
+		}
+	}
+
+	if dkimPrivateKey == nil {
+		return nil, "", fmt.Errorf("DKIM private key not loaded")
+	}
+	return dkimPrivateKey, domains.DefaultSelector, nil
+}
+
+// signingDomain returns the domain of the mail, which defaults to the domain of the sender.
+func signingDomain(m Mail) string {
+	if m.Domain != "" {
+		return m.Domain
+	}
+	return m.From[strings.LastIndex(m.From, "@")+1:]
+}
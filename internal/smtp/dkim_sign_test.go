@@ -0,0 +1,62 @@
+package smtp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	ddb "github.com/OliverSchlueter/mail-server/internal/domains/database/fake"
+)
+
+func TestSignMailWithDomainKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+
+	ds := domains.NewStore(domains.Configuration{DB: ddb.NewDB()})
+	_, err = ds.Add(domains.Domain{
+		Name: "example.com",
+		DKIM: domains.DKIM{Selector: "2024", PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))},
+	})
+	if err != nil {
+		t.Fatalf("Add domain: %v", err)
+	}
+
+	c := NewClient(ClientConfiguration{Domains: ds})
+	m := Mail{From: "alice@example.com", To: []string{"bob@example.org"}, Subject: "Hello", DataBuffer: []string{"Hello Bob"}}
+	lines, err := c.signMail(m)
+	if err != nil {
+		t.Fatalf("signMail: unexpected error: %v", err)
+	}
+	signature := strings.Join(lines, "\n")
+	if !strings.Contains(signature, "s=2024") || !strings.Contains(signature, "a=ed25519-sha256") {
+		t.Errorf("Expected signature with the key of the domain, got %s", lines[0])
+	}
+
+	// Forwarded mail is signed for the domain of its rewritten sender
+	fwd := Mail{From: "SRS0=HHHH=TT=example.net=carol@example.com", To: []string{"bob@example.org"}, DataBuffer: []string{"Subject: Hello", "", "Hello Bob"}, Domain: "example.com"}
+	lines, err = c.signMail(fwd)
+	if err != nil {
+		t.Fatalf("signMail forwarded: unexpected error: %v", err)
+	}
+	if signature := strings.Join(lines, "\n"); !strings.Contains(signature, "d=example.com") || !strings.Contains(signature, "s=2024") {
+		t.Errorf("Expected forwarded mail to be signed with the key of the SRS domain, got %s", lines[0])
+	}
+
+	// Domains without a key of their own need the server-wide key
+	if dkimPrivateKey == nil {
+		m.From = "alice@example.net"
+		if _, err := c.signMail(m); err == nil {
+			t.Errorf("Expected error without server-wide key")
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package smtp
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+// forwardForUser forwards the mail if the user forwards their mail, and
+// reports whether it did and whether the user keeps a copy. The forwarded mail
+// gets a Delivered-To header with the user's address. Mail that already has
+// it was forwarded by the user before and came back, it is kept instead of
+// being forwarded in a loop.
+func (s *Server) forwardForUser(m Mail, u *users.User) (bool, bool) {
+	if !u.IsForwarding() || !s.forwardAs(m, u, u.Forwarding.Addresses) {
+		return false, true
+	}
+	return true, u.Forwarding.KeepCopy
+}
+
+// forwardAs forwards the mail on behalf of the user, with a Delivered-To header
+// with the user's address, and reports whether it did. It does not if the
+// mail already has the header, as it was forwarded by the user before.
+func (s *Server) forwardAs(m Mail, u *users.User, to []string) bool {
+	if slices.ContainsFunc(deliveredTo(m), func(a string) bool { return strings.EqualFold(a, u.PrimaryEmail) }) {
+		slog.Warn("Mail loop detected, keeping forwarded email", slog.String("user_id", u.ID))
+		return false
+	}
+
+	fwd := m
+	fwd.DataBuffer = append([]string{"Delivered-To: " + u.PrimaryEmail}, m.DataBuffer...)
+	s.forward(fwd, to)
+	return true
+}
+
+// deliveredTo returns the addresses of all Delivered-To headers of the mail.
+func deliveredTo(m Mail) []string {
+	var addresses []string
+	for _, line := range m.DataBuffer {
+		if line == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Delivered-To") {
+			addresses = append(addresses, strings.Trim(strings.TrimSpace(value), "<>"))
+		}
+	}
+	return addresses
+}
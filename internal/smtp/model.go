@@ -1,5 +1,7 @@
 package smtp
 
+import "strings"
+
 const (
 	MaxMessageSize = 15 * 1024 * 1024 // 15 MB
 	MaxRecipients  = 100
@@ -10,9 +12,21 @@ type Session struct {
 	RemoteAddr   string
 	TLSActive    bool
 	HeloReceived bool
-	Mail         Mail
-	AuthLogin    AuthLogin // state for AUTH LOGIN authentication flow
-	DeliveryUser string    // the user that should receive the mail, determined by the RCPT TO command
+	// MailFromReceived is set by MAIL FROM, the sender may be empty for bounces.
+	MailFromReceived bool
+	Mail             Mail
+	AuthLogin        AuthLogin // state for AUTH LOGIN authentication flow
+	// Deliveries are the users that receive the mail and Forwards the external
+	// addresses it is forwarded to, both determined by the RCPT TO commands.
+	Deliveries []Delivery
+	Forwards   []string
+}
+
+// Delivery is a user that receives an incoming mail.
+type Delivery struct {
+	UserID    string
+	Mailbox   string // name of the mailbox the mail is delivered to, the inbox if empty
+	Recipient string // the RCPT TO address the user receives the mail for, like an alias or subaddress
 }
 
 type Mail struct {
@@ -48,3 +62,28 @@ type AuthLogin struct {
 	Password          string
 	IsAuthenticated   bool
 }
+
+func (m *Mail) Headers() map[string]string {
+	headers := make(map[string]string)
+	lastKey := ""
+	for _, line := range m.DataBuffer {
+		if line == "" {
+			break
+		}
+
+		// Folded header continuation line
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && lastKey != "" {
+			headers[lastKey] += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		lastKey = strings.TrimSpace(parts[0])
+		headers[lastKey] = strings.TrimSpace(parts[1])
+	}
+	return headers
+}
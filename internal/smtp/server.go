@@ -8,12 +8,19 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
 	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/quotas"
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	"github.com/OliverSchlueter/mail-server/internal/srs"
 	"github.com/OliverSchlueter/mail-server/internal/users"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
 )
 
 type Server struct {
@@ -22,6 +29,16 @@ type Server struct {
 	tlsConfig *tls.Config
 	users     users.Store
 	mails     mails.Store
+	quotas    *quotas.Service
+	domains   *domains.Store
+	routes    *routing.Store
+	send      func(m Mail) (int, error)
+	srs       *srs.Rewriter
+	vacation  *vacation.Service
+	sieve     *sieve.Store
+
+	subaddressSeparators string
+	detailMailboxes      bool
 }
 
 type Configuration struct {
@@ -31,12 +48,44 @@ type Configuration struct {
 	KeyFile  string
 	Users    users.Store
 	Mails    mails.Store
+	Quotas   *quotas.Service // optional, storage quotas are not enforced if not set
+	// Domains is optional. If set, mail is only accepted for the hostname and
+	// the hosted domains, and the certificates of the domains are served via
+	// SNI, with the certificate of CertFile as fallback.
+	Domains *domains.Store
+	// Routes is optional. If set, recipients are resolved through its aliases,
+	// groups and catch-all addresses instead of only the addresses of users.
+	Routes *routing.Store
+	Send   func(m Mail) (int, error) // forwards mail to external addresses, defaults to a Client with the Domains
+	// SubaddressSeparators are the characters that separate the local part of
+	// an address from its detail (RFC 5233), like + in oliver+github@example.com.
+	// Mail to unknown addresses with a detail is delivered to the address
+	// without it. Subaddressing is disabled if empty.
+	SubaddressSeparators string
+	// DetailMailboxes delivers mail to subaddresses into the mailbox named
+	// after the detail instead of the inbox. The mailbox is created if it does
+	// not exist yet.
+	DetailMailboxes bool
+	// SRS is optional. If set, the envelope sender of forwarded mail is
+	// rewritten, so SPF checks at the destination pass, and mail to rewritten
+	// addresses is sent back to the original sender.
+	SRS *srs.Rewriter
+	// Vacation is optional. If set, users that are away reply to the mail
+	// they receive automatically.
+	Vacation *vacation.Service
+	// Sieve is optional. If set, the active Sieve scripts of users decide
+	// which mailboxes their mail is delivered to, whether it is redirected,
+	// discarded or rejected, and whether it is replied to.
+	Sieve *sieve.Store
 }
 
 func NewServer(config Configuration) *Server {
 	if config.Port == "" {
 		config.Port = "25"
 	}
+	if config.Send == nil {
+		config.Send = NewClient(ClientConfiguration{Domains: config.Domains}).SendMail
+	}
 
 	var tlsConfig *tls.Config
 	if config.CertFile != "" && config.KeyFile != "" {
@@ -56,6 +105,9 @@ func NewServer(config Configuration) *Server {
 				Renegotiation:          tls.RenegotiateNever,
 				CurvePreferences:       []tls.CurveID{tls.X25519, tls.CurveP256},
 			}
+			if config.Domains != nil {
+				tlsConfig.GetCertificate = config.Domains.GetCertificate
+			}
 		}
 	}
 
@@ -65,6 +117,16 @@ func NewServer(config Configuration) *Server {
 		tlsConfig: tlsConfig,
 		users:     config.Users,
 		mails:     config.Mails,
+		quotas:    config.Quotas,
+		domains:   config.Domains,
+		routes:    config.Routes,
+		send:      config.Send,
+		srs:       config.SRS,
+		vacation:  config.Vacation,
+		sieve:     config.Sieve,
+
+		subaddressSeparators: config.SubaddressSeparators,
+		detailMailboxes:      config.DetailMailboxes,
 	}
 }
 
@@ -147,25 +209,26 @@ func (s *Server) handle(conn net.Conn) {
 					slog.Warn("Relaying attempted during DATA but relay support is disabled")
 					writeLine(w, StatusRelayDenied)
 				} else {
-					m := mails.Mail{
-						UID:        mails.RandomUID(),
-						MailboxUID: mails.DefaultMailboxUID,
-						Flags:      []string{},
-						Date:       time.Now(),
-						Size:       len(session.Mail.Body()),
-						Headers:    session.Mail.Headers(),
-						Body:       session.Mail.Body(),
-					}
-					err := s.mails.CreateMail(session.DeliveryUser, mails.DefaultMailboxUID, m)
-					if err != nil {
-						slog.Error("Failed to save incoming email", sloki.WrapError(err))
-						writeLine(w, StatusInternalServerError)
+					if err := s.deliver(session); err != nil {
+						if errors.Is(err, quotas.ErrQuotaExceeded) {
+							slog.Warn("Rejected incoming email, recipients are over quota", slog.Any("deliveries", session.Deliveries))
+							writeLine(w, StatusExceededStorage)
+						} else if errors.Is(err, errRejected) {
+							slog.Info("Rejected incoming email, recipients rejected it", slog.Any("deliveries", session.Deliveries))
+							writeLine(w, StatusRejected)
+						} else {
+							slog.Error("Failed to save incoming email", sloki.WrapError(err))
+							writeLine(w, StatusInternalServerError)
+						}
 
 						// reset reading state and continue
 						session.Mail.DataBuffer = nil
 						session.Mail.From = ""
+						session.MailFromReceived = false
 						session.Mail.To = nil
 						session.Mail.ReadingData = false
+						session.Deliveries = nil
+						session.Forwards = nil
 						continue
 					}
 					slog.Info("Incoming email received", "mail", session.Mail)
@@ -175,8 +238,11 @@ func (s *Server) handle(conn net.Conn) {
 				// Reset session for next email
 				session.Mail.DataBuffer = nil
 				session.Mail.From = ""
+				session.MailFromReceived = false
 				session.Mail.To = nil
 				session.Mail.ReadingData = false
+				session.Deliveries = nil
+				session.Forwards = nil
 			} else {
 				if strings.HasPrefix(line, ".") {
 					line = line[1:]
@@ -203,6 +269,7 @@ func (s *Server) handle(conn net.Conn) {
 			session.AuthLogin.RequestedUsername = false
 			session.AuthLogin.RequestedPassword = true
 			writeLine(w, StatusAuthPassword) // Request password
+			continue
 		} else if session.AuthLogin.RequestedPassword {
 			decoded, err := base64.StdEncoding.DecodeString(line)
 			if err != nil {
@@ -214,25 +281,7 @@ func (s *Server) handle(conn net.Conn) {
 			session.AuthLogin.Password = string(decoded)
 			session.AuthLogin.RequestedPassword = false
 
-			u, err := s.users.GetByName(session.AuthLogin.Username)
-			if err != nil {
-				if errors.Is(err, users.ErrUserNotFound) {
-					writeLine(w, StatusNoSuchUser)
-					continue
-				}
-
-				slog.Error("Failed to get user by name", sloki.WrapError(err))
-				continue
-			}
-
-			if u.Password != users.Hash(session.AuthLogin.Password) {
-				writeLine(w, StatusAuthenticationFailed)
-				continue
-			}
-
-			session.AuthLogin.IsAuthenticated = true
-
-			writeLine(w, StatusAuthSuccess)
+			s.authenticate(session, w)
 			continue
 		}
 
@@ -278,7 +327,7 @@ func (s *Server) handle(conn net.Conn) {
 			slog.Debug("TLS connection established", "remote_addr", conn.RemoteAddr().String())
 
 		// AUTH LOGIN
-		case upper == CmdAuthLogin.Prefix:
+		case upper == CmdAuthLogin.Name:
 			s.handleAuthLogin(session, w, line)
 
 		// AUTH PLAIN
@@ -299,7 +348,14 @@ func (s *Server) handle(conn net.Conn) {
 
 		// RSET
 		case upper == CmdRset.Prefix:
-			session = &Session{} // Reset session
+			// Reset the mail transaction, but keep the greeting, TLS and authentication
+			*session = Session{
+				Hostname:     session.Hostname,
+				RemoteAddr:   session.RemoteAddr,
+				TLSActive:    session.TLSActive,
+				HeloReceived: session.HeloReceived,
+				AuthLogin:    AuthLogin{Username: session.AuthLogin.Username, IsAuthenticated: session.AuthLogin.IsAuthenticated},
+			}
 			writeLine(w, StatusOK)
 
 		// QUIT
@@ -322,17 +378,15 @@ func (s *Server) handlEhlo(session *Session, w *bufio.Writer, line string) {
 	clientHostname := line[len(CmdEhlo.Prefix):]
 	session.HeloReceived = true
 	session.Hostname = clientHostname
-	writeLine(w, fmt.Sprintf(StatusGreeting, s.hostname, clientHostname))
 
+	lines := []string{fmt.Sprintf(StatusGreeting, s.hostname, clientHostname)}
 	if !session.TLSActive && s.tlsConfig != nil {
-		writeLine(w, CmdStartTls.Structure)
-		return
+		lines = append(lines, CmdStartTls.Structure)
 	}
-
 	if session.TLSActive {
-		writeLine(w, CmdAuthLogin.Structure)
-		writeLine(w, strings.Replace(CmdAuthPlain.Structure, "-", " ", 1))
+		lines = append(lines, CmdAuthLogin.Structure, CmdAuthPlain.Structure)
 	}
+	writeLines(w, lines)
 }
 
 func (s *Server) handleHelo(session *Session, w *bufio.Writer, line string) {
@@ -340,7 +394,7 @@ func (s *Server) handleHelo(session *Session, w *bufio.Writer, line string) {
 	session.HeloReceived = true
 	session.Hostname = clientHostname
 
-	writeLine(w, fmt.Sprintf(StatusGreeting, s.hostname, clientHostname))
+	writeLines(w, []string{fmt.Sprintf(StatusGreeting, s.hostname, clientHostname)})
 }
 
 func (s *Server) handleAuthLogin(session *Session, w *bufio.Writer, line string) {
@@ -390,19 +444,26 @@ func (s *Server) handleAuthPlain(session *Session, w *bufio.Writer, line string)
 	session.AuthLogin.Username = parts[1]
 	session.AuthLogin.Password = parts[2]
 
-	u, err := s.users.GetByName(session.AuthLogin.Username)
+	s.authenticate(session, w)
+}
+
+// authenticate checks the credentials of the AUTH LOGIN or AUTH PLAIN exchange.
+// Besides the user's password, app passwords with the smtp-submit scope are accepted.
+// Users with two-factor authentication can only use app passwords.
+func (s *Server) authenticate(session *Session, w *bufio.Writer) {
+	_, _, err := s.users.Authenticate(session.AuthLogin.Username, session.AuthLogin.Password, users.ScopeSMTPSubmit)
 	if err != nil {
-		if errors.Is(err, users.ErrUserNotFound) {
-			writeLine(w, StatusNoSuchUser)
+		if errors.Is(err, users.ErrSecondFactorRequired) {
+			writeLine(w, StatusAppPasswordRequired)
+			return
+		}
+		if errors.Is(err, users.ErrInvalidCredentials) || errors.Is(err, users.ErrInsufficientScope) || errors.Is(err, users.ErrUserDisabled) {
+			writeLine(w, StatusAuthenticationFailed)
 			return
 		}
 
-		slog.Error("Failed to get user by name", sloki.WrapError(err))
-		return
-	}
-
-	if u.Password != users.Hash(session.AuthLogin.Password) {
-		writeLine(w, StatusAuthenticationFailed)
+		slog.Error("Failed to authenticate user", sloki.WrapError(err))
+		writeLine(w, StatusInternalServerError)
 		return
 	}
 
@@ -423,11 +484,6 @@ func (s *Server) handleMailFrom(session *Session, w *bufio.Writer, line string)
 		return
 	}
 
-	if session.TLSActive && !session.AuthLogin.IsAuthenticated {
-		writeLine(w, StatusAuthRequired)
-		return
-	}
-
 	addr := strings.TrimPrefix(line, CmdMailFrom.Prefix)
 	addr = strings.TrimSpace(strings.Trim(addr, "<>"))
 
@@ -435,6 +491,7 @@ func (s *Server) handleMailFrom(session *Session, w *bufio.Writer, line string)
 	if addr == "" {
 		session.Mail.From = ""
 		session.Mail.Outgoing = false
+		session.MailFromReceived = true
 		writeLine(w, StatusOK)
 		return
 	}
@@ -446,17 +503,26 @@ func (s *Server) handleMailFrom(session *Session, w *bufio.Writer, line string)
 		return
 	}
 
-	domain := parts[1]
-	// Reject relaying: only accept senders from the server's hostname (local)
-	if domain != s.hostname {
-		slog.Warn(fmt.Sprintf("Relaying attempt denied for MAIL FROM: %s", addr))
-		writeLine(w, StatusRelayDenied)
-		return
+	// Authenticated clients submit mail and may only send as senders of the
+	// server's hostname and hosted domains. Everybody else delivers incoming
+	// mail from anywhere, its recipients must be local, see handleRcptTo.
+	if session.AuthLogin.IsAuthenticated || session.Mail.Outgoing {
+		local, err := s.isLocalDomain(parts[1])
+		if err != nil {
+			slog.Error("Failed to check domain", sloki.WrapError(err))
+			writeLine(w, StatusInternalServerError)
+			return
+		}
+		if !local {
+			slog.Warn(fmt.Sprintf("Relaying attempt denied for MAIL FROM: %s", addr))
+			writeLine(w, StatusRelayDenied)
+			return
+		}
 	}
 
-	// Accept local sender
 	session.Mail.From = addr
 	session.Mail.Outgoing = false
+	session.MailFromReceived = true
 
 	session.Mail.To = nil
 	session.Mail.ReadingData = false
@@ -471,7 +537,7 @@ func (s *Server) handleRcptTo(session *Session, w *bufio.Writer, line string) {
 		return
 	}
 
-	if session.Mail.From == "" {
+	if !session.MailFromReceived {
 		writeLine(w, fmt.Sprintf(StatusBadSequence, CmdMailFrom.Name))
 		return
 	}
@@ -487,17 +553,78 @@ func (s *Server) handleRcptTo(session *Session, w *bufio.Writer, line string) {
 
 	// check if it's an incoming email
 	if !session.Mail.Outgoing {
-		u, err := s.users.GetByEmail(recipient)
-		if err != nil {
-			if errors.Is(err, users.ErrUserNotFound) {
+		if s.domains != nil {
+			local, err := s.isLocalDomain(domains.DomainOf(recipient))
+			if err != nil {
+				slog.Error("Failed to check domain", sloki.WrapError(err))
+				writeLine(w, StatusInternalServerError)
+				return
+			}
+			if !local {
+				writeLine(w, StatusRelayDenied)
+				return
+			}
+		}
+
+		// Replies and bounces to rewritten senders of forwarded mail
+		if s.srs != nil && srs.IsSRS(recipient) {
+			original, err := s.srs.Reverse(recipient)
+			if err != nil {
+				slog.Warn("Rejected invalid SRS address", slog.String("recipient", recipient), sloki.WrapError(err))
 				writeLine(w, StatusNoSuchUser)
 				return
 			}
 
-			slog.Error("Failed to get user by name", sloki.WrapError(err))
+			if !slices.Contains(session.Forwards, original) {
+				session.Forwards = append(session.Forwards, original)
+			}
+			session.Mail.To = append(session.Mail.To, recipient)
+			writeLine(w, StatusOK)
+			return
+		}
+
+		res, detail, err := s.resolveRecipient(recipient)
+		if err != nil {
+			switch {
+			case isUnknownAddress(err):
+				writeLine(w, StatusNoSuchUser)
+			case errors.Is(err, routing.ErrRoutingLoop):
+				slog.Warn("Routing loop detected", slog.String("recipient", recipient))
+				writeLine(w, StatusRoutingLoop)
+			default:
+				slog.Error("Failed to resolve recipient", sloki.WrapError(err))
+				writeLine(w, StatusInternalServerError)
+			}
+			return
+		}
+
+		// Members of groups that are over quota are skipped, the recipient is
+		// only rejected if nobody is left to receive the mail
+		userIDs, err := s.withStorage(res.UserIDs)
+		if err != nil {
+			slog.Error("Failed to check quota", sloki.WrapError(err))
+			writeLine(w, StatusInternalServerError)
 			return
 		}
-		session.DeliveryUser = u.ID
+		if len(userIDs) == 0 && len(res.External) == 0 {
+			writeLine(w, StatusInsufficientStorage)
+			return
+		}
+
+		mailbox := ""
+		if s.detailMailboxes {
+			mailbox = detailMailbox(detail)
+		}
+		for _, id := range userIDs {
+			if !slices.ContainsFunc(session.Deliveries, func(d Delivery) bool { return d.UserID == id }) {
+				session.Deliveries = append(session.Deliveries, Delivery{UserID: id, Mailbox: mailbox, Recipient: recipient})
+			}
+		}
+		for _, address := range res.External {
+			if !slices.Contains(session.Forwards, address) {
+				session.Forwards = append(session.Forwards, address)
+			}
+		}
 	}
 
 	session.Mail.To = append(session.Mail.To, recipient)
@@ -520,6 +647,60 @@ func (s *Server) handleData(session *Session, w *bufio.Writer, line string) {
 	writeLine(w, StatusStartMailInput)
 }
 
+// isLocalDomain reports whether the domain is the hostname of the server or
+// one of the hosted domains.
+func (s *Server) isLocalDomain(domain string) (bool, error) {
+	domain = domains.Normalize(domain)
+	if domain == domains.Normalize(s.hostname) {
+		return true, nil
+	}
+	if s.domains == nil {
+		return false, nil
+	}
+	return s.domains.IsHosted(domain)
+}
+
+// checkQuota returns quotas.ErrQuotaExceeded if the mail does not fit into the user's quota.
+func (s *Server) checkQuota(userID string, mailboxUID uint32, size int64) error {
+	if s.quotas == nil {
+		return nil
+	}
+
+	u, err := s.users.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	return s.quotas.Check(u, mailboxUID, size)
+}
+
+// notifyQuota warns the user if a delivery made them cross a quota warning threshold.
+func (s *Server) notifyQuota(userID string) {
+	if s.quotas == nil {
+		return
+	}
+
+	u, err := s.users.GetByID(userID)
+	if err != nil {
+		slog.Warn("Failed to get user for quota notification", sloki.WrapError(err))
+		return
+	}
+
+	s.quotas.Notify(u)
+}
+
+// writeLines writes a multi-line reply, whose lines all start with the code
+// and a hyphen. The hyphen of the last line is replaced by a space to mark
+// the end of the reply, see RFC 5321 section 4.2.1.
+func writeLines(w *bufio.Writer, lines []string) {
+	for i, line := range lines {
+		if i == len(lines)-1 {
+			line = strings.Replace(line, "-", " ", 1)
+		}
+		writeLine(w, line)
+	}
+}
+
 func writeLine(w *bufio.Writer, line string) {
 	if _, err := w.WriteString(line + "\r\n"); err != nil {
 		slog.Error("Failed to write to connection", sloki.WrapError(err))
@@ -3,13 +3,32 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	ddb "github.com/OliverSchlueter/mail-server/internal/domains/database/fake"
 	"github.com/OliverSchlueter/mail-server/internal/mails"
 	mdb "github.com/OliverSchlueter/mail-server/internal/mails/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/quotas"
+	"github.com/OliverSchlueter/mail-server/internal/routing"
+	rdb "github.com/OliverSchlueter/mail-server/internal/routing/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	sdb "github.com/OliverSchlueter/mail-server/internal/sieve/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/srs"
 	"github.com/OliverSchlueter/mail-server/internal/users"
 	udb "github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+	vdb "github.com/OliverSchlueter/mail-server/internal/vacation/database/fake"
+	"math/big"
 	"net"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -63,7 +82,17 @@ func TestHandleEhlo(t *testing.T) {
 		t.Errorf("Expected session hostname to be client.example.com, got %s", session.Hostname)
 	}
 
-	expected := "250-test.server.com greets client.example.com\r\n250-AUTH LOGIN\r\n250 AUTH PLAIN\r\n"
+	// Authentication is only offered with TLS
+	expected := "250 test.server.com greets client.example.com\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
+	}
+
+	buf.Reset()
+	session.TLSActive = true
+	server.handlEhlo(session, writer, "EHLO client.example.com")
+
+	expected = "250-test.server.com greets client.example.com\r\n250-AUTH LOGIN\r\n250 AUTH PLAIN\r\n"
 	if buf.String() != expected {
 		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
 	}
@@ -90,7 +119,7 @@ func TestHandleHelo(t *testing.T) {
 		t.Errorf("Expected session hostname to be client.example.com, got %s", session.Hostname)
 	}
 
-	expected := "250-test.server.com greets client.example.com\r\n"
+	expected := "250 test.server.com greets client.example.com\r\n"
 	if buf.String() != expected {
 		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
 	}
@@ -116,11 +145,21 @@ func TestHandleAuthLogin(t *testing.T) {
 		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
 	}
 
-	// Test with HELO
+	// Test without TLS
 	buf.Reset()
 	session.HeloReceived = true
 	server.handleAuthLogin(session, writer, "AUTH LOGIN")
 
+	expected = "538 Encryption required for requested authentication mechanism\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
+	}
+
+	// Test with HELO and TLS
+	buf.Reset()
+	session.TLSActive = true
+	server.handleAuthLogin(session, writer, "AUTH LOGIN")
+
 	if !session.AuthLogin.RequestedUsername {
 		t.Error("Expected RequestedUsername to be true")
 	}
@@ -154,6 +193,7 @@ func TestHandleAuthPlain(t *testing.T) {
 	// Test with valid credentials
 	buf.Reset()
 	session.HeloReceived = true
+	session.TLSActive = true
 
 	// Create a valid AUTH PLAIN credentials string (format: \0username\0password)
 	auth := []byte("\x00oliver\x00oliver123")
@@ -179,6 +219,71 @@ func TestHandleAuthPlain(t *testing.T) {
 	}
 }
 
+func TestAuthLoginAppPassword(t *testing.T) {
+	us := createUserStore(t)
+	oliver, err := us.GetByName("oliver")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	secret, _, err := us.CreateToken(oliver.ID, "phone", []users.Scope{users.ScopeSMTPSubmit}, time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+
+	server := &Server{
+		hostname:  "test.server.com",
+		users:     *us,
+		tlsConfig: testTLSConfig(t),
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.handle(conn)
+
+	r := bufio.NewReader(client)
+	// reply reads a reply of one or more lines and returns its last line
+	reply := func() string {
+		t.Helper()
+
+		for {
+			if err := client.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+				t.Fatalf("Failed to set deadline: %v", err)
+			}
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if len(line) < 4 || line[3] != '-' {
+				return strings.TrimRight(line, "\r\n")
+			}
+		}
+	}
+	send := func(command, expected string) {
+		t.Helper()
+
+		if _, err := client.Write([]byte(command + "\r\n")); err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+		if line := reply(); !strings.HasPrefix(line, expected) {
+			t.Fatalf("%s: expected response %q, got %q", command, expected, line)
+		}
+	}
+
+	reply()
+	send("EHLO client.example.com", "250")
+	send("STARTTLS", "220")
+	tlsConn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	client = tlsConn
+	r = bufio.NewReader(tlsConn)
+
+	send("EHLO client.example.com", "250 AUTH PLAIN")
+	send("AUTH LOGIN", StatusAuthUsername)
+	send(base64.StdEncoding.EncodeToString([]byte("oliver")), StatusAuthPassword)
+	send(base64.StdEncoding.EncodeToString([]byte(secret)), StatusAuthSuccess)
+}
+
 func TestHandleMailFrom(t *testing.T) {
 	server := &Server{
 		hostname: "test.server.com",
@@ -192,7 +297,6 @@ func TestHandleMailFrom(t *testing.T) {
 
 	// Test without HELO first
 	session := &Session{}
-	session.AuthLogin.IsAuthenticated = true
 	server.handleMailFrom(session, writer, "MAIL FROM:<sender@example.com>")
 
 	expected := "503 Bad sequence: 'EHLO' required first\r\n"
@@ -200,18 +304,37 @@ func TestHandleMailFrom(t *testing.T) {
 		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
 	}
 
-	// Test with HELO
-	buf.Reset()
-	session.HeloReceived = true
-	server.handleMailFrom(session, writer, "MAIL FROM:<sender@example.com>")
+	// Incoming mail is accepted from any sender
+	for _, sender := range []string{"sender@example.com", ""} {
+		buf.Reset()
+		session = &Session{HeloReceived: true}
+		server.handleMailFrom(session, writer, "MAIL FROM:<"+sender+">")
 
-	if session.Mail.From != "sender@example.com" {
-		t.Errorf("Expected From to be sender@example.com, got %s", session.Mail.From)
+		if session.Mail.From != sender || !session.MailFromReceived {
+			t.Errorf("Expected From to be %q, got %q", sender, session.Mail.From)
+		}
+		expected = "250 OK\r\n"
+		if buf.String() != expected {
+			t.Errorf("MAIL FROM %q: expected response '%s', got '%s'", sender, expected, buf.String())
+		}
 	}
 
-	expected = "250 OK\r\n"
-	if buf.String() != expected {
-		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
+	// Authenticated users may only send as local senders
+	for _, c := range []struct {
+		sender   string
+		expected string
+	}{
+		{"oliver@test.server.com", "250 OK\r\n"},
+		{"sender@example.com", "550 Relaying denied\r\n"},
+	} {
+		buf.Reset()
+		session = &Session{HeloReceived: true}
+		session.AuthLogin.IsAuthenticated = true
+		server.handleMailFrom(session, writer, "MAIL FROM:<"+c.sender+">")
+
+		if buf.String() != c.expected {
+			t.Errorf("Authenticated MAIL FROM %s: expected response '%s', got '%s'", c.sender, c.expected, buf.String())
+		}
 	}
 }
 
@@ -235,11 +358,20 @@ func TestHandleRcptTo(t *testing.T) {
 		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
 	}
 
-	// Test with HELO
+	// Test with HELO but without MAIL FROM
 	buf.Reset()
 	session.HeloReceived = true
 	server.handleRcptTo(session, writer, "RCPT TO:<oliver@localhost>")
 
+	if buf.String() != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
+	}
+
+	// Test with HELO and MAIL FROM
+	server.handleMailFrom(session, writer, "MAIL FROM:<sender@example.com>")
+	buf.Reset()
+	server.handleRcptTo(session, writer, "RCPT TO:<oliver@localhost>")
+
 	if len(session.Mail.To) != 1 || session.Mail.To[0] != "oliver@localhost" {
 		t.Errorf("Expected recipient oliver@localhost, got %v", session.Mail.To)
 	}
@@ -250,6 +382,561 @@ func TestHandleRcptTo(t *testing.T) {
 	}
 }
 
+func TestHandleRcptToOverQuota(t *testing.T) {
+	us := createUserStore(t)
+	ms := mails.NewStore(mails.Configuration{
+		DB: mdb.NewDB(),
+	})
+
+	err := us.Create(users.User{
+		Name:         "full",
+		Password:     "full123",
+		PrimaryEmail: "full@localhost",
+		Emails:       []string{"full@localhost"},
+		Quota:        users.Quota{StorageLimit: 10},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	u, err := us.GetByName("full")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if err := ms.CreateMail(u.ID, mails.DefaultMailboxUID, mails.Mail{UID: 1, Body: "0123456789"}); err != nil {
+		t.Fatalf("Failed to create mail: %v", err)
+	}
+
+	server := &Server{
+		hostname: "test.server.com",
+		users:    *us,
+		mails:    *ms,
+		quotas:   quotas.NewService(quotas.Configuration{Hostname: "test.server.com", Mails: *ms}),
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+
+	session := &Session{HeloReceived: true}
+	server.handleMailFrom(session, writer, "MAIL FROM:<sender@example.com>")
+	buf.Reset()
+	server.handleRcptTo(session, writer, "RCPT TO:<full@localhost>")
+
+	expected := "452 Insufficient system storage\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
+	}
+	if len(session.Mail.To) != 0 {
+		t.Errorf("Expected recipient to be rejected, got %v", session.Mail.To)
+	}
+
+	// Recipients with storage left are still accepted
+	buf.Reset()
+	server.handleRcptTo(session, writer, "RCPT TO:<oliver@localhost>")
+
+	expected = "250 OK\r\n"
+	if buf.String() != expected {
+		t.Errorf("Expected response '%s', got '%s'", expected, buf.String())
+	}
+}
+
+func TestHandleHostedDomains(t *testing.T) {
+	us := createUserStore(t)
+	ds := domains.NewStore(domains.Configuration{DB: ddb.NewDB()})
+	for _, d := range []domains.Domain{
+		{Name: "localhost", CatchAll: "oliver@localhost"},
+		{Name: "example.org"},
+	} {
+		if _, err := ds.Add(d); err != nil {
+			t.Fatalf("Failed to add domain: %v", err)
+		}
+	}
+	oliver, err := us.GetByName("oliver")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	server := &Server{
+		hostname: "test.server.com",
+		users:    *us,
+		mails:    *mails.NewStore(mails.Configuration{DB: mdb.NewDB()}),
+		domains:  ds,
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+
+	session := &Session{HeloReceived: true}
+	session.AuthLogin.IsAuthenticated = true
+	server.handleMailFrom(session, writer, "MAIL FROM:<sender@Example.org>")
+	if buf.String() != "250 OK\r\n" {
+		t.Errorf("Expected sender of hosted domain to be accepted, got '%s'", buf.String())
+	}
+
+	// Mail from the internet is accepted for the hosted domains only
+	buf.Reset()
+	session = &Session{HeloReceived: true}
+	server.handleMailFrom(session, writer, "MAIL FROM:<sender@example.net>")
+	if buf.String() != "250 OK\r\n" {
+		t.Errorf("Expected external sender to be accepted, got '%s'", buf.String())
+	}
+
+	for _, c := range []struct {
+		recipient string
+		expected  string
+	}{
+		{"oliver@localhost", "250 OK\r\n"},
+		{"unknown@localhost", "250 OK\r\n"}, // catch-all
+		{"unknown@example.org", "550 No such user here\r\n"},
+		{"someone@example.com", "550 Relaying denied\r\n"},
+	} {
+		buf.Reset()
+		session.Deliveries = nil
+		server.handleRcptTo(session, writer, "RCPT TO:<"+c.recipient+">")
+
+		if buf.String() != c.expected {
+			t.Errorf("RCPT TO %s: expected response '%s', got '%s'", c.recipient, c.expected, buf.String())
+		}
+		if c.expected == "250 OK\r\n" && !slices.Equal(session.Deliveries, []Delivery{{UserID: oliver.ID, Recipient: c.recipient}}) {
+			t.Errorf("RCPT TO %s: expected delivery to oliver, got %v", c.recipient, session.Deliveries)
+		}
+	}
+
+	buf.Reset()
+	session.AuthLogin.IsAuthenticated = true
+	server.handleMailFrom(session, writer, "MAIL FROM:<sender@example.com>")
+	if buf.String() != "550 Relaying denied\r\n" {
+		t.Errorf("Expected authenticated sender of other domain to be denied, got '%s'", buf.String())
+	}
+}
+
+func TestHandleRoutes(t *testing.T) {
+	us := createUserStore(t)
+	if err := us.Create(users.User{Name: "anna", PrimaryEmail: "anna@localhost", Emails: []string{"anna@localhost"}}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	oliver, _ := us.GetByName("oliver")
+	anna, _ := us.GetByName("anna")
+
+	rs := routing.NewStore(routing.Configuration{Hostname: "localhost", DB: rdb.NewDB(), Users: *us})
+	for _, r := range []routing.Route{
+		{Address: "team@localhost", Kind: routing.KindGroup, Targets: []string{"oliver@localhost", "anna@localhost"}},
+		{Address: "info@localhost", Kind: routing.KindAlias, Targets: []string{"anna@localhost", "carol@example.org"}},
+		{Address: "ping@localhost", Kind: routing.KindAlias, Targets: []string{"pong@localhost"}},
+		{Address: "pong@localhost", Kind: routing.KindAlias, Targets: []string{"ping@localhost"}},
+	} {
+		if _, err := rs.Add(r); err != nil {
+			t.Fatalf("Failed to add route: %v", err)
+		}
+	}
+
+	forwarded := make(chan Mail, 1)
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+	server := &Server{
+		hostname: "localhost",
+		users:    *us,
+		mails:    *ms,
+		routes:   rs,
+		send: func(m Mail) (int, error) {
+			forwarded <- m
+			return len(m.To), nil
+		},
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+
+	session := &Session{HeloReceived: true}
+	server.handleMailFrom(session, writer, "MAIL FROM:<sender@localhost>")
+
+	for _, c := range []struct {
+		recipient string
+		expected  string
+	}{
+		{"team@localhost", "250 OK\r\n"},
+		{"info@localhost", "250 OK\r\n"},
+		{"ping@localhost", "554 Routing loop detected\r\n"},
+		{"nobody@localhost", "550 No such user here\r\n"},
+	} {
+		buf.Reset()
+		server.handleRcptTo(session, writer, "RCPT TO:<"+c.recipient+">")
+
+		if buf.String() != c.expected {
+			t.Errorf("RCPT TO %s: expected response '%s', got '%s'", c.recipient, c.expected, buf.String())
+		}
+	}
+
+	if !slices.Equal(session.Deliveries, []Delivery{{UserID: oliver.ID, Recipient: "team@localhost"}, {UserID: anna.ID, Recipient: "team@localhost"}}) {
+		t.Errorf("Expected delivery to oliver and anna once, got %v", session.Deliveries)
+	}
+	if !slices.Equal(session.Forwards, []string{"carol@example.org"}) {
+		t.Errorf("Expected forward to carol@example.org, got %v", session.Forwards)
+	}
+
+	session.Mail.DataBuffer = []string{"Subject: Hello", "", "Hello team"}
+	if err := server.deliver(session); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+
+	for _, u := range []*users.User{oliver, anna} {
+		inbox, err := ms.GetMails(u.ID, mails.DefaultMailboxUID)
+		if err != nil || len(inbox) != 1 {
+			t.Errorf("Expected one mail in the inbox of %s, got %d, %v", u.Name, len(inbox), err)
+		}
+	}
+
+	select {
+	case m := <-forwarded:
+		if m.From != "sender@localhost" || !slices.Equal(m.To, []string{"carol@example.org"}) || len(m.DataBuffer) != 3 {
+			t.Errorf("Unexpected forwarded mail: %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected mail to be forwarded")
+	}
+}
+
+func TestHandleSubaddress(t *testing.T) {
+	us := createUserStore(t)
+	if err := us.Create(users.User{Name: "anna", PrimaryEmail: "anna@localhost", Emails: []string{"anna@localhost", "anna-smith@localhost"}}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	oliver, _ := us.GetByName("oliver")
+	anna, _ := us.GetByName("anna")
+
+	ds := domains.NewStore(domains.Configuration{DB: ddb.NewDB()})
+	if _, err := ds.Add(domains.Domain{Name: "localhost", CatchAll: "anna@localhost"}); err != nil {
+		t.Fatalf("Failed to add domain: %v", err)
+	}
+
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+	server := &Server{
+		hostname:             "localhost",
+		users:                *us,
+		mails:                *ms,
+		domains:              ds,
+		subaddressSeparators: "+-",
+		detailMailboxes:      true,
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+
+	session := &Session{HeloReceived: true}
+	server.handleMailFrom(session, writer, "MAIL FROM:<sender@localhost>")
+
+	for _, c := range []struct {
+		recipient string
+		expected  Delivery
+	}{
+		{"oliver+github@localhost", Delivery{UserID: oliver.ID, Mailbox: "github", Recipient: "oliver+github@localhost"}},
+		{"oliver-news@localhost", Delivery{UserID: oliver.ID, Mailbox: "news", Recipient: "oliver-news@localhost"}},
+		{"oliver+@localhost", Delivery{UserID: oliver.ID, Recipient: "oliver+@localhost"}},
+		{"oliver+a/b@localhost", Delivery{UserID: oliver.ID, Recipient: "oliver+a/b@localhost"}},
+		{"oliver+inbox@localhost", Delivery{UserID: oliver.ID, Recipient: "oliver+inbox@localhost"}},
+		{"anna-smith@localhost", Delivery{UserID: anna.ID, Recipient: "anna-smith@localhost"}}, // existing address with a separator
+		{"unknown+github@localhost", Delivery{UserID: anna.ID, Recipient: "unknown+github@localhost"}},
+		{"+github@localhost", Delivery{UserID: anna.ID, Recipient: "+github@localhost"}},
+	} {
+		buf.Reset()
+		session.Deliveries = nil
+		server.handleRcptTo(session, writer, "RCPT TO:<"+c.recipient+">")
+
+		if buf.String() != "250 OK\r\n" {
+			t.Errorf("RCPT TO %s: expected response '250 OK', got '%s'", c.recipient, buf.String())
+		}
+		if !slices.Equal(session.Deliveries, []Delivery{c.expected}) {
+			t.Errorf("RCPT TO %s: expected delivery %+v, got %+v", c.recipient, c.expected, session.Deliveries)
+		}
+	}
+
+	session.Deliveries = []Delivery{{UserID: oliver.ID, Mailbox: "github"}}
+	session.Mail.DataBuffer = []string{"Subject: New issue", "", "Hello"}
+	for range 2 {
+		if err := server.deliver(session); err != nil {
+			t.Fatalf("Failed to deliver: %v", err)
+		}
+	}
+
+	mb, err := ms.GetMailboxByName(oliver.ID, "github")
+	if err != nil {
+		t.Fatalf("Expected mailbox github to be created: %v", err)
+	}
+	if list, err := ms.GetMails(oliver.ID, mb.UID); err != nil || len(list) != 2 {
+		t.Errorf("Expected two mails in mailbox github, got %d, %v", len(list), err)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	us := createUserStore(t)
+	if err := us.Create(users.User{Name: "anna", PrimaryEmail: "anna@localhost", Emails: []string{"anna@localhost"}}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	oliver, _ := us.GetByName("oliver")
+	anna, _ := us.GetByName("anna")
+	if err := us.SetForwarding(oliver.ID, users.Forwarding{Addresses: []string{"oliver@example.org"}}); err != nil {
+		t.Fatalf("Failed to set forwarding: %v", err)
+	}
+	if err := us.SetForwarding(anna.ID, users.Forwarding{Addresses: []string{"anna@example.org"}, KeepCopy: true}); err != nil {
+		t.Fatalf("Failed to set forwarding: %v", err)
+	}
+
+	forwarded := make(chan Mail, 2)
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+	rewriter := srs.New(srs.Configuration{Secret: []byte("secret"), Domain: "fwd.localhost"})
+	server := &Server{
+		hostname: "localhost",
+		users:    *us,
+		mails:    *ms,
+		srs:      rewriter,
+		send: func(m Mail) (int, error) {
+			forwarded <- m
+			return len(m.To), nil
+		},
+	}
+	inbox := func(u *users.User) int {
+		t.Helper()
+		list, err := ms.GetMails(u.ID, mails.DefaultMailboxUID)
+		if err != nil && !errors.Is(err, mails.ErrMailboxNotFound) {
+			t.Fatalf("Failed to get mails: %v", err)
+		}
+		return len(list)
+	}
+
+	session := &Session{
+		Mail:       Mail{From: "sender@example.net", DataBuffer: []string{"Subject: Hello", "", "Hello"}},
+		Deliveries: []Delivery{{UserID: oliver.ID}, {UserID: anna.ID}},
+	}
+	if err := server.deliver(session); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+	if inbox(oliver) != 0 || inbox(anna) != 1 {
+		t.Errorf("Expected a copy only for anna, got %d for oliver and %d for anna", inbox(oliver), inbox(anna))
+	}
+
+	for range 2 {
+		select {
+		case m := <-forwarded:
+			if original, err := rewriter.Reverse(m.From); err != nil || original != "sender@example.net" {
+				t.Errorf("Expected SRS rewritten sender, got %s", m.From)
+			}
+			if m.Domain != "fwd.localhost" {
+				t.Errorf("Expected forwarded mail to be signed for the SRS domain, got %q", m.Domain)
+			}
+			if len(m.To) != 1 || m.DataBuffer[0] != "Delivered-To: "+strings.Replace(m.To[0], "example.org", "localhost", 1) {
+				t.Errorf("Unexpected forwarded mail to %v: %v", m.To, m.DataBuffer)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected mail to be forwarded")
+		}
+	}
+
+	// Mail that was forwarded by the user before is kept
+	session.Deliveries = []Delivery{{UserID: oliver.ID}}
+	session.Mail.DataBuffer = []string{"Delivered-To: oliver@localhost", "Subject: Hello", "", "Hello"}
+	if err := server.deliver(session); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+	if inbox(oliver) != 1 {
+		t.Errorf("Expected looping mail in the inbox of oliver")
+	}
+	select {
+	case m := <-forwarded:
+		t.Errorf("Expected looping mail not to be forwarded, got %v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Bounces to rewritten senders go back to the original sender
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	session = &Session{HeloReceived: true}
+	server.handleMailFrom(session, writer, "MAIL FROM:<>")
+	for _, c := range []struct {
+		recipient string
+		expected  string
+	}{
+		{rewriter.Forward("sender@example.net"), "250 OK\r\n"},
+		{"SRS0=xxxx=AA=example.net=mallory@fwd.localhost", "550 No such user here\r\n"},
+	} {
+		buf.Reset()
+		server.handleRcptTo(session, writer, "RCPT TO:<"+c.recipient+">")
+		if buf.String() != c.expected {
+			t.Errorf("RCPT TO %s: expected response '%s', got '%s'", c.recipient, c.expected, buf.String())
+		}
+	}
+	if !slices.Equal(session.Forwards, []string{"sender@example.net"}) {
+		t.Errorf("Expected bounce to be sent to the original sender, got %v", session.Forwards)
+	}
+}
+
+func TestVacation(t *testing.T) {
+	us := createUserStore(t)
+	oliver, _ := us.GetByName("oliver")
+
+	vs := vacation.NewService(vacation.Configuration{DB: vdb.NewDB()})
+	if _, err := vs.Set(vacation.Responder{UserID: oliver.ID, Enabled: true, Subject: "Out of office", Body: "I am away."}); err != nil {
+		t.Fatalf("Failed to set responder: %v", err)
+	}
+
+	sent := make(chan Mail, 2)
+	server := &Server{
+		hostname: "localhost",
+		users:    *us,
+		mails:    *mails.NewStore(mails.Configuration{DB: mdb.NewDB()}),
+		vacation: vs,
+		send: func(m Mail) (int, error) {
+			sent <- m
+			return len(m.To), nil
+		},
+	}
+
+	for _, data := range [][]string{
+		{"Subject: Hello", "Message-ID: <1@example.net>", "", "Hello"},
+		{"Subject: Hello again", "", "Hello"},
+		{"Subject: Newsletter", "Precedence: bulk", "", "News"},
+	} {
+		session := &Session{
+			Mail:       Mail{From: "sender@example.net", DataBuffer: data},
+			Deliveries: []Delivery{{UserID: oliver.ID}},
+		}
+		if err := server.deliver(session); err != nil {
+			t.Fatalf("Failed to deliver: %v", err)
+		}
+	}
+
+	select {
+	case m := <-sent:
+		if m.From != "" || !slices.Equal(m.To, []string{"sender@example.net"}) || m.Domain != "localhost" {
+			t.Errorf("Expected reply with the null sender to the sender, got %s -> %v for %s", m.From, m.To, m.Domain)
+		}
+		body := strings.Join(m.DataBuffer, "\n")
+		for _, want := range []string{"Subject: Out of office", "Auto-Submitted: auto-replied", "In-Reply-To: <1@example.net>"} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Expected reply to contain %q, got %s", want, body)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected an automatic reply")
+	}
+
+	// The sender got a reply already and bulk mail is not replied to
+	select {
+	case m := <-sent:
+		t.Errorf("Expected only one reply, got %v", m.DataBuffer)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSieve(t *testing.T) {
+	us := createUserStore(t)
+	oliver, _ := us.GetByName("oliver")
+	if err := us.Create(users.User{Name: "anna", Password: "anna123", PrimaryEmail: "anna@localhost", Emails: []string{"anna@localhost"}}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	anna, _ := us.GetByName("anna")
+
+	ss := sieve.NewStore(sieve.Configuration{DB: sdb.NewDB()})
+	if _, err := ss.Put(oliver.ID, "filters", `require ["envelope", "fileinto", "imap4flags", "reject", "vacation"];
+if envelope :is "to" "oliver+news@localhost" { fileinto "News"; stop; }
+if header :contains "subject" "github" { fileinto :flags "\\Seen" "GitHub"; stop; }
+if header :contains "subject" "spam" { discard; stop; }
+if header :contains "subject" "offer" { reject "No offers, please."; stop; }
+if header :contains "subject" "urgent" { redirect "oncall@example.org"; stop; }
+vacation :subject "Away" "I am away.";`); err != nil {
+		t.Fatalf("Failed to put script: %v", err)
+	}
+	if err := ss.Activate(oliver.ID, "filters"); err != nil {
+		t.Fatalf("Failed to activate script: %v", err)
+	}
+
+	ms := mails.NewStore(mails.Configuration{DB: mdb.NewDB()})
+	sent := make(chan Mail, 2)
+	server := &Server{
+		hostname: "localhost",
+		users:    *us,
+		mails:    *ms,
+		vacation: vacation.NewService(vacation.Configuration{DB: vdb.NewDB()}),
+		sieve:    ss,
+		send: func(m Mail) (int, error) {
+			sent <- m
+			return len(m.To), nil
+		},
+	}
+	deliver := func(subject string, to ...*users.User) error {
+		session := &Session{Mail: Mail{From: "sender@example.net", DataBuffer: []string{"Subject: " + subject, "", "Hello"}}}
+		for _, u := range to {
+			session.Deliveries = append(session.Deliveries, Delivery{UserID: u.ID})
+		}
+		return server.deliver(session)
+	}
+	inbox := func(u *users.User) int {
+		list, _ := ms.GetMails(u.ID, mails.DefaultMailboxUID)
+		return len(list)
+	}
+	expectSent := func(to string, want string) {
+		t.Helper()
+		select {
+		case m := <-sent:
+			if !slices.Equal(m.To, []string{to}) || !strings.Contains(strings.Join(m.DataBuffer, "\n"), want) {
+				t.Errorf("Expected mail to %s containing %q, got %v: %v", to, want, m.To, m.DataBuffer)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected mail to %s", to)
+		}
+	}
+
+	if err := deliver("[github] New issue", oliver); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+	mb, err := ms.GetMailboxByName(oliver.ID, "GitHub")
+	if err != nil {
+		t.Fatalf("Expected mailbox GitHub to be created: %v", err)
+	}
+	if list, err := ms.GetMails(oliver.ID, mb.UID); err != nil || len(list) != 1 || !slices.Equal(list[0].Flags, []string{"\\Seen"}) {
+		t.Errorf("Expected one seen mail in mailbox GitHub, got %+v, %v", list, err)
+	}
+
+	// The envelope has the address the mail was sent to
+	session := &Session{
+		Mail:       Mail{From: "sender@example.net", DataBuffer: []string{"Subject: Weekly news", "", "Hello"}},
+		Deliveries: []Delivery{{UserID: oliver.ID, Recipient: "oliver+news@localhost"}},
+	}
+	if err := server.deliver(session); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+	if mb, err := ms.GetMailboxByName(oliver.ID, "News"); err != nil {
+		t.Errorf("Expected mail to the subaddress in mailbox News: %v", err)
+	} else if list, _ := ms.GetMails(oliver.ID, mb.UID); len(list) != 1 {
+		t.Errorf("Expected one mail in mailbox News, got %d", len(list))
+	}
+
+	if err := deliver("Cheap spam", oliver); err != nil {
+		t.Fatalf("Failed to deliver discarded mail: %v", err)
+	}
+	if inbox(oliver) != 0 {
+		t.Errorf("Expected filtered mail not to be in the inbox")
+	}
+
+	// Mail is rejected during the transaction if nobody else receives it
+	if err := deliver("Special offer", oliver); !errors.Is(err, errRejected) {
+		t.Errorf("Expected rejected mail, got %v", err)
+	}
+	if err := deliver("Special offer", oliver, anna); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+	if inbox(oliver) != 0 || inbox(anna) != 1 {
+		t.Errorf("Expected offer only in the inbox of anna")
+	}
+	expectSent("sender@example.net", "Subject: Rejected: Special offer")
+
+	if err := deliver("Urgent: server down", oliver); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+	expectSent("oncall@example.org", "Delivered-To: oliver@localhost")
+
+	if err := deliver("Question", oliver); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+	if inbox(oliver) != 1 {
+		t.Errorf("Expected mail to be kept in the inbox")
+	}
+	expectSent("sender@example.net", "Subject: Away")
+}
+
 func TestHandleData(t *testing.T) {
 	server := &Server{
 		hostname: "test.server.com",
@@ -299,14 +986,16 @@ func TestWriteLine(t *testing.T) {
 }
 
 func TestFullEmailFlow(t *testing.T) {
-	// Create a server with authentication disabled for testing
+	// Create a server without TLS, that receives incoming mail
+	us := createUserStore(t) // Create a user store with a test user
+	ms := mails.NewStore(mails.Configuration{
+		DB: mdb.NewDB(),
+	})
 	server := NewServer(Configuration{
 		Hostname: "test.server.com",
-		Port:     "0",                 // Use port 0 to get a random available port
-		Users:    *createUserStore(t), // Create a user store with a test user
-		Mails: *mails.NewStore(mails.Configuration{
-			DB: mdb.NewDB(),
-		}),
+		Port:     "0", // Use port 0 to get a random available port
+		Users:    *us,
+		Mails:    *ms,
 	})
 
 	listener, err := net.Listen("tcp", ":0")
@@ -405,11 +1094,14 @@ func TestFullEmailFlow(t *testing.T) {
 	ehloResponse := sendCommand("EHLO client.example.com", "250")
 	t.Logf("EHLO response: %s", ehloResponse)
 
-	// 2. Authenticate using AUTH PLAIN
+	// 2. Authentication requires TLS, incoming mail does not need it
 	authString := base64.StdEncoding.EncodeToString([]byte("\x00oliver\x00oliver123"))
-	authResponse := sendCommand("AUTH PLAIN "+authString, "235")
+	authResponse := sendCommand("AUTH PLAIN "+authString, "538")
 	t.Logf("AUTH response: %s", authResponse)
 
+	// RSET keeps the greeting
+	sendCommand("RSET", "250")
+
 	// 3. Set sender with MAIL FROM
 	fromResponse := sendCommand("MAIL FROM:<sender@example.com>", "250")
 	t.Logf("MAIL FROM response: %s", fromResponse)
@@ -455,6 +1147,18 @@ func TestFullEmailFlow(t *testing.T) {
 	// 7. Quit the session
 	quitResponse := sendCommand("QUIT", "221")
 	t.Logf("QUIT response: %s", quitResponse)
+
+	oliver, err := us.GetByName("oliver")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	inbox, err := ms.GetMails(oliver.ID, mails.DefaultMailboxUID)
+	if err != nil || len(inbox) != 1 {
+		t.Fatalf("Expected the mail in the inbox, got %d, %v", len(inbox), err)
+	}
+	if !strings.Contains(inbox[0].Body, "Hello, world!") {
+		t.Errorf("Unexpected body of the received mail: %s", inbox[0].Body)
+	}
 }
 
 func createUserStore(t *testing.T) *users.Store {
@@ -476,3 +1180,28 @@ func createUserStore(t *testing.T) *users.Store {
 
 	return us
 }
+
+// testTLSConfig returns a configuration with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
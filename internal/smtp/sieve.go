@@ -0,0 +1,160 @@
+package smtp
+
+import (
+	"errors"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/compose"
+	"github.com/OliverSchlueter/mail-server/internal/domains"
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+	"github.com/OliverSchlueter/mail-server/internal/sieve"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+)
+
+// errRejected is returned by deliver if all recipients rejected the mail with
+// their Sieve scripts.
+var errRejected = errors.New("mail rejected by the recipients")
+
+// filter returns the actions of the active Sieve script of the user for the
+// mail of the delivery. Without a script, the mail is kept. Scripts that fail
+// keep the mail too, see RFC 5228 section 2.10.6.
+func (s *Server) filter(m Mail, d Delivery, u *users.User) []sieve.Action {
+	keep := []sieve.Action{{Kind: sieve.ActionKeep, Flags: []string{}}}
+	if s.sieve == nil {
+		return keep
+	}
+
+	script, err := s.sieve.Active(u.ID)
+	if err != nil {
+		slog.Warn("Failed to get Sieve script, keeping email", slog.String("user_id", u.ID), sloki.WrapError(err))
+		return keep
+	}
+	if script == nil {
+		return keep
+	}
+
+	env := sieve.Envelope{From: m.From, To: d.Recipient}
+	if env.To == "" {
+		env.To = u.PrimaryEmail
+	}
+
+	res, err := script.Run(mails.Mail{Headers: m.Headers(), Body: m.Body()}, env)
+	if err != nil {
+		slog.Warn("Failed to run Sieve script, keeping email", slog.String("user_id", u.ID), sloki.WrapError(err))
+		return keep
+	}
+	return res.Actions
+}
+
+// store saves the mail in the mailbox with the name, the inbox if empty, with
+// the flags.
+func (s *Server) store(userID, mailbox string, flags []string, headers map[string]string, body string) error {
+	mailboxUID, err := s.deliveryMailbox(userID, mailbox)
+	if err != nil {
+		slog.Warn("Failed to get mailbox for delivery, using the inbox", slog.String("user_id", userID), slog.String("mailbox", mailbox), sloki.WrapError(err))
+		mailboxUID = mails.DefaultMailboxUID
+	}
+
+	m := mails.Mail{
+		UID:        mails.RandomUID(),
+		MailboxUID: mailboxUID,
+		Flags:      flags,
+		Date:       time.Now(),
+		Size:       len(body),
+		Headers:    headers,
+		Body:       body,
+	}
+
+	if err := s.checkQuota(userID, m.MailboxUID, int64(m.Size)); err != nil {
+		return err
+	}
+	return s.mails.CreateMail(userID, m.MailboxUID, m)
+}
+
+// rejectionNotice sends a notice that the user rejected the mail to its sender
+// in the background, for mail that could not be rejected during the SMTP
+// transaction, see RFC 5429 section 2.1. Like automatic replies, it is sent
+// with the null sender.
+func (s *Server) rejectionNotice(m Mail, u *users.User, reason string) {
+	if m.From == "" {
+		return
+	}
+
+	subject := "Rejected message"
+	if msg, err := mail.ReadMessage(strings.NewReader(m.Body())); err == nil && msg.Header.Get("Subject") != "" {
+		subject = "Rejected: " + message.DecodeHeader(msg.Header.Get("Subject"))
+	}
+
+	notice := compose.Message{
+		From:    u.PrimaryEmail,
+		To:      []string{m.From},
+		Subject: subject,
+		Text:    "Your message to " + u.PrimaryEmail + " was rejected by the recipient:\n\n" + reason,
+		Headers: map[string]string{"Auto-Submitted": "auto-replied"},
+	}
+	raw, err := notice.Build()
+	if err != nil {
+		slog.Warn("Failed to create rejection notice", slog.String("user_id", u.ID), sloki.WrapError(err))
+		return
+	}
+
+	s.sendReply(u.ID, u.PrimaryEmail, m.From, raw)
+}
+
+// sieveReply sends the automatic reply of the vacation action of a Sieve
+// script in the background, following the same rules as autoReply.
+func (s *Server) sieveReply(m Mail, u *users.User, v *sieve.Vacation) {
+	if s.vacation == nil {
+		slog.Warn("Sieve vacation action without vacation service, not replying", slog.String("user_id", u.ID))
+		return
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(m.Body()))
+	if err != nil {
+		slog.Warn("Failed to parse email for automatic reply", slog.String("user_id", u.ID), sloki.WrapError(err))
+		return
+	}
+
+	opts := vacation.Options{Handle: v.Handle, Addresses: v.Addresses}
+	if v.From != "" {
+		if addr, err := mail.ParseAddress(v.From); err == nil {
+			opts.From = addr.Address
+		}
+	}
+
+	r := vacation.Responder{UserID: u.ID, Subject: v.Subject, Body: v.Reason, Days: v.Days}
+	reply, err := s.vacation.ReplyWith(u, r, vacation.Message{Sender: m.From, Header: msg.Header}, opts)
+	if err != nil {
+		slog.Warn("Failed to create automatic reply", slog.String("user_id", u.ID), sloki.WrapError(err))
+		return
+	}
+	if reply == nil {
+		return
+	}
+
+	s.sendReply(u.ID, reply.From, reply.To, reply.Raw)
+}
+
+// sendReply sends the encoded message with the null sender in the background,
+// signed for the domain of the sender.
+func (s *Server) sendReply(userID, from, to string, raw []byte) {
+	out := Mail{
+		Outgoing:   true,
+		To:         []string{to},
+		DataBuffer: strings.Split(strings.TrimSuffix(string(raw), "\r\n"), "\r\n"),
+		Domain:     domains.DomainOf(from),
+	}
+
+	go func() {
+		sent, err := s.send(out)
+		if err != nil || sent < len(out.To) {
+			slog.Warn("Failed to send automatic reply", slog.String("user_id", userID), slog.String("to", to), sloki.WrapError(err))
+		}
+	}()
+}
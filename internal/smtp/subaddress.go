@@ -0,0 +1,65 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/OliverSchlueter/mail-server/internal/mails"
+)
+
+// maxDetailMailboxLength is the maximum length of a detail that is used as the
+// name of a mailbox.
+const maxDetailMailboxLength = 64
+
+// splitDetail splits the local part of the address at the first separator
+// into the address without the detail and the detail. ok is false if the local
+// part has no separator or starts with one.
+func splitDetail(address string, separators string) (string, string, bool) {
+	at := strings.LastIndex(address, "@")
+	if separators == "" || at < 0 {
+		return address, "", false
+	}
+
+	i := strings.IndexAny(address[:at], separators)
+	if i <= 0 {
+		return address, "", false
+	}
+	return address[:i] + address[at:], address[i+1 : at], true
+}
+
+// detailMailbox returns the name of the mailbox mail to the detail is
+// delivered to, or an empty string for the inbox. Only plain names are used,
+// so senders can not create nested mailboxes or address special ones.
+func detailMailbox(detail string) string {
+	if detail == "" || len(detail) > maxDetailMailboxLength || strings.EqualFold(detail, mails.DefaultMailboxName) {
+		return ""
+	}
+
+	for _, c := range detail {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return ""
+		}
+	}
+	return detail
+}
+
+// deliveryMailbox returns the UID of the user's mailbox with the name, which is
+// created if it does not exist yet. An empty name is the inbox.
+func (s *Server) deliveryMailbox(userID string, name string) (uint32, error) {
+	if name == "" {
+		return mails.DefaultMailboxUID, nil
+	}
+
+	mb, err := s.mails.GetMailboxByName(userID, name)
+	if errors.Is(err, mails.ErrMailboxNotFound) {
+		err = s.mails.CreateMailbox(mails.Mailbox{UserID: userID, Name: name, Flags: []string{}})
+		if err != nil && !errors.Is(err, mails.ErrMailboxAlreadyExists) {
+			return 0, err
+		}
+		mb, err = s.mails.GetMailboxByName(userID, name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return mb.UID, nil
+}
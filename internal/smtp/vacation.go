@@ -0,0 +1,42 @@
+package smtp
+
+import (
+	"log/slog"
+	"net/mail"
+	"strings"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+)
+
+// autoReply sends the automatic reply of the user to the sender of the mail in
+// the background, if the user is away and the mail may be replied to. The
+// reply is sent with the null sender and signed for the domain of the user.
+func (s *Server) autoReply(m Mail, userID string) {
+	if s.vacation == nil {
+		return
+	}
+
+	u, err := s.users.GetByID(userID)
+	if err != nil {
+		slog.Warn("Failed to get user for automatic reply", slog.String("user_id", userID), sloki.WrapError(err))
+		return
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(m.Body()))
+	if err != nil {
+		slog.Warn("Failed to parse email for automatic reply", slog.String("user_id", userID), sloki.WrapError(err))
+		return
+	}
+
+	reply, err := s.vacation.Reply(u, vacation.Message{Sender: m.From, Header: msg.Header})
+	if err != nil {
+		slog.Warn("Failed to create automatic reply", slog.String("user_id", userID), sloki.WrapError(err))
+		return
+	}
+	if reply == nil {
+		return
+	}
+
+	s.sendReply(userID, reply.From, reply.To, reply.Raw)
+}
@@ -0,0 +1,10 @@
+package srs
+
+import "errors"
+
+var (
+	ErrNotSRS       = errors.New("address is not an SRS address")
+	ErrInvalidHash  = errors.New("invalid SRS hash")
+	ErrExpired      = errors.New("SRS address expired")
+	ErrInvalidStamp = errors.New("invalid SRS timestamp")
+)
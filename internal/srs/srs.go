@@ -0,0 +1,145 @@
+// Package srs implements the Sender Rewriting Scheme. Forwarded mail gets an
+// envelope sender in the domain of the forwarding server, so SPF checks at the
+// destination pass, and bounces to it can be sent back to the original sender.
+//
+// Addresses are rewritten to SRS0=HHHH=TT=domain=local@forwarder, where TT is
+// the day the mail was forwarded and HHHH a truncated HMAC of the other parts,
+// so the server can not be abused to relay mail to arbitrary addresses.
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxAge is how long bounces to rewritten addresses are accepted.
+	DefaultMaxAge = 21 * 24 * time.Hour
+
+	prefix      = "SRS0"
+	hashLength  = 4
+	stampAlpha  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	stampPeriod = 1024 // days, two base32 characters
+	stampUnit   = 24 * time.Hour
+)
+
+type Rewriter struct {
+	secret []byte
+	domain string
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+type Configuration struct {
+	Secret []byte        // key of the HMAC, must be kept across restarts
+	Domain string        // domain of the rewritten addresses, usually the hostname of the server
+	MaxAge time.Duration // defaults to DefaultMaxAge
+	Now    func() time.Time
+}
+
+func New(cfg Configuration) *Rewriter {
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = DefaultMaxAge
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	return &Rewriter{
+		secret: cfg.Secret,
+		domain: strings.ToLower(cfg.Domain),
+		maxAge: cfg.MaxAge,
+		now:    cfg.Now,
+	}
+}
+
+// Domain returns the domain of the rewritten addresses.
+func (r *Rewriter) Domain() string {
+	return r.domain
+}
+
+// Forward returns the envelope sender for mail from the sender that is
+// forwarded. The null sender and senders in the domain of the rewriter are
+// kept as they are.
+func (r *Rewriter) Forward(sender string) string {
+	at := strings.LastIndex(sender, "@")
+	if at <= 0 || strings.EqualFold(sender[at+1:], r.domain) {
+		return sender
+	}
+
+	local, domain := sender[:at], sender[at+1:]
+	ts := stamp(r.now())
+	return strings.Join([]string{prefix, r.hash(ts, domain, local), ts, domain, local}, "=") + "@" + r.domain
+}
+
+// Reverse returns the original sender of a rewritten address. Rewritten
+// addresses are case-insensitive, as some servers change the case of addresses.
+func (r *Rewriter) Reverse(address string) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 || !IsSRS(address) {
+		return "", ErrNotSRS
+	}
+
+	// The local part of the original sender may contain separators itself
+	parts := strings.SplitN(address[len(prefix)+1:at], "=", 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", ErrNotSRS
+	}
+	hash, stamp, domain, local := parts[0], parts[1], parts[2], parts[3]
+
+	if !hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(r.hash(stamp, domain, local)))) {
+		return "", ErrInvalidHash
+	}
+
+	forwarded, err := decodeStamp(stamp)
+	if err != nil {
+		return "", err
+	}
+	age := (day(r.now()) - forwarded + stampPeriod) % stampPeriod
+	if time.Duration(age)*stampUnit > r.maxAge {
+		return "", ErrExpired
+	}
+
+	return local + "@" + domain, nil
+}
+
+// IsSRS reports whether the address is a rewritten address.
+func IsSRS(address string) bool {
+	return len(address) > len(prefix) && strings.EqualFold(address[:len(prefix)+1], prefix+"=")
+}
+
+func (r *Rewriter) hash(stamp string, domain string, local string) string {
+	mac := hmac.New(sha1.New, r.secret)
+	mac.Write([]byte(strings.ToLower(stamp + domain + local)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+// day returns the day of the time within the period of the stamps.
+func day(t time.Time) int {
+	return int(t.Unix()/int64(stampUnit/time.Second)) % stampPeriod
+}
+
+// stamp encodes the day of the time as two base32 characters.
+func stamp(t time.Time) string {
+	d := day(t)
+	return string([]byte{stampAlpha[d>>5], stampAlpha[d&31]})
+}
+
+func decodeStamp(stamp string) (int, error) {
+	if len(stamp) != 2 {
+		return 0, ErrInvalidStamp
+	}
+
+	day := 0
+	for _, c := range strings.ToUpper(stamp) {
+		i := strings.IndexRune(stampAlpha, c)
+		if i < 0 {
+			return 0, ErrInvalidStamp
+		}
+		day = day<<5 | i
+	}
+	return day, nil
+}
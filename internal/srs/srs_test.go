@@ -0,0 +1,69 @@
+package srs_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/srs"
+)
+
+func TestForwardReverse(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := srs.New(srs.Configuration{
+		Secret: []byte("secret"),
+		Domain: "Mail.Example.com",
+		Now:    func() time.Time { return now },
+	})
+
+	for _, sender := range []string{"alice@example.org", "a=b+c@example.net", "SRS0=abcd=AA=example.net=bob@other.example"} {
+		rewritten := r.Forward(sender)
+		if !srs.IsSRS(rewritten) || !strings.HasSuffix(rewritten, "@mail.example.com") {
+			t.Errorf("Forward(%s): unexpected address %s", sender, rewritten)
+		}
+
+		original, err := r.Reverse(rewritten)
+		if err != nil || original != sender {
+			t.Errorf("Reverse(%s): expected %s, got %s, %v", rewritten, sender, original, err)
+		}
+		if original, err := r.Reverse(strings.ToLower(rewritten)); err != nil || !strings.EqualFold(original, sender) {
+			t.Errorf("Reverse(%s): expected %s, got %s, %v", strings.ToLower(rewritten), sender, original, err)
+		}
+	}
+
+	for _, sender := range []string{"", "bob@mail.example.com", "postmaster"} {
+		if got := r.Forward(sender); got != sender {
+			t.Errorf("Forward(%q): expected the sender to be kept, got %q", sender, got)
+		}
+	}
+
+	rewritten := r.Forward("alice@example.org")
+	for _, c := range []struct {
+		address string
+		err     error
+	}{
+		{"alice@example.org", srs.ErrNotSRS},
+		{"SRS0=abcd@mail.example.com", srs.ErrNotSRS},
+		{strings.Replace(rewritten, "alice", "mallory", 1), srs.ErrInvalidHash},
+		{strings.Replace(rewritten, "example.org", "example.net", 1), srs.ErrInvalidHash},
+	} {
+		if _, err := r.Reverse(c.address); !errors.Is(err, c.err) {
+			t.Errorf("Reverse(%s): expected %v, got %v", c.address, c.err, err)
+		}
+	}
+
+	other := srs.New(srs.Configuration{Secret: []byte("other"), Domain: "mail.example.com"})
+	if _, err := other.Reverse(rewritten); !errors.Is(err, srs.ErrInvalidHash) {
+		t.Errorf("Reverse with other secret: expected ErrInvalidHash, got %v", err)
+	}
+
+	now = now.Add(srs.DefaultMaxAge - time.Hour)
+	if _, err := r.Reverse(rewritten); err != nil {
+		t.Errorf("Reverse before expiry: unexpected error: %v", err)
+	}
+	now = now.Add(48 * time.Hour)
+	if _, err := r.Reverse(rewritten); !errors.Is(err, srs.ErrExpired) {
+		t.Errorf("Reverse after expiry: expected ErrExpired, got %v", err)
+	}
+}
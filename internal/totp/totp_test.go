@@ -0,0 +1,77 @@
+package totp
+
+import (
+	"encoding/base32"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the test vectors in RFC 6238 appendix B.
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// The RFC lists 8 digit codes, the last 6 digits are the 6 digit codes
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tc := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tc.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code: unexpected error: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("Code at %d: expected %s, got %s", tc.unix, tc.want, got)
+		}
+	}
+
+	if _, err := Code("not base32!", 1); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("Code with invalid secret: expected ErrInvalidSecret, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: unexpected error: %v", err)
+	}
+
+	now := time.Now()
+	code, err := Code(secret, Step(now)-1)
+	if err != nil {
+		t.Fatalf("Code: unexpected error: %v", err)
+	}
+
+	step, ok := Validate(secret, code, now, 0)
+	if !ok || step != Step(now)-1 {
+		t.Fatalf("Validate: expected code of previous step to be accepted")
+	}
+	if _, ok := Validate(secret, code, now, step); ok {
+		t.Errorf("Validate: expected used code to be rejected")
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period), 0); ok {
+		t.Errorf("Validate: expected old code to be rejected")
+	}
+	if _, ok := Validate(secret, "12345", now, 0); ok {
+		t.Errorf("Validate: expected short code to be rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("example.com", "alice@example.com", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/example.com:alice@example.com?") {
+		t.Errorf("URI: unexpected label in %s", uri)
+	}
+	if !strings.Contains(uri, "secret=ABC") || !strings.Contains(uri, "issuer=example.com") {
+		t.Errorf("URI: missing parameters in %s", uri)
+	}
+}
@@ -0,0 +1,103 @@
+package users
+
+import (
+	"errors"
+	"net/mail"
+	"slices"
+	"strings"
+)
+
+// List returns all users, sorted by name.
+func (s *Store) List() ([]User, error) {
+	return s.db.List()
+}
+
+// CreateUser validates the user like Update and creates it with a new ID. The
+// password of u is hashed before it is stored. The created user is returned.
+func (s *Store) CreateUser(u User) (*User, error) {
+	u.ID = GenerateID()
+	if err := s.validate(&u); err != nil {
+		return nil, err
+	}
+	u.Password = Hash(u.Password)
+
+	if err := s.db.Insert(u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Update replaces the stored user after validating its name and addresses.
+// The primary address must be one of the addresses and none of them may
+// belong to another user.
+func (s *Store) Update(u User) error {
+	if err := s.validate(&u); err != nil {
+		return err
+	}
+	return s.db.Update(u)
+}
+
+// SetPassword replaces the password of the user.
+func (s *Store) SetPassword(userID string, password string) error {
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	u.Password = Hash(password)
+	return s.db.Update(*u)
+}
+
+// SetDisabled disables or enables the user, see User.Disabled.
+func (s *Store) SetDisabled(userID string, disabled bool) error {
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	u.Disabled = disabled
+	return s.db.Update(*u)
+}
+
+// Delete removes the user. Their mailboxes are not touched, see mails.Store.DeleteMailboxes.
+func (s *Store) Delete(userID string) error {
+	return s.db.Delete(userID)
+}
+
+// validate checks the name and addresses of the user and normalizes them.
+func (s *Store) validate(u *User) error {
+	u.Name = strings.TrimSpace(u.Name)
+	if u.Name == "" || strings.ContainsAny(u.Name, "@/ \t\r\n") {
+		// Logins are tried as email address first, so names must not look like one
+		return ErrInvalidName
+	}
+
+	emails := make([]string, 0, len(u.Emails))
+	for _, email := range u.Emails {
+		email = strings.TrimSpace(email)
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email {
+			return ErrInvalidEmail
+		}
+		if slices.Contains(emails, email) {
+			continue
+		}
+
+		owner, err := s.db.GetByEmail(email)
+		if err == nil && owner.ID != u.ID {
+			return ErrEmailInUse
+		}
+		if err != nil && !errors.Is(err, ErrUserNotFound) {
+			return err
+		}
+
+		emails = append(emails, email)
+	}
+	u.Emails = emails
+
+	u.PrimaryEmail = strings.TrimSpace(u.PrimaryEmail)
+	if !slices.Contains(u.Emails, u.PrimaryEmail) {
+		return ErrPrimaryEmail
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package users_test
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+func TestManageUsers(t *testing.T) {
+	s, alice := setup(t)
+
+	bob, err := s.CreateUser(users.User{
+		Name:         " bob ",
+		Password:     "bob123",
+		PrimaryEmail: "bob@example.com",
+		Emails:       []string{"bob@example.com", " bob@other.example.com", "bob@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("CreateUser: unexpected error: %v", err)
+	}
+	if bob.ID == "" || bob.Name != "bob" || len(bob.Emails) != 2 || bob.Emails[1] != "bob@other.example.com" {
+		t.Errorf("CreateUser: expected normalized user, got %+v", bob)
+	}
+	if _, _, err := s.Authenticate("bob@other.example.com", "bob123", users.ScopeIMAP); err != nil {
+		t.Errorf("Authenticate: unexpected error: %v", err)
+	}
+
+	for _, c := range []struct {
+		name string
+		user users.User
+		err  error
+	}{
+		{"empty name", users.User{Name: " ", PrimaryEmail: "carol@example.com", Emails: []string{"carol@example.com"}}, users.ErrInvalidName},
+		{"name like address", users.User{Name: "carol@example.com", PrimaryEmail: "carol@example.com", Emails: []string{"carol@example.com"}}, users.ErrInvalidName},
+		{"invalid address", users.User{Name: "carol", PrimaryEmail: "carol", Emails: []string{"carol"}}, users.ErrInvalidEmail},
+		{"address with name", users.User{Name: "carol", PrimaryEmail: "carol@example.com", Emails: []string{"Carol <carol@example.com>"}}, users.ErrInvalidEmail},
+		{"address of other user", users.User{Name: "carol", PrimaryEmail: "carol@example.com", Emails: []string{"carol@example.com", "bob@example.com"}}, users.ErrEmailInUse},
+		{"unknown primary address", users.User{Name: "carol", PrimaryEmail: "carol@example.com", Emails: []string{"carol@other.example.com"}}, users.ErrPrimaryEmail},
+		{"taken name", users.User{Name: "bob", PrimaryEmail: "carol@example.com", Emails: []string{"carol@example.com"}}, users.ErrUserAlreadyExists},
+	} {
+		if _, err := s.CreateUser(c.user); !errors.Is(err, c.err) {
+			t.Errorf("CreateUser with %s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(list) != 2 || list[0].ID != alice.ID || list[1].ID != bob.ID {
+		t.Errorf("List: expected alice and bob, got %+v", list)
+	}
+
+	// Addresses move between users once they are released
+	alice.Emails = []string{"alice@example.com", "bob@other.example.com"}
+	if err := s.Update(*alice); !errors.Is(err, users.ErrEmailInUse) {
+		t.Errorf("Update with address of bob: expected ErrEmailInUse, got %v", err)
+	}
+	bob.Emails = []string{"bob@example.com"}
+	if err := s.Update(*bob); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+	if err := s.Update(*alice); err != nil {
+		t.Errorf("Update with released address: unexpected error: %v", err)
+	}
+
+	if err := s.SetPassword(bob.ID, "new-password"); err != nil {
+		t.Fatalf("SetPassword: unexpected error: %v", err)
+	}
+	if _, _, err := s.Authenticate("bob", "bob123", users.ScopeIMAP); !errors.Is(err, users.ErrInvalidCredentials) {
+		t.Errorf("Authenticate with old password: expected ErrInvalidCredentials, got %v", err)
+	}
+
+	// Disabled users can not log in, not even with tokens
+	secret, _, err := s.CreateToken(bob.ID, "phone", []users.Scope{users.ScopeIMAP}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken: unexpected error: %v", err)
+	}
+	bob, err = s.GetByID(bob.ID)
+	if err != nil {
+		t.Fatalf("GetByID: unexpected error: %v", err)
+	}
+	bob.Disabled = true
+	if err := s.Update(*bob); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+	if _, _, err := s.Authenticate("bob", "new-password", users.ScopeIMAP); !errors.Is(err, users.ErrUserDisabled) {
+		t.Errorf("Authenticate disabled user: expected ErrUserDisabled, got %v", err)
+	}
+	if _, _, err := s.Authenticate("bob", "wrong", users.ScopeIMAP); !errors.Is(err, users.ErrInvalidCredentials) {
+		t.Errorf("Authenticate disabled user with wrong password: expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, _, err := s.AuthenticateToken(secret, users.ScopeIMAP); !errors.Is(err, users.ErrUserDisabled) {
+		t.Errorf("AuthenticateToken of disabled user: expected ErrUserDisabled, got %v", err)
+	}
+	if _, err := s.VerifyPassword("bob", "new-password"); !errors.Is(err, users.ErrUserDisabled) {
+		t.Errorf("VerifyPassword of disabled user: expected ErrUserDisabled, got %v", err)
+	}
+
+	if err := s.Delete(bob.ID); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	if _, err := s.GetByID(bob.ID); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("GetByID after Delete: expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestSetForwarding(t *testing.T) {
+	s, alice := setup(t)
+
+	err := s.SetForwarding(alice.ID, users.Forwarding{Addresses: []string{" alice@example.org", "Alice@example.org", "bob@example.net"}, KeepCopy: true})
+	if err != nil {
+		t.Fatalf("SetForwarding: unexpected error: %v", err)
+	}
+	got, _ := s.GetByID(alice.ID)
+	if !got.IsForwarding() || !slices.Equal(got.Forwarding.Addresses, []string{"alice@example.org", "bob@example.net"}) || !got.Forwarding.KeepCopy {
+		t.Errorf("SetForwarding: unexpected forwarding %+v", got.Forwarding)
+	}
+
+	tooMany := make([]string, 0, users.MaxForwardingAddresses+1)
+	for i := range users.MaxForwardingAddresses + 1 {
+		tooMany = append(tooMany, fmt.Sprintf("alice%d@example.org", i))
+	}
+	for _, addresses := range [][]string{
+		{"Alice <alice@example.org>"},
+		{"alice"},
+		{"ALICE@example.com"},
+		tooMany,
+	} {
+		if err := s.SetForwarding(alice.ID, users.Forwarding{Addresses: addresses}); !errors.Is(err, users.ErrInvalidForwarding) {
+			t.Errorf("SetForwarding(%v): expected ErrInvalidForwarding, got %v", addresses, err)
+		}
+	}
+
+	if err := s.SetForwarding(alice.ID, users.Forwarding{}); err != nil {
+		t.Fatalf("SetForwarding off: unexpected error: %v", err)
+	}
+	if got, _ := s.GetByID(alice.ID); got.IsForwarding() {
+		t.Errorf("SetForwarding off: expected no forwarding, got %+v", got.Forwarding)
+	}
+	if err := s.SetForwarding("missing", users.Forwarding{}); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("SetForwarding for unknown user: expected ErrUserNotFound, got %v", err)
+	}
+}
@@ -2,7 +2,10 @@ package fake
 
 import (
 	"github.com/OliverSchlueter/mail-server/internal/users"
+	"maps"
+	"slices"
 	"sync"
+	"time"
 )
 
 type DB struct {
@@ -17,6 +20,20 @@ func NewDB() *DB {
 	}
 }
 
+func (db *DB) GetByID(id string) (*users.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, user := range db.Items {
+		if user.ID == id {
+			user = clone(user)
+			return &user, nil
+		}
+	}
+
+	return nil, users.ErrUserNotFound
+}
+
 func (db *DB) GetByName(name string) (*users.User, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -25,6 +42,7 @@ func (db *DB) GetByName(name string) (*users.User, error) {
 	if !exists {
 		return nil, users.ErrUserNotFound
 	}
+	user = clone(user)
 	return &user, nil
 }
 
@@ -34,11 +52,13 @@ func (db *DB) GetByEmail(email string) (*users.User, error) {
 
 	for _, user := range db.Items {
 		if user.PrimaryEmail == email {
+			user = clone(user)
 			return &user, nil
 		}
 
 		for _, userEmail := range user.Emails {
 			if userEmail == email {
+				user = clone(user)
 				return &user, nil
 			}
 		}
@@ -74,6 +94,89 @@ func (db *DB) Insert(user users.User) error {
 		return users.ErrUserAlreadyExists
 	}
 
-	db.Items[user.Name] = user
+	db.Items[user.Name] = clone(user)
 	return nil
 }
+
+func (db *DB) Update(user users.User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for name, existing := range db.Items {
+		if existing.ID != user.ID {
+			continue
+		}
+
+		if name != user.Name {
+			if _, exists := db.Items[user.Name]; exists {
+				return users.ErrUserAlreadyExists
+			}
+			delete(db.Items, name)
+		}
+		db.Items[user.Name] = clone(user)
+		return nil
+	}
+
+	return users.ErrUserNotFound
+}
+
+func (db *DB) UpdateTokenLastUsed(userID string, tokenID string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, user := range db.Items {
+		if user.ID != userID {
+			continue
+		}
+
+		for i, t := range user.Tokens {
+			if t.ID == tokenID {
+				user.Tokens[i].LastUsedAt = at
+				return nil
+			}
+		}
+		return users.ErrTokenNotFound
+	}
+
+	return users.ErrUserNotFound
+}
+
+func (db *DB) Delete(id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for name, user := range db.Items {
+		if user.ID == id {
+			delete(db.Items, name)
+			return nil
+		}
+	}
+
+	return users.ErrUserNotFound
+}
+
+func (db *DB) List() ([]users.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	names := slices.Sorted(maps.Keys(db.Items))
+	list := make([]users.User, 0, len(names))
+	for _, name := range names {
+		list = append(list, clone(db.Items[name]))
+	}
+
+	return list, nil
+}
+
+// clone returns a copy of the user that does not share any slices with u.
+func clone(u users.User) users.User {
+	u.Emails = slices.Clone(u.Emails)
+	u.Quota.MailboxLimits = maps.Clone(u.Quota.MailboxLimits)
+	u.TwoFactor.RecoveryCodes = slices.Clone(u.TwoFactor.RecoveryCodes)
+	u.Forwarding.Addresses = slices.Clone(u.Forwarding.Addresses)
+	u.Tokens = slices.Clone(u.Tokens)
+	for i := range u.Tokens {
+		u.Tokens[i].Scopes = slices.Clone(u.Tokens[i].Scopes)
+	}
+	return u
+}
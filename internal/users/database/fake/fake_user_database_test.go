@@ -0,0 +1,14 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	"github.com/OliverSchlueter/mail-server/internal/users/userstest"
+)
+
+func TestDB(t *testing.T) {
+	userstest.RunDBSuite(t, func() users.DB {
+		return NewDB()
+	})
+}
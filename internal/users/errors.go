@@ -3,6 +3,22 @@ package users
 import "errors"
 
 var (
-	ErrUserNotFound      = errors.New("user not found")
-	ErrUserAlreadyExists = errors.New("user already exists")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUserAlreadyExists  = errors.New("user already exists")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInsufficientScope  = errors.New("token does not have the required scope")
+	ErrTokenNotFound      = errors.New("token not found")
+	ErrInvalidScope       = errors.New("invalid scope")
+	ErrUserDisabled       = errors.New("user is disabled")
+	ErrInvalidName        = errors.New("invalid user name")
+	ErrInvalidEmail       = errors.New("invalid email address")
+	ErrEmailInUse         = errors.New("email address is used by another user")
+	ErrPrimaryEmail       = errors.New("primary email address is not one of the user's addresses")
+	ErrInvalidForwarding  = errors.New("invalid forwarding address")
+
+	ErrSecondFactorRequired = errors.New("second factor required")
+	ErrInvalidCode          = errors.New("invalid second factor code")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication already enabled")
+	ErrTwoFactorNotEnrolled = errors.New("two-factor authentication not enrolled")
+	ErrTooManyAttempts      = errors.New("too many wrong second factor codes")
 )
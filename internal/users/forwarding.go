@@ -0,0 +1,42 @@
+package users
+
+import (
+	"net/mail"
+	"slices"
+	"strings"
+)
+
+// MaxForwardingAddresses is the maximum number of addresses a user's mail is
+// forwarded to.
+const MaxForwardingAddresses = 10
+
+// SetForwarding replaces the forwarding of the user. The addresses must be
+// plain email addresses that do not belong to the user, duplicates are
+// removed. An empty list turns forwarding off.
+func (s *Store) SetForwarding(userID string, f Forwarding) error {
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	addresses := make([]string, 0, len(f.Addresses))
+	for _, address := range f.Addresses {
+		address = strings.TrimSpace(address)
+		addr, err := mail.ParseAddress(address)
+		if err != nil || addr.Address != address {
+			return ErrInvalidForwarding
+		}
+		if strings.EqualFold(u.PrimaryEmail, address) || slices.ContainsFunc(u.Emails, func(e string) bool { return strings.EqualFold(e, address) }) {
+			return ErrInvalidForwarding
+		}
+		if !slices.ContainsFunc(addresses, func(a string) bool { return strings.EqualFold(a, address) }) {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) > MaxForwardingAddresses {
+		return ErrInvalidForwarding
+	}
+
+	u.Forwarding = Forwarding{Addresses: addresses, KeepCopy: f.KeepCopy}
+	return s.db.Update(*u)
+}
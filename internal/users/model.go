@@ -1,9 +1,91 @@
 package users
 
+import "time"
+
 type User struct {
-	ID           string   `json:"id"`
-	Name         string   `json:"name"`
-	Password     string   `json:"password"`
-	PrimaryEmail string   `json:"primary_email"`
-	Emails       []string `json:"emails"`
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Password     string     `json:"password"`
+	PrimaryEmail string     `json:"primary_email"`
+	Emails       []string   `json:"emails"`
+	Quota        Quota      `json:"quota"`
+	Role         Role       `json:"role"`
+	Tokens       []Token    `json:"tokens"` // personal API tokens and app passwords
+	TwoFactor    TwoFactor  `json:"two_factor"`
+	Disabled     bool       `json:"disabled"` // disabled users can not log in anywhere, but still receive mail
+	Forwarding   Forwarding `json:"forwarding"`
+}
+
+// Forwarding forwards all incoming mail of a user to other addresses.
+type Forwarding struct {
+	Addresses []string `json:"addresses"` // forwarding is off if empty
+	KeepCopy  bool     `json:"keep_copy"` // also deliver forwarded mail to the user's mailboxes
+}
+
+// IsForwarding reports whether incoming mail of the user is forwarded.
+func (u User) IsForwarding() bool {
+	return len(u.Forwarding.Addresses) > 0
+}
+
+// TwoFactor is the TOTP second factor of a user. While it is enabled, the
+// user's password alone is not accepted anywhere, protocol logins need app passwords.
+type TwoFactor struct {
+	Enabled       bool      `json:"enabled"`
+	Secret        string    `json:"-"` // set during enrollment already, before it is enabled
+	RecoveryCodes []string  `json:"-"` // hashes of the unused recovery codes
+	LastStep      int64     `json:"-"` // time step of the last accepted code, to prevent replays
+	Failures      int       `json:"-"` // wrong codes since the last accepted one
+	LockedUntil   time.Time `json:"-"` // no code is accepted before, set after too many wrong codes
+}
+
+type Role string
+
+const (
+	RoleUser  Role = "" // regular users may only access their own data
+	RoleAdmin Role = "admin"
+)
+
+func (u User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+type Quota struct {
+	StorageLimit  int64            `json:"storage_limit"`  // in bytes, 0 means unlimited
+	MailboxLimits map[string]int64 `json:"mailbox_limits"` // mailbox name -> limit in bytes
+}
+
+// Scope limits what a token may be used for.
+type Scope string
+
+const (
+	ScopeSMTPSubmit Scope = "smtp-submit" // send mail via SMTP
+	ScopeIMAP       Scope = "imap"        // read mail via IMAP
+	ScopeAPIRead    Scope = "api-read"    // read data via the REST API
+	ScopeAPISend    Scope = "api-send"    // send mail and change data via the REST API
+)
+
+var Scopes = []Scope{ScopeSMTPSubmit, ScopeIMAP, ScopeAPIRead, ScopeAPISend}
+
+// Token is a personal API token or app password. Only the hash of the secret is stored.
+type Token struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Hash       string    `json:"-"`
+	Scopes     []Scope   `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"` // zero means the token never expires
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+func (t Token) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t Token) IsExpired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
 }
@@ -0,0 +1,153 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/OliverSchlueter/goutils/sloki"
+)
+
+// TokenPrefix marks personal API tokens, so they can be told apart from
+// passwords and recognized by secret scanners.
+const TokenPrefix = "mst_"
+
+// lastUsedInterval limits how often the last use of a token is written.
+const lastUsedInterval = time.Minute
+
+// CreateToken creates a token for the user and returns its secret. The secret
+// is not stored and can not be retrieved later.
+func (s *Store) CreateToken(userID string, name string, scopes []Scope, expiresAt time.Time) (string, *Token, error) {
+	if len(scopes) == 0 {
+		return "", nil, ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return "", nil, ErrInvalidScope
+		}
+	}
+
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	// The user ID is part of the secret, so tokens can be used without a login name
+	secret := TokenPrefix + u.ID + "_" + base64.RawURLEncoding.EncodeToString(raw)
+
+	t := Token{
+		ID:        GenerateID(),
+		Name:      name,
+		Hash:      Hash(secret),
+		Scopes:    slices.Clone(scopes),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+
+	u.Tokens = append(u.Tokens, t)
+	if err := s.db.Update(*u); err != nil {
+		return "", nil, err
+	}
+
+	return secret, &t, nil
+}
+
+func (s *Store) GetTokens(userID string) ([]Token, error) {
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Tokens == nil {
+		return []Token{}, nil
+	}
+	return u.Tokens, nil
+}
+
+// RevokeToken deletes the token, it can not be used afterward.
+func (s *Store) RevokeToken(userID string, tokenID string) error {
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(u.Tokens, func(t Token) bool { return t.ID == tokenID })
+	if i < 0 {
+		return ErrTokenNotFound
+	}
+
+	u.Tokens = slices.Delete(u.Tokens, i, i+1)
+	return s.db.Update(*u)
+}
+
+// AuthenticateToken returns the user a personal API token belongs to, if the
+// token has the scope.
+func (s *Store) AuthenticateToken(secret string, scope Scope) (*User, *Token, error) {
+	rest, ok := strings.CutPrefix(secret, TokenPrefix)
+	if !ok {
+		return nil, nil, ErrInvalidCredentials
+	}
+	userID, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, nil, ErrInvalidCredentials
+	}
+
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, nil, ErrInvalidCredentials
+		}
+		return nil, nil, err
+	}
+
+	t, err := s.useToken(u, secret, scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Disabled {
+		return nil, nil, ErrUserDisabled
+	}
+	return u, t, nil
+}
+
+// useToken returns the token of the user with the secret and records its use.
+func (s *Store) useToken(u *User, secret string, scope Scope) (*Token, error) {
+	hash := Hash(secret)
+	now := time.Now().UTC()
+
+	for _, t := range u.Tokens {
+		if !equalHash(t.Hash, hash) {
+			continue
+		}
+
+		if t.IsExpired(now) {
+			return nil, ErrInvalidCredentials
+		}
+		if !t.HasScope(scope) {
+			return nil, ErrInsufficientScope
+		}
+
+		if now.Sub(t.LastUsedAt) >= lastUsedInterval {
+			t.LastUsedAt = now
+			if err := s.db.UpdateTokenLastUsed(u.ID, t.ID, now); err != nil {
+				slog.Warn("Failed to update last use of token", slog.String("user_id", u.ID), sloki.WrapError(err))
+			}
+		}
+		return &t, nil
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+func equalHash(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
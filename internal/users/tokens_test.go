@@ -0,0 +1,108 @@
+package users_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	"github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func TestTokens(t *testing.T) {
+	s, u := setup(t)
+
+	secret, token, err := s.CreateToken(u.ID, "phone", []users.Scope{users.ScopeIMAP, users.ScopeSMTPSubmit}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken: unexpected error: %v", err)
+	}
+
+	// The user's password and the app password are accepted
+	if _, used, err := s.Authenticate("alice@example.com", "alice123", users.ScopeIMAP); err != nil || used != nil {
+		t.Errorf("Authenticate with password: expected no token, got %v, %v", used, err)
+	}
+	_, used, err := s.Authenticate("alice", secret, users.ScopeIMAP)
+	if err != nil {
+		t.Fatalf("Authenticate with app password: unexpected error: %v", err)
+	}
+	if used.ID != token.ID {
+		t.Errorf("Authenticate with app password: expected token %s, got %s", token.ID, used.ID)
+	}
+
+	if _, _, err := s.Authenticate("alice", secret, users.ScopeAPISend); !errors.Is(err, users.ErrInsufficientScope) {
+		t.Errorf("Authenticate without scope: expected ErrInsufficientScope, got %v", err)
+	}
+	if _, _, err := s.Authenticate("alice", "wrong", users.ScopeIMAP); !errors.Is(err, users.ErrInvalidCredentials) {
+		t.Errorf("Authenticate with wrong password: expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, _, err := s.Authenticate("mallory", "alice123", users.ScopeIMAP); !errors.Is(err, users.ErrInvalidCredentials) {
+		t.Errorf("Authenticate unknown user: expected ErrInvalidCredentials, got %v", err)
+	}
+
+	// Personal tokens are usable without login
+	if got, _, err := s.AuthenticateToken(secret, users.ScopeSMTPSubmit); err != nil || got.ID != u.ID {
+		t.Errorf("AuthenticateToken: expected alice, got %v, %v", got, err)
+	}
+	if _, _, err := s.AuthenticateToken("alice123", users.ScopeSMTPSubmit); !errors.Is(err, users.ErrInvalidCredentials) {
+		t.Errorf("AuthenticateToken with password: expected ErrInvalidCredentials, got %v", err)
+	}
+
+	// Listing does not reveal secrets, but records the last use
+	tokens, err := s.GetTokens(u.ID)
+	if err != nil {
+		t.Fatalf("GetTokens: unexpected error: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].Name != "phone" {
+		t.Fatalf("GetTokens: unexpected tokens %+v", tokens)
+	}
+	if tokens[0].LastUsedAt.IsZero() {
+		t.Errorf("GetTokens: expected last use to be recorded")
+	}
+	if tokens[0].Hash == secret {
+		t.Errorf("GetTokens: secret must not be stored")
+	}
+
+	if err := s.RevokeToken(u.ID, token.ID); err != nil {
+		t.Fatalf("RevokeToken: unexpected error: %v", err)
+	}
+	if _, _, err := s.Authenticate("alice", secret, users.ScopeIMAP); !errors.Is(err, users.ErrInvalidCredentials) {
+		t.Errorf("Authenticate with revoked token: expected ErrInvalidCredentials, got %v", err)
+	}
+	if err := s.RevokeToken(u.ID, token.ID); !errors.Is(err, users.ErrTokenNotFound) {
+		t.Errorf("RevokeToken twice: expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestTokenExpiryAndScopes(t *testing.T) {
+	s, u := setup(t)
+
+	if _, _, err := s.CreateToken(u.ID, "none", nil, time.Time{}); !errors.Is(err, users.ErrInvalidScope) {
+		t.Errorf("CreateToken without scopes: expected ErrInvalidScope, got %v", err)
+	}
+	if _, _, err := s.CreateToken(u.ID, "admin", []users.Scope{"admin"}, time.Time{}); !errors.Is(err, users.ErrInvalidScope) {
+		t.Errorf("CreateToken with unknown scope: expected ErrInvalidScope, got %v", err)
+	}
+
+	secret, _, err := s.CreateToken(u.ID, "script", []users.Scope{users.ScopeAPIRead}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("CreateToken: unexpected error: %v", err)
+	}
+	if _, _, err := s.AuthenticateToken(secret, users.ScopeAPIRead); !errors.Is(err, users.ErrInvalidCredentials) {
+		t.Errorf("AuthenticateToken with expired token: expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func setup(t *testing.T) (*users.Store, *users.User) {
+	t.Helper()
+
+	s := users.NewStore(users.Configuration{DB: fake.NewDB()})
+	if err := s.Create(users.User{Name: "alice", Password: "alice123", PrimaryEmail: "alice@example.com"}); err != nil {
+		t.Fatalf("Create: unexpected error: %v", err)
+	}
+
+	u, err := s.GetByName("alice")
+	if err != nil {
+		t.Fatalf("GetByName: unexpected error: %v", err)
+	}
+	return s, u
+}
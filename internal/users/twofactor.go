@@ -0,0 +1,180 @@
+package users
+
+import (
+	"crypto/rand"
+	"strings"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/totp"
+)
+
+const recoveryCodeCount = 10
+
+const (
+	// maxSecondFactorFailures is the number of wrong codes after which the
+	// second factor of a user is locked, across all logins.
+	maxSecondFactorFailures = 10
+	// secondFactorLockout is how long the second factor stays locked.
+	secondFactorLockout = 15 * time.Minute
+)
+
+// recoveryCodeAlphabet avoids characters that are easily confused, like 0 and o.
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// BeginTwoFactor starts the enrollment of a TOTP second factor and returns
+// its secret. It is only enabled once a code was confirmed with ConfirmTwoFactor.
+func (s *Store) BeginTwoFactor(userID string) (string, error) {
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if u.TwoFactor.Enabled {
+		return "", ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	u.TwoFactor = TwoFactor{Secret: secret}
+	if err := s.db.Update(*u); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ConfirmTwoFactor enables the second factor if the code matches the secret of
+// BeginTwoFactor and returns the recovery codes. They are not stored and can
+// not be retrieved later.
+func (s *Store) ConfirmTwoFactor(userID string, code string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.TwoFactor.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if u.TwoFactor.Secret == "" {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+
+	step, ok := totp.Validate(u.TwoFactor.Secret, code, time.Now(), u.TwoFactor.LastStep)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	u.TwoFactor.Enabled = true
+	u.TwoFactor.LastStep = step
+	u.TwoFactor.RecoveryCodes = hashes
+	if err := s.db.Update(*u); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor removes the second factor, which requires a valid code.
+func (s *Store) DisableTwoFactor(userID string, code string) error {
+	if err := s.VerifySecondFactor(userID, code); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	u.TwoFactor = TwoFactor{}
+	return s.db.Update(*u)
+}
+
+// VerifySecondFactor checks a TOTP code or recovery code of the user. Each
+// code can only be used once. After too many wrong codes the second factor is
+// locked for a while and ErrTooManyAttempts is returned for every code.
+func (s *Store) VerifySecondFactor(userID string, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.db.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if !u.TwoFactor.Enabled {
+		return ErrTwoFactorNotEnrolled
+	}
+
+	now := time.Now()
+	if now.Before(u.TwoFactor.LockedUntil) {
+		return ErrTooManyAttempts
+	}
+
+	if step, ok := totp.Validate(u.TwoFactor.Secret, code, now, u.TwoFactor.LastStep); ok {
+		u.TwoFactor.LastStep = step
+		u.TwoFactor.Failures = 0
+		return s.db.Update(*u)
+	}
+
+	hash := Hash(normalizeRecoveryCode(code))
+	for i, h := range u.TwoFactor.RecoveryCodes {
+		if equalHash(h, hash) {
+			u.TwoFactor.RecoveryCodes = append(u.TwoFactor.RecoveryCodes[:i], u.TwoFactor.RecoveryCodes[i+1:]...)
+			u.TwoFactor.Failures = 0
+			return s.db.Update(*u)
+		}
+	}
+
+	u.TwoFactor.Failures++
+	if u.TwoFactor.Failures >= maxSecondFactorFailures {
+		u.TwoFactor.Failures = 0
+		u.TwoFactor.LockedUntil = now.Add(secondFactorLockout)
+	}
+	if err := s.db.Update(*u); err != nil {
+		return err
+	}
+	return ErrInvalidCode
+}
+
+// generateRecoveryCodes returns the recovery codes and their hashes.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+
+		var b strings.Builder
+		for j, r := range raw {
+			if j == 5 {
+				b.WriteByte('-')
+			}
+			b.WriteByte(recoveryCodeAlphabet[int(r)%len(recoveryCodeAlphabet)])
+		}
+
+		codes[i] = b.String()
+		hashes[i] = Hash(normalizeRecoveryCode(codes[i]))
+	}
+
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
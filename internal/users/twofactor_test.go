@@ -0,0 +1,172 @@
+package users_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/totp"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	"github.com/OliverSchlueter/mail-server/internal/users/database/fake"
+)
+
+func TestTwoFactor(t *testing.T) {
+	s, u := setup(t)
+
+	if _, err := s.ConfirmTwoFactor(u.ID, "123456"); !errors.Is(err, users.ErrTwoFactorNotEnrolled) {
+		t.Errorf("ConfirmTwoFactor before begin: expected ErrTwoFactorNotEnrolled, got %v", err)
+	}
+
+	secret, err := s.BeginTwoFactor(u.ID)
+	if err != nil {
+		t.Fatalf("BeginTwoFactor: unexpected error: %v", err)
+	}
+
+	// The password is still accepted until the second factor is confirmed
+	if _, _, err := s.Authenticate("alice", "alice123", users.ScopeIMAP); err != nil {
+		t.Errorf("Authenticate during enrollment: unexpected error: %v", err)
+	}
+
+	if _, err := s.ConfirmTwoFactor(u.ID, "000000"); !errors.Is(err, users.ErrInvalidCode) {
+		t.Errorf("ConfirmTwoFactor with wrong code: expected ErrInvalidCode, got %v", err)
+	}
+
+	// Use the code of the previous step, so the next check can use the current one
+	code := codeAt(t, secret, time.Now().Add(-totp.Period))
+	recoveryCodes, err := s.ConfirmTwoFactor(u.ID, code)
+	if err != nil {
+		t.Fatalf("ConfirmTwoFactor: unexpected error: %v", err)
+	}
+	if len(recoveryCodes) == 0 {
+		t.Fatalf("ConfirmTwoFactor: expected recovery codes")
+	}
+	if _, err := s.BeginTwoFactor(u.ID); !errors.Is(err, users.ErrTwoFactorEnabled) {
+		t.Errorf("BeginTwoFactor when enabled: expected ErrTwoFactorEnabled, got %v", err)
+	}
+
+	// The password alone is no longer enough, app passwords are
+	if _, _, err := s.Authenticate("alice", "alice123", users.ScopeIMAP); !errors.Is(err, users.ErrSecondFactorRequired) {
+		t.Errorf("Authenticate with password: expected ErrSecondFactorRequired, got %v", err)
+	}
+	if _, err := s.VerifyPassword("alice", "alice123"); err != nil {
+		t.Errorf("VerifyPassword: unexpected error: %v", err)
+	}
+	appPassword, _, err := s.CreateToken(u.ID, "phone", []users.Scope{users.ScopeIMAP}, time.Time{})
+	if err != nil {
+		t.Fatalf("CreateToken: unexpected error: %v", err)
+	}
+	if _, _, err := s.Authenticate("alice", appPassword, users.ScopeIMAP); err != nil {
+		t.Errorf("Authenticate with app password: unexpected error: %v", err)
+	}
+
+	// Codes can not be replayed
+	if err := s.VerifySecondFactor(u.ID, code); !errors.Is(err, users.ErrInvalidCode) {
+		t.Errorf("VerifySecondFactor with used code: expected ErrInvalidCode, got %v", err)
+	}
+	if err := s.VerifySecondFactor(u.ID, codeAt(t, secret, time.Now())); err != nil {
+		t.Errorf("VerifySecondFactor: unexpected error: %v", err)
+	}
+
+	// Recovery codes can be used once
+	if err := s.VerifySecondFactor(u.ID, recoveryCodes[0]); err != nil {
+		t.Errorf("VerifySecondFactor with recovery code: unexpected error: %v", err)
+	}
+	if err := s.VerifySecondFactor(u.ID, recoveryCodes[0]); !errors.Is(err, users.ErrInvalidCode) {
+		t.Errorf("VerifySecondFactor with used recovery code: expected ErrInvalidCode, got %v", err)
+	}
+
+	if err := s.DisableTwoFactor(u.ID, recoveryCodes[1]); err != nil {
+		t.Fatalf("DisableTwoFactor: unexpected error: %v", err)
+	}
+	if _, _, err := s.Authenticate("alice", "alice123", users.ScopeIMAP); err != nil {
+		t.Errorf("Authenticate after disabling: unexpected error: %v", err)
+	}
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	db := fake.NewDB()
+	s := users.NewStore(users.Configuration{DB: db})
+	if err := s.Create(users.User{Name: "alice", Password: "alice123", PrimaryEmail: "alice@example.com"}); err != nil {
+		t.Fatalf("Create: unexpected error: %v", err)
+	}
+	u, err := s.GetByName("alice")
+	if err != nil {
+		t.Fatalf("GetByName: unexpected error: %v", err)
+	}
+	secret := enableTwoFactor(t, s, u.ID)
+
+	// Wrong codes count across logins, until the second factor is locked
+	for range 10 {
+		if err := s.VerifySecondFactor(u.ID, "000000"); !errors.Is(err, users.ErrInvalidCode) {
+			t.Fatalf("VerifySecondFactor with wrong code: expected ErrInvalidCode, got %v", err)
+		}
+	}
+	if err := s.VerifySecondFactor(u.ID, codeAt(t, secret, time.Now())); !errors.Is(err, users.ErrTooManyAttempts) {
+		t.Errorf("VerifySecondFactor while locked: expected ErrTooManyAttempts, got %v", err)
+	}
+
+	// Once the lockout is over, codes are accepted again
+	locked, err := s.GetByID(u.ID)
+	if err != nil {
+		t.Fatalf("GetByID: unexpected error: %v", err)
+	}
+	locked.TwoFactor.LockedUntil = time.Now().Add(-time.Second)
+	if err := db.Update(*locked); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+	if err := s.VerifySecondFactor(u.ID, codeAt(t, secret, time.Now())); err != nil {
+		t.Errorf("VerifySecondFactor after lockout: unexpected error: %v", err)
+	}
+}
+
+func TestSecondFactorConcurrentReplay(t *testing.T) {
+	s, u := setup(t)
+	secret := enableTwoFactor(t, s, u.ID)
+
+	code := codeAt(t, secret, time.Now())
+	var (
+		wg       sync.WaitGroup
+		accepted atomic.Int32
+	)
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.VerifySecondFactor(u.ID, code); err == nil {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("Expected the code to be accepted once, got %d", n)
+	}
+}
+
+// enableTwoFactor enrolls the user with the code of the previous step, so the
+// current one can still be used, and returns the secret.
+func enableTwoFactor(t *testing.T, s *users.Store, userID string) string {
+	t.Helper()
+
+	secret, err := s.BeginTwoFactor(userID)
+	if err != nil {
+		t.Fatalf("BeginTwoFactor: unexpected error: %v", err)
+	}
+	if _, err := s.ConfirmTwoFactor(userID, codeAt(t, secret, time.Now().Add(-totp.Period))); err != nil {
+		t.Fatalf("ConfirmTwoFactor: unexpected error: %v", err)
+	}
+	return secret
+}
+
+func codeAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := totp.Code(secret, totp.Step(at))
+	if err != nil {
+		t.Fatalf("Code: unexpected error: %v", err)
+	}
+	return code
+}
@@ -2,19 +2,35 @@ package users
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"sync"
+	"time"
 )
 
 type DB interface {
+	GetByID(id string) (*User, error)
 	GetByName(name string) (*User, error)
 	GetByEmail(email string) (*User, error)
 	DoesUserExistByEmail(email string) (bool, error)
 	Insert(user User) error
+	// Update replaces the user with the same ID.
+	Update(user User) error
+	// UpdateTokenLastUsed sets the last use of a token of the user, without
+	// touching any other data, so a concurrently revoked token stays revoked.
+	UpdateTokenLastUsed(userID string, tokenID string, at time.Time) error
+	Delete(id string) error
+	// List returns all users, sorted by name.
+	List() ([]User, error)
 }
 
 type Store struct {
 	db DB
+
+	// mu serializes changes to the second factor, so a code can not be used
+	// twice by concurrent logins
+	mu *sync.Mutex
 }
 
 type Configuration struct {
@@ -24,9 +40,14 @@ type Configuration struct {
 func NewStore(config Configuration) *Store {
 	return &Store{
 		db: config.DB,
+		mu: &sync.Mutex{},
 	}
 }
 
+func (s *Store) GetByID(id string) (*User, error) {
+	return s.db.GetByID(id)
+}
+
 func (s *Store) GetByName(name string) (*User, error) {
 	return s.db.GetByName(name)
 }
@@ -46,6 +67,71 @@ func (s *Store) Create(u User) error {
 	return s.db.Insert(u)
 }
 
+// Authenticate returns the user with the given email address or name if the
+// password is either the user's password or one of their app passwords with
+// the scope. The app password is returned if one was used. Unknown users and
+// wrong passwords both result in ErrInvalidCredentials, so callers cannot tell
+// which one it was. The user's password is rejected with ErrSecondFactorRequired
+// if two-factor authentication is enabled. Disabled users get ErrUserDisabled,
+// but only once the password was verified.
+func (s *Store) Authenticate(login string, password string, scope Scope) (*User, *Token, error) {
+	u, err := s.getByLogin(login)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if equalHash(u.Password, Hash(password)) {
+		if u.Disabled {
+			return nil, nil, ErrUserDisabled
+		}
+		if u.TwoFactor.Enabled {
+			return nil, nil, ErrSecondFactorRequired
+		}
+		return u, nil, nil
+	}
+
+	t, err := s.useToken(u, password, scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Disabled {
+		return nil, nil, ErrUserDisabled
+	}
+	return u, t, nil
+}
+
+// VerifyPassword returns the user if the password is the user's password. It
+// does not check the second factor, see VerifySecondFactor.
+func (s *Store) VerifyPassword(login string, password string) (*User, error) {
+	u, err := s.getByLogin(login)
+	if err != nil {
+		return nil, err
+	}
+
+	if !equalHash(u.Password, Hash(password)) {
+		return nil, ErrInvalidCredentials
+	}
+	if u.Disabled {
+		return nil, ErrUserDisabled
+	}
+	return u, nil
+}
+
+// getByLogin returns the user with the given email address or name.
+func (s *Store) getByLogin(login string) (*User, error) {
+	u, err := s.db.GetByEmail(login)
+	if errors.Is(err, ErrUserNotFound) {
+		u, err = s.db.GetByName(login)
+	}
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
 func GenerateID() string {
 	return uuid.New().String()
 }
@@ -0,0 +1,318 @@
+// Package userstest provides a conformance test suite that every users.DB
+// implementation is expected to pass.
+package userstest
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+// RunDBSuite runs all conformance tests against the users.DB returned by newDB.
+// newDB is called once per test and must return an empty database.
+func RunDBSuite(t *testing.T, newDB func() users.DB) {
+	t.Run("NotFound", func(t *testing.T) { TestNotFound(t, newDB()) })
+	t.Run("InsertAndGet", func(t *testing.T) { TestInsertAndGet(t, newDB()) })
+	t.Run("Update", func(t *testing.T) { TestUpdate(t, newDB()) })
+	t.Run("DeleteAndList", func(t *testing.T) { TestDeleteAndList(t, newDB()) })
+	t.Run("UserIsolation", func(t *testing.T) { TestUserIsolation(t, newDB()) })
+	t.Run("Concurrency", func(t *testing.T) { TestConcurrency(t, newDB()) })
+}
+
+func TestNotFound(t *testing.T, db users.DB) {
+	if _, err := db.GetByID("alice-id"); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("GetByID: expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := db.GetByName("alice"); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("GetByName: expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := db.GetByEmail("alice@example.com"); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("GetByEmail: expected ErrUserNotFound, got %v", err)
+	}
+
+	exists, err := db.DoesUserExistByEmail("alice@example.com")
+	if err != nil {
+		t.Fatalf("DoesUserExistByEmail: unexpected error: %v", err)
+	}
+	if exists {
+		t.Errorf("DoesUserExistByEmail: expected false for unknown address")
+	}
+}
+
+func TestInsertAndGet(t *testing.T, db users.DB) {
+	u := newUser("alice")
+	if err := db.Insert(u); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+	if err := db.Insert(u); !errors.Is(err, users.ErrUserAlreadyExists) {
+		t.Errorf("Insert with duplicate name: expected ErrUserAlreadyExists, got %v", err)
+	}
+
+	got, err := db.GetByName("alice")
+	if err != nil {
+		t.Fatalf("GetByName: unexpected error: %v", err)
+	}
+	if got.ID != u.ID || got.Password != u.Password || got.PrimaryEmail != u.PrimaryEmail {
+		t.Errorf("GetByName: stored user does not match inserted user: %+v", got)
+	}
+
+	got, err = db.GetByID(u.ID)
+	if err != nil {
+		t.Fatalf("GetByID: unexpected error: %v", err)
+	}
+	if got.Name != u.Name || got.Quota.StorageLimit != u.Quota.StorageLimit || got.Quota.MailboxLimits["INBOX"] != u.Quota.MailboxLimits["INBOX"] ||
+		!slices.Equal(got.Forwarding.Addresses, u.Forwarding.Addresses) || got.Forwarding.KeepCopy != u.Forwarding.KeepCopy {
+		t.Errorf("GetByID: stored user does not match inserted user: %+v", got)
+	}
+
+	for _, email := range []string{u.PrimaryEmail, u.Emails[1]} {
+		got, err := db.GetByEmail(email)
+		if err != nil {
+			t.Fatalf("GetByEmail(%s): unexpected error: %v", email, err)
+		}
+		if got.ID != u.ID {
+			t.Errorf("GetByEmail(%s): expected user %s, got %s", email, u.ID, got.ID)
+		}
+
+		exists, err := db.DoesUserExistByEmail(email)
+		if err != nil {
+			t.Fatalf("DoesUserExistByEmail(%s): unexpected error: %v", email, err)
+		}
+		if !exists {
+			t.Errorf("DoesUserExistByEmail(%s): expected true", email)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T, db users.DB) {
+	if err := db.Update(newUser("alice")); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("Update of unknown user: expected ErrUserNotFound, got %v", err)
+	}
+
+	alice := newUser("alice")
+	bob := newUser("bob")
+	for _, u := range []users.User{alice, bob} {
+		if err := db.Insert(u); err != nil {
+			t.Fatalf("Insert: unexpected error: %v", err)
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	alice.Tokens = []users.Token{{ID: "token-1", Name: "laptop", Hash: "hash", Scopes: []users.Scope{users.ScopeIMAP}, CreatedAt: now}}
+	if err := db.Update(alice); err != nil {
+		t.Fatalf("Update: unexpected error: %v", err)
+	}
+
+	got, err := db.GetByID(alice.ID)
+	if err != nil {
+		t.Fatalf("GetByID: unexpected error: %v", err)
+	}
+	if len(got.Tokens) != 1 || got.Tokens[0].Hash != "hash" || !got.Tokens[0].HasScope(users.ScopeIMAP) {
+		t.Errorf("Update: tokens were not stored: %+v", got.Tokens)
+	}
+
+	// Renaming
+	alice.Name = "alicia"
+	if err := db.Update(alice); err != nil {
+		t.Fatalf("Update with new name: unexpected error: %v", err)
+	}
+	if _, err := db.GetByName("alice"); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("GetByName with old name: expected ErrUserNotFound, got %v", err)
+	}
+	if got, err := db.GetByName("alicia"); err != nil || got.ID != alice.ID {
+		t.Errorf("GetByName with new name: expected alice, got %v, %v", got, err)
+	}
+
+	alice.Name = "bob"
+	if err := db.Update(alice); !errors.Is(err, users.ErrUserAlreadyExists) {
+		t.Errorf("Update to taken name: expected ErrUserAlreadyExists, got %v", err)
+	}
+
+	// Last use of tokens
+	if err := db.UpdateTokenLastUsed(alice.ID, "token-1", now); err != nil {
+		t.Fatalf("UpdateTokenLastUsed: unexpected error: %v", err)
+	}
+	got, err = db.GetByID(alice.ID)
+	if err != nil {
+		t.Fatalf("GetByID: unexpected error: %v", err)
+	}
+	if !got.Tokens[0].LastUsedAt.Equal(now) {
+		t.Errorf("UpdateTokenLastUsed: expected %v, got %v", now, got.Tokens[0].LastUsedAt)
+	}
+	if err := db.UpdateTokenLastUsed(alice.ID, "token-2", now); !errors.Is(err, users.ErrTokenNotFound) {
+		t.Errorf("UpdateTokenLastUsed of unknown token: expected ErrTokenNotFound, got %v", err)
+	}
+	if err := db.UpdateTokenLastUsed("unknown", "token-1", now); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("UpdateTokenLastUsed of unknown user: expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestDeleteAndList(t *testing.T, db users.DB) {
+	list, err := db.List()
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("List: expected no users, got %d", len(list))
+	}
+	if err := db.Delete("alice-id"); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("Delete of unknown user: expected ErrUserNotFound, got %v", err)
+	}
+
+	carol := newUser("carol")
+	alice := newUser("alice")
+	bob := newUser("bob")
+	for _, u := range []users.User{carol, alice, bob} {
+		if err := db.Insert(u); err != nil {
+			t.Fatalf("Insert: unexpected error: %v", err)
+		}
+	}
+
+	list, err = db.List()
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(list) != 3 || list[0].ID != alice.ID || list[1].ID != bob.ID || list[2].ID != carol.ID {
+		t.Fatalf("List: expected alice, bob and carol, got %+v", list)
+	}
+
+	// Modifying a listed user must not modify the stored user
+	list[0].Emails[0] = "changed@example.com"
+	if got, err := db.GetByName("alice"); err != nil || got.Emails[0] != "alice@example.com" {
+		t.Errorf("List: stored user was modified through returned value")
+	}
+
+	if err := db.Delete(bob.ID); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	if _, err := db.GetByID(bob.ID); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("GetByID after Delete: expected ErrUserNotFound, got %v", err)
+	}
+	if exists, err := db.DoesUserExistByEmail(bob.PrimaryEmail); err != nil || exists {
+		t.Errorf("DoesUserExistByEmail after Delete: expected false, got %v, %v", exists, err)
+	}
+	if err := db.Delete(bob.ID); !errors.Is(err, users.ErrUserNotFound) {
+		t.Errorf("Delete twice: expected ErrUserNotFound, got %v", err)
+	}
+
+	// The name is free again
+	if err := db.Insert(newUser("bob")); err != nil {
+		t.Errorf("Insert with name of deleted user: unexpected error: %v", err)
+	}
+
+	list, err = db.List()
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(list) != 3 || list[0].ID != alice.ID || list[1].ID == bob.ID {
+		t.Errorf("List after Delete: unexpected users %+v", list)
+	}
+}
+
+func TestUserIsolation(t *testing.T, db users.DB) {
+	alice := newUser("alice")
+	bob := newUser("bob")
+	for _, u := range []users.User{alice, bob} {
+		if err := db.Insert(u); err != nil {
+			t.Fatalf("Insert: unexpected error: %v", err)
+		}
+	}
+
+	got, err := db.GetByEmail(bob.Emails[1])
+	if err != nil {
+		t.Fatalf("GetByEmail: unexpected error: %v", err)
+	}
+	if got.ID != bob.ID {
+		t.Errorf("GetByEmail: expected bob, got %s", got.Name)
+	}
+
+	got, err = db.GetByName("alice")
+	if err != nil {
+		t.Fatalf("GetByName: unexpected error: %v", err)
+	}
+	if got.ID != alice.ID {
+		t.Errorf("GetByName: expected alice, got %s", got.Name)
+	}
+
+	got, err = db.GetByID(bob.ID)
+	if err != nil {
+		t.Fatalf("GetByID: unexpected error: %v", err)
+	}
+	if got.Name != "bob" {
+		t.Errorf("GetByID: expected bob, got %s", got.Name)
+	}
+
+	// Modifying a returned user must not modify the stored user
+	got, err = db.GetByName("alice")
+	if err != nil {
+		t.Fatalf("GetByName: unexpected error: %v", err)
+	}
+	got.Emails[0] = "changed@example.com"
+	got.Quota.MailboxLimits["INBOX"] = 1
+	got.Forwarding.Addresses[0] = "changed@example.org"
+	got, err = db.GetByName("alice")
+	if err != nil {
+		t.Fatalf("GetByName: unexpected error: %v", err)
+	}
+	if got.Emails[0] != "alice@example.com" || got.Quota.MailboxLimits["INBOX"] != 512 || got.Forwarding.Addresses[0] != "alice@example.org" {
+		t.Errorf("GetByName: stored user was modified through returned value")
+	}
+}
+
+func TestConcurrency(t *testing.T, db users.DB) {
+	const workers = 8
+	const perWorker = 25
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < perWorker; i++ {
+				name := fmt.Sprintf("user-%d-%d", w, i)
+				if err := db.Insert(newUser(name)); err != nil {
+					t.Errorf("Insert: unexpected error: %v", err)
+				}
+				if _, err := db.GetByName(name); err != nil {
+					t.Errorf("GetByName: unexpected error: %v", err)
+				}
+				if _, err := db.GetByEmail(name + "@example.com"); err != nil {
+					t.Errorf("GetByEmail: unexpected error: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 0; w < workers; w++ {
+		for i := 0; i < perWorker; i++ {
+			if _, err := db.GetByName(fmt.Sprintf("user-%d-%d", w, i)); err != nil {
+				t.Errorf("GetByName: unexpected error: %v", err)
+			}
+		}
+	}
+}
+
+func newUser(name string) users.User {
+	return users.User{
+		ID:           users.GenerateID(),
+		Name:         name,
+		Password:     users.Hash(name + "-password"),
+		PrimaryEmail: name + "@example.com",
+		Emails:       []string{name + "@example.com", name + "@other.example.com"},
+		Quota: users.Quota{
+			StorageLimit:  1024,
+			MailboxLimits: map[string]int64{"INBOX": 512},
+		},
+		Forwarding: users.Forwarding{
+			Addresses: []string{name + "@example.org"},
+			KeepCopy:  true,
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package fake
+
+import (
+	"sync"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+)
+
+type DB struct {
+	Responders map[string]vacation.Responder
+	Replies    map[string]map[string]time.Time // user ID -> sender -> last reply
+	mu         sync.Mutex
+}
+
+func NewDB() *DB {
+	return &DB{
+		Responders: make(map[string]vacation.Responder),
+		Replies:    make(map[string]map[string]time.Time),
+		mu:         sync.Mutex{},
+	}
+}
+
+func (db *DB) Get(userID string) (*vacation.Responder, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r, exists := db.Responders[userID]
+	if !exists {
+		return nil, vacation.ErrResponderNotFound
+	}
+	return &r, nil
+}
+
+func (db *DB) Set(r vacation.Responder) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.Responders[r.UserID] = r
+	return nil
+}
+
+func (db *DB) Delete(userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.Responders[userID]; !exists {
+		return vacation.ErrResponderNotFound
+	}
+	delete(db.Responders, userID)
+	return nil
+}
+
+func (db *DB) LastReply(userID, sender string) (time.Time, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.Replies[userID][sender], nil
+}
+
+func (db *DB) SetLastReply(userID, sender string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.Replies[userID] == nil {
+		db.Replies[userID] = make(map[string]time.Time)
+	}
+	db.Replies[userID][sender] = at
+	return nil
+}
+
+func (db *DB) DeleteReplies(userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.Replies, userID)
+	return nil
+}
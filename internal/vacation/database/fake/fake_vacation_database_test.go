@@ -0,0 +1,14 @@
+package fake
+
+import (
+	"testing"
+
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+	"github.com/OliverSchlueter/mail-server/internal/vacation/vacationtest"
+)
+
+func TestDB(t *testing.T) {
+	vacationtest.RunDBSuite(t, func() vacation.DB {
+		return NewDB()
+	})
+}
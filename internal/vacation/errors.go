@@ -0,0 +1,11 @@
+package vacation
+
+import "errors"
+
+var (
+	ErrResponderNotFound = errors.New("responder not found")
+	ErrInvalidSubject    = errors.New("invalid subject")
+	ErrEmptyBody         = errors.New("body is empty")
+	ErrInvalidDays       = errors.New("invalid number of days")
+	ErrInvalidDateRange  = errors.New("end is before start")
+)
@@ -0,0 +1,51 @@
+package vacation
+
+import (
+	"net/mail"
+	"time"
+)
+
+// Responder is the automatic reply a user sends while they are away.
+type Responder struct {
+	UserID    string    `json:"user_id"`
+	Enabled   bool      `json:"enabled"`
+	Subject   string    `json:"subject"` // "Auto: " and the subject of the mail if empty
+	Body      string    `json:"body"`
+	Start     time.Time `json:"start"` // replies are sent from then on, immediately if zero
+	End       time.Time `json:"end"`   // replies are sent until then, indefinitely if zero
+	Days      int       `json:"days"`  // days before the same sender gets another reply
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// IsActive reports whether the responder replies to mail at the given time.
+func (r Responder) IsActive(now time.Time) bool {
+	if !r.Enabled {
+		return false
+	}
+	if !r.Start.IsZero() && now.Before(r.Start) {
+		return false
+	}
+	return r.End.IsZero() || now.Before(r.End)
+}
+
+// Message is an incoming mail that may be replied to.
+type Message struct {
+	Sender string      // envelope sender, empty for the null sender
+	Header mail.Header // headers of the mail
+}
+
+// Reply is an automatic reply, which is sent with the null sender so it
+// can not cause further automatic replies or bounces.
+type Reply struct {
+	From string // address of the user, used as the domain to sign with
+	To   string // envelope recipient, the sender of the incoming mail
+	Raw  []byte // the encoded message with CRLF line endings
+}
+
+// Options customize the replies of responders that are not stored, like those
+// of Sieve scripts, see Service.ReplyWith.
+type Options struct {
+	Handle    string   // identifies the responder, replies are tracked per handle
+	From      string   // sender of the reply, the primary address of the user if empty
+	Addresses []string // other addresses of the user, mail from them is not replied to
+}
@@ -0,0 +1,243 @@
+// Package vacation sends automatic replies to incoming mail while users are
+// away, following the rules of RFC 3834 to not reply to mailing lists,
+// automatic mail or the same sender over and over again.
+package vacation
+
+import (
+	"errors"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/compose"
+	"github.com/OliverSchlueter/mail-server/internal/message"
+	"github.com/OliverSchlueter/mail-server/internal/users"
+)
+
+const (
+	DefaultDays = 7
+	MaxDays     = 365
+)
+
+// listHeaders are the headers of mail sent through mailing lists, see RFC 2369 and RFC 2919.
+var listHeaders = []string{"List-Id", "List-Help", "List-Unsubscribe", "List-Subscribe", "List-Post", "List-Owner", "List-Archive"}
+
+type DB interface {
+	Get(userID string) (*Responder, error)
+	// Set inserts or replaces the responder of the user.
+	Set(r Responder) error
+	Delete(userID string) error
+	// LastReply returns when the user last replied to the sender, the zero
+	// time if they never did.
+	LastReply(userID, sender string) (time.Time, error)
+	SetLastReply(userID, sender string, at time.Time) error
+	// DeleteReplies forgets all replies of the user.
+	DeleteReplies(userID string) error
+}
+
+type Service struct {
+	db  DB
+	now func() time.Time
+
+	mu *sync.Mutex // serializes replies, so a sender is not replied to twice
+}
+
+type Configuration struct {
+	DB  DB
+	Now func() time.Time // defaults to time.Now
+}
+
+func NewService(cfg Configuration) *Service {
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	return &Service{
+		db:  cfg.DB,
+		now: cfg.Now,
+		mu:  &sync.Mutex{},
+	}
+}
+
+func (s *Service) Get(userID string) (*Responder, error) {
+	return s.db.Get(userID)
+}
+
+// Set replaces the responder of the user. The days default to DefaultDays.
+// Senders that already got a reply get one again, as the message may have
+// changed.
+func (s *Service) Set(r Responder) (*Responder, error) {
+	if strings.ContainsAny(r.Subject, "\r\n") {
+		return nil, ErrInvalidSubject
+	}
+	if strings.TrimSpace(r.Body) == "" {
+		return nil, ErrEmptyBody
+	}
+	if r.Days == 0 {
+		r.Days = DefaultDays
+	}
+	if r.Days < 1 || r.Days > MaxDays {
+		return nil, ErrInvalidDays
+	}
+	if !r.Start.IsZero() && !r.End.IsZero() && r.End.Before(r.Start) {
+		return nil, ErrInvalidDateRange
+	}
+	r.UpdatedAt = s.now()
+
+	if err := s.db.Set(r); err != nil {
+		return nil, err
+	}
+	if err := s.db.DeleteReplies(r.UserID); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Remove deletes the responder of the user and forgets their replies.
+func (s *Service) Remove(userID string) error {
+	if err := s.db.Delete(userID); err != nil {
+		return err
+	}
+	return s.db.DeleteReplies(userID)
+}
+
+// RemoveAll deletes the responder of the user, if any, and forgets their replies.
+func (s *Service) RemoveAll(userID string) error {
+	if err := s.db.Delete(userID); err != nil && !errors.Is(err, ErrResponderNotFound) {
+		return err
+	}
+	return s.db.DeleteReplies(userID)
+}
+
+// Reply returns the automatic reply of the user to the mail, or nil if the
+// user has no active responder or the mail must not be replied to. The reply
+// is recorded, so the sender does not get another one within the days of the
+// responder.
+func (s *Service) Reply(u *users.User, m Message) (*Reply, error) {
+	r, err := s.db.Get(u.ID)
+	if err != nil {
+		if errors.Is(err, ErrResponderNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if !r.IsActive(s.now()) {
+		return nil, nil
+	}
+	return s.reply(u, *r, m, Options{})
+}
+
+// ReplyWith returns the automatic reply of the user to the mail with a
+// responder that is not stored, or nil if the mail must not be replied to. The
+// responder is used even if it is not enabled. Replies are recorded per
+// handle of the options, so responders do not suppress each other's replies.
+func (s *Service) ReplyWith(u *users.User, r Responder, m Message, opts Options) (*Reply, error) {
+	if r.Days < 1 {
+		r.Days = DefaultDays
+	}
+	r.Days = min(r.Days, MaxDays)
+	return s.reply(u, r, m, opts)
+}
+
+func (s *Service) reply(u *users.User, r Responder, m Message, opts Options) (*Reply, error) {
+	if opts.From == "" {
+		opts.From = u.PrimaryEmail
+	}
+	if !shouldReply(u, m, append([]string{opts.From}, opts.Addresses...)) {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(m.Sender)
+	if opts.Handle != "" {
+		key = opts.Handle + " " + key
+	}
+
+	now := s.now()
+	last, err := s.db.LastReply(u.ID, key)
+	if err != nil {
+		return nil, err
+	}
+	if !last.IsZero() && now.Before(last.AddDate(0, 0, r.Days)) {
+		return nil, nil
+	}
+
+	raw, err := buildReply(opts.From, r, m, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.SetLastReply(u.ID, key, now); err != nil {
+		return nil, err
+	}
+
+	return &Reply{From: opts.From, To: m.Sender, Raw: raw}, nil
+}
+
+// shouldReply reports whether the mail may be replied to automatically, see
+// RFC 3834 section 2. Mail without a sender, from the user themselves, from
+// mailing lists, bulk mail and mail that was sent automatically is not. Own
+// are further addresses of the user.
+func shouldReply(u *users.User, m Message, own []string) bool {
+	addr, err := mail.ParseAddress(m.Sender)
+	if err != nil || addr.Address != m.Sender {
+		return false
+	}
+	isSender := func(e string) bool { return strings.EqualFold(e, m.Sender) }
+	if isSender(u.PrimaryEmail) || slices.ContainsFunc(u.Emails, isSender) || slices.ContainsFunc(own, isSender) {
+		return false
+	}
+
+	local := strings.ToLower(m.Sender[:strings.LastIndex(m.Sender, "@")])
+	if local == "mailer-daemon" || local == "postmaster" || strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return false
+	}
+
+	if v := strings.ToLower(strings.TrimSpace(m.Header.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(m.Header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	for _, h := range listHeaders {
+		if m.Header.Get(h) != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// buildReply returns the encoded reply, which is marked as auto-replied and
+// placed in the thread of the mail, see RFC 3834 section 3.
+func buildReply(from string, r Responder, m Message, now time.Time) ([]byte, error) {
+	subject := r.Subject
+	if subject == "" {
+		subject = "Auto: " + message.DecodeHeader(m.Header.Get("Subject"))
+	}
+
+	headers := map[string]string{"Auto-Submitted": "auto-replied"}
+	if id := strings.TrimSpace(m.Header.Get("Message-Id")); id != "" {
+		references := strings.Fields(m.Header.Get("References"))
+		if len(references) == 0 {
+			references = strings.Fields(m.Header.Get("In-Reply-To"))
+		}
+		headers["In-Reply-To"] = id
+		headers["References"] = strings.Join(append(references, id), " ")
+	}
+
+	reply := compose.Message{
+		From:    from,
+		To:      []string{m.Sender},
+		Subject: subject,
+		Text:    r.Body,
+		Date:    now,
+		Headers: headers,
+	}
+	return reply.Build()
+}
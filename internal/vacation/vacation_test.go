@@ -0,0 +1,181 @@
+package vacation_test
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/users"
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+	"github.com/OliverSchlueter/mail-server/internal/vacation/database/fake"
+)
+
+func TestSet(t *testing.T) {
+	s := vacation.NewService(vacation.Configuration{DB: fake.NewDB()})
+
+	r, err := s.Set(vacation.Responder{UserID: "alice", Enabled: true, Body: "I am away."})
+	if err != nil {
+		t.Fatalf("Set: unexpected error: %v", err)
+	}
+	if r.Days != vacation.DefaultDays || r.UpdatedAt.IsZero() {
+		t.Errorf("Set: expected defaults, got %+v", r)
+	}
+
+	now := time.Now()
+	for _, c := range []struct {
+		name      string
+		responder vacation.Responder
+		err       error
+	}{
+		{"multi-line subject", vacation.Responder{Subject: "Away\r\nBcc: eve@example.org", Body: "I am away."}, vacation.ErrInvalidSubject},
+		{"empty body", vacation.Responder{Body: " \n"}, vacation.ErrEmptyBody},
+		{"negative days", vacation.Responder{Body: "I am away.", Days: -1}, vacation.ErrInvalidDays},
+		{"too many days", vacation.Responder{Body: "I am away.", Days: vacation.MaxDays + 1}, vacation.ErrInvalidDays},
+		{"end before start", vacation.Responder{Body: "I am away.", Start: now, End: now.Add(-time.Hour)}, vacation.ErrInvalidDateRange},
+	} {
+		c.responder.UserID = "alice"
+		if _, err := s.Set(c.responder); !errors.Is(err, c.err) {
+			t.Errorf("Set with %s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	if err := s.Remove("alice"); err != nil {
+		t.Fatalf("Remove: unexpected error: %v", err)
+	}
+	if _, err := s.Get("alice"); !errors.Is(err, vacation.ErrResponderNotFound) {
+		t.Errorf("Get after Remove: expected ErrResponderNotFound, got %v", err)
+	}
+}
+
+func TestReply(t *testing.T) {
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	s := vacation.NewService(vacation.Configuration{
+		DB:  fake.NewDB(),
+		Now: func() time.Time { return now },
+	})
+	u := &users.User{ID: "alice", PrimaryEmail: "alice@example.com", Emails: []string{"alice@example.com", "info@example.com"}}
+
+	if reply, err := s.Reply(u, incoming("bob@example.org", nil)); err != nil || reply != nil {
+		t.Fatalf("Reply without responder: expected none, got %v, %v", reply, err)
+	}
+
+	if _, err := s.Set(vacation.Responder{
+		UserID:  "alice",
+		Enabled: true,
+		Body:    "I am away until Monday.",
+		Start:   now.Add(-time.Hour),
+		End:     now.Add(4 * 24 * time.Hour),
+		Days:    3,
+	}); err != nil {
+		t.Fatalf("Set: unexpected error: %v", err)
+	}
+
+	reply, err := s.Reply(u, incoming("bob@example.org", map[string]string{"Message-Id": "<1@example.org>"}))
+	if err != nil || reply == nil {
+		t.Fatalf("Reply: expected reply, got %v, %v", reply, err)
+	}
+	if reply.To != "bob@example.org" || reply.From != "alice@example.com" {
+		t.Errorf("Reply: unexpected addresses %s -> %s", reply.From, reply.To)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(reply.Raw)))
+	if err != nil {
+		t.Fatalf("Reply: could not parse reply: %v", err)
+	}
+	for field, want := range map[string]string{
+		"Auto-Submitted": "auto-replied",
+		"Subject":        "Auto: Meeting",
+		"In-Reply-To":    "<1@example.org>",
+		"To":             "<bob@example.org>",
+	} {
+		if got := msg.Header.Get(field); got != want {
+			t.Errorf("Reply: expected %s %q, got %q", field, want, got)
+		}
+	}
+
+	// The sender gets one reply per interval
+	if reply, err := s.Reply(u, incoming("Bob@example.org", nil)); err != nil || reply != nil {
+		t.Errorf("Reply again: expected none, got %v, %v", reply, err)
+	}
+	now = now.Add(3 * 24 * time.Hour)
+	if reply, err := s.Reply(u, incoming("bob@example.org", nil)); err != nil || reply == nil {
+		t.Errorf("Reply after interval: expected reply, got %v, %v", reply, err)
+	}
+
+	// No replies after the end of the responder
+	now = now.Add(24 * time.Hour)
+	if reply, err := s.Reply(u, incoming("carol@example.org", nil)); err != nil || reply != nil {
+		t.Errorf("Reply after end: expected none, got %v, %v", reply, err)
+	}
+}
+
+func TestReplyWith(t *testing.T) {
+	s := vacation.NewService(vacation.Configuration{DB: fake.NewDB()})
+	u := &users.User{ID: "alice", PrimaryEmail: "alice@example.com"}
+	r := vacation.Responder{Subject: "Away", Body: "I am away."}
+	opts := vacation.Options{Handle: "a", From: "office@example.com", Addresses: []string{"team@example.com"}}
+
+	reply, err := s.ReplyWith(u, r, incoming("bob@example.org", nil), opts)
+	if err != nil || reply == nil {
+		t.Fatalf("ReplyWith: expected reply, got %v, %v", reply, err)
+	}
+	if reply.From != "office@example.com" || !strings.Contains(string(reply.Raw), "From: <office@example.com>") {
+		t.Errorf("ReplyWith: expected reply from office@example.com, got %s", reply.Raw)
+	}
+
+	if reply, err := s.ReplyWith(u, r, incoming("bob@example.org", nil), opts); err != nil || reply != nil {
+		t.Errorf("ReplyWith again: expected none, got %v, %v", reply, err)
+	}
+	if reply, err := s.ReplyWith(u, r, incoming("team@example.com", nil), vacation.Options{Handle: "b", Addresses: opts.Addresses}); err != nil || reply != nil {
+		t.Errorf("ReplyWith to own address: expected none, got %v, %v", reply, err)
+	}
+
+	// Replies of other handles are tracked separately
+	opts.Handle = "b"
+	if reply, err := s.ReplyWith(u, r, incoming("bob@example.org", nil), opts); err != nil || reply == nil {
+		t.Errorf("ReplyWith other handle: expected reply, got %v, %v", reply, err)
+	}
+}
+
+func TestReplyExclusions(t *testing.T) {
+	s := vacation.NewService(vacation.Configuration{DB: fake.NewDB()})
+	u := &users.User{ID: "alice", PrimaryEmail: "alice@example.com", Emails: []string{"alice@example.com", "info@example.com"}}
+
+	if _, err := s.Set(vacation.Responder{UserID: "alice", Enabled: true, Body: "I am away."}); err != nil {
+		t.Fatalf("Set: unexpected error: %v", err)
+	}
+
+	for _, c := range []struct {
+		name string
+		msg  vacation.Message
+	}{
+		{"null sender", incoming("", nil)},
+		{"own address", incoming("info@example.com", nil)},
+		{"mailer daemon", incoming("MAILER-DAEMON@example.org", nil)},
+		{"list owner", incoming("owner-golang@example.org", nil)},
+		{"list request", incoming("golang-request@example.org", nil)},
+		{"auto-submitted", incoming("bob@example.org", map[string]string{"Auto-Submitted": "auto-generated"})},
+		{"auto-replied", incoming("bob@example.org", map[string]string{"Auto-Submitted": "auto-replied"})},
+		{"bulk", incoming("bob@example.org", map[string]string{"Precedence": "bulk"})},
+		{"list precedence", incoming("bob@example.org", map[string]string{"Precedence": "list"})},
+		{"list", incoming("bob@example.org", map[string]string{"List-Id": "<golang.example.org>"})},
+		{"unsubscribe", incoming("bob@example.org", map[string]string{"List-Unsubscribe": "<mailto:leave@example.org>"})},
+	} {
+		if reply, err := s.Reply(u, c.msg); err != nil || reply != nil {
+			t.Errorf("Reply to %s: expected none, got %v, %v", c.name, reply, err)
+		}
+	}
+
+	if reply, err := s.Reply(u, incoming("bob@example.org", map[string]string{"Auto-Submitted": "no"})); err != nil || reply == nil {
+		t.Errorf("Reply to Auto-Submitted no: expected reply, got %v, %v", reply, err)
+	}
+}
+
+func incoming(sender string, header map[string]string) vacation.Message {
+	h := mail.Header{"Subject": {"Meeting"}}
+	for k, v := range header {
+		h[k] = []string{v}
+	}
+	return vacation.Message{Sender: sender, Header: h}
+}
@@ -0,0 +1,113 @@
+// Package vacationtest provides a conformance test suite that every
+// vacation.DB implementation is expected to pass.
+package vacationtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OliverSchlueter/mail-server/internal/vacation"
+)
+
+// RunDBSuite runs all conformance tests against the vacation.DB returned by newDB.
+// newDB is called once per test and must return an empty database.
+func RunDBSuite(t *testing.T, newDB func() vacation.DB) {
+	t.Run("NotFound", func(t *testing.T) { TestNotFound(t, newDB()) })
+	t.Run("SetGetDelete", func(t *testing.T) { TestSetGetDelete(t, newDB()) })
+	t.Run("Replies", func(t *testing.T) { TestReplies(t, newDB()) })
+}
+
+func TestNotFound(t *testing.T, db vacation.DB) {
+	if _, err := db.Get("alice"); !errors.Is(err, vacation.ErrResponderNotFound) {
+		t.Errorf("Get: expected ErrResponderNotFound, got %v", err)
+	}
+	if err := db.Delete("alice"); !errors.Is(err, vacation.ErrResponderNotFound) {
+		t.Errorf("Delete: expected ErrResponderNotFound, got %v", err)
+	}
+	if last, err := db.LastReply("alice", "bob@example.org"); err != nil || !last.IsZero() {
+		t.Errorf("LastReply: expected zero time, got %v, %v", last, err)
+	}
+	if err := db.DeleteReplies("alice"); err != nil {
+		t.Errorf("DeleteReplies: unexpected error: %v", err)
+	}
+}
+
+func TestSetGetDelete(t *testing.T, db vacation.DB) {
+	r := vacation.Responder{
+		UserID:    "alice",
+		Enabled:   true,
+		Subject:   "Out of office",
+		Body:      "I am away.",
+		Start:     time.Now().Truncate(time.Second),
+		End:       time.Now().Add(24 * time.Hour).Truncate(time.Second),
+		Days:      7,
+		UpdatedAt: time.Now().Truncate(time.Second),
+	}
+	if err := db.Set(r); err != nil {
+		t.Fatalf("Set: unexpected error: %v", err)
+	}
+
+	got, err := db.Get("alice")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if got.Subject != r.Subject || got.Body != r.Body || got.Days != r.Days || !got.Enabled || !got.Start.Equal(r.Start) || !got.End.Equal(r.End) {
+		t.Errorf("Get: stored responder does not match: %+v", got)
+	}
+
+	// Set replaces the existing responder
+	r.Enabled = false
+	r.Body = "I am back."
+	if err := db.Set(r); err != nil {
+		t.Fatalf("Set again: unexpected error: %v", err)
+	}
+	if got, err := db.Get("alice"); err != nil || got.Enabled || got.Body != r.Body {
+		t.Errorf("Get after Set: expected replaced responder, got %+v, %v", got, err)
+	}
+
+	if _, err := db.Get("bob"); !errors.Is(err, vacation.ErrResponderNotFound) {
+		t.Errorf("Get: expected ErrResponderNotFound for other user, got %v", err)
+	}
+
+	if err := db.Delete("alice"); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	if _, err := db.Get("alice"); !errors.Is(err, vacation.ErrResponderNotFound) {
+		t.Errorf("Get after Delete: expected ErrResponderNotFound, got %v", err)
+	}
+}
+
+func TestReplies(t *testing.T, db vacation.DB) {
+	first := time.Now().Add(-time.Hour).Truncate(time.Second)
+	second := time.Now().Truncate(time.Second)
+
+	if err := db.SetLastReply("alice", "bob@example.org", first); err != nil {
+		t.Fatalf("SetLastReply: unexpected error: %v", err)
+	}
+	if err := db.SetLastReply("alice", "bob@example.org", second); err != nil {
+		t.Fatalf("SetLastReply again: unexpected error: %v", err)
+	}
+	if err := db.SetLastReply("carol", "bob@example.org", first); err != nil {
+		t.Fatalf("SetLastReply: unexpected error: %v", err)
+	}
+
+	if last, err := db.LastReply("alice", "bob@example.org"); err != nil || !last.Equal(second) {
+		t.Errorf("LastReply: expected %v, got %v, %v", second, last, err)
+	}
+	if last, err := db.LastReply("alice", "dave@example.org"); err != nil || !last.IsZero() {
+		t.Errorf("LastReply for other sender: expected zero time, got %v, %v", last, err)
+	}
+
+	if err := db.DeleteReplies("alice"); err != nil {
+		t.Fatalf("DeleteReplies: unexpected error: %v", err)
+	}
+	if last, err := db.LastReply("alice", "bob@example.org"); err != nil || !last.IsZero() {
+		t.Errorf("LastReply after DeleteReplies: expected zero time, got %v, %v", last, err)
+	}
+
+	// Replies of other users are kept
+	if last, err := db.LastReply("carol", "bob@example.org"); err != nil || !last.Equal(first) {
+		t.Errorf("LastReply of other user: expected %v, got %v, %v", first, last, err)
+	}
+}